@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/server"
+)
+
+// runExport implements the `okaproxy export` subcommand
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "config.toml", "Path to configuration file")
+	format := fs.String("format", "json", "Output format (json)")
+	fs.Parse(args)
+
+	if *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unsupported export format %q\n", *format)
+		return 2
+	}
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 2
+	}
+
+	model, err := server.Export(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to export configuration: %v\n", err)
+		return 2
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(model); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write export: %v\n", err)
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/server"
+)
+
+// runTest implements the `okaproxy test` subcommand
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	configPath := fs.String("config", "config.toml", "Path to configuration file")
+	testsPath := fs.String("tests", "", "Additional file of [[test]] cases")
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load configuration: %v\n", err)
+		return 2
+	}
+	if *testsPath != "" {
+		if err := cfg.LoadTests(*testsPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to load tests: %v\n", err)
+			return 2
+		}
+	}
+	if len(cfg.Test) == 0 {
+		fmt.Fprintln(os.Stderr, "No [[test]] cases found")
+		return 2
+	}
+
+	failed, err := server.RunTests(cfg, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to run tests: %v\n", err)
+		return 2
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package accesslog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// variables lists the supported names; $http_<header> is accepted too
+var variables = map[string]bool{
+	"remote_addr":            true,
+	"remote_port":            true,
+	"time_local":             true,
+	"time_iso8601":           true,
+	"msec":                   true,
+	"request":                true,
+	"request_method":         true,
+	"request_uri":            true,
+	"uri":                    true,
+	"args":                   true,
+	"query_string":           true,
+	"server_protocol":        true,
+	"host":                   true,
+	"server_name":            true,
+	"status":                 true,
+	"body_bytes_sent":        true,
+	"request_time":           true,
+	"upstream_time":          true,
+	"upstream_response_time": true,
+	"request_id":             true,
+	"geo_country":            true,
+	"geo_city":               true,
+	"asn":                    true,
+}
+
+// Format is a compiled nginx-style access log template such as
+// `$remote_addr - [$time_local] "$request" $status $body_bytes_sent`
+type Format struct {
+	segments []segment
+}
+
+// segment is either literal text or a variable reference
+type segment struct {
+	literal  string
+	variable string
+}
+
+// Parse compiles a template. Variables are written $name or ${name}.
+func Parse(template string) (*Format, error) {
+	f := &Format{}
+	var literal strings.Builder
+
+	for i := 0; i < len(template); {
+		if template[i] != '$' {
+			literal.WriteByte(template[i])
+			i++
+			continue
+		}
+
+		var name string
+		if i+1 < len(template) && template[i+1] == '{' {
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated ${ at offset %d", i)
+			}
+			name = template[i+2 : i+end]
+			i += end + 1
+		} else {
+			j := i + 1
+			for j < len(template) && isNameByte(template[j]) {
+				j++
+			}
+			name = template[i+1 : j]
+			i = j
+		}
+
+		if name == "" {
+			// A lone $ is literal
+			literal.WriteByte('$')
+			continue
+		}
+		name = strings.ToLower(name)
+		if !variables[name] && !(strings.HasPrefix(name, "http_") && len(name) > len("http_")) {
+			return nil, fmt.Errorf("unknown variable $%s", name)
+		}
+
+		if literal.Len() > 0 {
+			f.segments = append(f.segments, segment{literal: literal.String()})
+			literal.Reset()
+		}
+		f.segments = append(f.segments, segment{variable: name})
+	}
+
+	if literal.Len() > 0 {
+		f.segments = append(f.segments, segment{literal: literal.String()})
+	}
+	return f, nil
+}
+
+// Render expands the template; lookup resolves a variable name and empty
+// values are written as "-"
+func (f *Format) Render(lookup func(variable string) string) string {
+	var line strings.Builder
+	for _, seg := range f.segments {
+		if seg.variable == "" {
+			line.WriteString(seg.literal)
+			continue
+		}
+		value := lookup(seg.variable)
+		if value == "" {
+			value = "-"
+		}
+		line.WriteString(value)
+	}
+	return line.String()
+}
+
+func isNameByte(b byte) bool {
+	return b == '_' || ('a' <= b && b <= 'z') || ('A' <= b && b <= 'Z') || ('0' <= b && b <= '9')
+}
@@ -0,0 +1,704 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"okaproxy/internal/certs"
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/maintenance"
+	"okaproxy/internal/middleware"
+	"okaproxy/internal/proxy"
+)
+
+// Server serves the admin API on its own listener, away from proxied traffic
+type Server struct {
+	config    config.AdminConfig
+	runtimeMu sync.RWMutex
+	runtime   *config.Config
+	scheduler *maintenance.Scheduler
+	certs     *certs.Inventory
+	proxy     *proxy.ProxyManager
+	bans      *middleware.BanManager
+	cache     *middleware.ResponseCache
+	sessions  *middleware.SessionStore
+	apiKeys   *middleware.APIKeys
+	logger    *logger.Logger
+	server    *http.Server
+	listener  net.Listener
+	wg        sync.WaitGroup
+}
+
+// Runtime is the state the admin API reports on and acts upon
+type Runtime struct {
+	Config    *config.Config
+	Scheduler *maintenance.Scheduler
+	Certs     *certs.Inventory
+	Proxy     *proxy.ProxyManager
+	Bans      *middleware.BanManager // nil when bans are disabled
+	Cache     *middleware.ResponseCache
+	Sessions  *middleware.SessionStore
+	APIKeys   *middleware.APIKeys
+}
+
+// windowRequest is the body accepted when opening a maintenance window
+type windowRequest struct {
+	Minutes int    `json:"minutes"`
+	Reason  string `json:"reason"`
+	Actor   string `json:"actor"`
+}
+
+// levelRequest is the body accepted when changing the log level
+type levelRequest struct {
+	Level   string `json:"level"`
+	Minutes int    `json:"minutes"` // Revert to the configured level after N minutes; 0 keeps the level
+}
+
+// clockRequest is the body accepted when advancing the test mode clock
+type clockRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+// apiKeyRequest is the body accepted when creating an API key
+type apiKeyRequest struct {
+	Name  string `json:"name"`
+	Rate  int    `json:"rate"` // Requests per minute (0 = the server's rate, -1 = unlimited)
+	Actor string `json:"actor"`
+}
+
+// upstreamRequest is the body accepted when draining or enabling an upstream
+type upstreamRequest struct {
+	URL   string `json:"url"`
+	Actor string `json:"actor"`
+}
+
+// NewServer creates the admin API server
+func NewServer(cfg config.AdminConfig, rt Runtime, log *logger.Logger) *Server {
+	s := &Server{
+		config:    cfg,
+		runtime:   rt.Config,
+		scheduler: rt.Scheduler,
+		certs:     rt.Certs,
+		proxy:     rt.Proxy,
+		bans:      rt.Bans,
+		cache:     rt.Cache,
+		sessions:  rt.Sessions,
+		apiKeys:   rt.APIKeys,
+		logger:    log,
+	}
+
+	gin.SetMode(gin.ReleaseMode)
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.Use(s.authenticate())
+
+	router.GET("/servers", s.listServers)
+	router.GET("/config", s.getConfig)
+	router.GET("/upstreams/:server", s.listUpstreams)
+	router.POST("/upstreams/:server/drain", s.drainUpstream)
+	router.POST("/upstreams/:server/enable", s.enableUpstream)
+	router.GET("/bans", s.listBans)
+	router.DELETE("/bans/:key", s.deleteBan)
+	router.DELETE("/cache/:server", s.purgeCache)
+	router.GET("/sessions", s.listSessions)
+	router.DELETE("/sessions/:server", s.revokeSessions)
+	router.GET("/apikeys", s.listAPIKeys)
+	router.POST("/apikeys/:server", s.createAPIKey)
+	router.DELETE("/apikeys/:server/:name", s.deleteAPIKey)
+	router.GET("/maintenance/:server", s.getWindow)
+	router.POST("/maintenance/:server", s.beginWindow)
+	router.DELETE("/maintenance/:server", s.endWindow)
+	router.GET("/certificates", s.listCertificates)
+	router.GET("/log/level", s.getLevel)
+	router.PUT("/log/level", s.setLevel)
+	router.GET("/clock", s.getClock)
+	router.POST("/clock/advance", s.advanceClock)
+
+	s.server = &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           router,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// UseListener makes Start serve on ln instead of binding the listen address,
+// such as a socket handed over by the process being upgraded
+func (s *Server) UseListener(ln net.Listener) {
+	s.listener = ln
+}
+
+// Listener returns the listener the admin API serves on once started
+func (s *Server) Listener() net.Listener {
+	return s.listener
+}
+
+// Start binds the admin listener and serves in the background
+func (s *Server) Start() error {
+	ln := s.listener
+	if ln == nil {
+		var err error
+		ln, err = net.Listen("tcp", s.config.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", s.config.Listen, err)
+		}
+		s.listener = ln
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		s.logger.Infof("Admin API listening on %s", s.config.Listen)
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			s.logger.Errorf("Admin API stopped with error: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown stops the admin API
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.server.Shutdown(ctx)
+	s.wg.Wait()
+	return err
+}
+
+// SetConfig replaces the running configuration after a reload
+func (s *Server) SetConfig(cfg *config.Config) {
+	s.runtimeMu.Lock()
+	s.runtime = cfg
+	s.runtimeMu.Unlock()
+}
+
+// running returns the running configuration
+func (s *Server) running() *config.Config {
+	s.runtimeMu.RLock()
+	defer s.runtimeMu.RUnlock()
+	return s.runtime
+}
+
+// authenticate requires the configured bearer token on every request
+func (s *Server) authenticate() gin.HandlerFunc {
+	expected := []byte("Bearer " + s.config.Token)
+	return func(c *gin.Context) {
+		provided := []byte(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(provided, expected) != 1 {
+			s.logger.WithFields(map[string]interface{}{
+				"ip":   logger.GetClientIP(c.Request),
+				"path": c.Request.URL.Path,
+			}).Warn("Rejected unauthenticated admin request")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// listServers reports every server with its listeners, maintenance state and
+// a summary of its upstreams
+func (s *Server) listServers(c *gin.Context) {
+	running := s.running()
+	servers := make([]gin.H, 0, len(running.Server))
+	for _, serverConfig := range running.Server {
+		upstreams := s.proxy.Upstreams(serverConfig.Name)
+		drained, unhealthy := 0, 0
+		for _, upstream := range upstreams {
+			if upstream.Drained {
+				drained++
+			}
+			if !upstream.Healthy {
+				unhealthy++
+			}
+		}
+
+		window, _ := s.scheduler.Window(serverConfig.Name)
+		status := s.status(serverConfig.Name, window)
+		servers = append(servers, gin.H{
+			"name":        serverConfig.Name,
+			"type":        serverConfig.Type,
+			"listen":      serverConfig.ListenAddrs(),
+			"https":       serverConfig.HTTPS.Enabled,
+			"target_url":  serverConfig.TargetURL,
+			"maintenance": status["maintenance"],
+			"in_flight":   status["in_flight"],
+			"upstreams": gin.H{
+				"total":     len(upstreams),
+				"drained":   drained,
+				"unhealthy": unhealthy,
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"servers": servers})
+}
+
+// getConfig returns the running configuration with secrets redacted
+func (s *Server) getConfig(c *gin.Context) {
+	options, err := s.running().Redacted()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, options)
+}
+
+// listUpstreams reports the passive health and drain state of a server's targets
+func (s *Server) listUpstreams(c *gin.Context) {
+	server := c.Param("server")
+	if !s.knownServer(server) {
+		c.JSON(http.StatusNotFound, gin.H{"message": maintenance.ErrUnknownServer.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"server":    server,
+		"upstreams": s.proxy.Upstreams(server),
+	})
+}
+
+// drainUpstream stops sending new requests to a target
+func (s *Server) drainUpstream(c *gin.Context) {
+	s.setDrained(c, true)
+}
+
+// enableUpstream resumes sending requests to a drained target
+func (s *Server) enableUpstream(c *gin.Context) {
+	s.setDrained(c, false)
+}
+
+// setDrained drains or enables the upstream named in the request body
+func (s *Server) setDrained(c *gin.Context, drained bool) {
+	var req upstreamRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.URL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Request body must name the upstream url"})
+		return
+	}
+
+	server := c.Param("server")
+	status, err := s.proxy.SetDrained(server, req.URL, drained)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	action := "Upstream enabled"
+	if drained {
+		action = "Upstream drained"
+	}
+	s.logger.WithFields(map[string]interface{}{
+		"server":   server,
+		"upstream": req.URL,
+		"actor":    s.actor(c, req.Actor),
+	}).Warn(action)
+
+	c.JSON(http.StatusOK, gin.H{"server": server, "upstream": status})
+}
+
+// listBans reports the active bans issued by this instance
+func (s *Server) listBans(c *gin.Context) {
+	if s.bans == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false, "bans": []middleware.Ban{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "bans": s.bans.Bans()})
+}
+
+// deleteBan lifts a ban before it expires
+func (s *Server) deleteBan(c *gin.Context) {
+	if s.bans == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": "bans are disabled"})
+		return
+	}
+
+	key := c.Param("key")
+	s.bans.Unban(key)
+	s.logger.WithFields(map[string]interface{}{
+		"client": key,
+		"actor":  s.actor(c, c.Query("actor")),
+	}).Warn("Ban lifted through the admin API")
+
+	c.JSON(http.StatusOK, gin.H{"key": key, "banned": false})
+}
+
+// purgeCache drops cached responses of a server: those of ?url=, those
+// starting with ?prefix=, or all of them. Both take a path or an absolute URL
+// to limit the purge to one host.
+func (s *Server) purgeCache(c *gin.Context) {
+	server := c.Param("server")
+	if !s.knownServer(server) {
+		c.JSON(http.StatusNotFound, gin.H{"message": maintenance.ErrUnknownServer.Error()})
+		return
+	}
+
+	target, prefix := c.Query("url"), c.Query("prefix")
+	if target != "" && prefix != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "Give either url or prefix, not both"})
+		return
+	}
+	if prefix != "" {
+		target = prefix
+	}
+	host, path := "", "/"
+	if target != "" {
+		u, err := url.Parse(target)
+		if err != nil || (u.Host == "" && !strings.HasPrefix(target, "/")) {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "url and prefix must be a path or an absolute URL"})
+			return
+		}
+		host, path = u.Host, u.RequestURI()
+	}
+
+	purged := s.cache.Purge(server, host, path, target == "" || prefix != "")
+	s.logger.WithFields(map[string]interface{}{
+		"server": server,
+		"host":   host,
+		"path":   path,
+		"purged": purged,
+		"actor":  s.actor(c, c.Query("actor")),
+	}).Warn("Cache purged through the admin API")
+
+	c.JSON(http.StatusOK, gin.H{"server": server, "purged": purged})
+}
+
+// listSessions counts the active verification sessions of servers recording them
+func (s *Server) listSessions(c *gin.Context) {
+	servers := gin.H{}
+	for _, serverConfig := range s.running().Server {
+		if !serverConfig.Challenge.Sessions {
+			continue
+		}
+		active, err := s.sessions.Count(serverConfig.Name)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("failed to count sessions: %v", err)})
+			return
+		}
+		servers[serverConfig.Name] = gin.H{"active": active}
+	}
+	c.JSON(http.StatusOK, gin.H{"servers": servers})
+}
+
+// revokeSessions ends the verification session ?id=, or all sessions of a
+// server, so those clients are challenged again
+func (s *Server) revokeSessions(c *gin.Context) {
+	server := c.Param("server")
+	if !s.knownServer(server) {
+		c.JSON(http.StatusNotFound, gin.H{"message": maintenance.ErrUnknownServer.Error()})
+		return
+	}
+
+	revoked := 0
+	if id := c.Query("id"); id != "" {
+		found, err := s.sessions.Revoke(server, id)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("failed to revoke session: %v", err)})
+			return
+		}
+		if found {
+			revoked = 1
+		}
+	} else {
+		var err error
+		if revoked, err = s.sessions.RevokeAll(server); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("failed to revoke sessions: %v", err), "revoked": revoked})
+			return
+		}
+	}
+
+	s.logger.WithFields(map[string]interface{}{
+		"server":  server,
+		"session": c.Query("id"),
+		"revoked": revoked,
+		"actor":   s.actor(c, c.Query("actor")),
+	}).Warn("Verification sessions revoked through the admin API")
+
+	c.JSON(http.StatusOK, gin.H{"server": server, "revoked": revoked})
+}
+
+// listAPIKeys reports the API keys of servers requiring them, with their usage
+func (s *Server) listAPIKeys(c *gin.Context) {
+	servers := gin.H{}
+	for _, serverConfig := range s.running().Server {
+		if !serverConfig.APIKeys.Enabled() {
+			continue
+		}
+		usage, err := s.apiKeys.Usage(&serverConfig)
+		if err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("failed to list API keys: %v", err)})
+			return
+		}
+		servers[serverConfig.Name] = usage
+	}
+	c.JSON(http.StatusOK, gin.H{"servers": servers})
+}
+
+// createAPIKey generates a key for a server accepting created keys. The key
+// is only ever shown in this response.
+func (s *Server) createAPIKey(c *gin.Context) {
+	serverConfig := s.runningServer(c.Param("server"))
+	if serverConfig == nil {
+		c.JSON(http.StatusNotFound, gin.H{"message": maintenance.ErrUnknownServer.Error()})
+		return
+	}
+	if !serverConfig.APIKeys.Store {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "server does not accept created API keys (api_keys.store is off)"})
+		return
+	}
+
+	var req apiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "expected {\"name\": \"...\", \"rate\": N}"})
+		return
+	}
+	if req.Rate < -1 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "rate must be -1 or more"})
+		return
+	}
+
+	key, err := s.apiKeys.Create(serverConfig, req.Name, req.Rate)
+	if errors.Is(err, middleware.ErrAPIKeyExists) {
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("failed to create API key: %v", err)})
+		return
+	}
+
+	s.logger.WithFields(map[string]interface{}{
+		"server": serverConfig.Name,
+		"name":   req.Name,
+		"actor":  s.actor(c, req.Actor),
+	}).Info("API key created through the admin API")
+
+	c.JSON(http.StatusCreated, gin.H{"server": serverConfig.Name, "name": req.Name, "key": key})
+}
+
+// deleteAPIKey removes a created key, which stops working right away
+func (s *Server) deleteAPIKey(c *gin.Context) {
+	server, name := c.Param("server"), c.Param("name")
+	if !s.knownServer(server) {
+		c.JSON(http.StatusNotFound, gin.H{"message": maintenance.ErrUnknownServer.Error()})
+		return
+	}
+
+	deleted, err := s.apiKeys.Delete(server, name)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"message": fmt.Sprintf("failed to delete API key: %v", err)})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"message": "no created API key of that name"})
+		return
+	}
+
+	s.logger.WithFields(map[string]interface{}{
+		"server": server,
+		"name":   name,
+		"actor":  s.actor(c, c.Query("actor")),
+	}).Warn("API key deleted through the admin API")
+
+	c.JSON(http.StatusOK, gin.H{"server": server, "name": name, "deleted": true})
+}
+
+// knownServer reports whether a server of that name is configured
+func (s *Server) knownServer(name string) bool {
+	for _, serverConfig := range s.running().Server {
+		if serverConfig.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// runningServer returns the configuration of the named server, or nil
+func (s *Server) runningServer(name string) *config.ServerConfig {
+	servers := s.running().Server
+	for i := range servers {
+		if servers[i].Name == name {
+			return &servers[i]
+		}
+	}
+	return nil
+}
+
+// getWindow reports the active window and how many requests are still draining
+func (s *Server) getWindow(c *gin.Context) {
+	server := c.Param("server")
+	window, err := s.scheduler.Window(server)
+	if err != nil {
+		s.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s.status(server, window))
+}
+
+// beginWindow drains the server and puts it into maintenance for N minutes
+func (s *Server) beginWindow(c *gin.Context) {
+	var req windowRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid request body: %v", err)})
+		return
+	}
+	if req.Minutes <= 0 || req.Minutes > s.config.MaxMinutes {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("minutes must be between 1 and %d", s.config.MaxMinutes)})
+		return
+	}
+
+	server := c.Param("server")
+	window, err := s.scheduler.Begin(server, time.Duration(req.Minutes)*time.Minute, strings.TrimSpace(req.Reason), s.actor(c, req.Actor))
+	if err != nil {
+		if errors.Is(err, maintenance.ErrOverlap) {
+			c.JSON(http.StatusConflict, gin.H{"message": err.Error(), "window": window})
+			return
+		}
+		s.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, s.status(server, window))
+}
+
+// endWindow restores the server before its window expires
+func (s *Server) endWindow(c *gin.Context) {
+	server := c.Param("server")
+	if _, err := s.scheduler.End(server, s.actor(c, c.Query("actor"))); err != nil {
+		s.fail(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s.status(server, nil))
+}
+
+// listCertificates reports every served certificate, soonest expiry first.
+// With ?expiring_within=N only certificates missing or expiring within N days are listed.
+func (s *Server) listCertificates(c *gin.Context) {
+	list := s.certs.List()
+
+	if within := c.Query("expiring_within"); within != "" {
+		days, err := strconv.Atoi(within)
+		if err != nil || days < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "expiring_within must be a number of days"})
+			return
+		}
+		filtered := list[:0]
+		for _, status := range list {
+			if !status.Loaded || status.DaysLeft < days {
+				filtered = append(filtered, status)
+			}
+		}
+		list = filtered
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"generated_at": time.Now(),
+		"certificates": list,
+	})
+}
+
+// getLevel reports the current log level
+func (s *Server) getLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, s.logger.LevelStatus())
+}
+
+// setLevel changes the log level, optionally for a limited time
+func (s *Server) setLevel(c *gin.Context) {
+	var req levelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid request body: %v", err)})
+		return
+	}
+	level, err := logrus.ParseLevel(req.Level)
+	if err != nil || level < logrus.ErrorLevel || level > logrus.DebugLevel {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "level must be debug, info, warn or error"})
+		return
+	}
+	if req.Minutes < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "minutes must not be negative"})
+		return
+	}
+
+	s.logger.SwitchLevel(level, time.Duration(req.Minutes)*time.Minute)
+	s.logger.WithFields(map[string]interface{}{
+		"log_level": level.String(),
+		"minutes":   req.Minutes,
+		"actor":     s.actor(c, c.Query("actor")),
+	}).Warn("Log level changed through the admin API")
+
+	c.JSON(http.StatusOK, s.logger.LevelStatus())
+}
+
+// getClock reports the process time and whether it is fixed by test mode
+func (s *Server) getClock(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"now":   clock.Now(),
+		"fixed": clock.Current() != nil,
+	})
+}
+
+// advanceClock moves the test mode clock forward
+func (s *Server) advanceClock(c *gin.Context) {
+	fixed := clock.Current()
+	if fixed == nil {
+		c.JSON(http.StatusConflict, gin.H{"message": "the clock can only be advanced in test mode"})
+		return
+	}
+	var req clockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("Invalid request body: %v", err)})
+		return
+	}
+	if req.Seconds <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"message": "seconds must be positive"})
+		return
+	}
+
+	fixed.Advance(time.Duration(req.Seconds) * time.Second)
+	c.JSON(http.StatusOK, gin.H{"now": fixed.Now(), "fixed": true})
+}
+
+// status builds the response describing a server's maintenance state
+func (s *Server) status(server string, window *maintenance.Window) gin.H {
+	var inFlight int64
+	if counter := s.scheduler.InFlight(server); counter != nil {
+		inFlight = counter.Load()
+	}
+	return gin.H{
+		"server":      server,
+		"maintenance": window != nil,
+		"window":      window,
+		"in_flight":   inFlight,
+	}
+}
+
+// actor identifies who made the change for the audit log
+func (s *Server) actor(c *gin.Context, actor string) string {
+	if actor = strings.TrimSpace(actor); actor != "" {
+		return actor
+	}
+	return logger.GetClientIP(c.Request)
+}
+
+// fail maps scheduler errors to responses
+func (s *Server) fail(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, maintenance.ErrUnknownServer):
+		c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+	case errors.Is(err, maintenance.ErrNoWindow):
+		c.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+	}
+}
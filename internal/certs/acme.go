@@ -0,0 +1,433 @@
+package certs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+const (
+	defaultRenewBefore        = 30 * 24 * time.Hour
+	defaultPropagationTimeout = 120 * time.Second
+	renewCheckInterval        = 12 * time.Hour
+	accountKeyFile            = "account.key"
+)
+
+// ACMEManager obtains and renews a certificate for one server using DNS-01 challenges
+type ACMEManager struct {
+	name     string
+	config   config.ACMEConfig
+	logger   *logger.Logger
+	provider DNSProvider
+	cacheDir string
+
+	accountKey crypto.Signer
+
+	mu          sync.RWMutex
+	cert        *tls.Certificate
+	lastRenewal *RenewalAttempt
+
+	stop chan struct{}
+}
+
+// NewACMEManager creates a new ACME manager for the given server
+func NewACMEManager(name string, cfg config.ACMEConfig, log *logger.Logger) (*ACMEManager, error) {
+	provider, err := NewDNSProvider(cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.CacheDir == "" {
+		log.Warnf("ACME cache disabled for %s: certificates are kept in memory and reissued on restart", name)
+	}
+
+	return &ACMEManager{
+		name:     name,
+		config:   cfg,
+		logger:   log,
+		provider: provider,
+		cacheDir: cfg.CacheDir,
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// Start loads a cached certificate or obtains a new one, then renews it in the background
+func (am *ACMEManager) Start() error {
+	if am.cacheDir != "" {
+		if err := os.MkdirAll(am.cacheDir, 0700); err != nil {
+			return fmt.Errorf("failed to create ACME cache directory: %v", err)
+		}
+
+		if cert, err := am.loadCachedCertificate(); err == nil {
+			am.setCertificate(cert)
+			am.logger.Infof("Loaded cached ACME certificate for %s", am.name)
+		}
+	}
+
+	if am.needsRenewal() {
+		if err := am.renew(); err != nil {
+			if am.Certificate() == nil {
+				return fmt.Errorf("failed to obtain ACME certificate: %v", err)
+			}
+			am.logger.Errorf("ACME renewal for %s failed, keeping current certificate: %v", am.name, err)
+		}
+	}
+
+	go am.renewLoop()
+	return nil
+}
+
+// Stop stops the background renewal loop
+func (am *ACMEManager) Stop() {
+	close(am.stop)
+}
+
+// GetCertificate returns the current certificate for use in tls.Config
+func (am *ACMEManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := am.Certificate()
+	if cert == nil {
+		return nil, errors.New("no ACME certificate available")
+	}
+	return cert, nil
+}
+
+// Certificate returns the current certificate
+func (am *ACMEManager) Certificate() *tls.Certificate {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return am.cert
+}
+
+func (am *ACMEManager) setCertificate(cert *tls.Certificate) {
+	am.mu.Lock()
+	am.cert = cert
+	am.mu.Unlock()
+}
+
+// renewLoop periodically checks whether the certificate needs renewal
+func (am *ACMEManager) renewLoop() {
+	ticker := time.NewTicker(renewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-am.stop:
+			return
+		case <-ticker.C:
+			if !am.needsRenewal() {
+				continue
+			}
+			if err := am.renew(); err != nil {
+				am.logger.Errorf("ACME renewal for %s failed: %v", am.name, err)
+			}
+		}
+	}
+}
+
+// needsRenewal reports whether the current certificate is missing or close to expiry
+func (am *ACMEManager) needsRenewal() bool {
+	cert := am.Certificate()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+
+	renewBefore := defaultRenewBefore
+	if am.config.RenewBefore > 0 {
+		renewBefore = time.Duration(am.config.RenewBefore) * 24 * time.Hour
+	}
+	return time.Until(cert.Leaf.NotAfter) < renewBefore
+}
+
+// renew obtains a new certificate and records the outcome
+func (am *ACMEManager) renew() error {
+	err := am.obtain()
+
+	attempt := &RenewalAttempt{Time: time.Now(), Success: err == nil}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	am.mu.Lock()
+	am.lastRenewal = attempt
+	am.mu.Unlock()
+
+	return err
+}
+
+// Status describes the current certificate and the last renewal attempt
+func (am *ACMEManager) Status() CertificateStatus {
+	am.mu.RLock()
+	cert, lastRenewal := am.cert, am.lastRenewal
+	am.mu.RUnlock()
+
+	status := describe(am.name, SourceACME, cert)
+	status.LastRenewal = lastRenewal
+	return status
+}
+
+// obtain runs a full ACME order using DNS-01 challenges
+func (am *ACMEManager) obtain() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	am.logger.Infof("Requesting ACME certificate for %s (%s)", am.name, strings.Join(am.config.Domains, ", "))
+
+	client, err := am.newClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(am.config.Domains...))
+	if err != nil {
+		return fmt.Errorf("failed to create order: %v", err)
+	}
+
+	// Publish every DNS record first: a domain and its wildcard share one record name
+	var pending []dnsChallenge
+	defer func() {
+		for _, ch := range pending {
+			if err := am.provider.CleanUp(context.Background(), ch.fqdn, ch.value); err != nil {
+				am.logger.Warnf("Failed to clean up ACME record %s: %v", ch.fqdn, err)
+			}
+		}
+	}()
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return fmt.Errorf("failed to get authorization: %v", err)
+		}
+		if authz.Status == acme.StatusValid {
+			continue
+		}
+
+		var chal *acme.Challenge
+		for _, c := range authz.Challenges {
+			if c.Type == "dns-01" {
+				chal = c
+				break
+			}
+		}
+		if chal == nil {
+			return fmt.Errorf("no dns-01 challenge offered for %s", authz.Identifier.Value)
+		}
+
+		value, err := client.DNS01ChallengeRecord(chal.Token)
+		if err != nil {
+			return err
+		}
+
+		fqdn := "_acme-challenge." + authz.Identifier.Value
+		if err := am.provider.Present(ctx, fqdn, value); err != nil {
+			return fmt.Errorf("failed to publish DNS record for %s: %v", authz.Identifier.Value, err)
+		}
+		pending = append(pending, dnsChallenge{authzURL: authzURL, challenge: chal, fqdn: fqdn, value: value})
+	}
+
+	for _, ch := range pending {
+		am.waitForPropagation(ctx, ch.fqdn, ch.value)
+	}
+
+	for _, ch := range pending {
+		if _, err := client.Accept(ctx, ch.challenge); err != nil {
+			return fmt.Errorf("failed to accept challenge for %s: %v", ch.fqdn, err)
+		}
+		if _, err := client.WaitAuthorization(ctx, ch.authzURL); err != nil {
+			return fmt.Errorf("authorization failed for %s: %v", ch.fqdn, err)
+		}
+	}
+
+	order, err = client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return fmt.Errorf("order failed: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: am.config.Domains[0]},
+		DNSNames: am.config.Domains,
+	}, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CSR: %v", err)
+	}
+
+	der, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return fmt.Errorf("failed to finalize order: %v", err)
+	}
+
+	cert, err := am.saveCertificate(der, key)
+	if err != nil {
+		return err
+	}
+	am.setCertificate(cert)
+
+	am.logger.Infof("ACME certificate for %s issued, expires %s", am.name, cert.Leaf.NotAfter.Format(time.RFC3339))
+	return nil
+}
+
+// dnsChallenge tracks a published DNS-01 record
+type dnsChallenge struct {
+	authzURL  string
+	challenge *acme.Challenge
+	fqdn      string
+	value     string
+}
+
+// newClient creates an ACME client with a registered account
+func (am *ACMEManager) newClient(ctx context.Context) (*acme.Client, error) {
+	key, err := am.loadAccountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: am.config.DirectoryURL,
+		UserAgent:    "okaproxy",
+	}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	account := &acme.Account{}
+	if am.config.Email != "" {
+		account.Contact = []string{"mailto:" + am.config.Email}
+	}
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, fmt.Errorf("failed to register ACME account: %v", err)
+	}
+
+	return client, nil
+}
+
+// waitForPropagation polls DNS until the TXT record is visible or the timeout elapses
+func (am *ACMEManager) waitForPropagation(ctx context.Context, fqdn, value string) {
+	timeout := defaultPropagationTimeout
+	if am.config.DNS.PropagationTimeout > 0 {
+		timeout = time.Duration(am.config.DNS.PropagationTimeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if records, err := net.DefaultResolver.LookupTXT(ctx, fqdn); err == nil {
+			for _, record := range records {
+				if record == value {
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	am.logger.Warnf("TXT record %s not visible after %s, continuing anyway", fqdn, timeout)
+}
+
+// loadAccountKey loads or creates the ACME account key
+func (am *ACMEManager) loadAccountKey() (crypto.Signer, error) {
+	if am.accountKey != nil {
+		return am.accountKey, nil
+	}
+	if am.cacheDir == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		am.accountKey = key
+		return key, nil
+	}
+
+	path := filepath.Join(am.cacheDir, accountKeyFile)
+	if data, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("invalid account key in %s", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save account key: %v", err)
+	}
+	return key, nil
+}
+
+// certPaths returns the cache paths of this server's certificate and key
+func (am *ACMEManager) certPaths() (string, string) {
+	base := filepath.Join(am.cacheDir, am.name)
+	return base + ".crt", base + ".key"
+}
+
+// loadCachedCertificate loads a previously issued certificate from the cache
+func (am *ACMEManager) loadCachedCertificate() (*tls.Certificate, error) {
+	certPath, keyPath := am.certPaths()
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// saveCertificate parses the issued chain and writes it to the cache, if any
+func (am *ACMEManager) saveCertificate(der [][]byte, key *ecdsa.PrivateKey) (*tls.Certificate, error) {
+	var certPEM []byte
+	for _, b := range der {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: b})...)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if am.cacheDir != "" {
+		certPath, keyPath := am.certPaths()
+		if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+			return nil, fmt.Errorf("failed to save certificate: %v", err)
+		}
+		if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save certificate key: %v", err)
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
@@ -0,0 +1,53 @@
+package certs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+// DNSProvider publishes and removes TXT records for DNS-01 challenges
+type DNSProvider interface {
+	// Present creates a TXT record with the given value at fqdn
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record created by Present
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// NewDNSProvider creates the DNS provider selected in the configuration
+func NewDNSProvider(cfg config.ACMEDNSConfig) (DNSProvider, error) {
+	switch cfg.Provider {
+	case config.DNSProviderCloudflare:
+		return newCloudflareProvider(cfg), nil
+	case config.DNSProviderRoute53:
+		return newRoute53Provider(cfg), nil
+	case config.DNSProviderAliyun:
+		return newAliyunProvider(cfg), nil
+	default:
+		return nil, fmt.Errorf("unsupported DNS provider %q", cfg.Provider)
+	}
+}
+
+// dnsHTTPClient is shared by the DNS provider API clients
+var dnsHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// recordKey identifies a TXT record created by a provider
+func recordKey(fqdn, value string) string {
+	return fqdn + "|" + value
+}
+
+// guessZone returns the configured zone or the last two labels of the name
+func guessZone(zone, fqdn string) string {
+	if zone != "" {
+		return strings.TrimSuffix(zone, ".")
+	}
+	labels := strings.Split(strings.TrimSuffix(fqdn, "."), ".")
+	if len(labels) <= 2 {
+		return strings.Join(labels, ".")
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
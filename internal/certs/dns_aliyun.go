@@ -0,0 +1,149 @@
+package certs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+const aliyunDNSEndpoint = "https://alidns.aliyuncs.com/"
+
+// aliyunProvider manages TXT records through the Alibaba Cloud DNS API
+type aliyunProvider struct {
+	accessKeyID     string
+	accessKeySecret string
+	zone            string
+
+	mu      sync.Mutex
+	records map[string]string // recordKey -> record ID
+}
+
+func newAliyunProvider(cfg config.ACMEDNSConfig) *aliyunProvider {
+	return &aliyunProvider{
+		accessKeyID:     cfg.AccessKeyID,
+		accessKeySecret: cfg.SecretAccessKey,
+		zone:            cfg.Zone,
+		records:         make(map[string]string),
+	}
+}
+
+// Present creates the TXT record
+func (ap *aliyunProvider) Present(ctx context.Context, fqdn, value string) error {
+	zone := guessZone(ap.zone, fqdn)
+	rr := strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), "."+zone)
+
+	var result struct {
+		RecordID string `json:"RecordId"`
+	}
+	err := ap.call(ctx, map[string]string{
+		"Action":     "AddDomainRecord",
+		"DomainName": zone,
+		"RR":         rr,
+		"Type":       "TXT",
+		"Value":      value,
+		"TTL":        "600",
+	}, &result)
+	if err != nil {
+		return err
+	}
+
+	ap.mu.Lock()
+	ap.records[recordKey(fqdn, value)] = result.RecordID
+	ap.mu.Unlock()
+	return nil
+}
+
+// CleanUp deletes the TXT record
+func (ap *aliyunProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	ap.mu.Lock()
+	id, ok := ap.records[recordKey(fqdn, value)]
+	delete(ap.records, recordKey(fqdn, value))
+	ap.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	return ap.call(ctx, map[string]string{
+		"Action":   "DeleteDomainRecord",
+		"RecordId": id,
+	}, nil)
+}
+
+// call performs a signed RPC-style API request
+func (ap *aliyunProvider) call(ctx context.Context, params map[string]string, result interface{}) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	params["Format"] = "JSON"
+	params["Version"] = "2015-01-09"
+	params["AccessKeyId"] = ap.accessKeyID
+	params["SignatureMethod"] = "HMAC-SHA1"
+	params["SignatureVersion"] = "1.0"
+	params["SignatureNonce"] = hex.EncodeToString(nonce)
+	params["Timestamp"] = time.Now().UTC().Format("2006-01-02T15:04:05Z")
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, aliyunEscape(k)+"="+aliyunEscape(params[k]))
+	}
+	query := strings.Join(pairs, "&")
+
+	mac := hmac.New(sha1.New, []byte(ap.accessKeySecret+"&"))
+	mac.Write([]byte("GET&" + aliyunEscape("/") + "&" + aliyunEscape(query)))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		aliyunDNSEndpoint+"?"+query+"&Signature="+aliyunEscape(signature), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := dnsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `json:"Code"`
+			Message string `json:"Message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("aliyun: %s failed (status %d): %s %s", params["Action"], resp.StatusCode, apiErr.Code, apiErr.Message)
+	}
+
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// aliyunEscape percent-encodes a value as required by the Aliyun signature scheme
+func aliyunEscape(s string) string {
+	escaped := url.QueryEscape(s)
+	escaped = strings.ReplaceAll(escaped, "+", "%20")
+	escaped = strings.ReplaceAll(escaped, "*", "%2A")
+	return strings.ReplaceAll(escaped, "%7E", "~")
+}
@@ -0,0 +1,145 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"okaproxy/internal/config"
+)
+
+const cloudflareAPI = "https://api.cloudflare.com/client/v4"
+
+// cloudflareProvider manages TXT records through the Cloudflare v4 API
+type cloudflareProvider struct {
+	apiToken string
+	zone     string
+	zoneID   string
+
+	mu      sync.Mutex
+	records map[string]string // recordKey -> record ID
+}
+
+func newCloudflareProvider(cfg config.ACMEDNSConfig) *cloudflareProvider {
+	return &cloudflareProvider{
+		apiToken: cfg.APIToken,
+		zone:     cfg.Zone,
+		zoneID:   cfg.ZoneID,
+		records:  make(map[string]string),
+	}
+}
+
+// cloudflareResponse is the common envelope of Cloudflare API responses
+type cloudflareResponse struct {
+	Success bool              `json:"success"`
+	Errors  []json.RawMessage `json:"errors"`
+	Result  json.RawMessage   `json:"result"`
+}
+
+// Present creates the TXT record
+func (cp *cloudflareProvider) Present(ctx context.Context, fqdn, value string) error {
+	zoneID, err := cp.lookupZoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"type":    "TXT",
+		"name":    fqdn,
+		"content": value,
+		"ttl":     120,
+	}
+	var record struct {
+		ID string `json:"id"`
+	}
+	if err := cp.do(ctx, http.MethodPost, "/zones/"+zoneID+"/dns_records", body, &record); err != nil {
+		return err
+	}
+
+	cp.mu.Lock()
+	cp.records[recordKey(fqdn, value)] = record.ID
+	cp.mu.Unlock()
+	return nil
+}
+
+// CleanUp deletes the TXT record
+func (cp *cloudflareProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	cp.mu.Lock()
+	id, ok := cp.records[recordKey(fqdn, value)]
+	delete(cp.records, recordKey(fqdn, value))
+	cp.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	zoneID, err := cp.lookupZoneID(ctx, fqdn)
+	if err != nil {
+		return err
+	}
+	return cp.do(ctx, http.MethodDelete, "/zones/"+zoneID+"/dns_records/"+id, nil, nil)
+}
+
+// lookupZoneID resolves the zone ID, preferring the configured value
+func (cp *cloudflareProvider) lookupZoneID(ctx context.Context, fqdn string) (string, error) {
+	if cp.zoneID != "" {
+		return cp.zoneID, nil
+	}
+
+	zone := guessZone(cp.zone, fqdn)
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if err := cp.do(ctx, http.MethodGet, "/zones?name="+url.QueryEscape(zone), nil, &zones); err != nil {
+		return "", err
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("cloudflare zone %s not found", zone)
+	}
+
+	cp.zoneID = zones[0].ID
+	return cp.zoneID, nil
+}
+
+// do performs an authenticated API request and decodes the result
+func (cp *cloudflareProvider) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudflareAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cp.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := dnsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope cloudflareResponse
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("cloudflare: invalid response (status %d): %v", resp.StatusCode, err)
+	}
+	if !envelope.Success {
+		return fmt.Errorf("cloudflare: request failed (status %d): %s", resp.StatusCode, envelope.Errors)
+	}
+
+	if result != nil {
+		return json.Unmarshal(envelope.Result, result)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+const (
+	route53Endpoint = "https://route53.amazonaws.com"
+	route53Region   = "us-east-1"
+	route53Service  = "route53"
+)
+
+// route53Provider manages TXT records through the AWS Route53 API
+type route53Provider struct {
+	hostedZoneID    string
+	accessKeyID     string
+	secretAccessKey string
+}
+
+func newRoute53Provider(cfg config.ACMEDNSConfig) *route53Provider {
+	return &route53Provider{
+		hostedZoneID:    strings.TrimPrefix(cfg.ZoneID, "/hostedzone/"),
+		accessKeyID:     cfg.AccessKeyID,
+		secretAccessKey: cfg.SecretAccessKey,
+	}
+}
+
+// Present creates (or replaces) the TXT record
+func (rp *route53Provider) Present(ctx context.Context, fqdn, value string) error {
+	return rp.change(ctx, "UPSERT", fqdn, value)
+}
+
+// CleanUp deletes the TXT record
+func (rp *route53Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return rp.change(ctx, "DELETE", fqdn, value)
+}
+
+// change submits a ChangeResourceRecordSets request
+func (rp *route53Provider) change(ctx context.Context, action, fqdn, value string) error {
+	var body bytes.Buffer
+	body.WriteString(xml.Header)
+	fmt.Fprintf(&body, `<ChangeResourceRecordSetsRequest xmlns="https://route53.amazonaws.com/doc/2013-04-01/">`+
+		`<ChangeBatch><Changes><Change><Action>%s</Action><ResourceRecordSet>`+
+		`<Name>%s</Name><Type>TXT</Type><TTL>60</TTL>`+
+		`<ResourceRecords><ResourceRecord><Value>"%s"</Value></ResourceRecord></ResourceRecords>`+
+		`</ResourceRecordSet></Change></Changes></ChangeBatch></ChangeResourceRecordSetsRequest>`,
+		action, xmlEscape(fqdn+"."), xmlEscape(value))
+
+	path := "/2013-04-01/hostedzone/" + rp.hostedZoneID + "/rrset"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, route53Endpoint+path, bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	rp.sign(req, body.Bytes(), time.Now().UTC())
+
+	resp, err := dnsHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("route53: %s failed (status %d): %s", action, resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to the request
+func (rp *route53Provider) sign(req *http.Request, payload []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "content-type;host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "content-type:" + req.Header.Get("Content-Type") + "\n" +
+		"host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := dateStamp + "/" + route53Region + "/" + route53Service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+rp.secretAccessKey), dateStamp)
+	key = hmacSHA256(key, route53Region)
+	key = hmacSHA256(key, route53Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		rp.accessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
@@ -0,0 +1,140 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Certificate sources
+const (
+	SourceManual = "manual"
+	SourceACME   = "acme"
+)
+
+// CertificateStatus describes a served certificate for monitoring
+type CertificateStatus struct {
+	Server       string          `json:"server"`
+	Source       string          `json:"source"`
+	Loaded       bool            `json:"loaded"`
+	Subject      string          `json:"subject,omitempty"`
+	SANs         []string        `json:"sans,omitempty"`
+	Issuer       string          `json:"issuer,omitempty"`
+	SerialNumber string          `json:"serial_number,omitempty"`
+	NotBefore    time.Time       `json:"not_before"`
+	NotAfter     time.Time       `json:"not_after"`
+	DaysLeft     int             `json:"days_left"`
+	LastRenewal  *RenewalAttempt `json:"last_renewal,omitempty"`
+}
+
+// RenewalAttempt is the outcome of the most recent ACME order
+type RenewalAttempt struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Inventory lists every certificate served by the proxies
+type Inventory struct {
+	mu      sync.RWMutex
+	sources []inventorySource
+}
+
+// inventorySource reports the certificate of a server
+type inventorySource struct {
+	server string
+	status func() CertificateStatus
+}
+
+// NewInventory creates an empty inventory
+func NewInventory() *Inventory {
+	return &Inventory{}
+}
+
+// AddManual registers a certificate loaded from cert_path/key_path
+func (inv *Inventory) AddManual(server string, cert *tls.Certificate) {
+	status := describe(server, SourceManual, cert)
+	inv.add(server, func() CertificateStatus { return status })
+}
+
+// AddACME registers a certificate managed by ACME
+func (inv *Inventory) AddACME(am *ACMEManager) {
+	inv.add(am.name, am.Status)
+}
+
+func (inv *Inventory) add(server string, status func() CertificateStatus) {
+	inv.mu.Lock()
+	inv.sources = append(inv.sources, inventorySource{server: server, status: status})
+	inv.mu.Unlock()
+}
+
+// Remove forgets the certificates of a stopped server
+func (inv *Inventory) Remove(server string) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	kept := inv.sources[:0:0]
+	for _, source := range inv.sources {
+		if source.server != server {
+			kept = append(kept, source)
+		}
+	}
+	inv.sources = kept
+}
+
+// List returns the status of every certificate, soonest expiry first
+func (inv *Inventory) List() []CertificateStatus {
+	inv.mu.RLock()
+	sources := inv.sources
+	inv.mu.RUnlock()
+
+	now := time.Now()
+	list := make([]CertificateStatus, 0, len(sources))
+	for _, source := range sources {
+		status := source.status()
+		if status.Loaded {
+			status.DaysLeft = int(status.NotAfter.Sub(now).Hours() / 24)
+		}
+		list = append(list, status)
+	}
+
+	// Missing certificates come first, they need attention most
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Loaded != list[j].Loaded {
+			return !list[i].Loaded
+		}
+		return list[i].NotAfter.Before(list[j].NotAfter)
+	})
+	return list
+}
+
+// describe extracts the monitoring fields of a certificate's leaf
+func describe(server, source string, cert *tls.Certificate) CertificateStatus {
+	status := CertificateStatus{Server: server, Source: source}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return status
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return status
+		}
+		leaf = parsed
+	}
+
+	status.Loaded = true
+	status.Subject = leaf.Subject.String()
+	status.SANs = append(status.SANs, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		status.SANs = append(status.SANs, ip.String())
+	}
+	status.Issuer = leaf.Issuer.String()
+	status.SerialNumber = leaf.SerialNumber.Text(16)
+	status.NotBefore = leaf.NotBefore
+	status.NotAfter = leaf.NotAfter
+	return status
+}
@@ -0,0 +1,6 @@
+//go:build !lite
+
+package config
+
+// liteBuild is true when the binary was built with the "lite" tag
+const liteBuild = false
@@ -2,118 +2,3341 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+
+	"okaproxy/internal/accesslog"
+	"okaproxy/internal/waf"
 )
 
 // Config represents the main configuration structure
 type Config struct {
+	Lite   bool           `toml:"lite"` // Minimal-footprint mode: no Redis, no GeoIP, trimmed middleware
+	Paths  PathsConfig    `toml:"paths"`
 	Limit  LimitConfig    `toml:"limit"`
+	Flags  FlagsConfig    `toml:"flags"`
+	Reload ReloadConfig   `toml:"reload"`
+	Store  StoreConfig    `toml:"store"`
+	Bypass BypassConfig   `toml:"bypass"`
+	Admin  AdminConfig    `toml:"admin"`
+	GeoIP  GeoIPConfig    `toml:"geoip"`
+	Report ReportConfig   `toml:"report"`
 	Server []ServerConfig `toml:"server"`
+	Test   []TestCase     `toml:"test"` // Fixtures run by "okaproxy test"
+
+	Telemetry TelemetryConfig `toml:"telemetry"`
+	Log       LogConfig       `toml:"log"`
+	Logging   LoggingConfig   `toml:"logging"` // Alternative spelling of [log.remote]
+	Sentry    SentryConfig    `toml:"sentry"`
+	TestMode  TestModeConfig  `toml:"test_mode"`
+	Secrets   SecretsConfig   `toml:"secrets"`
+	Shutdown  ShutdownConfig  `toml:"shutdown"`
+
+	TrustedProxies TrustedProxiesConfig `toml:"trusted_proxies"`
+
+	Cache CacheConfig `toml:"cache"`
+
+	Include Patterns `toml:"include"` // Files with more [[server]] and [[test]] entries, e.g. "conf.d/*.toml"
+
+	Path string `toml:"-"` // File the configuration was loaded from
+
+	vaultRefs []vaultRef // Options read from Vault, checked again by RefreshSecrets
+}
+
+// Log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogConfig represents log output options
+type LogConfig struct {
+	Format       string          `toml:"format"`        // "text" (default) or "json" lines
+	Level        string          `toml:"level"`         // "debug", "info" (default), "warn" or "error"
+	DebugMinutes int             `toml:"debug_minutes"` // How long SIGUSR1 turns on debug logging (default 30)
+	Syslog       SyslogConfig    `toml:"syslog"`
+	Remote       LogRemoteConfig `toml:"remote"`
+}
+
+// logLevels lists the accepted log levels
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+// Remote log sinks
+const (
+	LogRemoteLoki          = "loki"
+	LogRemoteElasticsearch = "elasticsearch"
+)
+
+// LogRemoteConfig represents pushing access log records to Loki or Elasticsearch
+type LogRemoteConfig struct {
+	Type          string            `toml:"type"`           // "loki" or "elasticsearch" (empty disables shipping)
+	URL           string            `toml:"url"`            // Base URL, e.g. "http://loki:3100" or "http://es:9200"
+	Index         string            `toml:"index"`          // elasticsearch: index name (default "okaproxy-access")
+	Labels        map[string]string `toml:"labels"`         // loki: extra stream labels
+	Headers       map[string]string `toml:"headers"`        // Extra request headers, e.g. authentication
+	BatchSize     int               `toml:"batch_size"`     // Records per push (default 500)
+	QueueSize     int               `toml:"queue_size"`     // Records buffered before new ones are dropped (default 10000)
+	FlushInterval int               `toml:"flush_interval"` // Seconds between pushes (default 5)
+}
+
+// Enabled reports whether access logs are shipped
+func (r *LogRemoteConfig) Enabled() bool {
+	return r.Type != ""
+}
+
+// LoggingConfig accepts the remote log sink as [logging.remote]. LoadConfig
+// moves it to Log.Remote.
+type LoggingConfig struct {
+	Remote LogRemoteConfig `toml:"remote"`
+}
+
+// SyslogConfig represents shipping logs to a syslog endpoint as RFC 5424 messages
+type SyslogConfig struct {
+	Address  string `toml:"address"`  // "udp://host:514", "tcp://host:601" or "unix:///dev/log"
+	Facility string `toml:"facility"` // kern, user, daemon, auth, ... local0-local7 (default local0)
+	Tag      string `toml:"tag"`      // APP-NAME of every message (default okaproxy)
+	Only     bool   `toml:"only"`     // Send logs to syslog only, not to the log file or stdout
+}
+
+// Enabled reports whether logs are sent to syslog
+func (s *SyslogConfig) Enabled() bool {
+	return s.Address != ""
+}
+
+// syslogFacilities maps facility names to their codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// FacilityCode returns the numeric syslog facility
+func (s *SyslogConfig) FacilityCode() int {
+	return syslogFacilities[s.Facility]
+}
+
+// Endpoint returns the network and address to send messages to
+func (s *SyslogConfig) Endpoint() (network, address string, err error) {
+	u, err := url.Parse(s.Address)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid syslog address %q: %v", s.Address, err)
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" || u.Port() == "" {
+			return "", "", fmt.Errorf("syslog address %q needs a host and port", s.Address)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("syslog address %q needs a socket path", s.Address)
+		}
+		return "unixgram", u.Path, nil
+	default:
+		return "", "", fmt.Errorf("unsupported syslog address %q (expected udp://, tcp:// or unix://)", s.Address)
+	}
+}
+
+// PathsConfig represents every location okaproxy writes to
+type PathsConfig struct {
+	DataDir  string `toml:"data_dir"`  // Base directory for all writable data (default ".")
+	LogDir   string `toml:"log_dir"`   // Default: <data_dir>/logs
+	ACMEDir  string `toml:"acme_dir"`  // Default: <data_dir>/acme
+	CacheDir string `toml:"cache_dir"` // Default: <data_dir>/cache
+	GeoIPDir string `toml:"geoip_dir"` // Default: <data_dir>/geoip
+	ReadOnly bool   `toml:"read_only"` // Disable all file outputs (read-only root filesystem)
+}
+
+// LogPath returns the log directory, or "" when file logging is disabled
+func (p *PathsConfig) LogPath() string {
+	return p.resolve(p.LogDir, "logs")
+}
+
+// ACMEPath returns the ACME cache directory, or "" when it must not be persisted
+func (p *PathsConfig) ACMEPath() string {
+	return p.resolve(p.ACMEDir, "acme")
+}
+
+// CachePath returns the disk cache directory, or "" when disk caching is unavailable
+func (p *PathsConfig) CachePath() string {
+	return p.resolve(p.CacheDir, "cache")
+}
+
+// GeoIPPath returns the directory holding GeoIP databases
+func (p *PathsConfig) GeoIPPath() string {
+	if p.GeoIPDir != "" {
+		return p.GeoIPDir
+	}
+	return filepath.Join(p.dataDir(), "geoip")
+}
+
+// DataPath returns the base directory for writable data
+func (p *PathsConfig) DataPath() string {
+	return p.dataDir()
+}
+
+func (p *PathsConfig) dataDir() string {
+	if p.DataDir != "" {
+		return p.DataDir
+	}
+	return "."
+}
+
+// resolve returns dir, a subdirectory of data_dir, or "" in read-only mode
+func (p *PathsConfig) resolve(dir, sub string) string {
+	if p.ReadOnly {
+		return ""
+	}
+	if dir != "" {
+		return dir
+	}
+	return filepath.Join(p.dataDir(), sub)
 }
 
 // LimitConfig represents rate limiting configuration
 type LimitConfig struct {
-	Count  int `toml:"count"`  // Maximum requests per window
-	Window int `toml:"window"` // Time window in seconds
+	Count  int         `toml:"count"`  // Maximum requests per window
+	Window int         `toml:"window"` // Time window in seconds
+	Rules  []LimitRule `toml:"rules"`  // Path-scoped limits applied in addition to the general limit
+	Costs  []LimitCost `toml:"costs"`  // Paths that use more of the general limit per request
+	Ban    BanConfig   `toml:"ban"`
 }
 
-// ServerConfig represents individual server configuration
-type ServerConfig struct {
-	Name      string      `toml:"name"`
-	Port      int         `toml:"port"`
-	TargetURL string      `toml:"target_url"`
-	SecretKey string      `toml:"secret_key"`
-	Expired   int         `toml:"expired"`   // Cookie expiration in seconds
-	CtnMax    int         `toml:"ctn_max"`   // Maximum connections (0 = unlimited)
-	HTTPS     HTTPSConfig `toml:"https"`
+// BanConfig escalates repeated rate limit violations to a temporary ban
+type BanConfig struct {
+	Enabled   bool `toml:"enabled"`
+	Threshold int  `toml:"threshold"` // Violations within window that trigger a ban (default 5)
+	Window    int  `toml:"window"`    // Seconds over which violations are counted (default 600)
+	Duration  int  `toml:"duration"`  // Ban length in seconds (default 3600)
+
+	// Count oversized request headers as violations of the connecting address.
+	// Enable only when clients connect directly rather than through a CDN.
+	OversizedHeaders bool `toml:"oversized_headers"`
+
+	// Count connections dropped by [server.slow_clients] min_rate as
+	// violations of the connecting address, under the same caveat.
+	SlowClients bool `toml:"slow_clients"`
 }
 
-// HTTPSConfig represents HTTPS configuration
-type HTTPSConfig struct {
-	Enabled  bool   `toml:"enabled"`
-	CertPath string `toml:"cert_path"`
-	KeyPath  string `toml:"key_path"`
+// LimitRule limits requests to a path ("/login") or path prefix ("/api/*")
+type LimitRule struct {
+	Path   string `toml:"path"`
+	Count  int    `toml:"count"`
+	Window int    `toml:"window"`
 }
 
-// LoadConfig loads configuration from the specified file
-func LoadConfig(configPath string) (*Config, error) {
-	// Check if config file exists
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		// Try to copy from example file
-		examplePath := configPath + ".example"
-		if _, err := os.Stat(examplePath); err == nil {
-			if err := copyFile(examplePath, configPath); err != nil {
-				return nil, fmt.Errorf("failed to copy example config: %v", err)
-			}
-			return nil, fmt.Errorf("first time running. Please edit %s", configPath)
+// LimitCost makes requests to a path ("/search") or path prefix ("/api/*")
+// count as several requests against the general limit
+type LimitCost struct {
+	Path string `toml:"path"`
+	Cost int    `toml:"cost"`
+}
+
+// CostOf returns the cost of a request to path: that of the first matching
+// cost entry, or 1
+func (l *LimitConfig) CostOf(path string) int {
+	for i := range l.Costs {
+		if PathMatches(l.Costs[i].Path, path) {
+			return l.Costs[i].Cost
 		}
-		return nil, fmt.Errorf("configuration file %s does not exist and no example file found", configPath)
 	}
+	return 1
+}
 
-	var cfg Config
-	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse TOML configuration: %v", err)
-	}
+// GeneralEnabled reports whether the general per-client limit is active
+func (l *LimitConfig) GeneralEnabled() bool {
+	return l.Count > 0 && l.Window > 0
+}
 
-	// Validate configuration
-	if err := cfg.Validate(); err != nil {
-		return nil, fmt.Errorf("configuration validation failed: %v", err)
+// Enabled reports whether any rate limiting is configured
+func (l *LimitConfig) Enabled() bool {
+	return l.GeneralEnabled() || len(l.Rules) > 0
+}
+
+// MatchRule returns the index of the first rule matching path
+func (l *LimitConfig) MatchRule(path string) (int, bool) {
+	for i := range l.Rules {
+		if l.Rules[i].Matches(path) {
+			return i, true
+		}
 	}
+	return -1, false
+}
 
-	return &cfg, nil
+// Matches reports whether the rule applies to path
+func (r *LimitRule) Matches(path string) bool {
+	return PathMatches(r.Path, path)
 }
 
-// Validate validates the configuration
-func (c *Config) Validate() error {
-	if len(c.Server) == 0 {
-		return fmt.Errorf("no server configuration found")
+// PathMatches reports whether path matches pattern, an exact path ("/login")
+// or a prefix ending in "/*" ("/api/*")
+func PathMatches(pattern, path string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return path == prefix || strings.HasPrefix(path, prefix+"/")
 	}
+	return path == pattern
+}
 
-	for i, server := range c.Server {
-		if server.Name == "" {
-			return fmt.Errorf("server[%d]: name is required", i)
+// Rate limit key strategies
+const (
+	RateLimitKeyIP     = "ip"
+	RateLimitKeyHeader = "header"
+	RateLimitKeyCookie = "cookie"
+	RateLimitKeyJWTSub = "jwt_sub"
+)
+
+// ParseRateLimitKey splits a rate_limit_key setting into its strategy and argument
+func ParseRateLimitKey(value string) (strategy, name string, err error) {
+	strategy, name, _ = strings.Cut(value, ":")
+	switch strategy {
+	case "", RateLimitKeyIP:
+		return RateLimitKeyIP, "", nil
+	case RateLimitKeyHeader, RateLimitKeyCookie:
+		if name == "" {
+			return "", "", fmt.Errorf("rate_limit_key %q requires a name, e.g. %q", value, strategy+":X-API-Key")
 		}
-		if server.Port <= 0 || server.Port > 65535 {
-			return fmt.Errorf("server[%d]: invalid port number %d", i, server.Port)
+		return strategy, name, nil
+	case RateLimitKeyJWTSub:
+		// Optional header name; defaults to Authorization
+		if name == "" {
+			name = "Authorization"
 		}
-		if server.TargetURL == "" {
-			return fmt.Errorf("server[%d]: target_url is required", i)
+		return strategy, name, nil
+	default:
+		return "", "", fmt.Errorf("unsupported rate_limit_key %q", value)
+	}
+}
+
+// JWTConfig verifies bearer tokens before their subject is trusted. Tokens
+// signed with the HMAC secret or a key of the JWKS document are accepted.
+type JWTConfig struct {
+	HMACSecret string `toml:"hmac_secret"` // Shared secret of HS256/HS384/HS512 tokens
+	JWKSURL    string `toml:"jwks_url"`    // Key set of RS*, PS* and ES* tokens, e.g. "https://issuer/.well-known/jwks.json"
+	Issuer     string `toml:"issuer"`      // Required iss claim (empty = any)
+	Audience   string `toml:"audience"`    // Required aud claim (empty = any)
+}
+
+// validate checks that tokens can be verified
+func (j *JWTConfig) validate() error {
+	if j.HMACSecret == "" && j.JWKSURL == "" {
+		return fmt.Errorf("hmac_secret or jwks_url is required to verify tokens")
+	}
+	if j.JWKSURL != "" {
+		if u, err := url.Parse(j.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid jwks_url %q", j.JWKSURL)
 		}
-		if server.SecretKey == "" {
-			return fmt.Errorf("server[%d]: secret_key is required", i)
+	}
+	return nil
+}
+
+// BypassConfig lists clients that skip verification and rate limiting
+type BypassConfig struct {
+	IPs []string `toml:"ips"` // IP addresses or CIDR ranges, matched against the connecting address
+}
+
+// Prefixes parses the bypass list into network prefixes
+func (b *BypassConfig) Prefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(b.IPs)
+}
+
+// TrustedProxiesConfig lists the proxies whose forwarded client address
+// headers are believed
+type TrustedProxiesConfig struct {
+	IPs []string `toml:"ips"` // IP addresses or CIDR ranges of proxies in front of okaproxy (default loopback)
+}
+
+// Prefixes parses the trusted proxies into network prefixes
+func (t *TrustedProxiesConfig) Prefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(t.IPs)
+}
+
+// parsePrefixes parses IP addresses and CIDR ranges into network prefixes
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %v", entry, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
 		}
-		if server.Expired <= 0 {
-			return fmt.Errorf("server[%d]: expired must be positive", i)
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP address %q: %v", entry, err)
 		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
 
-		// Validate HTTPS configuration
-		if server.HTTPS.Enabled {
-			if server.HTTPS.CertPath == "" {
-				return fmt.Errorf("server[%d]: HTTPS cert_path is required when HTTPS is enabled", i)
-			}
-			if server.HTTPS.KeyPath == "" {
-				return fmt.Errorf("server[%d]: HTTPS key_path is required when HTTPS is enabled", i)
-			}
-			// Check if certificate files exist
-			if _, err := os.Stat(server.HTTPS.CertPath); os.IsNotExist(err) {
-				return fmt.Errorf("server[%d]: certificate file not found: %s", i, server.HTTPS.CertPath)
-			}
-			if _, err := os.Stat(server.HTTPS.KeyPath); os.IsNotExist(err) {
-				return fmt.Errorf("server[%d]: key file not found: %s", i, server.HTTPS.KeyPath)
-			}
+// State store backends
+const (
+	StoreBackendRedis = "redis"
+	StoreBackendBolt  = "bolt"
+)
+
+// StoreConfig represents where shared state (counters, cache, flags) is kept
+type StoreConfig struct {
+	Backend       string `toml:"backend"`    // "redis" (default) or "bolt" (embedded, single node)
+	Path          string `toml:"path"`       // Bolt database file (default <data_dir>/state.db)
+	RedisAddr     string `toml:"redis_addr"` // Default "localhost:6379"
+	RedisPassword string `toml:"redis_password"`
+	RedisDB       int    `toml:"redis_db"`
+
+	RedisPasswordFile string `toml:"redis_password_file"` // Read redis_password from this file
+}
+
+// RedisAddress returns the Redis server address
+func (s *StoreConfig) RedisAddress() string {
+	if s.RedisAddr != "" {
+		return s.RedisAddr
+	}
+	return "localhost:6379"
+}
+
+// Feature flag providers
+const (
+	FlagsProviderRedis = "redis"
+	FlagsProviderHTTP  = "http"
+)
+
+// FlagsConfig represents the runtime feature flag provider
+type FlagsConfig struct {
+	Provider     string `toml:"provider"`      // "redis" or "http" (empty disables runtime flags)
+	URL          string `toml:"url"`           // Flag service endpoint for the http provider
+	KeyPrefix    string `toml:"key_prefix"`    // Redis hash prefix (default "okaproxy:flags:")
+	PollInterval int    `toml:"poll_interval"` // Seconds between refreshes (default 10)
+}
+
+// ReloadConfig represents automatic configuration reloads
+type ReloadConfig struct {
+	Watch    bool `toml:"watch"`    // Reload when the configuration file changes
+	Interval int  `toml:"interval"` // Seconds between checks of the file where change notifications are unavailable (default 2)
+}
+
+// ShutdownConfig represents how the proxy drains on SIGINT and SIGTERM. New
+// connections are refused at once; requests in flight get drain_timeout.
+type ShutdownConfig struct {
+	DrainTimeout int `toml:"drain_timeout"` // Seconds requests in flight may take to finish (default 30)
+	FailHealth   int `toml:"fail_health"`   // Seconds /health answers 503 on open connections before draining (0 = off)
+}
+
+// CacheConfig represents the response cache shared by the servers. Responses
+// are kept in the state store when one is configured, in memory otherwise.
+type CacheConfig struct {
+	MemorySize int `toml:"memory_size"` // Bytes of responses kept in memory without a store (default 64 MB)
+
+	Disk DiskCacheConfig `toml:"disk"`
+}
+
+// DiskCacheConfig represents the on-disk tier of the response cache, keeping
+// large objects out of the store and memory
+type DiskCacheConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Dir     string `toml:"dir"`      // Default: <cache_dir>/responses
+	MaxSize int64  `toml:"max_size"` // Bytes kept on disk before the least recently used are evicted (default 1 GB)
+	MinSize int    `toml:"min_size"` // Bodies of at least this many bytes are kept on disk (default 256 KB)
+}
+
+// ServerCacheConfig represents the caching of a server's proxied GET responses
+type ServerCacheConfig struct {
+	Enabled bool     `toml:"enabled"`
+	TTL     int      `toml:"ttl"`      // Seconds responses without a Cache-Control max-age are kept (default 60)
+	MaxSize int      `toml:"max_size"` // Largest body cached, in bytes (default 1 MB)
+	Paths   []string `toml:"paths"`    // Routes cached ("/static/*"); empty means all
+
+	StaleWhileRevalidate int `toml:"stale_while_revalidate"` // Seconds an expired response is served while it is refreshed (default: the response's directive, else 0)
+	StaleIfError         int `toml:"stale_if_error"`         // Seconds an expired response replaces upstream errors (default: the response's directive, else 0)
+
+	PurgeFrom []string `toml:"purge_from"` // IPs/CIDRs allowed to send PURGE requests (empty passes PURGE to the target)
+}
+
+// CachesPath reports whether responses for path may be cached
+func (c *ServerCacheConfig) CachesPath(path string) bool {
+	if !c.Enabled {
+		return false
+	}
+	if len(c.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range c.Paths {
+		if PathMatches(pattern, path) {
+			return true
 		}
 	}
+	return false
+}
+
+// PurgePrefixes parses the clients allowed to send PURGE requests
+func (c *ServerCacheConfig) PurgePrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(c.PurgeFrom)
+}
+
+// GeoIP database editions that can be downloaded
+const (
+	GeoIPEditionCity = "GeoLite2-City"
+	GeoIPEditionASN  = "GeoLite2-ASN"
+)
+
+// GeoIPConfig represents automatic GeoLite2 database downloads
+type GeoIPConfig struct {
+	LicenseKey      string   `toml:"license_key"`      // MaxMind license key (empty disables downloads)
+	AccountID       string   `toml:"account_id"`       // MaxMind account ID; enables the authenticated download endpoint
+	Editions        []string `toml:"editions"`         // Default ["GeoLite2-City", "GeoLite2-ASN"]
+	RefreshInterval int      `toml:"refresh_interval"` // Hours between refreshes (default 24)
+	URL             string   `toml:"url"`              // Download server (default "https://download.maxmind.com")
+
+	LicenseKeyFile string `toml:"license_key_file"` // Read license_key from this file
+}
+
+// Enabled reports whether databases should be downloaded
+func (g *GeoIPConfig) Enabled() bool {
+	return g.LicenseKey != ""
+}
+
+// AdminConfig represents the admin API used by deploy pipelines
+type AdminConfig struct {
+	Listen     string `toml:"listen"`      // Address such as "127.0.0.1:9090" (empty disables the admin API)
+	Token      string `toml:"token"`       // Bearer token required on every admin request
+	MaxMinutes int    `toml:"max_minutes"` // Longest maintenance window accepted (default 240)
+
+	TokenFile string `toml:"token_file"` // Read token from this file
+}
+
+// Enabled reports whether the admin API should be served
+func (a *AdminConfig) Enabled() bool {
+	return a.Listen != ""
+}
+
+// TelemetryConfig represents OpenTelemetry trace export over OTLP/HTTP
+type TelemetryConfig struct {
+	Endpoint      string            `toml:"endpoint"`       // OTLP traces URL, e.g. "http://localhost:4318/v1/traces" (empty disables tracing)
+	ServiceName   string            `toml:"service_name"`   // Default "okaproxy"
+	SampleRatio   float64           `toml:"sample_ratio"`   // Fraction of new traces recorded, 0 < ratio <= 1 (default 1)
+	TrustIncoming bool              `toml:"trust_incoming"` // Continue traces from client traceparent headers
+	Headers       map[string]string `toml:"headers"`        // Extra export headers, e.g. authentication
+	FlushInterval int               `toml:"flush_interval"` // Seconds between exports (default 5)
+}
+
+// Enabled reports whether traces should be exported
+func (t *TelemetryConfig) Enabled() bool {
+	return t.Endpoint != ""
+}
+
+// SentryConfig represents error reporting to Sentry
+type SentryConfig struct {
+	DSN            string `toml:"dsn"`             // Project DSN, e.g. "https://<key>@o0.ingest.sentry.io/<project>" (empty disables reporting)
+	Environment    string `toml:"environment"`     // Default "production"
+	Release        string `toml:"release"`         // Release reported with every event (default: okaproxy@<version>)
+	BurstThreshold int    `toml:"burst_threshold"` // 5xx responses within burst_window reported as a burst (default 50)
+	BurstWindow    int    `toml:"burst_window"`    // Seconds (default 60)
+
+	DSNFile string `toml:"dsn_file"` // Read dsn from this file
+}
+
+// Enabled reports whether errors are reported to Sentry
+func (s *SentryConfig) Enabled() bool {
+	return s.DSN != ""
+}
+
+// Endpoint returns the envelope URL and public key of the DSN
+func (s *SentryConfig) Endpoint() (string, string, error) {
+	u, err := url.Parse(s.DSN)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid dsn: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("invalid dsn %q (expected \"https://<key>@<host>/<project>\")", s.DSN)
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if _, err := strconv.Atoi(project); err != nil {
+		return "", "", fmt.Errorf("invalid dsn %q: missing project ID", s.DSN)
+	}
+
+	endpoint := url.URL{Scheme: u.Scheme, Host: u.Host, Path: path[:slash] + "/api/" + project + "/envelope/"}
+	return endpoint.String(), u.User.Username(), nil
+}
+
+// Secrets providers
+const (
+	SecretsProviderVault = "vault"
+)
+
+// SecretsConfig represents an external secrets provider. Secret options set
+// to "vault:<path>#<field>" are read from it.
+type SecretsConfig struct {
+	Provider        string `toml:"provider"`         // "vault" (empty disables)
+	Address         string `toml:"address"`          // Default $VAULT_ADDR
+	Namespace       string `toml:"namespace"`        // Vault Enterprise namespace
+	CAPath          string `toml:"ca_path"`          // CA bundle used to verify the Vault server
+	Token           string `toml:"token"`            // Default $VAULT_TOKEN
+	TokenFile       string `toml:"token_file"`       // Read token from this file
+	RoleID          string `toml:"role_id"`          // Log in with an AppRole instead of a token
+	SecretID        string `toml:"secret_id"`        // AppRole secret ID
+	SecretIDFile    string `toml:"secret_id_file"`   // Read secret_id from this file
+	AppRoleMount    string `toml:"approle_mount"`    // Default "approle"
+	RefreshInterval int    `toml:"refresh_interval"` // Seconds between token renewals and secret checks (default 300)
+}
 
+// validate checks the provider settings
+func (s *SecretsConfig) validate() error {
+	switch s.Provider {
+	case "":
+		return nil
+	case SecretsProviderVault:
+	default:
+		return fmt.Errorf("secrets: invalid provider %q (expected \"vault\")", s.Provider)
+	}
+	if s.Address == "" {
+		return fmt.Errorf("secrets: address is required (or set VAULT_ADDR)")
+	}
+	if s.RoleID == "" && s.Token == "" {
+		return fmt.Errorf("secrets: token or role_id is required (or set VAULT_TOKEN)")
+	}
+	if s.RoleID != "" && s.SecretID == "" {
+		return fmt.Errorf("secrets: secret_id is required with role_id")
+	}
+	if s.RefreshInterval < 0 {
+		return fmt.Errorf("secrets: refresh_interval must not be negative")
+	}
 	return nil
 }
 
-// copyFile copies a file from src to dst
-func copyFile(src, dst string) error {
-	input, err := os.ReadFile(src)
+// TestModeConfig represents deterministic mode: a fixed clock and seeded
+// randomness, so token expiry, rate limit windows, store TTLs and request IDs
+// can be reproduced in tests
+type TestModeConfig struct {
+	Enabled bool   `toml:"enabled"`
+	Time    string `toml:"time"` // RFC 3339 start time of the clock (default "2000-01-01T00:00:00Z")
+	Seed    int64  `toml:"seed"` // Seed of request IDs and weighted target choice
+}
+
+// StartTime returns the time the clock starts at
+func (t *TestModeConfig) StartTime() (time.Time, error) {
+	start, err := time.Parse(time.RFC3339, t.Time)
 	if err != nil {
-		return err
+		return time.Time{}, fmt.Errorf("invalid time %q (expected RFC 3339, e.g. \"2000-01-01T00:00:00Z\")", t.Time)
 	}
-	return os.WriteFile(dst, input, 0644)
-}
\ No newline at end of file
+	return start, nil
+}
+
+// Report schedules and formats
+const (
+	ReportDaily  = "daily"
+	ReportWeekly = "weekly"
+	ReportJSON   = "json"
+	ReportHTML   = "html"
+)
+
+// ReportConfig represents scheduled traffic reports
+type ReportConfig struct {
+	Schedule string      `toml:"schedule"`  // "daily" or "weekly" (empty disables reports)
+	Format   string      `toml:"format"`    // "json" (default) or "html"
+	Dir      string      `toml:"dir"`       // Where reports are written (default <data_dir>/reports; skipped in read-only mode)
+	TopPaths int         `toml:"top_paths"` // Attacked paths listed per server (default 10)
+	Email    EmailConfig `toml:"email"`
+}
+
+// Enabled reports whether scheduled reports are configured
+func (r *ReportConfig) Enabled() bool {
+	return r.Schedule != ""
+}
+
+// EmailConfig represents SMTP delivery of reports
+type EmailConfig struct {
+	SMTPAddr string   `toml:"smtp_addr"` // e.g. "smtp.example.com:587" (empty disables email)
+	Username string   `toml:"username"`
+	Password string   `toml:"password"`
+	From     string   `toml:"from"`
+	To       []string `toml:"to"`
+
+	PasswordFile string `toml:"password_file"` // Read password from this file
+}
+
+// Enabled reports whether reports should be emailed
+func (e *EmailConfig) Enabled() bool {
+	return e.SMTPAddr != ""
+}
+
+// ServerConfig represents individual server configuration
+type ServerConfig struct {
+	Name      string      `toml:"name"`
+	Port      int         `toml:"port"`
+	TargetURL string      `toml:"target_url"`
+	SecretKey string      `toml:"secret_key"`
+	Expired   int         `toml:"expired"`   // Cookie expiration in seconds
+	CtnMax    int         `toml:"ctn_max"`   // Maximum connections (0 = unlimited)
+	HTTPS     HTTPSConfig `toml:"https"`
+
+	Listen []string `toml:"listen"` // Additional addresses: ":8080", "127.0.0.1:9000", "[::1]:8443" or "unix:/path/to.sock"; the only ones with port = 0
+
+	Bind string `toml:"bind"` // Address port is bound to, e.g. "127.0.0.1" or "::1" (default: all interfaces)
+
+	SecretKeyFile string `toml:"secret_key_file"` // Read secret_key from this file
+
+	UnderAttack bool `toml:"under_attack"` // Challenge every client, non-browsers included
+
+	AuthSkipPaths      []string `toml:"auth_skip_paths"`       // Paths that skip the verification challenge ("/api/*", "/.well-known/*")
+	AuthSkipNonBrowser bool     `toml:"auth_skip_non_browser"` // Requests that do not accept HTML skip the verification challenge
+
+	Challenge ChallengeConfig `toml:"challenge"`
+
+	RateLimitKey string    `toml:"rate_limit_key"` // Rate limit key: "ip" (default), "header:<name>", "cookie:<name>" or "jwt_sub"
+	JWT          JWTConfig `toml:"jwt"`            // Verifies the tokens of rate_limit_key = "jwt_sub"
+
+	GeoHeaders bool `toml:"geo_headers"` // Send X-Geo-Country, X-Geo-City and X-Geo-ASN to the target
+
+	AccessLogFormat string `toml:"access_log_format"` // nginx-style access log line, e.g. "$remote_addr \"$request\" $status" (empty = standard fields)
+	AccessLog       string `toml:"access_log"`        // File for this server's access log (default: the shared log)
+	ErrorLog        string `toml:"error_log"`         // File for this server's other messages (default: the shared log)
+
+	CORS            CORSConfig            `toml:"cors"`
+	Connection      ConnectionConfig      `toml:"connection"`
+	TCP             TCPConfig             `toml:"tcp"`
+	ResponseHeaders ResponseHeadersConfig `toml:"response_headers"`
+	ACL             ACLConfig             `toml:"acl"`
+	Device          DeviceConfig          `toml:"device"`
+	GeoBlock        GeoBlockConfig        `toml:"geo_block"`
+	GeoRouting      GeoRoutingConfig      `toml:"geo_routing"`
+	Concurrency     ConcurrencyConfig     `toml:"concurrency"`
+	Snapshot        SnapshotConfig        `toml:"snapshot"`
+	ASN             ASNConfig             `toml:"asn"`
+	Mesh            MeshConfig            `toml:"mesh"`
+
+	UpstreamTLS UpstreamTLSConfig `toml:"upstream_tls"`
+
+	ProxyProtocol ProxyProtocolConfig `toml:"proxy_protocol"`
+
+	UpstreamProxyProtocol string `toml:"upstream_proxy_protocol"` // PROXY protocol header sent to the target: "v1" or "v2" (default: none)
+
+	SecurityHeaders SecurityHeadersConfig `toml:"security_headers"`
+
+	Cache ServerCacheConfig `toml:"cache"`
+
+	Compression CompressionConfig `toml:"compression"`
+
+	Timeouts TimeoutsConfig `toml:"timeouts"`
+
+	Transport TransportConfig `toml:"transport"`
+
+	SlowClients SlowClientsConfig `toml:"slow_clients"`
+
+	Pages PagesConfig `toml:"pages"`
+
+	Static StaticConfig `toml:"static"`
+
+	Endpoints EndpointsConfig `toml:"endpoints"`
+
+	BasicAuth BasicAuthConfig `toml:"basic_auth"`
+
+	OIDC OIDCConfig `toml:"oidc"`
+
+	ForwardAuth ForwardAuthConfig `toml:"forward_auth"`
+
+	APIKeys APIKeysConfig `toml:"api_keys"`
+
+	SearchBots SearchBotsConfig `toml:"search_bots"`
+
+	WAF WAFConfig `toml:"waf"`
+
+	Rules []RequestRule `toml:"rules"`
+
+	Anomaly AnomalyConfig `toml:"anomaly"`
+
+	Type string     `toml:"type"` // "http" (default) or "tcp" to forward raw connections to target_url
+	SNI  []SNIRoute `toml:"sni"`  // TCP servers: route TLS connections by server name without terminating TLS
+
+	Canary CanaryConfig `toml:"canary"`
+}
+
+// CanaryConfig sends a share of clients to a canary target. Each client is
+// assigned a bucket once, so it stays on the same side while the weight holds.
+type CanaryConfig struct {
+	Target string `toml:"target"` // Canary target URL
+	Weight int    `toml:"weight"` // Percent of clients sent to the target (0-100); the canary_weight flag overrides it
+}
+
+// Enabled reports whether a canary target is set
+func (c *CanaryConfig) Enabled() bool {
+	return c.Target != ""
+}
+
+// validate checks the target and weight
+func (c *CanaryConfig) validate() error {
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("weight must be between 0 and 100")
+	}
+	if c.Target == "" {
+		if c.Weight > 0 {
+			return fmt.Errorf("weight requires a target")
+		}
+		return nil
+	}
+	if u, err := url.Parse(c.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid target %q", c.Target)
+	}
+	return nil
+}
+
+// SNIRoute sends the TLS connections of some server names to a target of its
+// own. The TLS stream is forwarded as is, so the target holds the certificates.
+type SNIRoute struct {
+	Hosts  []string `toml:"hosts"`  // Server names, e.g. "mail.example.com" or "*.example.com"
+	Target string   `toml:"target"` // "tcp://host:port"
+}
+
+// Server types
+const (
+	ServerTypeHTTP = "http"
+	ServerTypeTCP  = "tcp"
+)
+
+// SearchBotsConfig lets search engine crawlers through the verification
+// challenge once a reverse DNS lookup of their address names their operator's
+// domain and a forward lookup of that name returns the address
+type SearchBotsConfig struct {
+	Verify         bool  `toml:"verify"`          // Let verified crawlers skip the challenge
+	BlockImpostors *bool `toml:"block_impostors"` // Reject clients claiming to be a crawler from other addresses (default true)
+}
+
+// BlocksImpostors reports whether fake crawlers are rejected
+func (s *SearchBotsConfig) BlocksImpostors() bool {
+	return s.BlockImpostors == nil || *s.BlockImpostors
+}
+
+// EndpointOff disables a built-in endpoint
+const EndpointOff = "off"
+
+// EndpointsConfig places a server's built-in health and status routes, which
+// shadow target paths of the same name
+type EndpointsConfig struct {
+	Health string   `toml:"health"` // Health check path (default "/health", "off" disables)
+	Status string   `toml:"status"` // Status path (default "/status", "off" disables)
+	Allow  []string `toml:"allow"`  // IPs/CIDRs that may call them; others get a 404 (empty = everyone)
+}
+
+// AllowPrefixes parses the clients allowed to call the endpoints
+func (e *EndpointsConfig) AllowPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(e.Allow)
+}
+
+// validate checks that the endpoints are distinct paths
+func (e *EndpointsConfig) validate() error {
+	for _, path := range []string{e.Health, e.Status} {
+		if path != EndpointOff && !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("path %q must start with \"/\" or be \"off\"", path)
+		}
+	}
+	if e.Health == e.Status && e.Health != EndpointOff {
+		return fmt.Errorf("health and status share the path %s", e.Health)
+	}
+	if _, err := e.AllowPrefixes(); err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	return nil
+}
+
+// BasicAuthConfig puts a server, or some of its paths, behind HTTP Basic
+// authentication. Passwords are bcrypt hashes, as written by
+// "htpasswd -B" or "caddy hash-password".
+type BasicAuthConfig struct {
+	Realm string            `toml:"realm"` // Realm shown in the browser's login prompt
+	Users map[string]string `toml:"users"` // User name to bcrypt hash
+	File  string            `toml:"file"`  // htpasswd file of "user:hash" lines, merged with users
+	Paths []string          `toml:"paths"` // Protected paths ("/admin/*"; empty = every path)
+}
+
+// Enabled reports whether any users are configured
+func (b *BasicAuthConfig) Enabled() bool {
+	return len(b.Users) > 0 || b.File != ""
+}
+
+// Protects reports whether requests for path must authenticate
+func (b *BasicAuthConfig) Protects(path string) bool {
+	if len(b.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range b.Paths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Credentials returns the user name to bcrypt hash map of the inline users and
+// the htpasswd file. Inline users take precedence.
+func (b *BasicAuthConfig) Credentials() (map[string]string, error) {
+	credentials := make(map[string]string)
+	if b.File != "" {
+		data, err := os.ReadFile(b.File)
+		if err != nil {
+			return nil, err
+		}
+		for n, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok || user == "" {
+				return nil, fmt.Errorf("%s:%d: expected user:hash", b.File, n+1)
+			}
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("%s:%d: user %s: only bcrypt hashes are supported", b.File, n+1, user)
+			}
+			credentials[user] = hash
+		}
+	}
+	for user, hash := range b.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("user %s: only bcrypt hashes are supported", user)
+		}
+		credentials[user] = hash
+	}
+	return credentials, nil
+}
+
+// validate checks the users and the protected paths
+func (b *BasicAuthConfig) validate() error {
+	if !b.Enabled() {
+		return nil
+	}
+	credentials, err := b.Credentials()
+	if err != nil {
+		return err
+	}
+	if len(credentials) == 0 {
+		return fmt.Errorf("no users in %s", b.File)
+	}
+	for user := range credentials {
+		if strings.Contains(user, ":") {
+			return fmt.Errorf("user %q must not contain \":\"", user)
+		}
+	}
+	for _, pattern := range b.Paths {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("path %q must start with \"/\"", pattern)
+		}
+	}
+	if strings.ContainsAny(b.Realm, "\"\r\n") {
+		return fmt.Errorf("realm must not contain quotes or line breaks")
+	}
+	return nil
+}
+
+// OIDCConfig signs browser users in with an OpenID Connect provider before
+// their requests reach the target, which receives their identity in headers
+type OIDCConfig struct {
+	Issuer           string   `toml:"issuer"`             // Provider URL, e.g. "https://accounts.google.com" (empty disables)
+	ClientID         string   `toml:"client_id"`          // Client registered with the provider
+	ClientSecret     string   `toml:"client_secret"`      // Client secret (empty for public clients)
+	ClientSecretFile string   `toml:"client_secret_file"` // Read client_secret from this file
+	RedirectURL      string   `toml:"redirect_url"`       // Callback registered with the provider, on this server
+	Scopes           []string `toml:"scopes"`             // Requested scopes
+	AllowedDomains   []string `toml:"allowed_domains"`    // Email domains that may sign in (empty = any)
+	AllowedUsers     []string `toml:"allowed_users"`      // Emails that may sign in, besides those domains
+	Session          int      `toml:"session"`            // Seconds a sign-in lasts
+	Paths            []string `toml:"paths"`              // Protected paths ("/admin/*"; empty = every path)
+	UserHeader       string   `toml:"user_header"`        // Header the user name is sent to the target in
+	EmailHeader      string   `toml:"email_header"`       // Header the email is sent to the target in
+}
+
+// Enabled reports whether users sign in with a provider
+func (o *OIDCConfig) Enabled() bool {
+	return o.Issuer != ""
+}
+
+// Protects reports whether requests for path need a signed-in user
+func (o *OIDCConfig) Protects(path string) bool {
+	if len(o.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range o.Paths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// CallbackPath returns the path of the redirect URL
+func (o *OIDCConfig) CallbackPath() string {
+	u, err := url.Parse(o.RedirectURL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// Admits reports whether a user with email may sign in. Unverified emails
+// only pass when no allow list is set.
+func (o *OIDCConfig) Admits(email string, verified bool) bool {
+	if len(o.AllowedDomains) == 0 && len(o.AllowedUsers) == 0 {
+		return true
+	}
+	if email == "" || !verified {
+		return false
+	}
+	for _, user := range o.AllowedUsers {
+		if strings.EqualFold(user, email) {
+			return true
+		}
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	for _, allowed := range o.AllowedDomains {
+		if strings.EqualFold(allowed, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the provider, client and redirect URL
+func (o *OIDCConfig) validate() error {
+	if !o.Enabled() {
+		return nil
+	}
+	issuer, err := url.Parse(o.Issuer)
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && issuer.Scheme != "http") {
+		return fmt.Errorf("invalid issuer %q", o.Issuer)
+	}
+	if o.ClientID == "" {
+		return fmt.Errorf("client_id is required")
+	}
+	redirect, err := url.Parse(o.RedirectURL)
+	if err != nil || redirect.Host == "" || !strings.HasPrefix(redirect.Path, "/") {
+		return fmt.Errorf("redirect_url must be an absolute URL, got %q", o.RedirectURL)
+	}
+	if !slices.Contains(o.Scopes, "openid") {
+		return fmt.Errorf("scopes must include \"openid\"")
+	}
+	if o.Session < 0 {
+		return fmt.Errorf("session must not be negative")
+	}
+	for _, pattern := range o.Paths {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("path %q must start with \"/\"", pattern)
+		}
+	}
+	return nil
+}
+
+// ForwardAuthConfig asks an external service whether each request may pass,
+// as Traefik's forwardAuth and nginx's auth_request do. The service sees the
+// request's headers; a 2xx answer lets it through, any other answer is sent
+// to the client instead.
+type ForwardAuthConfig struct {
+	Address         string   `toml:"address"`          // Auth service URL (empty disables)
+	RequestHeaders  []string `toml:"request_headers"`  // Headers sent to the service (empty = all)
+	ResponseHeaders []string `toml:"response_headers"` // Headers of a 2xx answer copied to the request to the target
+	Timeout         int      `toml:"timeout"`          // Seconds to wait for the service (default 5)
+	Paths           []string `toml:"paths"`            // Protected paths ("/admin/*"; empty = every path)
+}
+
+// Enabled reports whether an auth service is configured
+func (f *ForwardAuthConfig) Enabled() bool {
+	return f.Address != ""
+}
+
+// Protects reports whether requests for path are checked
+func (f *ForwardAuthConfig) Protects(path string) bool {
+	if len(f.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range f.Paths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeoutDuration returns how long to wait for the auth service
+func (f *ForwardAuthConfig) TimeoutDuration() time.Duration {
+	if f.Timeout > 0 {
+		return time.Duration(f.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// validate checks the address and the protected paths
+func (f *ForwardAuthConfig) validate() error {
+	if !f.Enabled() {
+		return nil
+	}
+	u, err := url.Parse(f.Address)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid address %q", f.Address)
+	}
+	if f.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	for _, pattern := range f.Paths {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("path %q must start with \"/\"", pattern)
+		}
+	}
+	return nil
+}
+
+// APIKeysConfig requires an API key on a server's paths. Keys are listed here
+// or, with store enabled, created through the admin API and kept in the state
+// store. Each key has its own rate limit, counted per instance.
+type APIKeysConfig struct {
+	Header string   `toml:"header"` // Header carrying the key
+	Query  string   `toml:"query"`  // Query parameter also accepted (empty = header only)
+	Paths  []string `toml:"paths"`  // Paths that need a key ("/api/*"; empty = every path)
+	Rate   int      `toml:"rate"`   // Requests per minute per key (0 = unlimited)
+	Store  bool     `toml:"store"`  // Also accept keys created through the admin API
+	Keys   []APIKey `toml:"keys"`
+}
+
+// APIKey is a key listed in the configuration
+type APIKey struct {
+	Name string `toml:"name"` // Shown in logs and usage counters
+	Key  string `toml:"key"`
+	Rate int    `toml:"rate"` // Requests per minute (0 = the section's rate, -1 = unlimited)
+}
+
+// Enabled reports whether API keys are required
+func (a *APIKeysConfig) Enabled() bool {
+	return len(a.Keys) > 0 || a.Store
+}
+
+// Protects reports whether requests for path need a key
+func (a *APIKeysConfig) Protects(path string) bool {
+	if len(a.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range a.Paths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyRate returns the requests per minute a key with the given rate may
+// make, or 0 for unlimited
+func (a *APIKeysConfig) KeyRate(rate int) int {
+	switch {
+	case rate < 0:
+		return 0
+	case rate == 0:
+		return a.Rate
+	}
+	return rate
+}
+
+// validate checks the keys and the protected paths
+func (a *APIKeysConfig) validate() error {
+	if !a.Enabled() {
+		return nil
+	}
+	if a.Rate < 0 {
+		return fmt.Errorf("rate must not be negative")
+	}
+	names := make(map[string]bool)
+	values := make(map[string]bool)
+	for i, key := range a.Keys {
+		if key.Name == "" {
+			return fmt.Errorf("keys[%d]: name is required", i)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("keys[%d]: duplicate name %s", i, key.Name)
+		}
+		if len(key.Key) < 16 {
+			return fmt.Errorf("keys[%d]: key %s must be at least 16 characters", i, key.Name)
+		}
+		if values[key.Key] {
+			return fmt.Errorf("keys[%d]: key %s is used by another key", i, key.Name)
+		}
+		if key.Rate < -1 {
+			return fmt.Errorf("keys[%d]: rate must be -1 or more", i)
+		}
+		names[key.Name] = true
+		values[key.Key] = true
+	}
+	for _, pattern := range a.Paths {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("path %q must start with \"/\"", pattern)
+		}
+	}
+	return nil
+}
+
+// Request rule actions
+const (
+	RuleActionBlock = "block"
+	RuleActionAllow = "allow"
+)
+
+// RequestRule blocks or allows requests matching every condition it sets.
+// Patterns are regular expressions.
+type RequestRule struct {
+	Name    string            `toml:"name"`    // Shown in logs
+	Action  string            `toml:"action"`  // "block" (default) or "allow" to skip later rules and the WAF
+	Methods []string          `toml:"methods"` // e.g. ["POST", "PUT"] (empty = any)
+	Path    string            `toml:"path"`    // Pattern matched against the path
+	Query   string            `toml:"query"`   // Pattern matched against the raw query string
+	Headers map[string]string `toml:"headers"` // Header name to pattern; a missing header matches ""
+	Body    string            `toml:"body"`    // Pattern matched against the first 64 KB of the body
+	Status  int               `toml:"status"`  // Status of blocked requests (default 403)
+	Message string            `toml:"message"` // Body of blocked requests (empty = the forbidden page)
+}
+
+// validate checks the action, status and patterns
+func (r *RequestRule) validate() error {
+	if r.Action != RuleActionBlock && r.Action != RuleActionAllow {
+		return fmt.Errorf("invalid action %q (expected \"block\" or \"allow\")", r.Action)
+	}
+	if r.Status < 100 || r.Status > 599 {
+		return fmt.Errorf("invalid status %d", r.Status)
+	}
+	if len(r.Methods) == 0 && r.Path == "" && r.Query == "" && len(r.Headers) == 0 && r.Body == "" {
+		return fmt.Errorf("rule has no conditions")
+	}
+	patterns := map[string]string{"path": r.Path, "query": r.Query, "body": r.Body}
+	for name, pattern := range r.Headers {
+		patterns["headers."+name] = pattern
+	}
+	for name, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// WAF modes
+const (
+	WAFModeBlock  = "block"
+	WAFModeDetect = "detect"
+)
+
+// WAFConfig inspects a server's requests with web application firewall rules
+// in the SecRule language
+type WAFConfig struct {
+	Enabled       bool     `toml:"enabled"`
+	Mode          string   `toml:"mode"`           // "block" (default) or "detect" to only log
+	Threshold     int      `toml:"threshold"`      // Anomaly score that blocks a request (default 5)
+	Builtin       *bool    `toml:"builtin"`        // Apply the built-in rules (default true)
+	Rules         []string `toml:"rules"`          // Rule files, globs allowed
+	DisabledRules []int    `toml:"disabled_rules"` // Rule IDs left out, e.g. after false positives
+	BodyLimit     int      `toml:"body_limit"`     // Bytes of request bodies inspected (default 131072, -1 = none)
+	SkipPaths     []string `toml:"skip_paths"`     // Paths not inspected ("/upload/*")
+}
+
+// Options returns the rule engine options
+func (w *WAFConfig) Options() waf.Options {
+	return waf.Options{
+		Builtin:   w.Builtin == nil || *w.Builtin,
+		Files:     w.Rules,
+		Disabled:  w.DisabledRules,
+		Threshold: w.Threshold,
+	}
+}
+
+// Skips reports whether requests for path are not inspected
+func (w *WAFConfig) Skips(path string) bool {
+	for _, pattern := range w.SkipPaths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the mode and loads the rules
+func (w *WAFConfig) validate() error {
+	if !w.Enabled {
+		return nil
+	}
+	if w.Mode != WAFModeBlock && w.Mode != WAFModeDetect {
+		return fmt.Errorf("invalid mode %q (expected \"block\" or \"detect\")", w.Mode)
+	}
+	if w.Threshold < 1 {
+		return fmt.Errorf("threshold must be at least 1")
+	}
+	if w.BodyLimit < -1 {
+		return fmt.Errorf("body_limit must be -1 or more")
+	}
+	for _, pattern := range w.SkipPaths {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("skip path %q must start with \"/\"", pattern)
+		}
+	}
+	engine, err := waf.New(w.Options())
+	if err != nil {
+		return err
+	}
+	if engine.Rules() == 0 {
+		return fmt.Errorf("no rules to apply")
+	}
+	return nil
+}
+
+// AnomalyConfig scores clients by the trouble they cause and escalates as
+// their score grows: first the verification challenge, then delayed
+// responses, then a ban. Scores are kept for window seconds from a client's
+// first signal. Steps set to -1 are skipped.
+type AnomalyConfig struct {
+	Enabled          bool          `toml:"enabled"`
+	Window           int           `toml:"window"`            // Seconds scores are kept (default 600)
+	Challenge        int           `toml:"challenge"`         // Score that requires the challenge, even from non-browsers (default 10)
+	ChallengeExpired int           `toml:"challenge_expired"` // Verification lifetime in seconds for challenged clients (default 300)
+	Tarpit           int           `toml:"tarpit"`            // Score that delays requests (default 25)
+	TarpitDelay      int           `toml:"tarpit_delay"`      // Seconds requests are delayed (default 5)
+	Ban              int           `toml:"ban"`               // Score that bans the client for the [limit.ban] duration (default 50)
+	Scores           AnomalyScores `toml:"scores"`
+}
+
+// AnomalyScores are the points each signal adds to a client's score. Signals
+// set to -1 are ignored.
+type AnomalyScores struct {
+	RateLimited     int `toml:"rate_limited"`     // Request over a rate limit (default 5)
+	WAF             int `toml:"waf"`              // Request at the WAF threshold, blocked or detected (default 10)
+	NotFound        int `toml:"not_found"`        // 404 response, as when scanning for files (default 1)
+	SuspiciousAgent int `toml:"suspicious_agent"` // Request with no User-Agent or a scanner's or HTTP library's (default 2)
+}
+
+// validate checks the steps and scores
+func (a *AnomalyConfig) validate() error {
+	if !a.Enabled {
+		return nil
+	}
+	if a.Window < 1 {
+		return fmt.Errorf("window must be at least 1")
+	}
+	steps := map[string]int{"challenge": a.Challenge, "tarpit": a.Tarpit, "ban": a.Ban}
+	for name, score := range steps {
+		if score < 1 && score != -1 {
+			return fmt.Errorf("%s must be at least 1, or -1 to skip it", name)
+		}
+	}
+	if a.ChallengeExpired < 1 {
+		return fmt.Errorf("challenge_expired must be at least 1")
+	}
+	if a.TarpitDelay < 1 || a.TarpitDelay > 60 {
+		return fmt.Errorf("tarpit_delay must be between 1 and 60")
+	}
+	scores := map[string]int{
+		"rate_limited":     a.Scores.RateLimited,
+		"waf":              a.Scores.WAF,
+		"not_found":        a.Scores.NotFound,
+		"suspicious_agent": a.Scores.SuspiciousAgent,
+	}
+	for name, score := range scores {
+		if score < -1 {
+			return fmt.Errorf("scores.%s must be -1 or more", name)
+		}
+	}
+	return nil
+}
+
+// StaticConfig serves a server's site from a directory. Only the listed paths
+// are proxied to the target.
+type StaticConfig struct {
+	Root        string   `toml:"root"`         // Directory files are served from (empty = proxy every request)
+	Proxy       []string `toml:"proxy"`        // Paths still proxied to the target ("/api/*")
+	SPAFallback string   `toml:"spa_fallback"` // File in root served for unknown paths, e.g. "index.html" (empty = 404)
+}
+
+// Enabled reports whether files are served from a directory
+func (s *StaticConfig) Enabled() bool {
+	return s.Root != ""
+}
+
+// Proxied reports whether requests for path go to the target
+func (s *StaticConfig) Proxied(path string) bool {
+	for _, pattern := range s.Proxy {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks that the root is a directory holding the fallback file
+func (s *StaticConfig) validate() error {
+	if !s.Enabled() {
+		return nil
+	}
+	info, err := os.Stat(s.Root)
+	if err != nil {
+		return fmt.Errorf("root: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("root %s is not a directory", s.Root)
+	}
+	for _, pattern := range s.Proxy {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("proxy path %q must start with \"/\"", pattern)
+		}
+	}
+	if s.SPAFallback != "" {
+		if _, err := os.Stat(filepath.Join(s.Root, s.SPAFallback)); err != nil {
+			return fmt.Errorf("spa_fallback: %v", err)
+		}
+	}
+	return nil
+}
+
+// PagesConfig points a server at its own page files, so sites behind one
+// instance can carry their own branding. Unset pages use the shared files in
+// public/, or the built-in pages when those are missing.
+type PagesConfig struct {
+	Verification string `toml:"verification"` // Verification page (default public/verification.html)
+	Error        string `toml:"error"`        // Page served when the target fails (default public/502.html)
+	Maintenance  string `toml:"maintenance"`  // Maintenance page (default public/maintenance.html)
+	Forbidden    string `toml:"forbidden"`    // Access denied page (default public/403.html; [server.acl] page wins)
+	WaitingRoom  string `toml:"waiting_room"` // Waiting room template (default public/waiting-room.html)
+}
+
+// validate checks that the configured page files exist
+func (p *PagesConfig) validate() error {
+	files := []struct{ name, path string }{
+		{"verification", p.Verification},
+		{"error", p.Error},
+		{"maintenance", p.Maintenance},
+		{"forbidden", p.Forbidden},
+		{"waiting_room", p.WaitingRoom},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); os.IsNotExist(err) {
+			return fmt.Errorf("%s page not found: %s", file.name, file.path)
+		}
+	}
+	return nil
+}
+
+// SlowClientsConfig guards a server's listeners against clients that hold
+// connections open by sending requests slowly or opening many at once.
+// Addresses are those of the connecting peer, so limits behind a CDN or load
+// balancer need the PROXY protocol.
+type SlowClientsConfig struct {
+	MaxConnsPerIP int `toml:"max_conns_per_ip"` // Open connections per client address (0 = unlimited)
+	MinRate       int `toml:"min_rate"`         // Bytes per second a client must send request headers and bodies at (0 = no minimum)
+	Grace         int `toml:"grace"`            // Seconds a request may take before min_rate applies (default 5)
+}
+
+// GraceDuration returns how long a request may take before min_rate applies
+func (s *SlowClientsConfig) GraceDuration() time.Duration {
+	return time.Duration(s.Grace) * time.Second
+}
+
+// TransportConfig tunes the connections to a server's target. The dial
+// timeout is [server.timeouts] connect.
+type TransportConfig struct {
+	MaxIdleConns        int   `toml:"max_idle_conns"`          // Idle connections kept across all target hosts (default 100)
+	MaxIdleConnsPerHost int   `toml:"max_idle_conns_per_host"` // Idle connections kept per target host (default ctn_max, else max_idle_conns)
+	IdleConnTimeout     int   `toml:"idle_conn_timeout"`       // Seconds an idle connection is kept (default 90)
+	TLSHandshakeTimeout int   `toml:"tls_handshake_timeout"`   // Seconds to complete the TLS handshake with the target (default 10)
+	HTTP2               *bool `toml:"http2"`                   // Negotiate HTTP/2 with TLS targets (default true)
+}
+
+// ForceAttemptHTTP2 reports whether HTTP/2 is negotiated with TLS targets
+func (t *TransportConfig) ForceAttemptHTTP2() bool {
+	return t.HTTP2 == nil || *t.HTTP2
+}
+
+// TimeoutsConfig represents how long a server waits on clients and its target
+type TimeoutsConfig struct {
+	Read       int `toml:"read"`        // Seconds to read a request, body included (default 30)
+	Write      int `toml:"write"`       // Seconds to write a response (default 30)
+	ReadHeader int `toml:"read_header"` // Seconds to read request headers (default 5)
+	Connect    int `toml:"connect"`     // Seconds to connect to the target (default 30)
+	Response   int `toml:"response"`    // Seconds to wait for the target's response headers (default 0 = no limit)
+
+	Routes []RouteTimeouts `toml:"routes"` // Overrides for matching paths; the first match applies
+}
+
+// RouteTimeouts overrides a server's timeouts for matching paths. Unset
+// values keep the server's.
+type RouteTimeouts struct {
+	Path     string `toml:"path"`     // "/upload" or "/reports/*"
+	Read     int    `toml:"read"`     // Seconds to read the request body
+	Write    int    `toml:"write"`    // Seconds to write the response
+	Response int    `toml:"response"` // Seconds to wait for the target's response headers
+}
+
+// Route returns the overrides of the first route matching path
+func (t *TimeoutsConfig) Route(path string) (RouteTimeouts, bool) {
+	for _, route := range t.Routes {
+		if PathMatches(route.Path, path) {
+			return route, true
+		}
+	}
+	return RouteTimeouts{}, false
+}
+
+// validate checks that timeouts are not negative and routes are paths
+func (t *TimeoutsConfig) validate() error {
+	if t.Read < 0 || t.Write < 0 || t.ReadHeader < 0 || t.Connect < 0 || t.Response < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	for _, route := range t.Routes {
+		if !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("route path %q must start with \"/\"", route.Path)
+		}
+		if route.Read < 0 || route.Write < 0 || route.Response < 0 {
+			return fmt.Errorf("route %s: timeouts must not be negative", route.Path)
+		}
+	}
+	return nil
+}
+
+// Response encodings offered by compression
+const (
+	EncodingBrotli = "br"
+	EncodingZstd   = "zstd"
+	EncodingGzip   = "gzip"
+)
+
+// CompressionConfig represents the compression of a server's responses
+type CompressionConfig struct {
+	Encodings   []string `toml:"encodings"`    // Offered encodings, preferred first (default ["br", "zstd", "gzip"], none in lite mode; empty disables compression)
+	GzipLevel   int      `toml:"gzip_level"`   // 1 (fastest) to 9 (smallest), default 6
+	BrotliLevel int      `toml:"brotli_level"` // 1 (fastest) to 11 (smallest), default 5
+	ZstdLevel   int      `toml:"zstd_level"`   // 1 (fastest) to 4 (smallest), default 2
+
+	MinSize      int      `toml:"min_size"`      // Responses with a smaller Content-Length are sent as they are (default 256)
+	ExcludeTypes []string `toml:"exclude_types"` // Content types never compressed, e.g. "application/pdf" or "font/*"; images, video, audio and archives never are
+	ExcludePaths []string `toml:"exclude_paths"` // Routes never compressed ("/downloads/*")
+}
+
+// Excludes reports whether responses of contentType to path are left uncompressed
+func (c *CompressionConfig) Excludes(path, contentType string) bool {
+	for _, pattern := range c.ExcludePaths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	for _, pattern := range c.ExcludeTypes {
+		pattern = strings.ToLower(pattern)
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(mediaType, prefix) {
+				return true
+			}
+		} else if mediaType == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the encodings and levels
+func (c *CompressionConfig) validate() error {
+	for _, encoding := range c.Encodings {
+		switch encoding {
+		case EncodingBrotli, EncodingZstd, EncodingGzip:
+		default:
+			return fmt.Errorf("unsupported encoding %q (expected \"br\", \"zstd\" or \"gzip\")", encoding)
+		}
+	}
+	if c.GzipLevel < 1 || c.GzipLevel > 9 {
+		return fmt.Errorf("gzip_level must be between 1 and 9")
+	}
+	if c.BrotliLevel < 1 || c.BrotliLevel > 11 {
+		return fmt.Errorf("brotli_level must be between 1 and 11")
+	}
+	if c.ZstdLevel < 1 || c.ZstdLevel > 4 {
+		return fmt.Errorf("zstd_level must be between 1 and 4")
+	}
+	if c.MinSize < 0 {
+		return fmt.Errorf("min_size must not be negative")
+	}
+	for _, contentType := range c.ExcludeTypes {
+		if !strings.Contains(contentType, "/") {
+			return fmt.Errorf("exclude_types entry %q is not a content type", contentType)
+		}
+	}
+	for _, pattern := range c.ExcludePaths {
+		if !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("exclude_paths entry %q must start with \"/\"", pattern)
+		}
+	}
+	return nil
+}
+
+// ACLConfig restricts which clients may reach a server
+type ACLConfig struct {
+	Allow []string `toml:"allow"` // Only these IPs/CIDRs may connect (empty = everyone)
+	Deny  []string `toml:"deny"`  // These IPs/CIDRs are always rejected; deny wins over allow
+	Page  string   `toml:"page"`  // HTML file served with the 403 (default public/403.html)
+}
+
+// Prefixes parses the allow and deny lists into network prefixes
+func (a *ACLConfig) Prefixes() (allow, deny []netip.Prefix, err error) {
+	if allow, err = parsePrefixes(a.Allow); err != nil {
+		return nil, nil, fmt.Errorf("allow: %v", err)
+	}
+	if deny, err = parsePrefixes(a.Deny); err != nil {
+		return nil, nil, fmt.Errorf("deny: %v", err)
+	}
+	return allow, deny, nil
+}
+
+// Enabled reports whether any access rule is configured
+func (a *ACLConfig) Enabled() bool {
+	return len(a.Allow) > 0 || len(a.Deny) > 0
+}
+
+// Geo blocking modes and actions
+const (
+	GeoModeAllow       = "allow"
+	GeoModeDeny        = "deny"
+	GeoActionBlock     = "block"
+	GeoActionChallenge = "challenge"
+)
+
+// GeoBlockConfig restricts access by the client's country
+type GeoBlockConfig struct {
+	Mode             string   `toml:"mode"`              // "deny" matches the listed countries, "allow" matches all others (empty disables)
+	Countries        []string `toml:"countries"`         // ISO 3166-1 alpha-2 codes, e.g. ["CN", "RU"]
+	Action           string   `toml:"action"`            // "block" (403 page, default) or "challenge" (short-lived verification)
+	ChallengeExpired int      `toml:"challenge_expired"` // Verification lifetime in seconds for challenged clients (default 60)
+	BlockUnknown     bool     `toml:"block_unknown"`     // Also match clients whose country cannot be resolved
+}
+
+// Enabled reports whether geo blocking is configured
+func (g *GeoBlockConfig) Enabled() bool {
+	return g.Mode != ""
+}
+
+// Matches reports whether a client from country is subject to the action
+func (g *GeoBlockConfig) Matches(country string) bool {
+	if country == "" {
+		return g.BlockUnknown
+	}
+	listed := false
+	for _, code := range g.Countries {
+		if strings.EqualFold(code, country) {
+			listed = true
+			break
+		}
+	}
+	if g.Mode == GeoModeAllow {
+		return !listed
+	}
+	return listed
+}
+
+// ASNConfig filters clients by autonomous system, e.g. hosting providers used by scrapers
+type ASNConfig struct {
+	Block       []uint `toml:"block"`        // ASNs rejected with the 403 page
+	Limit       []uint `toml:"limit"`        // ASNs whose addresses share a single rate limit
+	LimitCount  int    `toml:"limit_count"`  // Requests allowed per window for each limited ASN
+	LimitWindow int    `toml:"limit_window"` // Window in seconds (default 60)
+}
+
+// Enabled reports whether any ASN rule is configured
+func (a *ASNConfig) Enabled() bool {
+	return len(a.Block) > 0 || len(a.Limit) > 0
+}
+
+// Continent codes used by GeoIP
+var continentCodes = map[string]bool{"AF": true, "AN": true, "AS": true, "EU": true, "NA": true, "OC": true, "SA": true}
+
+// GeoRoutingConfig represents target selection by client country or continent
+type GeoRoutingConfig struct {
+	Fallback string          `toml:"fallback"` // Group for unknown or unmatched locations (empty = target_url)
+	Groups   []GeoRouteGroup `toml:"groups"`
+}
+
+// GeoRouteGroup is a set of weighted targets serving some countries or continents
+type GeoRouteGroup struct {
+	Name       string           `toml:"name"`
+	Countries  []string         `toml:"countries"`  // ISO country codes, matched before continents
+	Continents []string         `toml:"continents"` // AF, AN, AS, EU, NA, OC or SA
+	Targets    []WeightedTarget `toml:"targets"`
+}
+
+// WeightedTarget is a target URL receiving a share of its group's traffic
+type WeightedTarget struct {
+	URL    string `toml:"url"`
+	Weight int    `toml:"weight"` // Relative share (default 1)
+}
+
+// EffectiveWeight returns the weight, defaulting to 1
+func (w *WeightedTarget) EffectiveWeight() int {
+	if w.Weight == 0 {
+		return 1
+	}
+	return w.Weight
+}
+
+// Enabled reports whether geographic routing is configured
+func (g *GeoRoutingConfig) Enabled() bool {
+	return len(g.Groups) > 0
+}
+
+// Service mesh header conventions
+const (
+	MeshEnvoy   = "envoy"
+	MeshLinkerd = "linkerd"
+)
+
+// MeshConfig represents service mesh header handling toward the target
+type MeshConfig struct {
+	Mode        string `toml:"mode"`         // "envoy" or "linkerd" (empty disables)
+	RetryOn     string `toml:"retry_on"`     // envoy: x-envoy-retry-on policy, e.g. "5xx,connect-failure"
+	MaxRetries  int    `toml:"max_retries"`  // envoy: x-envoy-max-retries
+	Timeout     int    `toml:"timeout"`      // envoy: x-envoy-upstream-rq-timeout-ms
+	DstOverride string `toml:"dst_override"` // linkerd: l5d-dst-override authority, e.g. "web.default.svc.cluster.local:80"
+}
+
+// Device classes derived from client hints and the User-Agent
+const (
+	DeviceMobile  = "mobile"
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+)
+
+// DeviceConfig represents device-class detection and routing
+type DeviceConfig struct {
+	Header   string            `toml:"header"`    // Request header carrying the class to the backend, e.g. "X-Device-Class" (empty = not sent)
+	Targets  map[string]string `toml:"targets"`   // Per-class target URLs, e.g. { mobile = "http://mobile:8080" }
+	AcceptCH bool              `toml:"accept_ch"` // Ask browsers for client hints with Accept-CH
+}
+
+// Enabled reports whether the device class is needed
+func (d *DeviceConfig) Enabled() bool {
+	return d.Header != "" || len(d.Targets) > 0
+}
+
+// ConcurrencyConfig represents the limit on requests proxied at once and the
+// queue in front of it
+type ConcurrencyConfig struct {
+	Max          int  `toml:"max"`           // Requests proxied at once (0 = unlimited)
+	Queue        int  `toml:"queue"`         // Requests waiting for a slot (default max, -1 sheds excess requests right away)
+	QueueTimeout int  `toml:"queue_timeout"` // Seconds a request may wait for a slot (default 10)
+	WaitingRoom  bool `toml:"waiting_room"`  // Serve browsers a waiting room page with their place in line instead of a 503
+	RetryAfter   int  `toml:"retry_after"`   // Seconds before the waiting room page retries (default 5)
+}
+
+// Enabled reports whether proxied requests are limited
+func (c *ConcurrencyConfig) Enabled() bool {
+	return c.Max > 0
+}
+
+// Verification challenge modes
+const (
+	ChallengeModeCookie      = "cookie"
+	ChallengeModeProofOfWork = "pow"
+)
+
+// ChallengeConfig selects what a client must do to be verified
+type ChallengeConfig struct {
+	Mode       string `toml:"mode"`       // "cookie" (default): the verification page carries the cookies; "pow": its script must solve a proof of work first
+	Difficulty int    `toml:"difficulty"` // Leading zero bits of the SHA-256 proof of work (default 16)
+
+	Bind          string `toml:"bind"`            // Tie verification cookies to the client address: "addr", "prefix" (its /24 or /48) or "none" (default "prefix")
+	BindUserAgent *bool  `toml:"bind_user_agent"` // Tie verification cookies to the User-Agent too (default true)
+
+	Sessions bool `toml:"sessions"` // Record verifications in the state store so they can be counted and revoked
+}
+
+// Client address bindings of verification cookies
+const (
+	ChallengeBindAddr   = "addr"
+	ChallengeBindPrefix = "prefix"
+	ChallengeBindNone   = "none"
+)
+
+// BindsUserAgent reports whether verification cookies are tied to the User-Agent
+func (c *ChallengeConfig) BindsUserAgent() bool {
+	return c.BindUserAgent == nil || *c.BindUserAgent
+}
+
+// ProofOfWork reports whether clients must solve a proof of work
+func (c *ChallengeConfig) ProofOfWork() bool {
+	return c.Mode == ChallengeModeProofOfWork
+}
+
+// validate checks the mode and that the difficulty stays solvable in a browser
+func (c *ChallengeConfig) validate() error {
+	switch c.Mode {
+	case ChallengeModeCookie, ChallengeModeProofOfWork:
+	default:
+		return fmt.Errorf("invalid mode %q (expected \"cookie\" or \"pow\")", c.Mode)
+	}
+	if c.Difficulty < 1 || c.Difficulty > 24 {
+		return fmt.Errorf("difficulty must be between 1 and 24")
+	}
+	switch c.Bind {
+	case ChallengeBindAddr, ChallengeBindPrefix, ChallengeBindNone:
+	default:
+		return fmt.Errorf("invalid bind %q (expected \"addr\", \"prefix\" or \"none\")", c.Bind)
+	}
+	return nil
+}
+
+// SkipsVerification reports whether requests for path skip the verification challenge
+func (s *ServerConfig) SkipsVerification(path string) bool {
+	for _, pattern := range s.AuthSkipPaths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAddrs returns the primary port followed by the additional listen addresses
+func (s *ServerConfig) ListenAddrs() []string {
+	if s.Port == 0 {
+		return s.Listen
+	}
+	return append([]string{net.JoinHostPort(s.Bind, strconv.Itoa(s.Port))}, s.Listen...)
+}
+
+// IsTCP reports whether the server forwards raw TCP connections
+func (s *ServerConfig) IsTCP() bool {
+	return s.Type == ServerTypeTCP
+}
+
+// IsSNIPassthrough reports whether the server routes TLS connections by
+// server name instead of terminating them
+func (s *ServerConfig) IsSNIPassthrough() bool {
+	return s.IsTCP() && len(s.SNI) > 0
+}
+
+// TCPTarget returns the address a TCP server forwards connections to, and
+// whether it is reached over TLS: target_url is "tcp://host:port" or
+// "tls://host:port". With SNI routes target_url may be empty, leaving
+// connections no route matches without a target.
+func (s *ServerConfig) TCPTarget() (address string, useTLS bool, err error) {
+	if s.TargetURL == "" && s.IsSNIPassthrough() {
+		return "", false, nil
+	}
+	scheme, address, err := ParseTCPTarget(s.TargetURL)
+	if err != nil {
+		return "", false, fmt.Errorf("target_url %v", err)
+	}
+	return address, scheme == "tls", nil
+}
+
+// ParseTCPTarget splits a "tcp://host:port" or "tls://host:port" target into
+// its scheme and address
+func ParseTCPTarget(target string) (scheme, address string, err error) {
+	scheme, address, ok := strings.Cut(target, "://")
+	if !ok || (scheme != "tcp" && scheme != "tls") {
+		return "", "", fmt.Errorf("%q must be tcp://host:port or tls://host:port", target)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" {
+		return "", "", fmt.Errorf("%q must be tcp://host:port or tls://host:port", target)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", "", fmt.Errorf("%q has an invalid port", target)
+	}
+	return scheme, address, nil
+}
+
+// validateSNI checks the SNI routes of a TCP server. The TLS stream reaches
+// targets as is, so they must be plain tcp:// targets and the server must not
+// terminate TLS itself.
+func (s *ServerConfig) validateSNI() error {
+	if s.HTTPS.Enabled {
+		return fmt.Errorf("routes forward TLS without terminating it and cannot be combined with [server.https]")
+	}
+	if s.TargetURL != "" && !strings.HasPrefix(s.TargetURL, "tcp://") {
+		return fmt.Errorf("target_url %q must be a tcp:// target", s.TargetURL)
+	}
+	seen := make(map[string]bool)
+	for i, route := range s.SNI {
+		if len(route.Hosts) == 0 {
+			return fmt.Errorf("route %d has no hosts", i)
+		}
+		for _, host := range route.Hosts {
+			name := strings.TrimPrefix(strings.ToLower(host), "*.")
+			if name == "" || strings.ContainsAny(name, "*/: ") {
+				return fmt.Errorf("route %d: invalid host %q", i, host)
+			}
+			if seen[strings.ToLower(host)] {
+				return fmt.Errorf("host %q is routed twice", host)
+			}
+			seen[strings.ToLower(host)] = true
+		}
+		scheme, _, err := ParseTCPTarget(route.Target)
+		if err != nil {
+			return fmt.Errorf("route %d: target %v", i, err)
+		}
+		if scheme != "tcp" {
+			return fmt.Errorf("route %d: target %q must be a tcp:// target", i, route.Target)
+		}
+	}
+	return nil
+}
+
+// ParseListenAddr splits a listen address into the network and address to bind
+func ParseListenAddr(addr string) (network, address string, err error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return "", "", fmt.Errorf("missing socket path in %q", addr)
+		}
+		return "unix", path, nil
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", "", fmt.Errorf("invalid port in listen address %q", addr)
+	}
+	return "tcp", addr, nil
+}
+
+// SnapshotConfig represents static copies of key pages served when the target is down
+type SnapshotConfig struct {
+	Paths    []string `toml:"paths"`    // Client paths to snapshot, e.g. "/" and "/about"
+	Interval int      `toml:"interval"` // Seconds between snapshots (default 300)
+	Dir      string   `toml:"dir"`      // Where snapshots are kept (default <cache_dir>/snapshots/<server>; memory only in read-only mode)
+}
+
+// Enabled reports whether snapshots are taken
+func (s *SnapshotConfig) Enabled() bool {
+	return len(s.Paths) > 0
+}
+
+// ConnectionConfig represents client connection management for a listener
+type ConnectionConfig struct {
+	MaxRequests int  `toml:"max_requests"` // Requests served per connection before it is closed (0 = unlimited)
+	MaxAge      int  `toml:"max_age"`      // Seconds a connection may be reused (0 = unlimited)
+	IdleTimeout int  `toml:"idle_timeout"` // Seconds an idle keep-alive connection is kept open (default 120)
+	ForceClose  bool `toml:"force_close"`  // Disable keep-alive and send Connection: close on every response
+}
+
+// IdleTimeoutDuration returns the keep-alive idle timeout
+func (c *ConnectionConfig) IdleTimeoutDuration() time.Duration {
+	if c.IdleTimeout > 0 {
+		return time.Duration(c.IdleTimeout) * time.Second
+	}
+	return 120 * time.Second
+}
+
+// TCPConfig tunes the sockets of a server's TCP listeners
+type TCPConfig struct {
+	ReusePort         bool  `toml:"reuse_port"`         // Set SO_REUSEPORT so several sockets share an address (not on Windows)
+	AcceptLoops       int   `toml:"accept_loops"`       // Sockets bound per address, each with its own accept loop; needs reuse_port (default 1)
+	NoDelay           *bool `toml:"no_delay"`           // TCP_NODELAY on accepted connections (default true)
+	KeepAlive         int   `toml:"keepalive"`          // Idle seconds before keepalive probes (0 = 15, -1 disables keepalive)
+	KeepAliveInterval int   `toml:"keepalive_interval"` // Seconds between keepalive probes (0 = 15)
+	KeepAliveCount    int   `toml:"keepalive_count"`    // Unanswered probes before the connection is dropped (0 = 9)
+	Backlog           int   `toml:"backlog"`            // Accept queue length hint, capped by the kernel (0 = system default)
+
+	Family string `toml:"family"` // IP versions of TCP addresses: "dual" (default), "ipv4" or "ipv6" only
+}
+
+// IP versions TCP addresses are bound with
+const (
+	TCPFamilyDual = "dual"
+	TCPFamilyIPv4 = "ipv4"
+	TCPFamilyIPv6 = "ipv6"
+)
+
+// Network returns the network TCP addresses are bound with. Dual-stack
+// wildcard addresses accept IPv4 and IPv6 connections; "ipv6" binds IPv6 only.
+func (t *TCPConfig) Network() string {
+	switch t.Family {
+	case TCPFamilyIPv4:
+		return "tcp4"
+	case TCPFamilyIPv6:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// ProxyProtocolConfig accepts the PROXY protocol header a load balancer sends
+// ahead of each connection, so clients are seen with their own address
+type ProxyProtocolConfig struct {
+	Enabled bool     `toml:"enabled"` // Expect a PROXY protocol v1 or v2 header on every connection
+	Trusted []string `toml:"trusted"` // Load balancer IPs/CIDRs allowed to connect (empty = everyone)
+	Timeout int      `toml:"timeout"` // Seconds to wait for the header (default 5)
+}
+
+// PROXY protocol versions sent to targets
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// TrustedPrefixes parses the trusted list into network prefixes
+func (p *ProxyProtocolConfig) TrustedPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(p.Trusted)
+}
+
+// TimeoutDuration returns how long to wait for the header
+func (p *ProxyProtocolConfig) TimeoutDuration() time.Duration {
+	if p.Timeout > 0 {
+		return time.Duration(p.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// NoDelayEnabled reports whether accepted connections send small writes immediately
+func (t *TCPConfig) NoDelayEnabled() bool {
+	return t.NoDelay == nil || *t.NoDelay
+}
+
+// ResponseHeadersConfig controls which upstream response headers reach clients
+type ResponseHeadersConfig struct {
+	Strict bool     `toml:"strict"` // Forward only allowlisted upstream headers
+	Paths  []string `toml:"paths"`  // Routes strict mode applies to ("/api/*"); empty means all
+	Allow  []string `toml:"allow"`  // Headers allowed in addition to the built-in safe set
+}
+
+// StrictFor reports whether strict filtering applies to path
+func (r *ResponseHeadersConfig) StrictFor(path string) bool {
+	if !r.Strict {
+		return false
+	}
+	if len(r.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range r.Paths {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS preflight handling modes
+const (
+	PreflightEdge    = "edge"
+	PreflightForward = "forward"
+)
+
+// SecurityHeaderOff turns off a security header that is sent by default
+const SecurityHeaderOff = "off"
+
+// SecurityHeadersConfig sets the security headers added to every response
+type SecurityHeadersConfig struct {
+	ContentSecurityPolicy string            `toml:"content_security_policy"` // Content-Security-Policy (default: none)
+	CSPReportOnly         bool              `toml:"csp_report_only"`         // Send the policy as Content-Security-Policy-Report-Only
+	FrameOptions          string            `toml:"frame_options"`           // X-Frame-Options: "DENY" (default), "SAMEORIGIN" or "off"
+	ReferrerPolicy        string            `toml:"referrer_policy"`         // Referrer-Policy (default "strict-origin-when-cross-origin", "off")
+	PermissionsPolicy     string            `toml:"permissions_policy"`      // Permissions-Policy (default: none)
+	ContentTypeOptions    *bool             `toml:"content_type_options"`    // X-Content-Type-Options: nosniff (default true)
+	XSSProtection         *bool             `toml:"xss_protection"`          // X-XSS-Protection: 1; mode=block (default true)
+	HSTSMaxAge            int               `toml:"hsts_max_age"`            // Strict-Transport-Security max-age on HTTPS (default 31536000, -1 disables)
+	HSTSIncludeSubdomains *bool             `toml:"hsts_include_subdomains"` // Add includeSubDomains (default true)
+	HSTSPreload           bool              `toml:"hsts_preload"`            // Add preload, for the browsers' HSTS preload lists
+	Headers               map[string]string `toml:"headers"`                 // Other headers to set on every response
+}
+
+// Values returns the headers sent on every response, as name and value pairs.
+// Headers turned off are left out; HSTS is returned by HSTSValue.
+func (s *SecurityHeadersConfig) Values() [][2]string {
+	var headers [][2]string
+	add := func(name, value string) {
+		if value != "" {
+			headers = append(headers, [2]string{name, value})
+		}
+	}
+	if s.ContentTypeOptions == nil || *s.ContentTypeOptions {
+		add("X-Content-Type-Options", "nosniff")
+	}
+	add("X-Frame-Options", headerValue(s.FrameOptions, "DENY"))
+	if s.XSSProtection == nil || *s.XSSProtection {
+		add("X-XSS-Protection", "1; mode=block")
+	}
+	add("Referrer-Policy", headerValue(s.ReferrerPolicy, "strict-origin-when-cross-origin"))
+	if s.CSPReportOnly {
+		add("Content-Security-Policy-Report-Only", s.ContentSecurityPolicy)
+	} else {
+		add("Content-Security-Policy", s.ContentSecurityPolicy)
+	}
+	add("Permissions-Policy", s.PermissionsPolicy)
+	for name, value := range s.Headers {
+		add(name, value)
+	}
+	return headers
+}
+
+// HSTSValue returns the Strict-Transport-Security value, or "" when disabled
+func (s *SecurityHeadersConfig) HSTSValue() string {
+	if s.HSTSMaxAge < 0 {
+		return ""
+	}
+	maxAge := s.HSTSMaxAge
+	if maxAge == 0 {
+		maxAge = 31536000
+	}
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	if s.HSTSIncludeSubdomains == nil || *s.HSTSIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if s.HSTSPreload {
+		value += "; preload"
+	}
+	return value
+}
+
+// headerValue applies a header's default and the "off" keyword
+func headerValue(value, fallback string) string {
+	switch {
+	case strings.EqualFold(value, SecurityHeaderOff):
+		return ""
+	case value == "":
+		return fallback
+	default:
+		return value
+	}
+}
+
+// validate checks header values and the HSTS preload requirements
+func (s *SecurityHeadersConfig) validate() error {
+	switch strings.ToUpper(s.FrameOptions) {
+	case "", "DENY", "SAMEORIGIN", "OFF":
+	default:
+		return fmt.Errorf("invalid frame_options %q (expected \"DENY\", \"SAMEORIGIN\" or \"off\")", s.FrameOptions)
+	}
+	if s.HSTSMaxAge < -1 {
+		return fmt.Errorf("hsts_max_age must be -1 (disabled) or more")
+	}
+	if s.HSTSPreload && (s.HSTSMaxAge < 0 || (s.HSTSMaxAge > 0 && s.HSTSMaxAge < 31536000) ||
+		(s.HSTSIncludeSubdomains != nil && !*s.HSTSIncludeSubdomains)) {
+		return fmt.Errorf("hsts_preload needs hsts_max_age of at least 31536000 and hsts_include_subdomains")
+	}
+
+	values := map[string]string{
+		"content_security_policy": s.ContentSecurityPolicy,
+		"referrer_policy":         s.ReferrerPolicy,
+		"permissions_policy":      s.PermissionsPolicy,
+	}
+	for name, value := range s.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		values["headers."+name] = value
+	}
+	for option, value := range values {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%s must not contain line breaks", option)
+		}
+	}
+	return nil
+}
+
+// CORSConfig represents the CORS policy enforced at the edge
+type CORSConfig struct {
+	AllowOrigins     []string `toml:"allow_origins"`     // Allowed origins ("*" or empty reflects any Origin)
+	AllowMethods     []string `toml:"allow_methods"`     // Default: POST, OPTIONS, GET, PUT, DELETE
+	AllowHeaders     []string `toml:"allow_headers"`     // Default: common request headers
+	ExposeHeaders    []string `toml:"expose_headers"`    // Response headers readable by scripts
+	AllowCredentials *bool    `toml:"allow_credentials"` // Default: true
+	MaxAge           int      `toml:"max_age"`           // Seconds browsers may cache a preflight result
+	Preflight        string   `toml:"preflight"`         // "edge" (default) answers OPTIONS locally, "forward" passes them to the backend
+	ForwardPreflight []string `toml:"forward_preflight"` // Paths ("/upload", "/api/*") whose OPTIONS still reach the backend in edge mode
+}
+
+// Credentials reports whether credentialed requests are allowed
+func (c *CORSConfig) Credentials() bool {
+	return c.AllowCredentials == nil || *c.AllowCredentials
+}
+
+// ForwardsPreflight reports whether OPTIONS requests for path go to the backend
+func (c *CORSConfig) ForwardsPreflight(path string) bool {
+	if c.Preflight == PreflightForward {
+		return true
+	}
+	for _, pattern := range c.ForwardPreflight {
+		if PathMatches(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamTLSConfig represents TLS settings used when dialing the target
+type UpstreamTLSConfig struct {
+	CertPath           string `toml:"cert_path"`            // Client certificate presented to the backend (mTLS)
+	KeyPath            string `toml:"key_path"`             // Private key of the client certificate
+	CAPath             string `toml:"ca_path"`              // CA bundle used to verify the backend certificate
+	ServerName         string `toml:"server_name"`          // SNI / verification name override
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"` // Disable backend certificate verification
+
+	// Session resumption skips the full handshake when reconnecting to the backend
+	SessionCacheSize         int  `toml:"session_cache_size"`         // Sessions cached per target pool (default 256)
+	DisableSessionResumption bool `toml:"disable_session_resumption"` // Always perform full handshakes
+}
+
+// HTTPSConfig represents HTTPS configuration
+type HTTPSConfig struct {
+	Enabled  bool   `toml:"enabled"`
+	CertPath string `toml:"cert_path"`
+	KeyPath  string `toml:"key_path"`
+
+	// PEM contents instead of files, usually read from Vault
+	Cert string `toml:"cert"` // e.g. "vault:secret/data/okaproxy/tls#certificate"
+	Key  string `toml:"key"`
+
+	// Client certificate (mTLS) authentication
+	ClientAuth       string `toml:"client_auth"`        // "", "optional" or "require"
+	ClientCAPath     string `toml:"client_ca_path"`     // CA bundle used to verify client certificates
+	ClientCertHeader string `toml:"client_cert_header"` // Header carrying the client cert subject upstream
+
+	ACME ACMEConfig `toml:"acme"`
+}
+
+// ACMEConfig represents automatic certificate issuance via ACME
+type ACMEConfig struct {
+	Enabled      bool          `toml:"enabled"`
+	Email        string        `toml:"email"`
+	Domains      []string      `toml:"domains"`       // May include wildcards such as "*.example.com"
+	DirectoryURL string        `toml:"directory_url"` // Defaults to Let's Encrypt production
+	CacheDir     string        `toml:"cache_dir"`     // Where account keys and certificates are stored (default: paths.acme_dir)
+	RenewBefore  int           `toml:"renew_before"`  // Days before expiry to renew (default 30)
+	DNS          ACMEDNSConfig `toml:"dns"`
+}
+
+// ACMEDNSConfig represents the DNS provider used for DNS-01 challenges
+type ACMEDNSConfig struct {
+	Provider           string `toml:"provider"`            // "cloudflare", "route53" or "aliyun"
+	APIToken           string `toml:"api_token"`           // Cloudflare API token
+	Zone               string `toml:"zone"`                // DNS zone name (e.g. "example.com")
+	ZoneID             string `toml:"zone_id"`             // Cloudflare zone ID / Route53 hosted zone ID
+	AccessKeyID        string `toml:"access_key_id"`       // Route53 / Aliyun access key
+	SecretAccessKey    string `toml:"secret_access_key"`   // Route53 / Aliyun secret
+	PropagationTimeout int    `toml:"propagation_timeout"` // Seconds to wait for TXT propagation (default 120)
+
+	APITokenFile        string `toml:"api_token_file"`         // Read api_token from this file
+	SecretAccessKeyFile string `toml:"secret_access_key_file"` // Read secret_access_key from this file
+}
+
+// Supported ACME DNS providers
+const (
+	DNSProviderCloudflare = "cloudflare"
+	DNSProviderRoute53    = "route53"
+	DNSProviderAliyun     = "aliyun"
+)
+
+// Client certificate authentication modes
+const (
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// DefaultClientCertHeader is the header used to pass the client cert subject to the backend
+const DefaultClientCertHeader = "X-Client-Cert-Subject"
+
+// ClientAuthEnabled reports whether client certificates are requested on this listener
+func (h *HTTPSConfig) ClientAuthEnabled() bool {
+	return h.Enabled && h.ClientAuth != ""
+}
+
+// ClientCertHeaderName returns the configured client cert header or the default
+func (h *HTTPSConfig) ClientCertHeaderName() string {
+	if h.ClientCertHeader != "" {
+		return h.ClientCertHeader
+	}
+	return DefaultClientCertHeader
+}
+
+// LoadConfig loads configuration from the specified file
+func LoadConfig(configPath string) (*Config, error) {
+	// Check if config file exists
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("configuration file %s does not exist. Run \"okaproxy init --output %s\" to create one", configPath, configPath)
+	}
+
+	var cfg Config
+	if _, err := decodeFile(configPath, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse configuration: %v", err)
+	}
+
+	// Lite builds always run in lite mode
+	cfg.Lite = cfg.Lite || liteBuild
+	cfg.Path = configPath
+
+	// Merge the servers and tests of included files
+	if err := cfg.loadIncludes(); err != nil {
+		return nil, fmt.Errorf("failed to include configuration: %v", err)
+	}
+
+	// Both [log.remote] and [logging.remote] configure the remote log sink
+	if cfg.Logging.Remote.Enabled() {
+		if cfg.Log.Remote.Enabled() {
+			return nil, fmt.Errorf("configuration validation failed: log.remote and logging.remote are both set")
+		}
+		cfg.Log.Remote, cfg.Logging.Remote = cfg.Logging.Remote, LogRemoteConfig{}
+	}
+
+	cfg.applyDefaults()
+
+	if err := cfg.loadSecrets(); err != nil {
+		return nil, fmt.Errorf("failed to read secrets: %v", err)
+	}
+
+	// Validate configuration
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("configuration validation failed: %v", err)
+	}
+
+	return &cfg, nil
+}
+
+// applyDefaults fills in values derived from other settings
+func (c *Config) applyDefaults() {
+	if c.Flags.KeyPrefix == "" {
+		c.Flags.KeyPrefix = "okaproxy:flags:"
+	}
+	if c.Flags.PollInterval == 0 {
+		c.Flags.PollInterval = 10
+	}
+	if c.Reload.Interval == 0 {
+		c.Reload.Interval = 2
+	}
+	if c.TrustedProxies.IPs == nil {
+		c.TrustedProxies.IPs = []string{"127.0.0.0/8", "::1"}
+	}
+	if c.Shutdown.DrainTimeout == 0 {
+		c.Shutdown.DrainTimeout = 30
+	}
+	if c.Cache.MemorySize == 0 {
+		c.Cache.MemorySize = 64 << 20
+	}
+	if c.Cache.Disk.Dir == "" && c.Paths.CachePath() != "" {
+		c.Cache.Disk.Dir = filepath.Join(c.Paths.CachePath(), "responses")
+	}
+	if c.Cache.Disk.MaxSize == 0 {
+		c.Cache.Disk.MaxSize = 1 << 30
+	}
+	if c.Cache.Disk.MinSize == 0 {
+		c.Cache.Disk.MinSize = 256 << 10
+	}
+
+	if c.Log.Syslog.Facility == "" {
+		c.Log.Syslog.Facility = "local0"
+	}
+	if c.Log.Syslog.Tag == "" {
+		c.Log.Syslog.Tag = "okaproxy"
+	}
+
+	if len(c.GeoIP.Editions) == 0 {
+		c.GeoIP.Editions = []string{GeoIPEditionCity, GeoIPEditionASN}
+	}
+	if c.GeoIP.RefreshInterval == 0 {
+		c.GeoIP.RefreshInterval = 24
+	}
+	if c.GeoIP.URL == "" {
+		c.GeoIP.URL = "https://download.maxmind.com"
+	}
+
+	if c.Report.Format == "" {
+		c.Report.Format = ReportJSON
+	}
+	if c.Report.TopPaths == 0 {
+		c.Report.TopPaths = 10
+	}
+	if c.Report.Dir == "" && !c.Paths.ReadOnly {
+		c.Report.Dir = filepath.Join(c.Paths.DataPath(), "reports")
+	}
+
+	if c.Admin.MaxMinutes == 0 {
+		c.Admin.MaxMinutes = 240
+	}
+
+	if c.TestMode.Time == "" {
+		c.TestMode.Time = "2000-01-01T00:00:00Z"
+	}
+
+	if c.Secrets.Address == "" {
+		c.Secrets.Address = os.Getenv("VAULT_ADDR")
+	}
+	if c.Secrets.Token == "" && c.Secrets.TokenFile == "" && c.Secrets.RoleID == "" {
+		c.Secrets.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if c.Secrets.AppRoleMount == "" {
+		c.Secrets.AppRoleMount = "approle"
+	}
+	if c.Secrets.RefreshInterval == 0 {
+		c.Secrets.RefreshInterval = 300
+	}
+
+	if c.Sentry.Environment == "" {
+		c.Sentry.Environment = "production"
+	}
+	if c.Sentry.BurstThreshold == 0 {
+		c.Sentry.BurstThreshold = 50
+	}
+	if c.Sentry.BurstWindow == 0 {
+		c.Sentry.BurstWindow = 60
+	}
+
+	if c.Log.Level == "" {
+		c.Log.Level = "info"
+	}
+	if c.Log.DebugMinutes == 0 {
+		c.Log.DebugMinutes = 30
+	}
+	if c.Log.Remote.Index == "" {
+		c.Log.Remote.Index = "okaproxy-access"
+	}
+	if c.Log.Remote.BatchSize == 0 {
+		c.Log.Remote.BatchSize = 500
+	}
+	if c.Log.Remote.QueueSize == 0 {
+		c.Log.Remote.QueueSize = 10000
+	}
+	if c.Log.Remote.FlushInterval == 0 {
+		c.Log.Remote.FlushInterval = 5
+	}
+
+	if c.Telemetry.ServiceName == "" {
+		c.Telemetry.ServiceName = "okaproxy"
+	}
+	if c.Telemetry.SampleRatio == 0 {
+		c.Telemetry.SampleRatio = 1
+	}
+	if c.Telemetry.FlushInterval == 0 {
+		c.Telemetry.FlushInterval = 5
+	}
+
+	ban := &c.Limit.Ban
+	if ban.Threshold == 0 {
+		ban.Threshold = 5
+	}
+	if ban.Window == 0 {
+		ban.Window = 600
+	}
+	if ban.Duration == 0 {
+		ban.Duration = 3600
+	}
+
+	for i := range c.Server {
+		if c.Server[i].ASN.LimitWindow == 0 {
+			c.Server[i].ASN.LimitWindow = 60
+		}
+
+		geo := &c.Server[i].GeoBlock
+		if geo.Action == "" {
+			geo.Action = GeoActionBlock
+		}
+		if geo.ChallengeExpired == 0 {
+			geo.ChallengeExpired = 60
+		}
+
+		if c.Server[i].TCP.AcceptLoops == 0 {
+			c.Server[i].TCP.AcceptLoops = 1
+		}
+		if c.Server[i].UpstreamTLS.SessionCacheSize == 0 {
+			c.Server[i].UpstreamTLS.SessionCacheSize = 256
+		}
+		if c.Server[i].Cache.TTL == 0 {
+			c.Server[i].Cache.TTL = 60
+		}
+		if c.Server[i].Cache.MaxSize == 0 {
+			c.Server[i].Cache.MaxSize = 1 << 20
+		}
+
+		concurrency := &c.Server[i].Concurrency
+		if concurrency.Queue == 0 {
+			concurrency.Queue = concurrency.Max
+		}
+		if concurrency.QueueTimeout == 0 {
+			concurrency.QueueTimeout = 10
+		}
+		if concurrency.RetryAfter == 0 {
+			concurrency.RetryAfter = 5
+		}
+
+		timeouts := &c.Server[i].Timeouts
+		if timeouts.Read == 0 {
+			timeouts.Read = 30
+		}
+		if timeouts.Write == 0 {
+			timeouts.Write = 30
+		}
+		if timeouts.ReadHeader == 0 {
+			timeouts.ReadHeader = 5
+		}
+		if timeouts.Connect == 0 {
+			timeouts.Connect = 30
+		}
+
+		transport := &c.Server[i].Transport
+		if transport.MaxIdleConns == 0 {
+			transport.MaxIdleConns = 100
+		}
+		if transport.MaxIdleConnsPerHost == 0 {
+			transport.MaxIdleConnsPerHost = transport.MaxIdleConns
+			if c.Server[i].CtnMax > 0 {
+				transport.MaxIdleConnsPerHost = c.Server[i].CtnMax
+			}
+		}
+		if transport.IdleConnTimeout == 0 {
+			transport.IdleConnTimeout = 90
+		}
+		if transport.TLSHandshakeTimeout == 0 {
+			transport.TLSHandshakeTimeout = 10
+		}
+
+		if c.Server[i].SlowClients.Grace == 0 {
+			c.Server[i].SlowClients.Grace = 5
+		}
+
+		challenge := &c.Server[i].Challenge
+		if challenge.Mode == "" {
+			challenge.Mode = ChallengeModeCookie
+		}
+		if challenge.Difficulty == 0 {
+			challenge.Difficulty = 16
+		}
+		if challenge.Bind == "" {
+			challenge.Bind = ChallengeBindPrefix
+		}
+
+		endpoints := &c.Server[i].Endpoints
+		if endpoints.Health == "" {
+			endpoints.Health = "/health"
+		}
+		if endpoints.Status == "" {
+			endpoints.Status = "/status"
+		}
+
+		if c.Server[i].Type == "" {
+			c.Server[i].Type = ServerTypeHTTP
+		}
+
+		if c.Server[i].BasicAuth.Realm == "" {
+			c.Server[i].BasicAuth.Realm = "Restricted"
+		}
+
+		if c.Server[i].APIKeys.Header == "" {
+			c.Server[i].APIKeys.Header = "X-API-Key"
+		}
+
+		for j := range c.Server[i].Rules {
+			rule := &c.Server[i].Rules[j]
+			if rule.Action == "" {
+				rule.Action = RuleActionBlock
+			}
+			if rule.Status == 0 {
+				rule.Status = 403
+			}
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("rules[%d]", j)
+			}
+		}
+
+		firewall := &c.Server[i].WAF
+		if firewall.Mode == "" {
+			firewall.Mode = WAFModeBlock
+		}
+		if firewall.Threshold == 0 {
+			firewall.Threshold = 5
+		}
+		if firewall.BodyLimit == 0 {
+			firewall.BodyLimit = 131072
+		}
+
+		anomaly := &c.Server[i].Anomaly
+		if anomaly.Window == 0 {
+			anomaly.Window = 600
+		}
+		if anomaly.Challenge == 0 {
+			anomaly.Challenge = 10
+		}
+		if anomaly.ChallengeExpired == 0 {
+			anomaly.ChallengeExpired = 300
+		}
+		if anomaly.Tarpit == 0 {
+			anomaly.Tarpit = 25
+		}
+		if anomaly.TarpitDelay == 0 {
+			anomaly.TarpitDelay = 5
+		}
+		if anomaly.Ban == 0 {
+			anomaly.Ban = 50
+		}
+		if anomaly.Scores.RateLimited == 0 {
+			anomaly.Scores.RateLimited = 5
+		}
+		if anomaly.Scores.WAF == 0 {
+			anomaly.Scores.WAF = 10
+		}
+		if anomaly.Scores.NotFound == 0 {
+			anomaly.Scores.NotFound = 1
+		}
+		if anomaly.Scores.SuspiciousAgent == 0 {
+			anomaly.Scores.SuspiciousAgent = 2
+		}
+
+		oidc := &c.Server[i].OIDC
+		if oidc.Scopes == nil {
+			oidc.Scopes = []string{"openid", "email", "profile"}
+		}
+		if oidc.Session == 0 {
+			oidc.Session = 28800
+		}
+		if oidc.UserHeader == "" {
+			oidc.UserHeader = "X-Auth-Request-User"
+		}
+		if oidc.EmailHeader == "" {
+			oidc.EmailHeader = "X-Auth-Request-Email"
+		}
+
+		compression := &c.Server[i].Compression
+		if compression.Encodings == nil && !c.Lite {
+			compression.Encodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+		}
+		if compression.GzipLevel == 0 {
+			compression.GzipLevel = 6
+		}
+		if compression.BrotliLevel == 0 {
+			compression.BrotliLevel = 5
+		}
+		if compression.ZstdLevel == 0 {
+			compression.ZstdLevel = 2
+		}
+		if compression.MinSize == 0 {
+			compression.MinSize = 256
+		}
+
+		snapshot := &c.Server[i].Snapshot
+		if snapshot.Interval == 0 {
+			snapshot.Interval = 300
+		}
+		if snapshot.Dir == "" && c.Paths.CachePath() != "" {
+			snapshot.Dir = filepath.Join(c.Paths.CachePath(), "snapshots", c.Server[i].Name)
+		}
+
+		acme := &c.Server[i].HTTPS.ACME
+		if acme.CacheDir == "" && !c.Paths.ReadOnly {
+			acme.CacheDir = c.Paths.ACMEPath()
+		}
+	}
+}
+
+// Validate validates the configuration
+func (c *Config) Validate() error {
+	if len(c.Server) == 0 {
+		return fmt.Errorf("no server configuration found")
+	}
+
+	// Validate temporary bans
+	if c.Limit.Ban.Threshold < 0 || c.Limit.Ban.Window < 0 || c.Limit.Ban.Duration < 0 {
+		return fmt.Errorf("limit.ban: threshold, window and duration must be positive")
+	}
+
+	// Validate bypass allowlist
+	if _, err := c.Bypass.Prefixes(); err != nil {
+		return fmt.Errorf("bypass: %v", err)
+	}
+
+	// Validate trusted proxies
+	if _, err := c.TrustedProxies.Prefixes(); err != nil {
+		return fmt.Errorf("trusted_proxies: %v", err)
+	}
+
+	// Validate state store
+	switch c.Store.Backend {
+	case "", StoreBackendRedis:
+	case StoreBackendBolt:
+		if c.Paths.ReadOnly && c.Store.Path == "" {
+			return fmt.Errorf("store: the bolt backend needs a writable path when paths.read_only is set")
+		}
+	default:
+		return fmt.Errorf("store: unsupported backend %q", c.Store.Backend)
+	}
+
+	// Validate feature flag provider
+	switch c.Flags.Provider {
+	case "":
+	case FlagsProviderRedis:
+		if c.Lite {
+			return fmt.Errorf("flags: the redis provider is not available in lite mode")
+		}
+		if c.Store.Backend == StoreBackendBolt {
+			return fmt.Errorf("flags: the redis provider requires the redis store backend")
+		}
+	case FlagsProviderHTTP:
+		if c.Flags.URL == "" {
+			return fmt.Errorf("flags: url is required for the http provider")
+		}
+	default:
+		return fmt.Errorf("flags: unsupported provider %q", c.Flags.Provider)
+	}
+	if c.Flags.PollInterval < 0 {
+		return fmt.Errorf("flags: poll_interval must not be negative")
+	}
+
+	// Validate configuration reloads
+	if c.Reload.Interval < 0 {
+		return fmt.Errorf("reload: interval must not be negative")
+	}
+
+	// Validate shutdown
+	if c.Shutdown.DrainTimeout < 0 || c.Shutdown.FailHealth < 0 {
+		return fmt.Errorf("shutdown: drain_timeout and fail_health must not be negative")
+	}
+
+	// Validate response cache
+	if c.Cache.MemorySize < 0 {
+		return fmt.Errorf("cache: memory_size must not be negative")
+	}
+	if c.Cache.Disk.MaxSize < 0 || c.Cache.Disk.MinSize < 0 {
+		return fmt.Errorf("cache.disk: max_size and min_size must not be negative")
+	}
+	if c.Cache.Disk.Enabled && c.Cache.Disk.Dir == "" {
+		return fmt.Errorf("cache.disk: dir is required in read-only mode")
+	}
+
+	// Validate admin API
+	if c.Admin.Enabled() {
+		if c.Admin.Token == "" {
+			return fmt.Errorf("admin: token is required when listen is set")
+		}
+		if c.Admin.MaxMinutes < 0 {
+			return fmt.Errorf("admin: max_minutes must not be negative")
+		}
+	}
+
+	// Validate GeoIP downloads
+	if c.GeoIP.Enabled() {
+		if c.Lite {
+			return fmt.Errorf("geoip: database downloads are not available in lite mode")
+		}
+		if c.Paths.ReadOnly && c.Paths.GeoIPDir == "" {
+			return fmt.Errorf("geoip: set paths.geoip_dir to a writable directory when paths.read_only is set")
+		}
+		if c.GeoIP.RefreshInterval < 0 {
+			return fmt.Errorf("geoip: refresh_interval must not be negative")
+		}
+		for _, edition := range c.GeoIP.Editions {
+			if edition != GeoIPEditionCity && edition != GeoIPEditionASN {
+				return fmt.Errorf("geoip: unsupported edition %q", edition)
+			}
+		}
+	}
+
+	// Validate log format
+	switch c.Log.Format {
+	case "", LogFormatText, LogFormatJSON:
+	default:
+		return fmt.Errorf("log: invalid format %q (expected \"text\" or \"json\")", c.Log.Format)
+	}
+	if !logLevels[c.Log.Level] {
+		return fmt.Errorf("log: invalid level %q (expected \"debug\", \"info\", \"warn\" or \"error\")", c.Log.Level)
+	}
+	if c.Log.DebugMinutes < 0 {
+		return fmt.Errorf("log: debug_minutes must not be negative")
+	}
+	if c.Log.Syslog.Enabled() {
+		if _, _, err := c.Log.Syslog.Endpoint(); err != nil {
+			return fmt.Errorf("log.syslog: %v", err)
+		}
+		if _, ok := syslogFacilities[c.Log.Syslog.Facility]; !ok {
+			return fmt.Errorf("log.syslog: unknown facility %q", c.Log.Syslog.Facility)
+		}
+	}
+
+	if remote := c.Log.Remote; remote.Enabled() {
+		if remote.Type != LogRemoteLoki && remote.Type != LogRemoteElasticsearch {
+			return fmt.Errorf("log.remote: invalid type %q (expected \"loki\" or \"elasticsearch\")", remote.Type)
+		}
+		if u, err := url.Parse(remote.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("log.remote: invalid url %q", remote.URL)
+		}
+		if remote.BatchSize < 0 || remote.QueueSize < 0 || remote.FlushInterval < 0 {
+			return fmt.Errorf("log.remote: batch_size, queue_size and flush_interval must not be negative")
+		}
+	}
+
+	// Validate trace export
+	if c.Telemetry.Enabled() {
+		if u, err := url.Parse(c.Telemetry.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("telemetry: invalid endpoint %q", c.Telemetry.Endpoint)
+		}
+		if c.Telemetry.SampleRatio < 0 || c.Telemetry.SampleRatio > 1 {
+			return fmt.Errorf("telemetry: sample_ratio must be between 0 and 1")
+		}
+		if c.Telemetry.FlushInterval < 0 {
+			return fmt.Errorf("telemetry: flush_interval must be positive")
+		}
+	}
+
+	// Validate deterministic mode
+	if _, err := c.TestMode.StartTime(); err != nil {
+		return fmt.Errorf("test_mode: %v", err)
+	}
+
+	// Validate error reporting
+	if err := c.Secrets.validate(); err != nil {
+		return err
+	}
+
+	if c.Sentry.Enabled() {
+		if _, _, err := c.Sentry.Endpoint(); err != nil {
+			return fmt.Errorf("sentry: %v", err)
+		}
+		if c.Sentry.BurstThreshold < 0 || c.Sentry.BurstWindow < 0 {
+			return fmt.Errorf("sentry: burst_threshold and burst_window must not be negative")
+		}
+	}
+
+	// Validate scheduled reports
+	if c.Report.Enabled() {
+		if c.Report.Schedule != ReportDaily && c.Report.Schedule != ReportWeekly {
+			return fmt.Errorf("report: invalid schedule %q (expected \"daily\" or \"weekly\")", c.Report.Schedule)
+		}
+		if c.Report.Format != ReportJSON && c.Report.Format != ReportHTML {
+			return fmt.Errorf("report: invalid format %q (expected \"json\" or \"html\")", c.Report.Format)
+		}
+		if c.Report.TopPaths < 0 {
+			return fmt.Errorf("report: top_paths must not be negative")
+		}
+		if c.Report.Email.Enabled() && (c.Report.Email.From == "" || len(c.Report.Email.To) == 0) {
+			return fmt.Errorf("report: email from and to are required when smtp_addr is set")
+		}
+		if c.Report.Dir == "" && !c.Report.Email.Enabled() {
+			return fmt.Errorf("report: set dir or email when paths.read_only is set")
+		}
+	}
+
+	// Validate path-scoped rate limit rules
+	for i, rule := range c.Limit.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("limit.rules[%d]: path must start with \"/\"", i)
+		}
+		if rule.Count <= 0 || rule.Window <= 0 {
+			return fmt.Errorf("limit.rules[%d]: count and window must be positive", i)
+		}
+	}
+
+	// Validate per-path request costs
+	for i, cost := range c.Limit.Costs {
+		if !strings.HasPrefix(cost.Path, "/") {
+			return fmt.Errorf("limit.costs[%d]: path must start with \"/\"", i)
+		}
+		if cost.Cost <= 0 {
+			return fmt.Errorf("limit.costs[%d]: cost must be positive", i)
+		}
+		if c.Limit.GeneralEnabled() && cost.Cost > c.Limit.Count {
+			return fmt.Errorf("limit.costs[%d]: cost %d exceeds the limit count %d", i, cost.Cost, c.Limit.Count)
+		}
+	}
+
+	serverNames := make(map[string]bool, len(c.Server))
+	listenAddrs := make(map[string]string) // Address -> server name
+	for i, server := range c.Server {
+		if server.Name == "" {
+			return fmt.Errorf("server[%d]: name is required", i)
+		}
+		// Servers may come from several included files
+		if serverNames[server.Name] {
+			return fmt.Errorf("server[%d]: duplicate name %q", i, server.Name)
+		}
+		serverNames[server.Name] = true
+		if server.Port == 0 && len(server.Listen) == 0 {
+			return fmt.Errorf("server[%d]: port is required unless listen is set", i)
+		}
+		if server.Port < 0 || server.Port > 65535 {
+			return fmt.Errorf("server[%d]: invalid port number %d", i, server.Port)
+		}
+		if server.Bind != "" {
+			if _, err := netip.ParseAddr(server.Bind); err != nil {
+				return fmt.Errorf("server[%d]: bind must be an IP address such as \"127.0.0.1\" or \"::1\", got %q", i, server.Bind)
+			}
+			if server.Port == 0 {
+				return fmt.Errorf("server[%d]: bind requires port", i)
+			}
+		}
+		for _, addr := range server.Listen {
+			if _, _, err := ParseListenAddr(addr); err != nil {
+				return fmt.Errorf("server[%d]: %v", i, err)
+			}
+		}
+		for _, addr := range server.ListenAddrs() {
+			if other, ok := listenAddrs[addr]; ok && other == server.Name {
+				return fmt.Errorf("server[%d]: listen address %s is listed twice", i, addr)
+			} else if ok {
+				return fmt.Errorf("server[%d]: listen address %s is also used by server %q", i, addr, other)
+			}
+			listenAddrs[addr] = server.Name
+		}
+		if server.TargetURL == "" && !server.IsSNIPassthrough() {
+			return fmt.Errorf("server[%d]: target_url is required", i)
+		}
+		switch server.Type {
+		case ServerTypeHTTP:
+			if len(server.SNI) > 0 {
+				return fmt.Errorf("server[%d]: sni routes require type = \"tcp\"", i)
+			}
+			if server.SecretKey == "" {
+				return fmt.Errorf("server[%d]: secret_key is required", i)
+			}
+			if server.Expired <= 0 {
+				return fmt.Errorf("server[%d]: expired must be positive", i)
+			}
+		case ServerTypeTCP:
+			// TCP servers have no verification challenge
+			if _, _, err := server.TCPTarget(); err != nil {
+				return fmt.Errorf("server[%d]: %v", i, err)
+			}
+			if len(server.SNI) > 0 {
+				if err := server.validateSNI(); err != nil {
+					return fmt.Errorf("server[%d]: sni: %v", i, err)
+				}
+			}
+		default:
+			return fmt.Errorf("server[%d]: invalid type %q (expected \"http\" or \"tcp\")", i, server.Type)
+		}
+
+		// Validate HTTPS configuration
+		if server.HTTPS.Enabled {
+			if server.HTTPS.ACME.Enabled {
+				if err := server.HTTPS.ACME.validate(); err != nil {
+					return fmt.Errorf("server[%d]: %v", i, err)
+				}
+			} else if server.HTTPS.Cert != "" || server.HTTPS.Key != "" {
+				if server.HTTPS.Cert == "" || server.HTTPS.Key == "" {
+					return fmt.Errorf("server[%d]: HTTPS cert and key must be set together", i)
+				}
+				if server.HTTPS.CertPath != "" || server.HTTPS.KeyPath != "" {
+					return fmt.Errorf("server[%d]: HTTPS cert and key replace cert_path and key_path", i)
+				}
+			} else {
+				if server.HTTPS.CertPath == "" {
+					return fmt.Errorf("server[%d]: HTTPS cert_path is required when HTTPS is enabled", i)
+				}
+				if server.HTTPS.KeyPath == "" {
+					return fmt.Errorf("server[%d]: HTTPS key_path is required when HTTPS is enabled", i)
+				}
+				// Check if certificate files exist
+				if _, err := os.Stat(server.HTTPS.CertPath); os.IsNotExist(err) {
+					return fmt.Errorf("server[%d]: certificate file not found: %s", i, server.HTTPS.CertPath)
+				}
+				if _, err := os.Stat(server.HTTPS.KeyPath); os.IsNotExist(err) {
+					return fmt.Errorf("server[%d]: key file not found: %s", i, server.HTTPS.KeyPath)
+				}
+			}
+
+			// Validate client certificate authentication
+			switch server.HTTPS.ClientAuth {
+			case "":
+			case ClientAuthOptional, ClientAuthRequire:
+				if server.HTTPS.ClientCAPath == "" {
+					return fmt.Errorf("server[%d]: HTTPS client_ca_path is required when client_auth is set", i)
+				}
+				if _, err := os.Stat(server.HTTPS.ClientCAPath); os.IsNotExist(err) {
+					return fmt.Errorf("server[%d]: client CA file not found: %s", i, server.HTTPS.ClientCAPath)
+				}
+			default:
+				return fmt.Errorf("server[%d]: invalid HTTPS client_auth %q (expected \"optional\" or \"require\")", i, server.HTTPS.ClientAuth)
+			}
+		}
+
+		// Validate CORS configuration
+		switch server.CORS.Preflight {
+		case "", PreflightEdge, PreflightForward:
+		default:
+			return fmt.Errorf("server[%d]: invalid cors preflight %q (expected \"edge\" or \"forward\")", i, server.CORS.Preflight)
+		}
+		for _, pattern := range server.CORS.ForwardPreflight {
+			if !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("server[%d]: cors forward_preflight path %q must start with \"/\"", i, pattern)
+			}
+		}
+		if server.CORS.MaxAge < 0 {
+			return fmt.Errorf("server[%d]: cors max_age must not be negative", i)
+		}
+
+		// Validate response caching
+		if server.Cache.TTL < 0 || server.Cache.MaxSize < 0 {
+			return fmt.Errorf("server[%d]: cache ttl and max_size must not be negative", i)
+		}
+		if server.Cache.StaleWhileRevalidate < 0 || server.Cache.StaleIfError < 0 {
+			return fmt.Errorf("server[%d]: cache stale_while_revalidate and stale_if_error must not be negative", i)
+		}
+		for _, pattern := range server.Cache.Paths {
+			if !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("server[%d]: cache path %q must start with \"/\"", i, pattern)
+			}
+		}
+		if _, err := server.Cache.PurgePrefixes(); err != nil {
+			return fmt.Errorf("server[%d]: cache purge_from: %v", i, err)
+		}
+
+		// Validate timeouts
+		if err := server.Timeouts.validate(); err != nil {
+			return fmt.Errorf("server[%d]: timeouts: %v", i, err)
+		}
+
+		// Validate upstream transport tuning
+		transport := server.Transport
+		if transport.MaxIdleConns < 0 || transport.MaxIdleConnsPerHost < 0 || transport.IdleConnTimeout < 0 || transport.TLSHandshakeTimeout < 0 {
+			return fmt.Errorf("server[%d]: transport settings must not be negative", i)
+		}
+
+		// Validate slow client limits
+		slow := server.SlowClients
+		if slow.MaxConnsPerIP < 0 || slow.MinRate < 0 || slow.Grace < 0 {
+			return fmt.Errorf("server[%d]: slow_clients settings must not be negative", i)
+		}
+
+		// Validate response compression
+		if len(server.Compression.Encodings) > 0 && c.Lite {
+			return fmt.Errorf("server[%d]: compression is not available in lite mode", i)
+		}
+		if err := server.Compression.validate(); err != nil {
+			return fmt.Errorf("server[%d]: compression: %v", i, err)
+		}
+
+		// Validate security headers
+		if err := server.SecurityHeaders.validate(); err != nil {
+			return fmt.Errorf("server[%d]: security_headers %v", i, err)
+		}
+
+		// Validate rate limit key strategy
+		if strategy, _, err := ParseRateLimitKey(server.RateLimitKey); err != nil {
+			return fmt.Errorf("server[%d]: %v", i, err)
+		} else if strategy == RateLimitKeyJWTSub {
+			if err := server.JWT.validate(); err != nil {
+				return fmt.Errorf("server[%d]: jwt: %v", i, err)
+			}
+		}
+
+		// Validate response header filtering
+		for _, pattern := range server.ResponseHeaders.Paths {
+			if !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("server[%d]: response_headers path %q must start with \"/\"", i, pattern)
+			}
+		}
+
+		// Validate connection management
+		if server.Connection.MaxRequests < 0 || server.Connection.MaxAge < 0 || server.Connection.IdleTimeout < 0 {
+			return fmt.Errorf("server[%d]: connection max_requests, max_age and idle_timeout must not be negative", i)
+		}
+
+		// Validate TCP options
+		tcp := server.TCP
+		if tcp.AcceptLoops < 0 || tcp.KeepAliveInterval < 0 || tcp.KeepAliveCount < 0 || tcp.Backlog < 0 {
+			return fmt.Errorf("server[%d]: tcp accept_loops, keepalive_interval, keepalive_count and backlog must not be negative", i)
+		}
+		if tcp.KeepAlive < -1 {
+			return fmt.Errorf("server[%d]: tcp keepalive must be -1 (disabled), 0 (default) or a number of seconds", i)
+		}
+		if tcp.ReusePort && runtime.GOOS == "windows" {
+			return fmt.Errorf("server[%d]: tcp reuse_port is not supported on Windows", i)
+		}
+		if tcp.AcceptLoops > 1 && !tcp.ReusePort {
+			return fmt.Errorf("server[%d]: tcp accept_loops greater than 1 requires reuse_port", i)
+		}
+		switch tcp.Family {
+		case "", TCPFamilyDual, TCPFamilyIPv4, TCPFamilyIPv6:
+		default:
+			return fmt.Errorf("server[%d]: invalid tcp family %q (expected \"dual\", \"ipv4\" or \"ipv6\")", i, tcp.Family)
+		}
+
+		// Validate geo blocking
+		if server.GeoBlock.Enabled() {
+			if c.Lite {
+				return fmt.Errorf("server[%d]: geo_block is not available in lite mode", i)
+			}
+			if server.GeoBlock.Mode != GeoModeAllow && server.GeoBlock.Mode != GeoModeDeny {
+				return fmt.Errorf("server[%d]: invalid geo_block mode %q (expected \"allow\" or \"deny\")", i, server.GeoBlock.Mode)
+			}
+			if server.GeoBlock.Action != GeoActionBlock && server.GeoBlock.Action != GeoActionChallenge {
+				return fmt.Errorf("server[%d]: invalid geo_block action %q (expected \"block\" or \"challenge\")", i, server.GeoBlock.Action)
+			}
+			if server.GeoBlock.ChallengeExpired < 0 {
+				return fmt.Errorf("server[%d]: geo_block challenge_expired must not be negative", i)
+			}
+			for _, code := range server.GeoBlock.Countries {
+				if len(code) != 2 {
+					return fmt.Errorf("server[%d]: invalid geo_block country code %q", i, code)
+				}
+			}
+		}
+
+		// Validate the concurrency limit
+		if server.Concurrency.Max < 0 || server.Concurrency.Queue < -1 || server.Concurrency.QueueTimeout < 0 || server.Concurrency.RetryAfter < 0 {
+			return fmt.Errorf("server[%d]: concurrency settings must not be negative", i)
+		}
+
+		// Validate snapshot paths
+		for _, path := range server.Snapshot.Paths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("server[%d]: snapshot path %q must start with \"/\"", i, path)
+			}
+		}
+		if server.Snapshot.Interval < 0 {
+			return fmt.Errorf("server[%d]: snapshot interval must not be negative", i)
+		}
+
+		// Validate geographic routing
+		if server.GeoRouting.Enabled() {
+			if c.Lite {
+				return fmt.Errorf("server[%d]: geo_routing is not available in lite mode", i)
+			}
+			if err := server.GeoRouting.validate(); err != nil {
+				return fmt.Errorf("server[%d]: geo_routing %v", i, err)
+			}
+		}
+
+		// Validate the access log format
+		if server.AccessLogFormat != "" {
+			if _, err := accesslog.Parse(server.AccessLogFormat); err != nil {
+				return fmt.Errorf("server[%d]: access_log_format: %v", i, err)
+			}
+		}
+
+		// Validate geolocation headers
+		if server.GeoHeaders && c.Lite {
+			return fmt.Errorf("server[%d]: geo_headers is not available in lite mode", i)
+		}
+
+		// Validate ASN filtering
+		if server.ASN.Enabled() && c.Lite {
+			return fmt.Errorf("server[%d]: asn filtering is not available in lite mode", i)
+		}
+		if len(server.ASN.Limit) > 0 && (server.ASN.LimitCount <= 0 || server.ASN.LimitWindow <= 0) {
+			return fmt.Errorf("server[%d]: asn limit_count and limit_window must be positive", i)
+		}
+
+		// Validate mesh headers
+		switch server.Mesh.Mode {
+		case "", MeshEnvoy, MeshLinkerd:
+		default:
+			return fmt.Errorf("server[%d]: invalid mesh mode %q (expected \"envoy\" or \"linkerd\")", i, server.Mesh.Mode)
+		}
+		if server.Mesh.MaxRetries < 0 || server.Mesh.Timeout < 0 {
+			return fmt.Errorf("server[%d]: mesh max_retries and timeout must not be negative", i)
+		}
+
+		// Validate device-class routing
+		for class, target := range server.Device.Targets {
+			switch class {
+			case DeviceMobile, DeviceDesktop, DeviceBot:
+			default:
+				return fmt.Errorf("server[%d]: device target for unknown class %q (expected mobile, desktop or bot)", i, class)
+			}
+			if u, err := url.Parse(target); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("server[%d]: invalid device target URL for %s: %q", i, class, target)
+			}
+		}
+
+		// Validate the PROXY protocol settings
+		if _, err := server.ProxyProtocol.TrustedPrefixes(); err != nil {
+			return fmt.Errorf("server[%d]: proxy_protocol trusted: %v", i, err)
+		}
+		if server.ProxyProtocol.Timeout < 0 {
+			return fmt.Errorf("server[%d]: proxy_protocol timeout must not be negative", i)
+		}
+		switch server.UpstreamProxyProtocol {
+		case "", ProxyProtocolV1, ProxyProtocolV2:
+		default:
+			return fmt.Errorf("server[%d]: invalid upstream_proxy_protocol %q (expected \"v1\" or \"v2\")", i, server.UpstreamProxyProtocol)
+		}
+
+		// Validate access control lists
+		if _, _, err := server.ACL.Prefixes(); err != nil {
+			return fmt.Errorf("server[%d]: acl %v", i, err)
+		}
+		if server.ACL.Page != "" {
+			if _, err := os.Stat(server.ACL.Page); os.IsNotExist(err) {
+				return fmt.Errorf("server[%d]: acl page not found: %s", i, server.ACL.Page)
+			}
+		}
+
+		// Validate verification exemptions
+		for _, pattern := range server.AuthSkipPaths {
+			if !strings.HasPrefix(pattern, "/") {
+				return fmt.Errorf("server[%d]: auth_skip_paths entry %q must start with \"/\"", i, pattern)
+			}
+		}
+
+		// Validate the verification challenge
+		if err := server.Challenge.validate(); err != nil {
+			return fmt.Errorf("server[%d]: challenge: %v", i, err)
+		}
+
+		// Validate built-in endpoints
+		if err := server.Endpoints.validate(); err != nil {
+			return fmt.Errorf("server[%d]: endpoints: %v", i, err)
+		}
+
+		// Validate basic authentication users
+		if err := server.BasicAuth.validate(); err != nil {
+			return fmt.Errorf("server[%d]: basic_auth: %v", i, err)
+		}
+
+		// Validate single sign-on
+		if err := server.OIDC.validate(); err != nil {
+			return fmt.Errorf("server[%d]: oidc: %v", i, err)
+		}
+
+		// Validate the external auth service
+		if err := server.ForwardAuth.validate(); err != nil {
+			return fmt.Errorf("server[%d]: forward_auth: %v", i, err)
+		}
+
+		// Validate API keys
+		if err := server.APIKeys.validate(); err != nil {
+			return fmt.Errorf("server[%d]: api_keys: %v", i, err)
+		}
+
+		// Validate request rules
+		for j := range server.Rules {
+			if err := server.Rules[j].validate(); err != nil {
+				return fmt.Errorf("server[%d]: rules[%d]: %v", i, j, err)
+			}
+		}
+
+		// Validate web application firewall rules
+		if err := server.WAF.validate(); err != nil {
+			return fmt.Errorf("server[%d]: waf: %v", i, err)
+		}
+
+		// Validate anomaly scoring
+		if err := server.Anomaly.validate(); err != nil {
+			return fmt.Errorf("server[%d]: anomaly: %v", i, err)
+		}
+
+		// Validate the canary target
+		if err := server.Canary.validate(); err != nil {
+			return fmt.Errorf("server[%d]: canary: %v", i, err)
+		}
+
+		// Validate static file serving
+		if err := server.Static.validate(); err != nil {
+			return fmt.Errorf("server[%d]: static: %v", i, err)
+		}
+
+		// Validate page files
+		if err := server.Pages.validate(); err != nil {
+			return fmt.Errorf("server[%d]: pages: %v", i, err)
+		}
+
+		// Validate upstream TLS configuration
+		if (server.UpstreamTLS.CertPath == "") != (server.UpstreamTLS.KeyPath == "") {
+			return fmt.Errorf("server[%d]: upstream_tls cert_path and key_path must be set together", i)
+		}
+		if server.UpstreamTLS.CertPath != "" {
+			if _, err := os.Stat(server.UpstreamTLS.CertPath); os.IsNotExist(err) {
+				return fmt.Errorf("server[%d]: upstream client certificate not found: %s", i, server.UpstreamTLS.CertPath)
+			}
+			if _, err := os.Stat(server.UpstreamTLS.KeyPath); os.IsNotExist(err) {
+				return fmt.Errorf("server[%d]: upstream client key not found: %s", i, server.UpstreamTLS.KeyPath)
+			}
+		}
+		if server.UpstreamTLS.CAPath != "" {
+			if _, err := os.Stat(server.UpstreamTLS.CAPath); os.IsNotExist(err) {
+				return fmt.Errorf("server[%d]: upstream CA file not found: %s", i, server.UpstreamTLS.CAPath)
+			}
+		}
+		if server.UpstreamTLS.SessionCacheSize < 0 {
+			return fmt.Errorf("server[%d]: upstream_tls.session_cache_size must not be negative", i)
+		}
+	}
+
+	// Validate test fixtures
+	for i := range c.Test {
+		if err := c.validateTest(&c.Test[i]); err != nil {
+			return fmt.Errorf("test[%d]: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks groups, targets and the fallback
+func (g *GeoRoutingConfig) validate() error {
+	names := make(map[string]bool, len(g.Groups))
+	for _, group := range g.Groups {
+		if group.Name == "" || names[group.Name] {
+			return fmt.Errorf("group names must be unique and not empty")
+		}
+		names[group.Name] = true
+
+		if len(group.Targets) == 0 {
+			return fmt.Errorf("group %s has no targets", group.Name)
+		}
+		for _, target := range group.Targets {
+			if u, err := url.Parse(target.URL); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("group %s: invalid target URL %q", group.Name, target.URL)
+			}
+			if target.Weight < 0 {
+				return fmt.Errorf("group %s: target weights must not be negative", group.Name)
+			}
+		}
+
+		for _, code := range group.Countries {
+			if len(code) != 2 {
+				return fmt.Errorf("group %s: invalid country code %q", group.Name, code)
+			}
+		}
+		for _, code := range group.Continents {
+			if !continentCodes[strings.ToUpper(code)] {
+				return fmt.Errorf("group %s: invalid continent code %q", group.Name, code)
+			}
+		}
+	}
+
+	if g.Fallback != "" && !names[g.Fallback] {
+		return fmt.Errorf("fallback group %q does not exist", g.Fallback)
+	}
+	return nil
+}
+
+// validate validates the ACME configuration
+func (a *ACMEConfig) validate() error {
+	if len(a.Domains) == 0 {
+		return fmt.Errorf("ACME domains are required when ACME is enabled")
+	}
+	if a.RenewBefore < 0 {
+		return fmt.Errorf("ACME renew_before must not be negative")
+	}
+
+	switch a.DNS.Provider {
+	case DNSProviderCloudflare:
+		if a.DNS.APIToken == "" {
+			return fmt.Errorf("ACME dns api_token is required for cloudflare")
+		}
+	case DNSProviderRoute53:
+		if a.DNS.ZoneID == "" || a.DNS.AccessKeyID == "" || a.DNS.SecretAccessKey == "" {
+			return fmt.Errorf("ACME dns zone_id, access_key_id and secret_access_key are required for route53")
+		}
+	case DNSProviderAliyun:
+		if a.DNS.AccessKeyID == "" || a.DNS.SecretAccessKey == "" {
+			return fmt.Errorf("ACME dns access_key_id and secret_access_key are required for aliyun")
+		}
+	case "":
+		return fmt.Errorf("ACME dns provider is required when ACME is enabled")
+	default:
+		return fmt.Errorf("unsupported ACME dns provider %q", a.DNS.Provider)
+	}
+
+	return nil
+}
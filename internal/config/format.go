@@ -0,0 +1,114 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// tomlPosition matches the position prefix of TOML decoding errors
+var tomlPosition = regexp.MustCompile(`^toml: (?:line \d+ )?\(last key "([^"]*)"\): `)
+
+// decodeFile decodes a configuration file into v. Files ending in .yaml, .yml
+// or .json are parsed as such and use the same option names as TOML; any
+// other file is TOML.
+func decodeFile(path string, v interface{}) (toml.MetaData, error) {
+	var parse func([]byte) (interface{}, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parse = parseYAML
+	case ".json":
+		parse = parseJSON
+	default:
+		return toml.DecodeFile(path, v)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return toml.MetaData{}, err
+	}
+	document, err := parse(content)
+	if err != nil {
+		return toml.MetaData{}, err
+	}
+	options, ok := normalize(document).(map[string]interface{})
+	if !ok {
+		return toml.MetaData{}, fmt.Errorf("the document must be a mapping of options")
+	}
+
+	// Decode through TOML so every format follows the same option names and types
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(options); err != nil {
+		return toml.MetaData{}, err
+	}
+	md, err := toml.Decode(buf.String(), v)
+	if err != nil {
+		// Line numbers refer to the intermediate TOML; keep the option name only
+		return md, errors.New(tomlPosition.ReplaceAllString(err.Error(), "$1: "))
+	}
+	return md, nil
+}
+
+func parseYAML(content []byte) (interface{}, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func parseJSON(content []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// normalize converts a parsed YAML or JSON document into values TOML can
+// encode: integral numbers become integers, null values are dropped and lists
+// of mappings become arrays of tables
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			if item == nil {
+				delete(v, key)
+				continue
+			}
+			v[key] = normalize(item)
+		}
+		return v
+	case []interface{}:
+		tables := make([]map[string]interface{}, 0, len(v))
+		for i, item := range v {
+			v[i] = normalize(item)
+			if table, ok := v[i].(map[string]interface{}); ok {
+				tables = append(tables, table)
+			}
+		}
+		if len(v) > 0 && len(tables) == len(v) {
+			return tables
+		}
+		return v
+	default:
+		return v
+	}
+}
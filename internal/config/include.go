@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Patterns is a list of file patterns that may also be written as a single string
+type Patterns []string
+
+// UnmarshalTOML implements toml.Unmarshaler
+func (p *Patterns) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		*p = Patterns{v}
+	case []interface{}:
+		patterns := make(Patterns, 0, len(v))
+		for _, item := range v {
+			pattern, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("include must be a string or a list of strings")
+			}
+			patterns = append(patterns, pattern)
+		}
+		*p = patterns
+	default:
+		return fmt.Errorf("include must be a string or a list of strings")
+	}
+	return nil
+}
+
+// IncludedFiles returns the files matched by the include patterns, in order.
+// Relative patterns are resolved against the directory of the configuration file.
+func (c *Config) IncludedFiles() ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(c.Path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include pattern %q: %v", pattern, err)
+		}
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				files = append(files, match)
+			}
+		}
+	}
+	return files, nil
+}
+
+// SourceFiles returns the configuration file followed by the files it
+// includes now, so watchers notice files added to an included directory, and
+// the files secrets are read from, so rotated secrets are picked up
+func (c *Config) SourceFiles() []string {
+	included, _ := c.IncludedFiles()
+	files := append([]string{c.Path}, included...)
+	return append(files, c.secretPaths()...)
+}
+
+// loadIncludes appends the servers and tests of the included files. Included
+// files may only define servers and tests.
+func (c *Config) loadIncludes() error {
+	files, err := c.IncludedFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		var included struct {
+			Server []ServerConfig `toml:"server"`
+			Test   []TestCase     `toml:"test"`
+		}
+		md, err := decodeFile(file, &included)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		for _, key := range md.Undecoded() {
+			if len(key) == 1 {
+				return fmt.Errorf("%s: only [[server]] and [[test]] may be included, found %q", file, key.String())
+			}
+		}
+
+		c.Server = append(c.Server, included.Server...)
+		c.Test = append(c.Test, included.Test...)
+	}
+	return nil
+}
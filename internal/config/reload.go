@@ -0,0 +1,34 @@
+package config
+
+import "reflect"
+
+// RetainStatic copies the sections that only take effect at startup from the
+// running configuration, so a reloaded configuration describes what is actually
+// running. It returns the names of the sections whose changes were not applied.
+func (c *Config) RetainStatic(running *Config) []string {
+	var ignored []string
+	retain := func(name string, loaded, current interface{}) {
+		dst := reflect.ValueOf(loaded).Elem()
+		src := reflect.ValueOf(current).Elem()
+		if !reflect.DeepEqual(dst.Interface(), src.Interface()) {
+			ignored = append(ignored, name)
+		}
+		dst.Set(src)
+	}
+
+	retain("lite", &c.Lite, &running.Lite)
+	retain("paths", &c.Paths, &running.Paths)
+	retain("limit.ban", &c.Limit.Ban, &running.Limit.Ban)
+	retain("flags", &c.Flags, &running.Flags)
+	retain("reload", &c.Reload, &running.Reload)
+	retain("store", &c.Store, &running.Store)
+	retain("admin", &c.Admin, &running.Admin)
+	retain("geoip", &c.GeoIP, &running.GeoIP)
+	retain("report", &c.Report, &running.Report)
+	retain("telemetry", &c.Telemetry, &running.Telemetry)
+	retain("log", &c.Log, &running.Log)
+	retain("sentry", &c.Sentry, &running.Sentry)
+	retain("test_mode", &c.TestMode, &running.TestMode)
+	retain("cache", &c.Cache, &running.Cache)
+	return ignored
+}
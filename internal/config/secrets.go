@@ -0,0 +1,206 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"okaproxy/internal/vault"
+)
+
+// vaultPrefix marks option values read from Vault: "vault:<path>#<field>"
+const vaultPrefix = "vault:"
+
+// secretOption is an option that may hold a secret
+type secretOption struct {
+	name  string  // Option name used in errors
+	value *string // Option the secret is stored in
+	file  string  // File named by the matching *_file option, if any
+}
+
+// vaultRef is an option whose value was read from Vault
+type vaultRef struct {
+	name  string
+	ref   string // "<path>#<field>"
+	value string
+}
+
+// vaultClients keeps one client per provider configuration, so reloads reuse
+// the token instead of logging in again
+var (
+	vaultClients   = map[vault.Options]*vault.Client{}
+	vaultClientsMu sync.Mutex
+)
+
+// secretFiles lists the options that have a *_file variant, such as a Docker
+// or Kubernetes secret mount
+func (c *Config) secretFiles() []secretOption {
+	secrets := []secretOption{
+		{"secrets.token", &c.Secrets.Token, c.Secrets.TokenFile},
+		{"secrets.secret_id", &c.Secrets.SecretID, c.Secrets.SecretIDFile},
+		{"store.redis_password", &c.Store.RedisPassword, c.Store.RedisPasswordFile},
+		{"admin.token", &c.Admin.Token, c.Admin.TokenFile},
+		{"geoip.license_key", &c.GeoIP.LicenseKey, c.GeoIP.LicenseKeyFile},
+		{"report.email.password", &c.Report.Email.Password, c.Report.Email.PasswordFile},
+		{"sentry.dsn", &c.Sentry.DSN, c.Sentry.DSNFile},
+	}
+	for i := range c.Server {
+		server := &c.Server[i]
+		dns := &server.HTTPS.ACME.DNS
+		secrets = append(secrets,
+			secretOption{fmt.Sprintf("server[%d].secret_key", i), &server.SecretKey, server.SecretKeyFile},
+			secretOption{fmt.Sprintf("server[%d].oidc.client_secret", i), &server.OIDC.ClientSecret, server.OIDC.ClientSecretFile},
+			secretOption{fmt.Sprintf("server[%d].https.acme.dns.api_token", i), &dns.APIToken, dns.APITokenFile},
+			secretOption{fmt.Sprintf("server[%d].https.acme.dns.secret_access_key", i), &dns.SecretAccessKey, dns.SecretAccessKeyFile},
+		)
+	}
+	return secrets
+}
+
+// vaultOptions lists the options that may be read from Vault
+func (c *Config) vaultOptions() []secretOption {
+	var options []secretOption
+	for _, secret := range c.secretFiles() {
+		// The provider's own credentials cannot come from the provider
+		if !strings.HasPrefix(secret.name, "secrets.") {
+			options = append(options, secret)
+		}
+	}
+	for i := range c.Server {
+		https := &c.Server[i].HTTPS
+		options = append(options,
+			secretOption{name: fmt.Sprintf("server[%d].https.cert", i), value: &https.Cert},
+			secretOption{name: fmt.Sprintf("server[%d].https.key", i), value: &https.Key},
+		)
+	}
+	return options
+}
+
+// loadSecrets reads the options set through *_file options, then the options
+// referencing Vault. Trailing line breaks of files are removed, as most tools
+// that write secrets add one.
+func (c *Config) loadSecrets() error {
+	for _, secret := range c.secretFiles() {
+		if secret.file == "" {
+			continue
+		}
+		if *secret.value != "" {
+			return fmt.Errorf("%s and %s_file are mutually exclusive", secret.name, secret.name)
+		}
+
+		content, err := os.ReadFile(secret.file)
+		if err != nil {
+			return fmt.Errorf("%s_file: %v", secret.name, err)
+		}
+		value := strings.TrimRight(string(content), "\r\n")
+		if value == "" {
+			return fmt.Errorf("%s_file: %s is empty", secret.name, secret.file)
+		}
+		*secret.value = value
+	}
+
+	var client *vault.Client
+	for _, option := range c.vaultOptions() {
+		if !strings.HasPrefix(*option.value, vaultPrefix) {
+			continue
+		}
+		ref := strings.TrimPrefix(*option.value, vaultPrefix)
+
+		if client == nil {
+			var err error
+			if client, err = c.vaultClient(); err != nil {
+				return fmt.Errorf("%s: %v", option.name, err)
+			}
+		}
+		value, err := readVault(client, ref)
+		if err != nil {
+			return fmt.Errorf("%s: %v", option.name, err)
+		}
+
+		*option.value = value
+		c.vaultRefs = append(c.vaultRefs, vaultRef{name: option.name, ref: ref, value: value})
+	}
+	return nil
+}
+
+// RefreshSecrets renews the Vault token and reports whether any secret read
+// from Vault has changed since the configuration was loaded
+func (c *Config) RefreshSecrets() (bool, error) {
+	if len(c.vaultRefs) == 0 {
+		return false, nil
+	}
+	client, err := c.vaultClient()
+	if err != nil {
+		return false, err
+	}
+
+	// A token that cannot be renewed only matters once reads fail
+	renewErr := client.Renew()
+
+	for _, ref := range c.vaultRefs {
+		value, err := readVault(client, ref.ref)
+		if err != nil {
+			if renewErr != nil {
+				return false, fmt.Errorf("%s: %v (%v)", ref.name, err, renewErr)
+			}
+			return false, fmt.Errorf("%s: %v", ref.name, err)
+		}
+		if value != ref.value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// vaultClient returns the client for the [secrets] settings
+func (c *Config) vaultClient() (*vault.Client, error) {
+	if c.Secrets.Provider != SecretsProviderVault {
+		return nil, fmt.Errorf("vault references require [secrets] provider = \"vault\"")
+	}
+	if err := c.Secrets.validate(); err != nil {
+		return nil, err
+	}
+
+	options := vault.Options{
+		Address:      c.Secrets.Address,
+		Namespace:    c.Secrets.Namespace,
+		CAPath:       c.Secrets.CAPath,
+		Token:        c.Secrets.Token,
+		RoleID:       c.Secrets.RoleID,
+		SecretID:     c.Secrets.SecretID,
+		AppRoleMount: c.Secrets.AppRoleMount,
+	}
+
+	vaultClientsMu.Lock()
+	defer vaultClientsMu.Unlock()
+	if client, ok := vaultClients[options]; ok {
+		return client, nil
+	}
+	client, err := vault.New(options)
+	if err != nil {
+		return nil, err
+	}
+	vaultClients[options] = client
+	return client, nil
+}
+
+// readVault reads a "<path>#<field>" reference
+func readVault(client *vault.Client, ref string) (string, error) {
+	path, field, ok := strings.Cut(ref, "#")
+	if !ok || path == "" || field == "" {
+		return "", fmt.Errorf("invalid vault reference %q (expected \"vault:<path>#<field>\")", vaultPrefix+ref)
+	}
+	return client.Read(path, field)
+}
+
+// secretPaths returns the files secrets were read from
+func (c *Config) secretPaths() []string {
+	var paths []string
+	for _, secret := range c.secretFiles() {
+		if secret.file != "" {
+			paths = append(paths, secret.file)
+		}
+	}
+	return paths
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Route expectations that do not name a target URL
+const (
+	TestRouteLocal    = "local"    // Answered by okaproxy itself
+	TestRouteUpstream = "upstream" // Proxied to any target
+)
+
+// TestCase describes a request and the outcome the configuration must produce
+type TestCase struct {
+	Name       string            `toml:"name"`
+	Server     string            `toml:"server"`      // Server name (default: the first server)
+	Method     string            `toml:"method"`      // Default GET
+	Path       string            `toml:"path"`        // Request path including the query string
+	Headers    map[string]string `toml:"headers"`     // Request headers; "Host" sets the host
+	RemoteAddr string            `toml:"remote_addr"` // Client address (default "192.0.2.1:40000")
+	Verified   bool              `toml:"verified"`    // Send valid verification cookies
+	Advance    int               `toml:"advance"`     // Seconds to move the clock forward before sending the request
+	Expect     TestExpect        `toml:"expect"`
+}
+
+// TestExpect is the expected outcome of a test case
+type TestExpect struct {
+	Status       int               `toml:"status"`
+	Route        string            `toml:"route"`         // "local", "upstream" or a target URL
+	Headers      map[string]string `toml:"headers"`       // Response header values; "" asserts absence
+	BodyContains string            `toml:"body_contains"` // Substring of the response body
+}
+
+// LoadTests appends the [[test]] cases of a separate file to the configuration
+func (c *Config) LoadTests(path string) error {
+	var file struct {
+		Test []TestCase `toml:"test"`
+	}
+	if _, err := decodeFile(path, &file); err != nil {
+		return fmt.Errorf("failed to parse tests: %v", err)
+	}
+
+	for i := range file.Test {
+		if err := c.validateTest(&file.Test[i]); err != nil {
+			return fmt.Errorf("%s: test[%d]: %v", path, i, err)
+		}
+	}
+	c.Test = append(c.Test, file.Test...)
+	return nil
+}
+
+// validateTest checks a test case and fills in its defaults
+func (c *Config) validateTest(t *TestCase) error {
+	if !strings.HasPrefix(t.Path, "/") {
+		return fmt.Errorf("path must start with /")
+	}
+	if t.Name == "" {
+		t.Name = t.Path
+	}
+	if t.Method == "" {
+		t.Method = http.MethodGet
+	}
+	t.Method = strings.ToUpper(t.Method)
+	if t.Advance < 0 {
+		return fmt.Errorf("advance must not be negative")
+	}
+	if t.RemoteAddr == "" {
+		t.RemoteAddr = "192.0.2.1:40000"
+	}
+
+	if t.Server == "" {
+		t.Server = c.Server[0].Name
+	} else if server := c.ServerByName(t.Server); server == nil {
+		return fmt.Errorf("unknown server %q", t.Server)
+	} else if server.IsTCP() {
+		return fmt.Errorf("server %q forwards TCP connections and cannot be tested with requests", t.Server)
+	}
+
+	if t.Expect.Status == 0 && t.Expect.Route == "" && len(t.Expect.Headers) == 0 && t.Expect.BodyContains == "" {
+		return fmt.Errorf("expect must check at least one of status, route, headers or body_contains")
+	}
+	return nil
+}
+
+// ServerByName returns the named server or nil
+func (c *Config) ServerByName(name string) *ServerConfig {
+	for i := range c.Server {
+		if c.Server[i].Name == name {
+			return &c.Server[i]
+		}
+	}
+	return nil
+}
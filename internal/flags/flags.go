@@ -0,0 +1,212 @@
+package flags
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/logger"
+)
+
+// Well-known flag names
+const (
+	Maintenance  = "maintenance"   // Serve the maintenance page (true/false)
+	UnderAttack  = "under_attack"  // Challenge every client (true/false)
+	CanaryWeight = "canary_weight" // Percent of clients sent to the canary target (0-100)
+)
+
+// fetchTimeout bounds a single refresh of all servers
+const fetchTimeout = 5 * time.Second
+
+// Source fetches the current flag values for a server
+type Source interface {
+	Name() string
+	Fetch(ctx context.Context, server string) (map[string]string, error)
+}
+
+// Manager polls a Source and keeps the latest flag values per server.
+// Every change is written to the log as an audit record.
+type Manager struct {
+	source   Source
+	interval time.Duration
+	servers  []string
+	logger   *logger.Logger
+
+	mu      sync.RWMutex
+	values  map[string]map[string]string
+	failing bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewManager creates a flag manager for the named servers
+func NewManager(source Source, interval time.Duration, servers []string, log *logger.Logger) *Manager {
+	return &Manager{
+		source:   source,
+		interval: interval,
+		servers:  servers,
+		logger:   log,
+		values:   make(map[string]map[string]string),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start loads the initial flag values and begins polling
+func (m *Manager) Start() {
+	m.refresh()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				m.refresh()
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops polling
+func (m *Manager) Stop() {
+	close(m.stop)
+	m.wg.Wait()
+}
+
+// Server returns the flag view for a single server
+func (m *Manager) Server(name string) *ServerFlags {
+	return &ServerFlags{manager: m, server: name}
+}
+
+// refresh fetches flags for every server, keeping the last known values on failure
+func (m *Manager) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	for _, server := range m.servers {
+		values, err := m.source.Fetch(ctx, server)
+		if err != nil {
+			m.fetchFailed(server, err)
+			continue
+		}
+		m.fetchSucceeded()
+		m.apply(server, values)
+	}
+}
+
+// fetchFailed logs the first failure of a streak
+func (m *Manager) fetchFailed(server string, err error) {
+	m.mu.Lock()
+	first := !m.failing
+	m.failing = true
+	m.mu.Unlock()
+
+	if first {
+		m.logger.Warnf("Feature flag refresh from %s failed for server %s: %v. Keeping last known values.", m.source.Name(), server, err)
+	}
+}
+
+// fetchSucceeded ends a failure streak
+func (m *Manager) fetchSucceeded() {
+	m.mu.Lock()
+	recovered := m.failing
+	m.failing = false
+	m.mu.Unlock()
+
+	if recovered {
+		m.logger.Infof("Feature flag refresh from %s recovered", m.source.Name())
+	}
+}
+
+// apply stores new values and audits every changed flag
+func (m *Manager) apply(server string, values map[string]string) {
+	normalized := make(map[string]string, len(values))
+	for name, value := range values {
+		normalized[strings.ToLower(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+
+	m.mu.Lock()
+	previous := m.values[server]
+	m.values[server] = normalized
+	m.mu.Unlock()
+
+	for name, value := range normalized {
+		if old, ok := previous[name]; !ok || old != value {
+			m.audit(server, name, old, value)
+		}
+	}
+	for name, old := range previous {
+		if _, ok := normalized[name]; !ok {
+			m.audit(server, name, old, "")
+		}
+	}
+}
+
+// audit records a flag change
+func (m *Manager) audit(server, name, oldValue, newValue string) {
+	m.logger.WithFields(map[string]interface{}{
+		"server": server,
+		"flag":   name,
+		"old":    oldValue,
+		"new":    newValue,
+		"source": m.source.Name(),
+	}).Info("Feature flag changed")
+}
+
+func (m *Manager) get(server, name string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	value, ok := m.values[server][name]
+	return value, ok
+}
+
+// ServerFlags exposes the runtime flags of one server. A nil *ServerFlags
+// behaves as if no flags were set.
+type ServerFlags struct {
+	manager *Manager
+	server  string
+}
+
+// Get returns the raw value of a flag
+func (sf *ServerFlags) Get(name string) (string, bool) {
+	if sf == nil {
+		return "", false
+	}
+	return sf.manager.get(sf.server, name)
+}
+
+// Bool returns a boolean flag, or def when it is unset or malformed
+func (sf *ServerFlags) Bool(name string, def bool) bool {
+	value, ok := sf.Get(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// Int returns an integer flag, or def when it is unset or malformed
+func (sf *ServerFlags) Int(name string, def int) int {
+	value, ok := sf.Get(name)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HashGetter reads a Redis hash
+type HashGetter interface {
+	GetHash(key string) (map[string]string, error)
+}
+
+// RedisSource reads flags from one Redis hash per server (<prefix><server>)
+type RedisSource struct {
+	client HashGetter
+	prefix string
+}
+
+// NewRedisSource creates a Redis-backed flag source
+func NewRedisSource(client HashGetter, prefix string) *RedisSource {
+	return &RedisSource{client: client, prefix: prefix}
+}
+
+// Name identifies the source in audit records
+func (rs *RedisSource) Name() string {
+	return "redis"
+}
+
+// Fetch returns all fields of the server's flag hash
+func (rs *RedisSource) Fetch(ctx context.Context, server string) (map[string]string, error) {
+	return rs.client.GetHash(rs.prefix + server)
+}
+
+// HTTPSource reads flags from an external flag service. The service is queried
+// with GET <url>?server=<name> and must return a JSON object of flag values.
+type HTTPSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPSource creates a flag source backed by an HTTP endpoint
+func NewHTTPSource(endpoint string) *HTTPSource {
+	return &HTTPSource{
+		url:    endpoint,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Name identifies the source in audit records
+func (hs *HTTPSource) Name() string {
+	return "http"
+}
+
+// Fetch queries the flag service for the server's flags
+func (hs *HTTPSource) Fetch(ctx context.Context, server string) (map[string]string, error) {
+	endpoint, err := url.Parse(hs.url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid flag service url: %v", err)
+	}
+	query := endpoint.Query()
+	query.Set("server", server)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := hs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("flag service returned %s", resp.Status)
+	}
+
+	var raw map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to decode flags: %v", err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		values[name] = fmt.Sprint(value)
+	}
+	return values, nil
+}
@@ -0,0 +1,187 @@
+package geoip
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// downloadTimeout bounds a single database download
+const downloadTimeout = 5 * time.Minute
+
+// Updater downloads GeoLite2 databases with a MaxMind license key, refreshes
+// them on a schedule and hot-swaps the logger's readers
+type Updater struct {
+	config   config.GeoIPConfig
+	dir      string
+	interval time.Duration
+	logger   *logger.Logger
+	client   *http.Client
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewUpdater creates an updater storing databases in dir
+func NewUpdater(cfg config.GeoIPConfig, dir string, log *logger.Logger) *Updater {
+	return &Updater{
+		config:   cfg,
+		dir:      dir,
+		interval: time.Duration(cfg.RefreshInterval) * time.Hour,
+		logger:   log,
+		client:   &http.Client{Timeout: downloadTimeout},
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start downloads missing or stale databases in the background and keeps them fresh
+func (u *Updater) Start() {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+
+		u.refresh(false)
+
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				u.refresh(true)
+			case <-u.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing
+func (u *Updater) Stop() {
+	close(u.stop)
+	u.wg.Wait()
+}
+
+// refresh updates every edition; unless forced, recent files are kept
+func (u *Updater) refresh(force bool) {
+	for _, edition := range u.config.Editions {
+		path := filepath.Join(u.dir, edition+".mmdb")
+		if !force {
+			if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < u.interval {
+				continue
+			}
+		}
+
+		if err := u.update(edition, path); err != nil {
+			u.logger.Errorf("Failed to update %s database: %v. Keeping the current one.", edition, err)
+		}
+	}
+}
+
+// update downloads edition to path and reloads it
+func (u *Updater) update(edition, path string) error {
+	if err := os.MkdirAll(u.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create GeoIP directory: %v", err)
+	}
+
+	// Write next to the target so the rename is atomic
+	tmp, err := os.CreateTemp(u.dir, edition+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := u.download(edition, tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := validate(tmp.Name(), edition); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	switch edition {
+	case config.GeoIPEditionCity:
+		return u.logger.ReloadGeoIP(path)
+	case config.GeoIPEditionASN:
+		return u.logger.ReloadASN(path)
+	}
+	return nil
+}
+
+// download fetches the edition archive and extracts its .mmdb file into w
+func (u *Updater) download(edition string, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.downloadURL(edition), nil)
+	if err != nil {
+		return err
+	}
+	if u.config.AccountID != "" {
+		req.SetBasicAuth(u.config.AccountID, u.config.LicenseKey)
+	}
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: unexpected status %d", resp.StatusCode)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return fmt.Errorf("invalid archive: %v", err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return fmt.Errorf("archive does not contain a .mmdb file")
+		}
+		if err != nil {
+			return fmt.Errorf("invalid archive: %v", err)
+		}
+		if header.Typeflag == tar.TypeReg && strings.HasSuffix(header.Name, ".mmdb") {
+			_, err := io.Copy(w, archive)
+			return err
+		}
+	}
+}
+
+// downloadURL returns the archive URL of edition. The account endpoint is used
+// when an account ID is configured, the legacy license key endpoint otherwise.
+func (u *Updater) downloadURL(edition string) string {
+	base := strings.TrimSuffix(u.config.URL, "/")
+	if u.config.AccountID != "" {
+		return fmt.Sprintf("%s/geoip/databases/%s/download?suffix=tar.gz", base, url.PathEscape(edition))
+	}
+
+	query := url.Values{}
+	query.Set("edition_id", edition)
+	query.Set("license_key", u.config.LicenseKey)
+	query.Set("suffix", "tar.gz")
+	return base + "/app/geoip_download?" + query.Encode()
+}
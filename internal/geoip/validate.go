@@ -0,0 +1,24 @@
+//go:build !lite
+
+package geoip
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// validate checks that path holds a readable database of the expected edition
+func validate(path, edition string) error {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return fmt.Errorf("downloaded database is unreadable: %v", err)
+	}
+	defer db.Close()
+
+	if dbType := db.Metadata().DatabaseType; !strings.EqualFold(dbType, edition) {
+		return fmt.Errorf("downloaded database is %s, expected %s", dbType, edition)
+	}
+	return nil
+}
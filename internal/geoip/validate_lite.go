@@ -0,0 +1,10 @@
+//go:build lite
+
+package geoip
+
+import "errors"
+
+// validate always fails: lite builds do not include GeoIP support
+func validate(string, string) error {
+	return errors.New("GeoIP is not available in lite builds")
+}
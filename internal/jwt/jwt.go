@@ -0,0 +1,317 @@
+// Package jwt verifies JSON Web Tokens signed with a shared HMAC secret
+// (HS256, HS384, HS512) or with a key published in a JWKS document (RS256,
+// RS384, RS512, PS256, PS384, PS512, ES256, ES384, ES512).
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // Hashes of the supported algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/clock"
+)
+
+const (
+	// jwksTTL is how long a key set is used before it is fetched again
+	jwksTTL = time.Hour
+	// jwksRetry is how long to wait before fetching a key set again for a key
+	// it did not have
+	jwksRetry = time.Minute
+	// leeway allows for clock skew when checking exp and nbf
+	leeway = 30 * time.Second
+)
+
+// hashes maps the hash suffix of an algorithm name to its hash
+var hashes = map[string]crypto.Hash{
+	"256": crypto.SHA256,
+	"384": crypto.SHA384,
+	"512": crypto.SHA512,
+}
+
+// Options configures a verifier. At least one of Secret and JWKSURL is set.
+type Options struct {
+	Secret   string // HMAC secret of HS* tokens
+	JWKSURL  string // Key set of RS*, PS* and ES* tokens
+	Issuer   string // Required iss claim (empty = any)
+	Audience string // Required aud claim (empty = any)
+}
+
+// Verifier checks the signature and claims of tokens
+type Verifier struct {
+	options Options
+	http    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey // By key ID
+	fetched   time.Time
+	attempted time.Time
+}
+
+// New creates a verifier. The key set is fetched on first use.
+func New(options Options) *Verifier {
+	return &Verifier{
+		options: options,
+		http:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Subject verifies a token and returns its sub claim
+func (v *Verifier) Subject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("jwt: malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("jwt: malformed signature: %v", err)
+	}
+	if err := v.verifySignature(header.Algorithm, header.KeyID, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Subject   string          `json:"sub"`
+		Issuer    string          `json:"iss"`
+		Audience  json.RawMessage `json:"aud"`
+		Expiry    *int64          `json:"exp"`
+		NotBefore *int64          `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := clock.Now()
+	switch {
+	case claims.Expiry != nil && now.Add(-leeway).Unix() > *claims.Expiry:
+		return "", errors.New("jwt: token expired")
+	case claims.NotBefore != nil && now.Add(leeway).Unix() < *claims.NotBefore:
+		return "", errors.New("jwt: token not valid yet")
+	case v.options.Issuer != "" && claims.Issuer != v.options.Issuer:
+		return "", fmt.Errorf("jwt: token issued by %q", claims.Issuer)
+	case v.options.Audience != "" && !slices.Contains(audience(claims.Audience), v.options.Audience):
+		return "", errors.New("jwt: token issued to another audience")
+	case claims.Subject == "":
+		return "", errors.New("jwt: token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// verifySignature checks the signature of signed, the encoded header and
+// claims, with the key the algorithm calls for
+func (v *Verifier) verifySignature(algorithm, keyID, signed string, signature []byte) error {
+	if len(algorithm) != 5 {
+		return fmt.Errorf("jwt: unsupported algorithm %q", algorithm)
+	}
+	hash, ok := hashes[algorithm[2:]]
+	if !ok {
+		return fmt.Errorf("jwt: unsupported algorithm %q", algorithm)
+	}
+
+	family := algorithm[:2]
+	if family == "HS" {
+		if v.options.Secret == "" {
+			return errors.New("jwt: no HMAC secret configured")
+		}
+		mac := hmac.New(hash.New, []byte(v.options.Secret))
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("jwt: invalid signature")
+		}
+		return nil
+	}
+	if family != "RS" && family != "PS" && family != "ES" {
+		return fmt.Errorf("jwt: unsupported algorithm %q", algorithm)
+	}
+
+	key, err := v.key(keyID)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if family == "RS" {
+			err = rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		} else if family == "PS" {
+			err = rsa.VerifyPSS(key, hash, digest, signature, nil)
+		} else {
+			err = errors.New("wrong key type")
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if family != "ES" || len(signature) != 2*size {
+			err = errors.New("wrong key type or signature size")
+		} else {
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(key, digest, r, s) {
+				err = errors.New("verification failed")
+			}
+		}
+	default:
+		err = errors.New("wrong key type")
+	}
+	if err != nil {
+		return fmt.Errorf("jwt: invalid signature: %v", err)
+	}
+	return nil
+}
+
+// key returns the key set entry with keyID, or the only key when the token
+// names none. Unknown keys cause the key set to be fetched again, at most once
+// per jwksRetry, as they appear when the issuer rotates its keys.
+func (v *Verifier) key(keyID string) (crypto.PublicKey, error) {
+	if v.options.JWKSURL == "" {
+		return nil, errors.New("jwt: no jwks_url configured")
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	stale := clock.Now().Sub(v.fetched) >= jwksTTL
+	if _, ok := v.lookup(keyID); (!ok || stale) && clock.Now().Sub(v.attempted) >= jwksRetry {
+		v.attempted = clock.Now()
+		keys, err := v.fetch()
+		if err != nil && v.keys == nil {
+			return nil, err
+		}
+		if err == nil {
+			v.keys, v.fetched = keys, clock.Now()
+		}
+	}
+	key, ok := v.lookup(keyID)
+	if !ok {
+		return nil, fmt.Errorf("jwt: unknown key %q", keyID)
+	}
+	return key, nil
+}
+
+// lookup finds a key in the current key set
+func (v *Verifier) lookup(keyID string) (crypto.PublicKey, bool) {
+	if keyID == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[keyID]
+	return key, ok
+}
+
+// fetch downloads and parses the key set. Keys of other types or uses are
+// skipped.
+func (v *Verifier) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.http.Get(v.options.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("jwt: jwks: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwt: jwks: unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("jwt: jwks: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Curve {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[jwk.KeyID] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: jwks has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("jwt: malformed token: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("jwt: malformed token: %v", err)
+	}
+	return nil
+}
+
+// audience reads an aud claim, a string or a list of them
+func audience(raw json.RawMessage) []string {
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		return list
+	}
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return []string{single}
+	}
+	return nil
+}
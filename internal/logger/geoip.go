@@ -0,0 +1,118 @@
+//go:build !lite
+
+package logger
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// geoIP wraps the MaxMind GeoIP2 reader
+type geoIP struct {
+	db *geoip2.Reader
+}
+
+// openGeoIP opens a GeoLite2 City database
+func openGeoIP(path string) (*geoIP, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIP{db: db}, nil
+}
+
+// location formats the country, city and coordinates of an IP address
+func (g *geoIP) location(ip net.IP) string {
+	record, err := g.db.City(ip)
+	if err != nil {
+		return "Unknown location"
+	}
+
+	var location strings.Builder
+
+	// Add country
+	if record.Country.Names["en"] != "" {
+		location.WriteString(record.Country.Names["en"])
+	}
+
+	// Add city
+	if record.City.Names["en"] != "" {
+		if location.Len() > 0 {
+			location.WriteString(" - ")
+		}
+		location.WriteString(record.City.Names["en"])
+	}
+
+	// Add coordinates if available
+	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
+		if location.Len() > 0 {
+			location.WriteString(" ")
+		}
+		location.WriteString(fmt.Sprintf("(%.4f, %.4f)",
+			record.Location.Latitude, record.Location.Longitude))
+	}
+
+	if location.Len() == 0 {
+		return "Unknown location"
+	}
+
+	return location.String()
+}
+
+// country returns the ISO country code of an IP address, or "" when unknown
+func (g *geoIP) country(ip net.IP) string {
+	record, err := g.db.Country(ip)
+	if err != nil {
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+// place returns the country, continent and city of an IP address
+func (g *geoIP) place(ip net.IP) Place {
+	record, err := g.db.City(ip)
+	if err != nil {
+		return Place{}
+	}
+	return Place{
+		Country:   record.Country.IsoCode,
+		Continent: record.Continent.Code,
+		City:      record.City.Names["en"],
+	}
+}
+
+// close closes the database
+func (g *geoIP) close() {
+	g.db.Close()
+}
+
+// asnDB wraps the MaxMind GeoLite2 ASN reader
+type asnDB struct {
+	db *geoip2.Reader
+}
+
+// openASN opens a GeoLite2 ASN database
+func openASN(path string) (*asnDB, error) {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &asnDB{db: db}, nil
+}
+
+// lookup returns the autonomous system number and organization of an IP address
+func (a *asnDB) lookup(ip net.IP) (uint, string) {
+	record, err := a.db.ASN(ip)
+	if err != nil {
+		return 0, ""
+	}
+	return record.AutonomousSystemNumber, record.AutonomousSystemOrganization
+}
+
+// close closes the database
+func (a *asnDB) close() {
+	a.db.Close()
+}
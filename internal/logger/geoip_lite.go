@@ -0,0 +1,42 @@
+//go:build lite
+
+package logger
+
+import (
+	"errors"
+	"net"
+)
+
+// geoIP is a stub: lite builds do not include GeoIP support
+type geoIP struct{}
+
+func openGeoIP(string) (*geoIP, error) {
+	return nil, errors.New("GeoIP is not available in lite builds")
+}
+
+func (g *geoIP) location(net.IP) string {
+	return "Unknown location"
+}
+
+func (g *geoIP) country(net.IP) string {
+	return ""
+}
+
+func (g *geoIP) place(net.IP) Place {
+	return Place{}
+}
+
+func (g *geoIP) close() {}
+
+// asnDB is a stub: lite builds do not include ASN support
+type asnDB struct{}
+
+func openASN(string) (*asnDB, error) {
+	return nil, errors.New("ASN lookups are not available in lite builds")
+}
+
+func (a *asnDB) lookup(net.IP) (uint, string) {
+	return 0, ""
+}
+
+func (a *asnDB) close() {}
@@ -0,0 +1,107 @@
+package logger
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// levels applies level changes to a logger and every logger derived from it.
+// A temporary level reverts to the base level when it expires.
+type levels struct {
+	mu      sync.Mutex
+	base    logrus.Level
+	until   time.Time
+	timer   *time.Timer
+	loggers []*logrus.Logger
+}
+
+// LevelStatus describes the current log level
+type LevelStatus struct {
+	Level string     `json:"level"`
+	Base  string     `json:"base"`            // Level restored when a temporary level expires
+	Until *time.Time `json:"until,omitempty"` // Set while the level is temporary
+}
+
+// add makes logger follow level changes
+func (lv *levels) add(logger *logrus.Logger) {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	lv.loggers = append(lv.loggers, logger)
+}
+
+// set changes the level of every logger; the caller holds lv.mu
+func (lv *levels) set(level logrus.Level) {
+	for _, logger := range lv.loggers {
+		logger.SetLevel(level)
+	}
+}
+
+// SwitchLevel switches this logger and those derived from it to level.
+// With a positive duration the change is temporary and the base level comes
+// back afterwards; otherwise level becomes the new base level.
+func (l *Logger) SwitchLevel(level logrus.Level, duration time.Duration) {
+	lv := l.levels
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+
+	if lv.timer != nil {
+		lv.timer.Stop()
+		lv.timer = nil
+	}
+	lv.until = time.Time{}
+	lv.set(level)
+
+	if duration <= 0 {
+		lv.base = level
+		return
+	}
+
+	lv.until = time.Now().Add(duration)
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		lv.mu.Lock()
+		defer lv.mu.Unlock()
+		if lv.timer != timer {
+			return
+		}
+		lv.timer = nil
+		lv.until = time.Time{}
+		lv.set(lv.base)
+		lv.loggers[0].Infof("Log level restored to %s", lv.base)
+	})
+	lv.timer = timer
+}
+
+// ToggleDebug switches to debug logging for duration, or back to the base
+// level when a temporary level is active, and returns the new level
+func (l *Logger) ToggleDebug(duration time.Duration) logrus.Level {
+	lv := l.levels
+	lv.mu.Lock()
+	temporary, base := !lv.until.IsZero(), lv.base
+	lv.mu.Unlock()
+
+	if temporary {
+		l.SwitchLevel(base, 0)
+		return base
+	}
+	l.SwitchLevel(logrus.DebugLevel, duration)
+	return logrus.DebugLevel
+}
+
+// LevelStatus reports the current and base log levels
+func (l *Logger) LevelStatus() LevelStatus {
+	lv := l.levels
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	status := LevelStatus{
+		Level: l.GetLevel().String(),
+		Base:  lv.base.String(),
+	}
+	if !lv.until.IsZero() {
+		until := lv.until
+		status.Until = &until
+	}
+	return status
+}
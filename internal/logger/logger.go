@@ -2,75 +2,233 @@ package logger
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/oschwald/geoip2-golang"
 	"github.com/sirupsen/logrus"
 )
 
 // Logger wraps logrus with additional functionality
 type Logger struct {
 	*logrus.Logger
-	geoipDB *geoip2.Reader
+	json   bool
+	dbs    *databases
+	levels *levels
+	file   *os.File    // set on loggers created by OpenFile
+	syslog *syslogHook // set on the logger created by NewLogger
+}
+
+// databases holds the GeoIP readers, shared by a logger and those derived from it
+type databases struct {
+	geoip atomic.Pointer[geoIP]
+	asn   atomic.Pointer[asnDB]
+}
+
+// Options controls optional logger features
+type Options struct {
+	DisableGeoIP bool           // Skip loading the GeoIP database (lite mode)
+	LogDir       string         // Directory for log files; empty logs to stdout only
+	GeoIPDir     string         // Extra directory searched for GeoIP databases
+	Output       io.Writer      // Destination when not logging to a file (default stdout)
+	JSON         bool           // Write JSON lines instead of text
+	Level        string         // "debug", "info" (default), "warn" or "error"
+	Syslog       *SyslogOptions // Also send logs to syslog (optional)
 }
 
 // NewLogger creates a new logger instance
-func NewLogger() *Logger {
+func NewLogger(opts Options) *Logger {
 	logger := logrus.New()
-	
-	// Create logs directory if it doesn't exist
-	if err := os.MkdirAll("logs", 0755); err != nil {
-		logger.Errorf("Failed to create logs directory: %v", err)
-	}
 
 	// Configure logger format
-	logger.SetFormatter(&logrus.TextFormatter{
-		FullTimestamp: true,
-		TimestampFormat: "2006-01-02 15:04:05",
-	})
+	if opts.JSON {
+		logger.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339Nano,
+			FieldMap: logrus.FieldMap{
+				logrus.FieldKeyTime:  "time",
+				logrus.FieldKeyLevel: "level",
+				logrus.FieldKeyMsg:   "msg",
+			},
+		})
+	} else {
+		logger.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp: true,
+			TimestampFormat: "2006-01-02 15:04:05",
+		})
+	}
 
 	// Set log level
-	logger.SetLevel(logrus.InfoLevel)
+	level, err := logrus.ParseLevel(opts.Level)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logger.SetLevel(level)
 
-	// Add file output
-	if file, err := os.OpenFile("logs/combined.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err == nil {
-		logger.SetOutput(file)
+	// Add file output, falling back to stdout on read-only filesystems
+	if opts.Output != nil {
+		logger.SetOutput(opts.Output)
 	} else {
-		logger.Errorf("Failed to open log file: %v", err)
+		logger.SetOutput(os.Stdout)
+	}
+	if opts.LogDir != "" {
+		if err := os.MkdirAll(opts.LogDir, 0755); err != nil {
+			logger.Warnf("Failed to create logs directory, logging to stdout: %v", err)
+		} else if file, err := os.OpenFile(filepath.Join(opts.LogDir, "combined.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666); err == nil {
+			logger.SetOutput(file)
+		} else {
+			logger.Warnf("Failed to open log file, logging to stdout: %v", err)
+		}
 	}
 
-	l := &Logger{Logger: logger}
-	l.initGeoIP()
+	l := &Logger{Logger: logger, json: opts.JSON, dbs: &databases{}, levels: &levels{base: level}}
+	l.levels.add(logger)
+	if opts.Syslog != nil {
+		l.syslog = newSyslogHook(*opts.Syslog, opts.JSON)
+		logger.AddHook(l.syslog)
+		if opts.Syslog.Only {
+			logger.SetOutput(io.Discard)
+		}
+	}
+	if !opts.DisableGeoIP {
+		l.initGeoIP(opts.GeoIPDir)
+	}
 
 	return l
 }
 
-// initGeoIP initializes the GeoIP database
-func (l *Logger) initGeoIP() {
-	// Try to find GeoLite2 database file
-	possiblePaths := []string{
-		"GeoLite2-City.mmdb",
-		"data/GeoLite2-City.mmdb",
-		"/usr/share/GeoIP/GeoLite2-City.mmdb",
-		"/opt/GeoIP/GeoLite2-City.mmdb",
+// OpenFile returns a logger with the same format and GeoIP databases writing
+// to the file at path, which is created if needed and appended to
+func (l *Logger) OpenFile(path string) (*Logger, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create log directory: %v", err)
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
 	}
 
-	for _, path := range possiblePaths {
-		if db, err := geoip2.Open(path); err == nil {
-			l.geoipDB = db
+	logger := logrus.New()
+	logger.SetFormatter(l.Formatter)
+	logger.SetLevel(l.GetLevel())
+	logger.SetOutput(file)
+	logger.ReplaceHooks(l.Hooks)
+	l.levels.add(logger)
+
+	return &Logger{Logger: logger, json: l.json, dbs: l.dbs, levels: l.levels, file: file}, nil
+}
+
+// JSON reports whether logs are written as JSON lines
+func (l *Logger) JSON() bool {
+	return l.json
+}
+
+// initGeoIP initializes the GeoIP City and ASN databases
+func (l *Logger) initGeoIP(geoipDir string) {
+	for _, path := range geoIPSearchPaths(geoipDir, "GeoLite2-City.mmdb") {
+		if db, err := openGeoIP(path); err == nil {
+			l.dbs.geoip.Store(db)
 			l.Infof("GeoIP database loaded from: %s", path)
+			break
+		}
+	}
+	if l.dbs.geoip.Load() == nil {
+		l.Warn("GeoIP database not found. Geographic location features will be disabled.")
+	}
+
+	// The ASN database is optional
+	for _, path := range geoIPSearchPaths(geoipDir, "GeoLite2-ASN.mmdb") {
+		if db, err := openASN(path); err == nil {
+			l.dbs.asn.Store(db)
+			l.Infof("ASN database loaded from: %s", path)
 			return
 		}
 	}
+}
+
+// retiredReaderDelay keeps replaced GeoIP readers open for lookups still in flight
+const retiredReaderDelay = time.Minute
+
+// ReloadGeoIP swaps in the City database at path
+func (l *Logger) ReloadGeoIP(path string) error {
+	db, err := openGeoIP(path)
+	if err != nil {
+		return err
+	}
+	if old := l.dbs.geoip.Swap(db); old != nil {
+		time.AfterFunc(retiredReaderDelay, old.close)
+	}
+	l.Infof("GeoIP database reloaded from: %s", path)
+	return nil
+}
+
+// ReloadASN swaps in the ASN database at path
+func (l *Logger) ReloadASN(path string) error {
+	db, err := openASN(path)
+	if err != nil {
+		return err
+	}
+	if old := l.dbs.asn.Swap(db); old != nil {
+		time.AfterFunc(retiredReaderDelay, old.close)
+	}
+	l.Infof("ASN database reloaded from: %s", path)
+	return nil
+}
+
+// geoIPSearchPaths returns the locations searched for a GeoLite2 database file
+func geoIPSearchPaths(geoipDir, file string) []string {
+	return []string{
+		filepath.Join(geoipDir, file),
+		file,
+		filepath.Join("data", file),
+		filepath.Join("/usr/share/GeoIP", file),
+		filepath.Join("/opt/GeoIP", file),
+	}
+}
+
+// trustedProxies holds the proxies whose forwarded headers GetClientIP believes
+var trustedProxies atomic.Pointer[[]netip.Prefix]
 
-	l.Warn("GeoIP database not found. Geographic location features will be disabled.")
+// SetTrustedProxies sets the proxies whose CF-Connecting-IP, X-Real-IP and
+// X-Forwarded-For headers are believed. Headers from other peers are ignored.
+func SetTrustedProxies(prefixes []netip.Prefix) {
+	trustedProxies.Store(&prefixes)
 }
 
-// GetClientIP extracts the client IP from the request
+// isTrustedProxy reports whether addr is a trusted proxy
+func isTrustedProxy(addr netip.Addr) bool {
+	prefixes := trustedProxies.Load()
+	if prefixes == nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range *prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetClientIP extracts the client IP from the request. Forwarded headers are
+// only used when the connection comes from a trusted proxy; unix socket peers
+// are local and always trusted.
 func GetClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if peer, err := netip.ParseAddr(host); err == nil && !isTrustedProxy(peer) {
+		return host
+	}
+
 	// Check CloudFlare header
 	if cfIP := r.Header.Get("CF-Connecting-IP"); cfIP != "" {
 		return cfIP
@@ -81,26 +239,27 @@ func GetClientIP(r *http.Request) string {
 		return realIP
 	}
 
-	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		// Take the first IP from the comma-separated list
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			return strings.TrimSpace(ips[0])
+	// Check X-Forwarded-For header. Each proxy appends the address it received
+	// the request from, so the client is the last entry that is not itself a
+	// trusted proxy; entries before it may have been made up by the client.
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		ips := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(ips) - 1; i >= 0; i-- {
+			ip := strings.TrimSpace(ips[i])
+			if addr, err := netip.ParseAddr(ip); err == nil && (i == 0 || !isTrustedProxy(addr)) {
+				return ip
+			}
 		}
 	}
 
 	// Fall back to RemoteAddr
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
 	return host
 }
 
 // GetGeolocation returns the geolocation information for an IP address
 func (l *Logger) GetGeolocation(ip string) string {
-	if l.geoipDB == nil {
+	geoip := l.dbs.geoip.Load()
+	if geoip == nil {
 		return "Unknown location (GeoIP disabled)"
 	}
 
@@ -109,40 +268,65 @@ func (l *Logger) GetGeolocation(ip string) string {
 		return "Invalid IP address"
 	}
 
-	record, err := l.geoipDB.City(netIP)
-	if err != nil {
-		return "Unknown location"
+	return geoip.location(netIP)
+}
+
+// GetCountry returns the ISO country code for an IP address, or "" when unknown
+func (l *Logger) GetCountry(ip string) string {
+	geoip := l.dbs.geoip.Load()
+	if geoip == nil {
+		return ""
 	}
 
-	var location strings.Builder
-	
-	// Add country
-	if record.Country.Names["en"] != "" {
-		location.WriteString(record.Country.Names["en"])
+	netIP := net.ParseIP(ip)
+	if netIP == nil {
+		return ""
 	}
 
-	// Add city
-	if record.City.Names["en"] != "" {
-		if location.Len() > 0 {
-			location.WriteString(" - ")
-		}
-		location.WriteString(record.City.Names["en"])
+	return geoip.country(netIP)
+}
+
+// Place is the location of an IP address; unknown fields are ""
+type Place struct {
+	Country   string // ISO country code
+	Continent string // Continent code, e.g. "EU"
+	City      string // English city name
+}
+
+// GetPlace returns the location of an IP address
+func (l *Logger) GetPlace(ip string) Place {
+	geoip := l.dbs.geoip.Load()
+	if geoip == nil {
+		return Place{}
 	}
 
-	// Add coordinates if available
-	if record.Location.Latitude != 0 || record.Location.Longitude != 0 {
-		if location.Len() > 0 {
-			location.WriteString(" ")
-		}
-		location.WriteString(fmt.Sprintf("(%.4f, %.4f)", 
-			record.Location.Latitude, record.Location.Longitude))
+	netIP := net.ParseIP(ip)
+	if netIP == nil {
+		return Place{}
+	}
+
+	return geoip.place(netIP)
+}
+
+// GetASN returns the autonomous system number and organization for an IP
+// address, or 0 when unknown
+func (l *Logger) GetASN(ip string) (uint, string) {
+	asn := l.dbs.asn.Load()
+	if asn == nil {
+		return 0, ""
 	}
 
-	if location.Len() == 0 {
-		return "Unknown location"
+	netIP := net.ParseIP(ip)
+	if netIP == nil {
+		return 0, ""
 	}
 
-	return location.String()
+	return asn.lookup(netIP)
+}
+
+// HasASN reports whether the ASN database is loaded
+func (l *Logger) HasASN() bool {
+	return l.dbs.asn.Load() != nil
 }
 
 // LogRequestFailure logs a failed request with IP and location information
@@ -181,9 +365,19 @@ func (l *Logger) LogServerStart(protocol string, port int) {
 		strings.ToUpper(protocol), strings.ToLower(protocol), port)
 }
 
-// Close closes the GeoIP database
+// Close closes the log file of a logger created by OpenFile, or else the GeoIP databases
 func (l *Logger) Close() {
-	if l.geoipDB != nil {
-		l.geoipDB.Close()
+	if l.file != nil {
+		l.file.Close()
+		return
+	}
+	if geoip := l.dbs.geoip.Swap(nil); geoip != nil {
+		geoip.close()
+	}
+	if asn := l.dbs.asn.Swap(nil); asn != nil {
+		asn.close()
+	}
+	if l.syslog != nil {
+		l.syslog.close()
 	}
 }
\ No newline at end of file
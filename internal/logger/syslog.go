@@ -0,0 +1,180 @@
+package logger
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	syslogQueueSize    = 1024
+	syslogDialTimeout  = 5 * time.Second
+	syslogWriteTimeout = 5 * time.Second
+	syslogRedialDelay  = 5 * time.Second
+)
+
+// SyslogOptions configures shipping logs to a syslog endpoint
+type SyslogOptions struct {
+	Network  string // "udp", "tcp" or "unixgram"
+	Address  string
+	Facility int    // Syslog facility code, e.g. 16 for local0
+	Tag      string // APP-NAME of every message
+	Only     bool   // Do not write logs anywhere else
+}
+
+// syslogHook formats log entries as RFC 5424 messages and sends them in the
+// background, dropping messages while the endpoint is unreachable or slow
+type syslogHook struct {
+	opts      SyslogOptions
+	formatter logrus.Formatter
+	hostname  string
+	pid       string
+
+	queue   chan []byte
+	dropped atomic.Uint64
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	conn     net.Conn
+	nextDial time.Time
+}
+
+func newSyslogHook(opts SyslogOptions, json bool) *syslogHook {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	// The syslog header carries the time and severity
+	var formatter logrus.Formatter = &logrus.TextFormatter{DisableTimestamp: true, DisableColors: true}
+	if json {
+		formatter = &logrus.JSONFormatter{DisableTimestamp: true}
+	}
+
+	h := &syslogHook{
+		opts:      opts,
+		formatter: formatter,
+		hostname:  hostname,
+		pid:       strconv.Itoa(os.Getpid()),
+		queue:     make(chan []byte, syslogQueueSize),
+		done:      make(chan struct{}),
+	}
+	h.wg.Add(1)
+	go h.run()
+	return h
+}
+
+// Levels sends every level to syslog
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire queues the entry as a syslog message
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	msg, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %s - - ",
+		h.opts.Facility*8+severity(entry.Level),
+		entry.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		h.hostname, h.opts.Tag, h.pid)
+	buf.Write(bytes.TrimRight(msg, "\n"))
+
+	select {
+	case h.queue <- buf.Bytes():
+	default:
+		h.dropped.Add(1)
+	}
+	return nil
+}
+
+// run sends queued messages until the hook is closed
+func (h *syslogHook) run() {
+	defer h.wg.Done()
+	for {
+		select {
+		case msg := <-h.queue:
+			h.send(msg)
+		case <-h.done:
+			// Flush whatever is still queued
+			for {
+				select {
+				case msg := <-h.queue:
+					h.send(msg)
+				default:
+					if h.conn != nil {
+						h.conn.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// send writes one message, reconnecting after failures
+func (h *syslogHook) send(msg []byte) {
+	if h.conn == nil {
+		if time.Now().Before(h.nextDial) {
+			h.dropped.Add(1)
+			return
+		}
+		conn, err := net.DialTimeout(h.opts.Network, h.opts.Address, syslogDialTimeout)
+		if err != nil {
+			h.nextDial = time.Now().Add(syslogRedialDelay)
+			h.dropped.Add(1)
+			fmt.Fprintf(os.Stderr, "syslog: failed to connect to %s: %v\n", h.opts.Address, err)
+			return
+		}
+		h.conn = conn
+		if dropped := h.dropped.Swap(0); dropped > 0 {
+			fmt.Fprintf(os.Stderr, "syslog: dropped %d messages\n", dropped)
+		}
+	}
+
+	// TCP uses octet-counting framing (RFC 6587); datagrams hold one message each
+	if h.opts.Network == "tcp" {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	h.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	if _, err := h.conn.Write(msg); err != nil {
+		h.conn.Close()
+		h.conn = nil
+		h.dropped.Add(1)
+	}
+}
+
+// close sends the remaining messages and closes the connection
+func (h *syslogHook) close() {
+	close(h.done)
+	h.wg.Wait()
+}
+
+// severity maps a log level to its syslog severity
+func severity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 // emerg
+	case logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3 // err
+	case logrus.WarnLevel:
+		return 4 // warning
+	case logrus.InfoLevel:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
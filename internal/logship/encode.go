@@ -0,0 +1,94 @@
+package logship
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Record fields used by the encoders
+const (
+	FieldTime   = "@timestamp"
+	FieldServer = "server"
+)
+
+// lokiPush is the body of a Loki push API request
+type lokiPush struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// encodeLoki groups records into one stream per server; each line is the
+// record as JSON
+func (s *Shipper) encodeLoki(batch []Record) (string, string, []byte, error) {
+	streams := make(map[string]*lokiStream)
+	var order []string
+	for _, record := range batch {
+		server, _ := record[FieldServer].(string)
+		stream, ok := streams[server]
+		if !ok {
+			labels := map[string]string{"job": "okaproxy", "server": server}
+			for name, value := range s.config.Labels {
+				labels[name] = value
+			}
+			stream = &lokiStream{Stream: labels}
+			streams[server] = stream
+			order = append(order, server)
+		}
+
+		line, err := json.Marshal(record)
+		if err != nil {
+			return "", "", nil, err
+		}
+		stream.Values = append(stream.Values, [2]string{
+			strconv.FormatInt(recordTime(record).UnixNano(), 10),
+			string(line),
+		})
+	}
+
+	var push lokiPush
+	for _, server := range order {
+		push.Streams = append(push.Streams, *streams[server])
+	}
+	body, err := json.Marshal(push)
+	return s.endpoint("/loki/api/v1/push"), "application/json", body, err
+}
+
+// encodeElasticsearch builds a bulk API request indexing every record
+func (s *Shipper) encodeElasticsearch(batch []Record) (string, string, []byte, error) {
+	action, err := json.Marshal(map[string]interface{}{
+		"index": map[string]string{"_index": s.config.Index},
+	})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	var body bytes.Buffer
+	for _, record := range batch {
+		doc, err := json.Marshal(record)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("failed to encode record: %v", err)
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+	return s.endpoint("/_bulk"), "application/x-ndjson", body.Bytes(), nil
+}
+
+// recordTime returns when the record was logged
+func recordTime(record Record) time.Time {
+	if ts, ok := record[FieldTime].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
@@ -0,0 +1,197 @@
+package logship
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+const (
+	pushTimeout = 10 * time.Second
+	maxAttempts = 3
+)
+
+// Record is one structured access log record
+type Record map[string]interface{}
+
+// Shipper pushes access log records to Loki or Elasticsearch in batches. It
+// never blocks requests: when the sink falls behind and the queue fills up,
+// new records are dropped and counted.
+type Shipper struct {
+	config   config.LogRemoteConfig
+	logger   *logger.Logger
+	client   *http.Client
+	interval time.Duration
+	encode   func([]Record) (string, string, []byte, error) // returns the URL, content type and body of a push
+
+	queue   chan Record
+	dropped atomic.Uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewShipper creates a shipper for the configured sink
+func NewShipper(cfg config.LogRemoteConfig, log *logger.Logger) *Shipper {
+	s := &Shipper{
+		config:   cfg,
+		logger:   log,
+		client:   &http.Client{Timeout: pushTimeout},
+		interval: time.Duration(cfg.FlushInterval) * time.Second,
+		queue:    make(chan Record, cfg.QueueSize),
+		done:     make(chan struct{}),
+	}
+	if cfg.Type == config.LogRemoteLoki {
+		s.encode = s.encodeLoki
+	} else {
+		s.encode = s.encodeElasticsearch
+	}
+	return s
+}
+
+// Send queues a record; a nil shipper discards it
+func (s *Shipper) Send(record Record) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- record:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Start pushes queued records in the background
+func (s *Shipper) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		batch := make([]Record, 0, s.config.BatchSize)
+		for {
+			select {
+			case record := <-s.queue:
+				batch = append(batch, record)
+				if len(batch) == s.config.BatchSize {
+					s.push(batch)
+					batch = batch[:0]
+				}
+			case <-ticker.C:
+				s.push(batch)
+				batch = batch[:0]
+			case <-s.done:
+				// Flush whatever is still queued
+				for {
+					select {
+					case record := <-s.queue:
+						batch = append(batch, record)
+						if len(batch) == s.config.BatchSize {
+							s.push(batch)
+							batch = batch[:0]
+						}
+					default:
+						s.push(batch)
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop pushes the remaining records and stops shipping
+func (s *Shipper) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
+
+// push sends a batch, retrying failures with a growing delay. Records keep
+// queueing meanwhile, so a slow sink leads to drops instead of unbounded memory.
+func (s *Shipper) push(batch []Record) {
+	if dropped := s.dropped.Swap(0); dropped > 0 {
+		s.logger.Warnf("Dropped %d access log records: %s sink is falling behind", dropped, s.config.Type)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	url, contentType, body, err := s.encode(batch)
+	if err != nil {
+		s.logger.Errorf("Failed to encode %d access log records: %v", len(batch), err)
+		return
+	}
+
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err = s.post(url, contentType, body)
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			break
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-s.done:
+			// Shutting down: make one final attempt without waiting
+			attempt = maxAttempts - 1
+		}
+	}
+	s.logger.Errorf("Failed to push %d access log records to %s: %v", len(batch), s.config.Type, err)
+}
+
+// post sends one request to the sink
+func (s *Shipper) post(url, contentType string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range s.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	// Elasticsearch reports per-document failures in a successful response
+	if s.config.Type == config.LogRemoteElasticsearch {
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if json.Unmarshal(respBody, &result) == nil && result.Errors {
+			return fmt.Errorf("some documents were rejected")
+		}
+	}
+	return nil
+}
+
+// endpoint joins the configured base URL and an API path
+func (s *Shipper) endpoint(path string) string {
+	return strings.TrimSuffix(s.config.URL, "/") + path
+}
@@ -0,0 +1,208 @@
+package maintenance
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/logger"
+)
+
+var (
+	// ErrUnknownServer is returned for servers that are not configured
+	ErrUnknownServer = errors.New("unknown server")
+	// ErrOverlap is returned when a window is already active for the server
+	ErrOverlap = errors.New("a maintenance window is already active")
+	// ErrNoWindow is returned when ending a window that is not active
+	ErrNoWindow = errors.New("no maintenance window is active")
+)
+
+// Window is a scheduled maintenance period for one server
+type Window struct {
+	Server  string    `json:"server"`
+	Started time.Time `json:"started"`
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason,omitempty"`
+	Actor   string    `json:"actor,omitempty"`
+}
+
+// Scheduler tracks maintenance windows opened by deploy pipelines. Each window
+// drains the server, puts it into maintenance and restores it automatically when
+// the window expires. Every transition is written to the log as an audit record.
+type Scheduler struct {
+	logger *logger.Logger
+
+	mu       sync.Mutex
+	servers  map[string]*serverState
+	inFlight map[string]*atomic.Int64
+}
+
+// serverState holds the active window of a server
+type serverState struct {
+	window *Window
+	timer  *time.Timer
+}
+
+// NewScheduler creates a scheduler for the named servers
+func NewScheduler(servers []string, log *logger.Logger) *Scheduler {
+	s := &Scheduler{
+		logger:   log,
+		servers:  make(map[string]*serverState, len(servers)),
+		inFlight: make(map[string]*atomic.Int64, len(servers)),
+	}
+	for _, name := range servers {
+		s.servers[name] = &serverState{}
+		s.inFlight[name] = &atomic.Int64{}
+	}
+	return s
+}
+
+// Begin opens a maintenance window on server for duration
+func (s *Scheduler) Begin(server string, duration time.Duration, reason, actor string) (*Window, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.servers[server]
+	if !ok {
+		return nil, ErrUnknownServer
+	}
+	if state.window != nil {
+		return state.window, ErrOverlap
+	}
+
+	now := time.Now()
+	window := &Window{
+		Server:  server,
+		Started: now,
+		Until:   now.Add(duration),
+		Reason:  reason,
+		Actor:   actor,
+	}
+	state.window = window
+	state.timer = time.AfterFunc(duration, func() {
+		s.expire(server, window)
+	})
+
+	s.audit("Maintenance window started", window, "")
+	return window, nil
+}
+
+// End closes the active window on server before it expires
+func (s *Scheduler) End(server, actor string) (*Window, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.servers[server]
+	if !ok {
+		return nil, ErrUnknownServer
+	}
+	if state.window == nil {
+		return nil, ErrNoWindow
+	}
+
+	window := state.window
+	state.timer.Stop()
+	state.window = nil
+	state.timer = nil
+
+	s.audit("Maintenance window ended", window, "cancelled by "+orUnknown(actor))
+	return window, nil
+}
+
+// Active reports whether server is inside a maintenance window
+func (s *Scheduler) Active(server string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.servers[server]
+	return ok && state.window != nil
+}
+
+// Window returns the active window of server, or nil
+func (s *Scheduler) Window(server string) (*Window, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.servers[server]
+	if !ok {
+		return nil, ErrUnknownServer
+	}
+	return state.window, nil
+}
+
+// InFlight returns the counter of proxied requests still being served by
+// server, so pipelines can wait for the drain to finish. Nil-safe.
+func (s *Scheduler) InFlight(server string) *atomic.Int64 {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inFlight[server]
+}
+
+// Add starts tracking a server added by a configuration reload
+func (s *Scheduler) Add(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.servers[server]; !ok {
+		s.servers[server] = &serverState{}
+		s.inFlight[server] = &atomic.Int64{}
+	}
+}
+
+// Stop cancels pending restores without auditing them
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, state := range s.servers {
+		if state.timer != nil {
+			state.timer.Stop()
+		}
+	}
+}
+
+// expire restores server when its window runs out
+func (s *Scheduler) expire(server string, window *Window) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A newer window may have replaced this one in the meantime
+	state := s.servers[server]
+	if state.window != window {
+		return
+	}
+	state.window = nil
+	state.timer = nil
+
+	s.audit("Maintenance window ended", window, "expired")
+}
+
+// audit logs a window transition
+func (s *Scheduler) audit(message string, window *Window, cause string) {
+	fields := map[string]interface{}{
+		"server": window.Server,
+		"until":  window.Until.Format(time.RFC3339),
+		"reason": window.Reason,
+		"actor":  orUnknown(window.Actor),
+	}
+	if cause != "" {
+		fields["cause"] = cause
+	}
+	s.logger.WithFields(fields).Warn(message)
+}
+
+func orUnknown(actor string) string {
+	if actor == "" {
+		return "unknown"
+	}
+	return actor
+}
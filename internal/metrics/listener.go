@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerMetrics tracks network-level activity of a single listener
+type ListenerMetrics struct {
+	Name string
+
+	accepted            atomic.Uint64
+	closedBeforeRequest atomic.Uint64
+	handshakes          atomic.Uint64
+	handshakeFailures   atomic.Uint64
+	oversizedHeaders    atomic.Uint64
+	slowClients         atomic.Uint64
+	connLimitRejected   atomic.Uint64
+
+	acceptRate         *rateWindow
+	handshakeDurations *durationSamples
+}
+
+// ListenerSnapshot is a point-in-time copy of listener metrics
+type ListenerSnapshot struct {
+	Name                string  `json:"name"`
+	Accepted            uint64  `json:"accepted"`
+	AcceptRate          float64 `json:"accept_rate_per_sec"`
+	ClosedBeforeRequest uint64  `json:"closed_before_request"`
+	Handshakes          uint64  `json:"tls_handshakes"`
+	HandshakeFailures   uint64  `json:"tls_handshake_failures"`
+	OversizedHeaders    uint64  `json:"oversized_headers"`
+	SlowClients         uint64  `json:"slow_clients_dropped"`
+	ConnLimitRejected   uint64  `json:"conns_per_ip_rejected"`
+	HandshakeP50Ms      float64 `json:"tls_handshake_p50_ms"`
+	HandshakeP90Ms      float64 `json:"tls_handshake_p90_ms"`
+	HandshakeP99Ms      float64 `json:"tls_handshake_p99_ms"`
+}
+
+// NewListenerMetrics creates metrics for the named listener
+func NewListenerMetrics(name string) *ListenerMetrics {
+	return &ListenerMetrics{
+		Name:               name,
+		acceptRate:         newRateWindow(60),
+		handshakeDurations: newDurationSamples(1024),
+	}
+}
+
+// ConnAccepted records an accepted connection
+func (lm *ListenerMetrics) ConnAccepted() {
+	lm.accepted.Add(1)
+	lm.acceptRate.add(time.Now())
+}
+
+// ConnClosedBeforeRequest records a connection that closed without sending a request
+func (lm *ListenerMetrics) ConnClosedBeforeRequest() {
+	lm.closedBeforeRequest.Add(1)
+}
+
+// HandshakeCompleted records a successful TLS handshake
+func (lm *ListenerMetrics) HandshakeCompleted(d time.Duration) {
+	lm.handshakes.Add(1)
+	lm.handshakeDurations.add(d)
+}
+
+// HandshakeFailed records a failed TLS handshake
+func (lm *ListenerMetrics) HandshakeFailed() {
+	lm.handshakeFailures.Add(1)
+}
+
+// OversizedHeaders records a connection closed for sending too large request headers
+func (lm *ListenerMetrics) OversizedHeaders() {
+	lm.oversizedHeaders.Add(1)
+}
+
+// SlowClientDropped records a connection closed for sending a request too slowly
+func (lm *ListenerMetrics) SlowClientDropped() {
+	lm.slowClients.Add(1)
+}
+
+// ConnLimitRejected records a connection refused because its address had too
+// many open connections
+func (lm *ListenerMetrics) ConnLimitRejected() {
+	lm.connLimitRejected.Add(1)
+}
+
+// Snapshot returns the current metric values
+func (lm *ListenerMetrics) Snapshot() ListenerSnapshot {
+	p := lm.handshakeDurations.percentiles(0.5, 0.9, 0.99)
+	return ListenerSnapshot{
+		Name:                lm.Name,
+		Accepted:            lm.accepted.Load(),
+		AcceptRate:          lm.acceptRate.perSecond(time.Now()),
+		ClosedBeforeRequest: lm.closedBeforeRequest.Load(),
+		Handshakes:          lm.handshakes.Load(),
+		HandshakeFailures:   lm.handshakeFailures.Load(),
+		OversizedHeaders:    lm.oversizedHeaders.Load(),
+		SlowClients:         lm.slowClients.Load(),
+		ConnLimitRejected:   lm.connLimitRejected.Load(),
+		HandshakeP50Ms:      milliseconds(p[0]),
+		HandshakeP90Ms:      milliseconds(p[1]),
+		HandshakeP99Ms:      milliseconds(p[2]),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// rateWindow counts events in one-second buckets over a sliding window
+type rateWindow struct {
+	mu      sync.Mutex
+	buckets []uint64
+	seconds []int64
+}
+
+func newRateWindow(size int) *rateWindow {
+	return &rateWindow{
+		buckets: make([]uint64, size),
+		seconds: make([]int64, size),
+	}
+}
+
+func (rw *rateWindow) add(now time.Time) {
+	sec := now.Unix()
+	i := int(sec % int64(len(rw.buckets)))
+
+	rw.mu.Lock()
+	if rw.seconds[i] != sec {
+		rw.seconds[i] = sec
+		rw.buckets[i] = 0
+	}
+	rw.buckets[i]++
+	rw.mu.Unlock()
+}
+
+// perSecond returns the average rate over the window
+func (rw *rateWindow) perSecond(now time.Time) float64 {
+	oldest := now.Unix() - int64(len(rw.buckets))
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	var total uint64
+	for i, sec := range rw.seconds {
+		if sec > oldest {
+			total += rw.buckets[i]
+		}
+	}
+	return float64(total) / float64(len(rw.buckets))
+}
+
+// durationSamples keeps the most recent durations for percentile estimates
+type durationSamples struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newDurationSamples(size int) *durationSamples {
+	return &durationSamples{samples: make([]time.Duration, size)}
+}
+
+func (ds *durationSamples) add(d time.Duration) {
+	ds.mu.Lock()
+	ds.samples[ds.next] = d
+	ds.next++
+	if ds.next == len(ds.samples) {
+		ds.next = 0
+		ds.full = true
+	}
+	ds.mu.Unlock()
+}
+
+// percentiles returns the requested quantiles (0..1) of the recorded samples
+func (ds *durationSamples) percentiles(qs ...float64) []time.Duration {
+	ds.mu.Lock()
+	n := ds.next
+	if ds.full {
+		n = len(ds.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, ds.samples[:n])
+	ds.mu.Unlock()
+
+	result := make([]time.Duration, len(qs))
+	if n == 0 {
+		return result
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, q := range qs {
+		result[i] = sorted[int(q*float64(n-1))]
+	}
+	return result
+}
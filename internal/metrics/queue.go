@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// QueueMetrics tracks the requests a server's concurrency limit admits,
+// queues and sheds
+type QueueMetrics struct {
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	admitted atomic.Uint64
+	waited   atomic.Uint64
+	shed     atomic.Uint64
+
+	waits *durationSamples
+}
+
+// QueueSnapshot is a point-in-time copy of queue metrics
+type QueueSnapshot struct {
+	InFlight  int64   `json:"in_flight"`
+	Queued    int64   `json:"queued"`
+	Admitted  uint64  `json:"admitted"`
+	Waited    uint64  `json:"admitted_after_wait"`
+	Shed      uint64  `json:"shed"`
+	WaitP50Ms float64 `json:"wait_p50_ms"`
+	WaitP99Ms float64 `json:"wait_p99_ms"`
+}
+
+// NewQueueMetrics creates empty queue metrics
+func NewQueueMetrics() *QueueMetrics {
+	return &QueueMetrics{waits: newDurationSamples(1024)}
+}
+
+// Enqueued records a request starting to wait for a slot
+func (qm *QueueMetrics) Enqueued() {
+	qm.queued.Add(1)
+}
+
+// Dequeued records a request done waiting, admitted or not
+func (qm *QueueMetrics) Dequeued() {
+	qm.queued.Add(-1)
+}
+
+// Admitted records a request taking a slot after waiting for wait
+func (qm *QueueMetrics) Admitted(wait time.Duration) {
+	qm.inFlight.Add(1)
+	qm.admitted.Add(1)
+	if wait > 0 {
+		qm.waited.Add(1)
+		qm.waits.add(wait)
+	}
+}
+
+// Released records a request freeing its slot
+func (qm *QueueMetrics) Released() {
+	qm.inFlight.Add(-1)
+}
+
+// Shed records a request rejected because no slot freed up in time
+func (qm *QueueMetrics) Shed() {
+	qm.shed.Add(1)
+}
+
+// Snapshot returns the current metric values
+func (qm *QueueMetrics) Snapshot() QueueSnapshot {
+	p := qm.waits.percentiles(0.5, 0.99)
+	return QueueSnapshot{
+		InFlight:  qm.inFlight.Load(),
+		Queued:    qm.queued.Load(),
+		Admitted:  qm.admitted.Load(),
+		Waited:    qm.waited.Load(),
+		Shed:      qm.shed.Load(),
+		WaitP50Ms: milliseconds(p[0]),
+		WaitP99Ms: milliseconds(p[1]),
+	}
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// processStart approximates when the process started
+var processStart = time.Now()
+
+// ProcessStart returns when the process started
+func ProcessStart() time.Time {
+	return processStart
+}
+
+// Uptime returns how long the process has been running
+func Uptime() time.Duration {
+	return time.Since(processStart)
+}
+
+// RequestCounters counts the requests a server answered, by outcome
+type RequestCounters struct {
+	requests     atomic.Uint64
+	clientErrors atomic.Uint64
+	serverErrors atomic.Uint64
+}
+
+// RequestSnapshot is a point-in-time copy of request counters
+type RequestSnapshot struct {
+	Requests     uint64 `json:"requests"`
+	ClientErrors uint64 `json:"client_errors"` // 4xx responses
+	ServerErrors uint64 `json:"server_errors"` // 5xx responses
+}
+
+// NewRequestCounters creates empty request counters
+func NewRequestCounters() *RequestCounters {
+	return &RequestCounters{}
+}
+
+// Observe records a request answered with status
+func (rc *RequestCounters) Observe(status int) {
+	rc.requests.Add(1)
+	switch {
+	case status >= 500:
+		rc.serverErrors.Add(1)
+	case status >= 400:
+		rc.clientErrors.Add(1)
+	}
+}
+
+// Snapshot returns the current counter values
+func (rc *RequestCounters) Snapshot() RequestSnapshot {
+	return RequestSnapshot{
+		Requests:     rc.requests.Load(),
+		ClientErrors: rc.clientErrors.Load(),
+		ServerErrors: rc.serverErrors.Load(),
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ResponseMetrics tracks the response times and status codes of an upstream
+type ResponseMetrics struct {
+	durations *durationSamples
+
+	mu       sync.Mutex
+	statuses map[int]uint64
+}
+
+// ResponseSnapshot is a point-in-time copy of response metrics
+type ResponseSnapshot struct {
+	P50Ms    float64           `json:"p50_ms"`
+	P90Ms    float64           `json:"p90_ms"`
+	P99Ms    float64           `json:"p99_ms"`
+	Statuses map[string]uint64 `json:"statuses"` // By status code; "error" counts transport errors
+}
+
+// NewResponseMetrics creates empty response metrics
+func NewResponseMetrics() *ResponseMetrics {
+	return &ResponseMetrics{
+		durations: newDurationSamples(1024),
+		statuses:  make(map[int]uint64),
+	}
+}
+
+// Observe records a response with status that took d; status 0 is a
+// transport error
+func (rm *ResponseMetrics) Observe(status int, d time.Duration) {
+	rm.durations.add(d)
+	rm.mu.Lock()
+	rm.statuses[status]++
+	rm.mu.Unlock()
+}
+
+// Snapshot returns the current metric values
+func (rm *ResponseMetrics) Snapshot() ResponseSnapshot {
+	p := rm.durations.percentiles(0.5, 0.9, 0.99)
+	snapshot := ResponseSnapshot{
+		P50Ms:    milliseconds(p[0]),
+		P90Ms:    milliseconds(p[1]),
+		P99Ms:    milliseconds(p[2]),
+		Statuses: make(map[string]uint64),
+	}
+
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	for status, count := range rm.statuses {
+		key := strconv.Itoa(status)
+		if status == 0 {
+			key = "error"
+		}
+		snapshot.Statuses[key] = count
+	}
+	return snapshot
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/accesslog"
+	"okaproxy/internal/logger"
+)
+
+// UpstreamTimeKey is the context key holding the upstream round trip duration
+const UpstreamTimeKey = "UpstreamTime"
+
+// accessLogLine renders a custom access log format for a finished request
+func accessLogLine(lg *logger.Logger, format *accesslog.Format, server string, c *gin.Context, start time.Time, latency time.Duration) string {
+	clientIP := logger.GetClientIP(c.Request)
+
+	var place *logger.Place
+	lookupPlace := func() logger.Place {
+		if place == nil {
+			p := lg.GetPlace(clientIP)
+			place = &p
+		}
+		return *place
+	}
+
+	return format.Render(func(variable string) string {
+		switch variable {
+		case "remote_addr":
+			return clientIP
+		case "remote_port":
+			_, port, _ := net.SplitHostPort(c.Request.RemoteAddr)
+			return port
+		case "time_local":
+			return start.Format("02/Jan/2006:15:04:05 -0700")
+		case "time_iso8601":
+			return start.Format(time.RFC3339)
+		case "msec":
+			return fmt.Sprintf("%.3f", float64(start.UnixMilli())/1000)
+		case "request":
+			return c.Request.Method + " " + c.Request.RequestURI + " " + c.Request.Proto
+		case "request_method":
+			return c.Request.Method
+		case "request_uri":
+			return c.Request.RequestURI
+		case "uri":
+			return c.Request.URL.Path
+		case "args", "query_string":
+			return c.Request.URL.RawQuery
+		case "server_protocol":
+			return c.Request.Proto
+		case "host":
+			return c.Request.Host
+		case "server_name":
+			return server
+		case "status":
+			return strconv.Itoa(c.Writer.Status())
+		case "body_bytes_sent":
+			return strconv.Itoa(max(c.Writer.Size(), 0))
+		case "request_time":
+			return fmt.Sprintf("%.3f", latency.Seconds())
+		case "upstream_time", "upstream_response_time":
+			if d, ok := c.Get(UpstreamTimeKey); ok {
+				return fmt.Sprintf("%.3f", d.(time.Duration).Seconds())
+			}
+			return ""
+		case "request_id":
+			return c.GetString("RequestID")
+		case "geo_country":
+			return lookupPlace().Country
+		case "geo_city":
+			return lookupPlace().City
+		case "asn":
+			if asn, _ := lg.GetASN(clientIP); asn != 0 {
+				return strconv.FormatUint(uint64(asn), 10)
+			}
+			return ""
+		}
+
+		// $http_<name> reads a request header, underscores standing for dashes
+		if name, ok := strings.CutPrefix(variable, "http_"); ok {
+			return c.Request.Header.Get(strings.ReplaceAll(name, "_", "-"))
+		}
+		return ""
+	})
+}
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+)
+
+// ACLMiddleware rejects clients outside the server's access control lists with
+// the forbidden page. Deny entries win over allow entries; an empty allow list
+// admits everyone not denied. Like the bypass list, only the connecting address
+// is matched.
+func ACLMiddleware(log *logger.Logger, allow, deny []netip.Prefix, page *pages.Page) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr, ok := remoteAddr(c.Request.RemoteAddr)
+		if ok && aclPermits(addr, allow, deny) {
+			c.Next()
+			return
+		}
+
+		log.WithFields(map[string]interface{}{
+			"ip":     addr.String(),
+			"method": c.Request.Method,
+			"path":   c.Request.URL.Path,
+		}).Info("Request rejected by access control list")
+
+		page.Write(c.Writer, c.Request, http.StatusForbidden)
+		c.Abort()
+	}
+}
+
+// aclPermits reports whether addr passes the allow and deny lists
+func aclPermits(addr netip.Addr, allow, deny []netip.Prefix) bool {
+	for _, prefix := range deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, prefix := range allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// InternalOnly hides a built-in endpoint from clients outside allow, answering
+// them with a 404 as if it did not exist. Only the connecting address is matched.
+func InternalOnly(allow []netip.Prefix) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if addr, ok := remoteAddr(c.Request.RemoteAddr); ok && aclPermits(addr, allow, nil) {
+			c.Next()
+			return
+		}
+		c.String(http.StatusNotFound, "404 page not found")
+		c.Abort()
+	}
+}
@@ -0,0 +1,190 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/store"
+)
+
+// anomalyChallengeKey marks requests from clients whose score requires the
+// verification challenge
+const anomalyChallengeKey = "anomaly_challenge"
+
+// Signals later stages leave on the request for anomaly scoring
+const (
+	rateLimitedKey = "rate_limited"
+	wafFlaggedKey  = "waf_flagged"
+)
+
+// suspiciousAgents are User-Agent substrings of security scanners and HTTP
+// libraries, lowercase
+var suspiciousAgents = []string{
+	"sqlmap", "nikto", "nmap", "masscan", "zgrab", "nuclei", "gobuster", "dirbuster", "ffuf", "wpscan",
+	"python-requests", "python-urllib", "aiohttp", "go-http-client", "curl/", "wget/", "libwww-perl",
+	"java/", "okhttp", "scrapy", "httpclient",
+}
+
+// AnomalyMiddleware scores clients by what their requests set off and
+// escalates as the score grows: clients at the challenge score must pass the
+// verification challenge, those at the tarpit score have their requests
+// delayed, and those reaching the ban score are banned through bans, which
+// may be nil when bans are not enabled.
+func AnomalyMiddleware(log *logger.Logger, serverConfig *config.ServerConfig, st store.Store, bans *BanManager, keyFunc RateLimitKeyFunc) gin.HandlerFunc {
+	cfg := serverConfig.Anomaly
+	scores := &anomalyScores{store: st, fallback: store.NewMemoryStore(), logger: log}
+	window := time.Duration(cfg.Window) * time.Second
+	delay := time.Duration(cfg.TarpitDelay) * time.Second
+
+	return func(c *gin.Context) {
+		if isBypassed(c) {
+			c.Next()
+			return
+		}
+
+		client := keyFunc(c)
+		key := "oka_anomaly:" + serverConfig.Name + ":" + client
+		score := scores.get(key)
+		if reaches(score, cfg.Tarpit) {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-c.Request.Context().Done():
+				timer.Stop()
+				c.Abort()
+				return
+			}
+		}
+		if reaches(score, cfg.Challenge) {
+			c.Set(anomalyChallengeKey, true)
+		}
+
+		c.Next()
+
+		// Verified crawlers often follow stale links
+		if isVerifiedBot(c) {
+			return
+		}
+		points := 0
+		signals := []string{}
+		add := func(signal string, set bool, score int) {
+			if set && score > 0 {
+				points += score
+				signals = append(signals, signal)
+			}
+		}
+		add("suspicious_agent", isSuspiciousAgent(c.Request.UserAgent()), cfg.Scores.SuspiciousAgent)
+		add("rate_limited", c.GetBool(rateLimitedKey), cfg.Scores.RateLimited)
+		add("waf", c.GetBool(wafFlaggedKey), cfg.Scores.WAF)
+		add("not_found", c.Writer.Status() == http.StatusNotFound, cfg.Scores.NotFound)
+		if points == 0 {
+			return
+		}
+
+		total := scores.add(key, int64(points), window)
+		fields := map[string]interface{}{
+			"client":  client,
+			"ip":      logger.GetClientIP(c.Request),
+			"score":   total,
+			"signals": signals,
+		}
+		previous := total - int64(points)
+		switch {
+		case crosses(previous, total, cfg.Ban) && bans != nil:
+			scores.delete(key)
+			fields["reason"] = "anomaly score"
+			bans.Ban(banKey(c, client), fields)
+		case crosses(previous, total, cfg.Tarpit):
+			log.WithFields(fields).Warn("Client tarpitted for anomalous requests")
+		case crosses(previous, total, cfg.Challenge):
+			log.WithFields(fields).Info("Client challenged for anomalous requests")
+		}
+	}
+}
+
+// anomalyScores keeps scores in the state store, or in memory while it is
+// unreachable
+type anomalyScores struct {
+	store    store.Store
+	fallback store.Store
+	logger   *logger.Logger
+}
+
+// get returns the score at key, or 0 when there is none
+func (as *anomalyScores) get(key string) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	value, err := as.store.Get(ctx, key)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		as.logger.Debugf("Anomaly score lookup failed: %v", err)
+		value, err = as.fallback.Get(ctx, key)
+	}
+	if err != nil {
+		return 0
+	}
+	score, _ := strconv.ParseInt(value, 10, 64)
+	return score
+}
+
+// add adds points to the score at key and returns the new score
+func (as *anomalyScores) add(key string, points int64, window time.Duration) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	total, _, err := as.store.IncrBy(ctx, key, points, window)
+	if err != nil {
+		as.logger.Debugf("Failed to record anomaly score in %s: %v", as.store.Name(), err)
+		total, _, _ = as.fallback.IncrBy(ctx, key, points, window)
+	}
+	return total
+}
+
+// delete clears the score at key
+func (as *anomalyScores) delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	as.fallback.Delete(ctx, key)
+	as.store.Delete(ctx, key)
+}
+
+// reaches reports whether score is at an escalation step; steps of -1 are
+// skipped
+func reaches(score int64, step int) bool {
+	return step > 0 && score >= int64(step)
+}
+
+// crosses reports whether a score going from previous to total reached step
+func crosses(previous, total int64, step int) bool {
+	return reaches(total, step) && !reaches(previous, step)
+}
+
+// isSuspiciousAgent reports whether a User-Agent is missing or belongs to a
+// scanner or HTTP library
+func isSuspiciousAgent(userAgent string) bool {
+	if strings.TrimSpace(userAgent) == "" {
+		return true
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, agent := range suspiciousAgents {
+		if strings.Contains(userAgent, agent) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAnomalyChallenged reports whether the request's client must pass the
+// challenge for its anomaly score
+func isAnomalyChallenged(c *gin.Context) bool {
+	return c.GetBool(anomalyChallengeKey)
+}
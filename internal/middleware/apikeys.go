@@ -0,0 +1,336 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/store"
+)
+
+// apiKeyPrefix namespaces API keys created through the admin API in the store
+const apiKeyPrefix = "apikey:"
+
+// API key sources reported in usage
+const (
+	APIKeySourceConfig = "config"
+	APIKeySourceStore  = "store"
+)
+
+// ErrAPIKeyExists is returned when creating a key under a name already in use
+var ErrAPIKeyExists = errors.New("an API key of that name already exists")
+
+// StoredAPIKey is a key created through the admin API. The store holds it
+// under a hash of the key, which is only shown once.
+type StoredAPIKey struct {
+	Name    string    `json:"name"`
+	Rate    int       `json:"rate"`
+	Created time.Time `json:"created"`
+}
+
+// KeyUsage counts the requests made with a key since the process started
+type KeyUsage struct {
+	Name     string     `json:"name"`
+	Source   string     `json:"source"`
+	Rate     int        `json:"rate"` // Requests per minute (0 = unlimited)
+	Requests uint64     `json:"requests"`
+	Limited  uint64     `json:"limited"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+}
+
+// usageKey identifies a key of a server
+type usageKey struct {
+	server, name string
+}
+
+// bucketKey identifies the buckets of a server's keys sharing a rate
+type bucketKey struct {
+	server string
+	rate   int
+}
+
+// APIKeys checks API keys and keeps their rate limits and usage counters,
+// which outlive configuration reloads
+type APIKeys struct {
+	store  store.Store
+	logger *logger.Logger
+
+	mu      sync.Mutex
+	usage   map[usageKey]*KeyUsage
+	buckets map[bucketKey]*bucketSet
+}
+
+// NewAPIKeys creates an API key checker reading created keys from st
+func NewAPIKeys(st store.Store, log *logger.Logger) *APIKeys {
+	return &APIKeys{
+		store:   st,
+		logger:  log,
+		usage:   make(map[usageKey]*KeyUsage),
+		buckets: make(map[bucketKey]*bucketSet),
+	}
+}
+
+// hashAPIKey returns the hex SHA-256 keys are looked up by
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// storedKey returns the store key of a created API key
+func storedKey(server, hash string) string {
+	return apiKeyPrefix + server + ":" + hash
+}
+
+// Middleware rejects requests to the server's protected paths without a
+// valid key, and requests over the key's rate limit. Built-in endpoints need
+// no key.
+func (ak *APIKeys) Middleware(serverConfig *config.ServerConfig) gin.HandlerFunc {
+	cfg := serverConfig.APIKeys
+	listed := make(map[string]config.APIKey, len(cfg.Keys))
+	for _, key := range cfg.Keys {
+		listed[hashAPIKey(key.Key)] = key
+	}
+
+	return func(c *gin.Context) {
+		if c.FullPath() != "" || !cfg.Protects(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		key := c.Request.Header.Get(cfg.Header)
+		if key == "" && cfg.Query != "" {
+			key = c.Query(cfg.Query)
+		}
+		if key == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "API key required"})
+			c.Abort()
+			return
+		}
+
+		hash := hashAPIKey(key)
+		name, rate := "", 0
+		if listedKey, ok := listed[hash]; ok {
+			name, rate = listedKey.Name, listedKey.Rate
+		} else if cfg.Store {
+			stored, err := ak.lookup(serverConfig.Name, hash)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				ak.logger.Warnf("Failed to look up API key: %v", err)
+				c.JSON(http.StatusServiceUnavailable, gin.H{"message": "API key could not be checked, please try again later."})
+				c.Abort()
+				return
+			}
+			if stored != nil {
+				name, rate = stored.Name, stored.Rate
+			}
+		}
+		if name == "" {
+			ak.logger.WithFields(map[string]interface{}{
+				"ip":   logger.GetClientIP(c.Request),
+				"path": c.Request.URL.Path,
+			}).Info("Request with invalid API key")
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Invalid API key"})
+			c.Abort()
+			return
+		}
+
+		result := ak.count(serverConfig.Name, name, cfg.KeyRate(rate))
+		if result != nil && !result.allowed {
+			abortRateLimited(c, result)
+			return
+		}
+		if result != nil {
+			setRateLimitHeaders(c, result)
+		}
+		c.Set(authenticatedKey, true)
+		c.Next()
+	}
+}
+
+// lookup returns the created key with the given hash
+func (ak *APIKeys) lookup(server, hash string) (*StoredAPIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+
+	value, err := ak.store.Get(ctx, storedKey(server, hash))
+	if err != nil {
+		return nil, err
+	}
+	var stored StoredAPIKey
+	if err := json.Unmarshal([]byte(value), &stored); err != nil {
+		return nil, err
+	}
+	return &stored, nil
+}
+
+// count records a request made with a key and takes it from the key's
+// bucket, returning nil when the key is unlimited
+func (ak *APIKeys) count(server, name string, rate int) *limitResult {
+	ak.mu.Lock()
+	usage, ok := ak.usage[usageKey{server, name}]
+	if !ok {
+		usage = &KeyUsage{Name: name}
+		ak.usage[usageKey{server, name}] = usage
+	}
+	now := clock.Now()
+	usage.Requests++
+	usage.LastUsed = &now
+
+	var buckets *bucketSet
+	if rate > 0 {
+		buckets, ok = ak.buckets[bucketKey{server, rate}]
+		if !ok {
+			buckets = newBucketSet(rate, 60)
+			ak.buckets[bucketKey{server, rate}] = buckets
+		}
+	}
+	ak.mu.Unlock()
+
+	if buckets == nil {
+		return nil
+	}
+	result := buckets.take(name, 1)
+	if !result.allowed {
+		ak.mu.Lock()
+		usage.Limited++
+		ak.mu.Unlock()
+	}
+	return result
+}
+
+// Usage returns the keys of a server with their counters, including keys not
+// used yet
+func (ak *APIKeys) Usage(serverConfig *config.ServerConfig) ([]KeyUsage, error) {
+	cfg := serverConfig.APIKeys
+	keys := make(map[string]KeyUsage)
+	for _, key := range cfg.Keys {
+		keys[key.Name] = KeyUsage{Name: key.Name, Source: APIKeySourceConfig, Rate: cfg.KeyRate(key.Rate)}
+	}
+	if cfg.Store {
+		stored, err := ak.stored(serverConfig.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range stored {
+			keys[key.Name] = KeyUsage{Name: key.Name, Source: APIKeySourceStore, Rate: cfg.KeyRate(key.Rate)}
+		}
+	}
+
+	ak.mu.Lock()
+	for name, key := range keys {
+		if usage, ok := ak.usage[usageKey{serverConfig.Name, name}]; ok {
+			key.Requests = usage.Requests
+			key.Limited = usage.Limited
+			key.LastUsed = usage.LastUsed
+			keys[name] = key
+		}
+	}
+	ak.mu.Unlock()
+
+	usage := make([]KeyUsage, 0, len(keys))
+	for _, key := range keys {
+		usage = append(usage, key)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Name < usage[j].Name })
+	return usage, nil
+}
+
+// stored returns the keys of a server created through the admin API, by
+// store key
+func (ak *APIKeys) stored(server string) (map[string]StoredAPIKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+
+	prefix := storedKey(server, "")
+	keys, err := ak.store.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]StoredAPIKey)
+	for _, key := range keys {
+		// Servers whose names extend this one's past a colon share the prefix
+		if strings.Contains(key[len(prefix):], ":") {
+			continue
+		}
+		value, err := ak.store.Get(ctx, key)
+		if errors.Is(err, store.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var apiKey StoredAPIKey
+		if json.Unmarshal([]byte(value), &apiKey) == nil {
+			stored[key] = apiKey
+		}
+	}
+	return stored, nil
+}
+
+// Create generates a key for a server and returns it. Only its hash is kept,
+// so it cannot be shown again.
+func (ak *APIKeys) Create(serverConfig *config.ServerConfig, name string, rate int) (string, error) {
+	for _, key := range serverConfig.APIKeys.Keys {
+		if key.Name == name {
+			return "", ErrAPIKeyExists
+		}
+	}
+	stored, err := ak.stored(serverConfig.Name)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range stored {
+		if key.Name == name {
+			return "", ErrAPIKeyExists
+		}
+	}
+
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	key := "oka_" + hex.EncodeToString(random)
+
+	value, _ := json.Marshal(StoredAPIKey{Name: name, Rate: rate, Created: clock.Now()})
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+	if err := ak.store.Set(ctx, storedKey(serverConfig.Name, hashAPIKey(key)), string(value), 0); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// Delete removes a server's created key by name, reporting whether it existed
+func (ak *APIKeys) Delete(server, name string) (bool, error) {
+	stored, err := ak.stored(server)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+	for key, apiKey := range stored {
+		if apiKey.Name == name {
+			if err := ak.store.Delete(ctx, key); err != nil {
+				return false, err
+			}
+			ak.mu.Lock()
+			delete(ak.usage, usageKey{server, name})
+			ak.mu.Unlock()
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+	"okaproxy/internal/store"
+)
+
+// ASNMiddleware blocks clients from listed autonomous systems and makes every
+// address of a limited autonomous system share one rate limit, kept in st.
+// Allowlisted clients are not checked.
+func ASNMiddleware(log *logger.Logger, server string, asnConfig config.ASNConfig, page *pages.Page, st store.Store) gin.HandlerFunc {
+	blocked := asnSet(asnConfig.Block)
+	limited := asnSet(asnConfig.Limit)
+	window := time.Duration(asnConfig.LimitWindow) * time.Second
+
+	return func(c *gin.Context) {
+		if isBypassed(c) {
+			c.Next()
+			return
+		}
+
+		clientIP := logger.GetClientIP(c.Request)
+		asn, org := log.GetASN(clientIP)
+		if asn == 0 {
+			c.Next()
+			return
+		}
+
+		if blocked[asn] {
+			log.WithFields(map[string]interface{}{
+				"ip":     clientIP,
+				"asn":    asn,
+				"org":    org,
+				"method": c.Request.Method,
+				"path":   c.Request.URL.Path,
+			}).Info("Request blocked by ASN")
+
+			page.Write(c.Writer, c.Request, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+
+		if limited[asn] {
+			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+			count, ttl, err := st.Incr(ctx, "oka_asn:"+server+":"+strconv.FormatUint(uint64(asn), 10), window)
+			cancel()
+			if err != nil {
+				// Fail open; per-client limits still apply
+				log.Debugf("ASN rate limit unavailable: %v", err)
+			} else if count > int64(asnConfig.LimitCount) {
+				log.LogRateLimit(c.Request)
+				abortRateLimited(c, &limitResult{
+					limit:      asnConfig.LimitCount,
+					reset:      ttl,
+					retryAfter: ttl,
+				})
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// asnSet builds a lookup table of autonomous system numbers
+func asnSet(asns []uint) map[uint]bool {
+	set := make(map[uint]bool, len(asns))
+	for _, asn := range asns {
+		set[asn] = true
+	}
+	return set
+}
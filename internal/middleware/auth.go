@@ -5,32 +5,43 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/hex"
+	"fmt"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	
+	"okaproxy/internal/accesslog"
+	"okaproxy/internal/clock"
 	"okaproxy/internal/config"
 	"okaproxy/internal/logger"
+	"okaproxy/internal/logship"
+	"okaproxy/internal/pages"
 )
 
 const (
 	ValidationTokenCookie     = "oka_validation_token"
 	ValidationExpirationCookie = "oka_validation_expiration"
+
+	// RequestIDHeader carries the request correlation ID to clients and backends
+	RequestIDHeader = "X-Request-ID"
 )
 
 // AuthMiddleware provides authentication and verification functionality
 type AuthMiddleware struct {
 	logger           *logger.Logger
-	verificationPage string
+	verificationPage *pages.Page
+	sessions         *SessionStore // nil unless verifications are recorded
 }
 
-// NewAuthMiddleware creates a new authentication middleware
-func NewAuthMiddleware(logger *logger.Logger, verificationPage string) *AuthMiddleware {
+// NewAuthMiddleware creates a new authentication middleware; sessions may be nil
+func NewAuthMiddleware(logger *logger.Logger, verificationPage *pages.Page, sessions *SessionStore) *AuthMiddleware {
 	return &AuthMiddleware{
 		logger:           logger,
 		verificationPage: verificationPage,
+		sessions:         sessions,
 	}
 }
 
@@ -55,9 +66,69 @@ func (am *AuthMiddleware) verifyToken(data, token, secretKey string) bool {
 	return subtle.ConstantTimeCompare(expectedBytes, tokenBytes) == 1
 }
 
+// validationData returns what a verification token signs: its expiration and,
+// when configured, the client's address or prefix and a hash of its User-Agent,
+// so harvested cookies do not work from other machines
+func validationData(expiration string, r *http.Request, serverConfig *config.ServerConfig) string {
+	data := expiration
+	challenge := serverConfig.Challenge
+	if challenge.Bind != config.ChallengeBindNone && challenge.Bind != "" {
+		data += "|" + clientPrefix(logger.GetClientIP(r), challenge.Bind == config.ChallengeBindPrefix)
+	}
+	if challenge.BindsUserAgent() {
+		sum := sha256.Sum256([]byte(r.UserAgent()))
+		data += "|" + hex.EncodeToString(sum[:8])
+	}
+	return data
+}
+
+// clientPrefix returns the client address, or its /24 (IPv4) or /48 (IPv6)
+// network when wide is set so clients moving within a network stay verified
+func clientPrefix(ip string, wide bool) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || !wide {
+		return ip
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
 // CheckVerification creates a middleware that checks for valid verification cookies
 func (am *AuthMiddleware) CheckVerification(serverConfig *config.ServerConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Allowlisted clients, verified crawlers and preflights routed to the
+		// backend (which carry no cookies) pass
+		if isBypassed(c) || isVerifiedBot(c) || isForwardedPreflight(c) {
+			c.Next()
+			return
+		}
+
+		// Exempt paths such as webhooks, and clients that cannot run the challenge
+		// page unless their anomaly score or under attack mode requires it
+		if serverConfig.SkipsVerification(c.Request.URL.Path) ||
+			(serverConfig.AuthSkipNonBrowser && !acceptsHTML(c.Request) && !isAnomalyChallenged(c) && !isUnderAttack(c)) {
+			c.Next()
+			return
+		}
+
+		// The challenge script and its answers come from clients not yet verified
+		if c.Request.URL.Path == ChallengeScriptPath {
+			serveChallengeScript(c)
+			return
+		}
+		if serverConfig.Challenge.ProofOfWork() && c.Request.URL.Path == ChallengeVerifyPath && c.Request.Method == http.MethodPost {
+			am.verifyChallenge(c, serverConfig)
+			return
+		}
+
 		// Get validation cookies
 		validationToken, err := c.Cookie(ValidationTokenCookie)
 		if err != nil || validationToken == "" {
@@ -79,13 +150,30 @@ func (am *AuthMiddleware) CheckVerification(serverConfig *config.ServerConfig) g
 		}
 		
 		// Check if token has expired
-		if time.Now().UnixMilli() > validationExpiration {
+		if clock.Now().UnixMilli() > validationExpiration {
+			am.clearCookiesAndShowVerification(c, serverConfig)
+			return
+		}
+
+		// Challenged clients may not keep a longer-lived token
+		if (isGeoChallenged(c) || isAnomalyChallenged(c)) && validationExpiration > clock.Now().UnixMilli()+int64(am.lifetime(c, serverConfig)*1000) {
 			am.clearCookiesAndShowVerification(c, serverConfig)
 			return
 		}
 		
 		// Verify token
-		if !am.verifyToken(validationExpirationStr, validationToken, serverConfig.SecretKey) {
+		session, _ := c.Cookie(VerificationSessionCookie)
+		data := validationData(validationExpirationStr, c.Request, serverConfig)
+		if am.recordsSessions(serverConfig) {
+			data += "|" + session
+		}
+		if !am.verifyToken(data, validationToken, serverConfig.SecretKey) {
+			am.clearCookiesAndShowVerification(c, serverConfig)
+			return
+		}
+
+		// Revoked sessions verify again
+		if am.recordsSessions(serverConfig) && !am.sessions.valid(serverConfig.Name, session) {
 			am.clearCookiesAndShowVerification(c, serverConfig)
 			return
 		}
@@ -95,20 +183,41 @@ func (am *AuthMiddleware) CheckVerification(serverConfig *config.ServerConfig) g
 	}
 }
 
-// showVerificationPage displays the verification page and sets new cookies
+// showVerificationPage displays the verification page with new cookies, or
+// with a challenge whose solution earns them
 func (am *AuthMiddleware) showVerificationPage(c *gin.Context, serverConfig *config.ServerConfig) {
+	if serverConfig.Challenge.ProofOfWork() {
+		am.issueChallenge(c, serverConfig)
+	} else {
+		am.setValidationCookies(c, serverConfig)
+	}
+
+	// Show verification page
+	am.verificationPage.Write(c.Writer, c.Request, http.StatusOK)
+	c.Abort()
+}
+
+// setValidationCookies issues the cookies that pass verification
+func (am *AuthMiddleware) setValidationCookies(c *gin.Context, serverConfig *config.ServerConfig) {
 	// Generate new expiration time
-	newExpirationTime := time.Now().UnixMilli() + int64(serverConfig.Expired*1000)
+	lifetime := am.lifetime(c, serverConfig)
+	newExpirationTime := clock.Now().UnixMilli() + int64(lifetime*1000)
 	newExpirationStr := strconv.FormatInt(newExpirationTime, 10)
 	
-	// Generate new token
-	newToken := am.encryptToken(newExpirationStr, serverConfig.SecretKey)
+	// Generate new token, signing the session it is recorded under
+	data := validationData(newExpirationStr, c.Request, serverConfig)
+	if am.recordsSessions(serverConfig) {
+		session := am.sessions.create(serverConfig.Name, logger.GetClientIP(c.Request), time.Duration(lifetime)*time.Second)
+		c.SetCookie(VerificationSessionCookie, session, lifetime, "/", "", false, true)
+		data += "|" + session
+	}
+	newToken := am.encryptToken(data, serverConfig.SecretKey)
 	
 	// Set cookies
 	c.SetCookie(
 		ValidationTokenCookie,
 		newToken,
-		serverConfig.Expired,
+		lifetime,
 		"/",
 		"",
 		false, // secure (set to true in HTTPS)
@@ -118,17 +227,47 @@ func (am *AuthMiddleware) showVerificationPage(c *gin.Context, serverConfig *con
 	c.SetCookie(
 		ValidationExpirationCookie,
 		newExpirationStr,
-		serverConfig.Expired,
+		lifetime,
 		"/",
 		"",
 		false, // secure (set to true in HTTPS)
 		true,  // httpOnly
 	)
-	
-	// Show verification page
-	c.Header("Content-Type", "text/html; charset=utf-8")
-	c.String(http.StatusOK, am.verificationPage)
-	c.Abort()
+}
+
+// recordsSessions reports whether verifications on the server are recorded
+func (am *AuthMiddleware) recordsSessions(serverConfig *config.ServerConfig) bool {
+	return am.sessions != nil && serverConfig.Challenge.Sessions
+}
+
+// lifetime returns the verification lifetime in seconds for the request
+func (am *AuthMiddleware) lifetime(c *gin.Context, serverConfig *config.ServerConfig) int {
+	lifetime := serverConfig.Expired
+	if isGeoChallenged(c) && serverConfig.GeoBlock.ChallengeExpired < lifetime {
+		lifetime = serverConfig.GeoBlock.ChallengeExpired
+	}
+	if isAnomalyChallenged(c) && serverConfig.Anomaly.ChallengeExpired < lifetime {
+		lifetime = serverConfig.Anomaly.ChallengeExpired
+	}
+	return lifetime
+}
+
+// NewVerificationCookies returns cookies that pass verification on serverConfig
+// for the client sending r, recording a session in sessions when enabled
+func NewVerificationCookies(serverConfig *config.ServerConfig, r *http.Request, sessions *SessionStore) []*http.Cookie {
+	expiration := strconv.FormatInt(clock.Now().UnixMilli()+int64(serverConfig.Expired*1000), 10)
+	data := validationData(expiration, r, serverConfig)
+	var cookies []*http.Cookie
+	if sessions != nil && serverConfig.Challenge.Sessions {
+		session := sessions.create(serverConfig.Name, logger.GetClientIP(r), time.Duration(serverConfig.Expired)*time.Second)
+		cookies = append(cookies, &http.Cookie{Name: VerificationSessionCookie, Value: session})
+		data += "|" + session
+	}
+	token := (&AuthMiddleware{}).encryptToken(data, serverConfig.SecretKey)
+	return append(cookies,
+		&http.Cookie{Name: ValidationTokenCookie, Value: token},
+		&http.Cookie{Name: ValidationExpirationCookie, Value: expiration},
+	)
 }
 
 // clearCookiesAndShowVerification clears invalid cookies and shows verification page
@@ -136,68 +275,48 @@ func (am *AuthMiddleware) clearCookiesAndShowVerification(c *gin.Context, server
 	// Clear invalid cookies
 	c.SetCookie(ValidationTokenCookie, "", -1, "/", "", false, true)
 	c.SetCookie(ValidationExpirationCookie, "", -1, "/", "", false, true)
+	if am.recordsSessions(serverConfig) {
+		c.SetCookie(VerificationSessionCookie, "", -1, "/", "", false, true)
+	}
 	
 	// Show verification page with new cookies
 	am.showVerificationPage(c, serverConfig)
 }
 
-// SecurityHeadersMiddleware adds security headers
-func SecurityHeadersMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Header("X-Content-Type-Options", "nosniff")
-		c.Header("X-Frame-Options", "DENY")
-		c.Header("X-XSS-Protection", "1; mode=block")
-		c.Header("Referrer-Policy", "strict-origin-when-cross-origin")
-		
-		// Don't add HSTS header for HTTP connections
-		if c.Request.TLS != nil {
-			c.Header("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
-		}
-		
-		c.Next()
-	}
-}
+// SecurityHeadersMiddleware adds the server's security headers
+func SecurityHeadersMiddleware(cfg config.SecurityHeadersConfig) gin.HandlerFunc {
+	headers := cfg.Values()
+	hsts := cfg.HSTSValue()
 
-// CORSMiddleware adds CORS headers
-func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		origin := c.Request.Header.Get("Origin")
-		c.Header("Access-Control-Allow-Origin", origin)
-		c.Header("Access-Control-Allow-Credentials", "true")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Header("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		for _, header := range headers {
+			c.Header(header[0], header[1])
+		}
 		
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
-			return
+		// Don't add HSTS header for HTTP connections
+		if c.Request.TLS != nil && hsts != "" {
+			c.Header("Strict-Transport-Security", hsts)
 		}
 		
 		c.Next()
 	}
 }
 
-// CompressionMiddleware enables gzip compression (Gin has built-in gzip middleware)
-func CompressionMiddleware() gin.HandlerFunc {
-	return gin.Recovery() // Placeholder, use gin's gzip middleware in actual implementation
-}
-
-// RequestIDMiddleware adds a unique request ID to each request
+// RequestIDMiddleware adds a unique request ID to each request and propagates it upstream
 func RequestIDMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		requestID := generateRequestID()
-		c.Header("X-Request-ID", requestID)
+		c.Request.Header.Set(RequestIDHeader, requestID)
+		c.Header(RequestIDHeader, requestID)
 		c.Set("RequestID", requestID)
 		c.Next()
 	}
 }
 
-// generateRequestID generates a simple request ID
-func generateRequestID() string {
-	return strconv.FormatInt(time.Now().UnixNano(), 36)
-}
-
-// LoggerMiddleware creates a custom logger middleware
-func LoggerMiddleware(lg *logger.Logger) gin.HandlerFunc {
+// LoggerMiddleware creates a custom logger middleware. A non-nil format
+// replaces the standard fields with a rendered access log line. Records are
+// also sent to shipper when it is not nil.
+func LoggerMiddleware(lg *logger.Logger, format *accesslog.Format, server string, shipper *logship.Shipper) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Start timer
 		startTime := time.Now()
@@ -213,15 +332,70 @@ func LoggerMiddleware(lg *logger.Logger) gin.HandlerFunc {
 		method := c.Request.Method
 		path := c.Request.URL.Path
 		statusCode := c.Writer.Status()
+
+		// Remote sinks always receive the structured record
+		if shipper != nil {
+			record := logship.Record(accessLogFields(lg, c, latency))
+			record[logship.FieldTime] = startTime.Format(time.RFC3339Nano)
+			record[logship.FieldServer] = server
+			shipper.Send(record)
+		}
 		
+		// Custom formats replace the field set
+		if format != nil {
+			lg.Info(accessLogLine(lg, format, server, c, startTime, latency))
+			return
+		}
+
+		// JSON logs use stable, typed field names
+		if lg.JSON() {
+			lg.WithFields(accessLogFields(lg, c, latency)).Info("Request processed")
+			return
+		}
+
 		// Log the request
-		lg.WithFields(map[string]interface{}{
+		fields := map[string]interface{}{
 			"ip":       clientIP,
 			"method":   method,
 			"path":     path,
 			"status":   statusCode,
 			"latency":  latency,
 			"location": lg.GetGeolocation(clientIP),
-		}).Info("Request processed")
+		}
+		if lg.HasASN() {
+			if asn, org := lg.GetASN(clientIP); asn != 0 {
+				fields["asn"] = fmt.Sprintf("AS%d %s", asn, org)
+			}
+		}
+		lg.WithFields(fields).Info("Request processed")
+	}
+}
+
+// accessLogFields builds the JSON access log record of a finished request
+func accessLogFields(lg *logger.Logger, c *gin.Context, latency time.Duration) map[string]interface{} {
+	clientIP := logger.GetClientIP(c.Request)
+	fields := map[string]interface{}{
+		"type":       "access",
+		"client_ip":  clientIP,
+		"method":     c.Request.Method,
+		"host":       c.Request.Host,
+		"path":       c.Request.URL.Path,
+		"query":      c.Request.URL.RawQuery,
+		"protocol":   c.Request.Proto,
+		"status":     c.Writer.Status(),
+		"bytes_out":  max(c.Writer.Size(), 0),
+		"latency_ms": float64(latency) / float64(time.Millisecond),
+		"user_agent": c.Request.UserAgent(),
+		"referer":    c.Request.Referer(),
+		"request_id": c.GetString("RequestID"),
 	}
-}
\ No newline at end of file
+
+	place := lg.GetPlace(clientIP)
+	fields["country"] = place.Country
+	fields["city"] = place.City
+	if asn, org := lg.GetASN(clientIP); asn != 0 {
+		fields["asn"] = asn
+		fields["asn_org"] = org
+	}
+	return fields
+}
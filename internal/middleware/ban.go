@@ -0,0 +1,255 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/store"
+)
+
+// banContextKey carries the ban manager and client key to the rate limiter
+const banContextKey = "ban"
+
+// BanManager turns repeated rate limit violations into temporary bans
+type BanManager struct {
+	store    store.Store
+	fallback store.Store // used while store is unreachable
+	logger   *logger.Logger
+	config   config.BanConfig
+	window   time.Duration
+	duration time.Duration
+
+	// Bans issued by this instance, for the admin API
+	mu     sync.Mutex
+	issued map[string]time.Time
+}
+
+// Ban is an active ban issued by this instance
+type Ban struct {
+	Key   string    `json:"key"`
+	Until time.Time `json:"until"`
+}
+
+// banContext is stored on the request so violations can be attributed
+type banContext struct {
+	manager *BanManager
+	key     string
+}
+
+// NewBanManager creates a ban manager keeping its state in st
+func NewBanManager(logger *logger.Logger, cfg config.BanConfig, st store.Store) *BanManager {
+	return &BanManager{
+		store:    st,
+		fallback: store.NewMemoryStore(),
+		logger:   logger,
+		config:   cfg,
+		window:   time.Duration(cfg.Window) * time.Second,
+		duration: time.Duration(cfg.Duration) * time.Second,
+		issued:   make(map[string]time.Time),
+	}
+}
+
+// BanMiddleware rejects banned clients before any other work is done
+func (bm *BanManager) BanMiddleware(keyFunc RateLimitKeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isBypassed(c) {
+			c.Next()
+			return
+		}
+
+		key := keyFunc(c)
+		remaining, banned := bm.banned(key)
+		// Connection-level violations (oversized headers, slow clients) ban the
+		// connecting address
+		if !banned && (bm.config.OversizedHeaders || bm.config.SlowClients) {
+			if addr, ok := remoteAddr(c.Request.RemoteAddr); ok {
+				remaining, banned = bm.banned(addrBanKey(addr))
+			}
+		}
+		if banned {
+			abortBanned(c, remaining)
+			return
+		}
+
+		c.Set(banContextKey, &banContext{manager: bm, key: key})
+		c.Next()
+	}
+}
+
+// abortBanned rejects a request from a client banned for remaining
+func abortBanned(c *gin.Context, remaining time.Duration) {
+	retryAfter := ceilSeconds(remaining)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Set(bannedKey, true)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusForbidden, gin.H{
+		"message":     "Temporarily banned after repeated violations.",
+		"retry_after": retryAfter,
+	})
+	c.Abort()
+}
+
+// banned reports whether key is banned and for how long
+func (bm *BanManager) banned(key string) (time.Duration, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	value, err := bm.store.Get(ctx, "oka_ban:"+key)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		bm.logger.Debugf("Ban lookup failed: %v", err)
+		value, err = bm.fallback.Get(ctx, "oka_ban:"+key)
+	}
+	if err != nil {
+		return 0, false
+	}
+
+	until, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return bm.duration, true
+	}
+	return clock.Until(time.Unix(until, 0)), true
+}
+
+// recordViolation counts a rate limit violation and bans the client at the threshold
+func (bm *BanManager) recordViolation(c *gin.Context, key string) {
+	bm.violation(key, map[string]interface{}{
+		"client": key,
+		"ip":     logger.GetClientIP(c.Request),
+	})
+}
+
+// RecordAddrViolation counts a connection-level violation, such as oversized
+// request headers, against the connecting address
+func (bm *BanManager) RecordAddrViolation(addr netip.Addr, reason string) {
+	bm.violation(addrBanKey(addr), map[string]interface{}{
+		"ip":     addr.String(),
+		"reason": reason,
+	})
+}
+
+// violation counts a violation of key and bans it at the threshold
+func (bm *BanManager) violation(key string, fields map[string]interface{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	st := bm.store
+	violations, _, err := st.Incr(ctx, "oka_ban_violations:"+key, bm.window)
+	if err != nil {
+		bm.logger.Debugf("Failed to record violation in %s: %v", st.Name(), err)
+		st = bm.fallback
+		violations, _, _ = st.Incr(ctx, "oka_ban_violations:"+key, bm.window)
+	}
+	if violations < int64(bm.config.Threshold) {
+		return
+	}
+
+	fields["violations"] = violations
+	if err := bm.ban(ctx, st, key, fields); err != nil {
+		bm.logger.Errorf("Failed to ban client %s: %v", key, err)
+	}
+}
+
+// Ban bans key for the configured duration, as when escalating a client's
+// anomaly score, and returns how long the ban lasts
+func (bm *BanManager) Ban(key string, fields map[string]interface{}) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := bm.ban(ctx, bm.store, key, fields); err != nil {
+		bm.logger.Debugf("Failed to record ban in %s: %v", bm.store.Name(), err)
+		bm.ban(ctx, bm.fallback, key, fields)
+	}
+	return bm.duration
+}
+
+// ban records a ban of key in st and clears its violations
+func (bm *BanManager) ban(ctx context.Context, st store.Store, key string, fields map[string]interface{}) error {
+	until := clock.Now().Add(bm.duration)
+	if err := st.Set(ctx, "oka_ban:"+key, strconv.FormatInt(until.Unix(), 10), bm.duration); err != nil {
+		return err
+	}
+	st.Delete(ctx, "oka_ban_violations:"+key)
+
+	bm.mu.Lock()
+	bm.issued[key] = until
+	bm.mu.Unlock()
+
+	fields["duration"] = bm.duration.String()
+	bm.logger.WithFields(fields).Warn("Client temporarily banned")
+	return nil
+}
+
+// Bans lists the active bans issued by this instance, soonest expiry first.
+// Bans issued by other instances sharing the store are not listed.
+func (bm *BanManager) Bans() []Ban {
+	now := clock.Now()
+	bm.mu.Lock()
+	bans := make([]Ban, 0, len(bm.issued))
+	for key, until := range bm.issued {
+		if !until.After(now) {
+			delete(bm.issued, key)
+			continue
+		}
+		bans = append(bans, Ban{Key: key, Until: until})
+	}
+	bm.mu.Unlock()
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+// Unban lifts the ban of key and clears its violations
+func (bm *BanManager) Unban(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	bm.mu.Lock()
+	delete(bm.issued, key)
+	bm.mu.Unlock()
+
+	bm.fallback.Delete(ctx, "oka_ban:"+key)
+	bm.fallback.Delete(ctx, "oka_ban_violations:"+key)
+	bm.store.Delete(ctx, "oka_ban_violations:"+key)
+	if err := bm.store.Delete(ctx, "oka_ban:"+key); err != nil {
+		// Bans made while the store was unreachable live in the fallback
+		bm.logger.Debugf("Failed to delete ban from %s: %v", bm.store.Name(), err)
+	}
+}
+
+// addrBanKey keys connection-level violations by connecting address
+func addrBanKey(addr netip.Addr) string {
+	return "addr:" + addr.String()
+}
+
+// banKey returns the key the ban stage checked for the request, which differs
+// from the later rate limit key when an identity stage accepted a header or
+// cookie credential in between
+func banKey(c *gin.Context, fallback string) string {
+	if value, ok := c.Get(banContextKey); ok {
+		return value.(*banContext).key
+	}
+	return fallback
+}
+
+// recordViolation attributes a rate limit violation to the request's client
+func recordViolation(c *gin.Context) {
+	if value, ok := c.Get(banContextKey); ok {
+		bc := value.(*banContext)
+		bc.manager.recordViolation(c, bc.key)
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// basicAuthCacheTTL bounds how long a checked password skips bcrypt
+const basicAuthCacheTTL = 5 * time.Minute
+
+// basicAuthCacheSize caps the remembered credentials before the cache is reset
+const basicAuthCacheSize = 1024
+
+// unknownUserHash is compared against for unknown users, so they take as long
+// to reject as wrong passwords
+const unknownUserHash = "$2a$10$6py6NEUDzCEKLifSS0p46eZVBj5NzfSLl5Cphd1Ij/SGYY9HN7OAa"
+
+// BasicAuthMiddleware asks for a user name and password on the protected
+// paths before anything else is done with the request. Built-in endpoints are
+// not protected. The Authorization header is not forwarded to the target.
+func BasicAuthMiddleware(log *logger.Logger, cfg config.BasicAuthConfig, credentials map[string]string) gin.HandlerFunc {
+	challenge := `Basic realm="` + cfg.Realm + `", charset="UTF-8"`
+	checked := &credentialCache{entries: make(map[[sha256.Size]byte]time.Time)}
+
+	return func(c *gin.Context) {
+		if c.FullPath() != "" || !cfg.Protects(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		user, password, ok := c.Request.BasicAuth()
+		if ok && checked.valid(c.Request.Header.Get("Authorization"), func() bool {
+			return checkPassword(credentials, user, password)
+		}) {
+			c.Request.Header.Del("Authorization")
+			c.Set(authenticatedKey, true)
+			c.Next()
+			return
+		}
+
+		if ok {
+			log.WithFields(map[string]interface{}{
+				"ip":   logger.GetClientIP(c.Request),
+				"user": user,
+				"path": c.Request.URL.Path,
+			}).Info("Basic authentication failed")
+			// Password guessing counts toward a ban like rate limit violations
+			recordViolation(c)
+		}
+
+		c.Header("WWW-Authenticate", challenge)
+		c.String(http.StatusUnauthorized, "Authentication required")
+		c.Abort()
+	}
+}
+
+// checkPassword reports whether password matches the user's hash
+func checkPassword(credentials map[string]string, user, password string) bool {
+	hash, known := credentials[user]
+	if !known {
+		hash = unknownUserHash
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	return known && err == nil
+}
+
+// credentialCache remembers Authorization headers that passed, since bcrypt is
+// deliberately slow and browsers send the header with every request
+type credentialCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]time.Time
+}
+
+// valid reports whether header passed recently, or else whether check passes
+func (cc *credentialCache) valid(header string, check func() bool) bool {
+	key := sha256.Sum256([]byte(header))
+	now := clock.Now()
+
+	cc.mu.Lock()
+	expires, found := cc.entries[key]
+	cc.mu.Unlock()
+	if found && now.Before(expires) {
+		return true
+	}
+
+	if !check() {
+		return false
+	}
+
+	cc.mu.Lock()
+	if len(cc.entries) >= basicAuthCacheSize {
+		clear(cc.entries)
+	}
+	cc.entries[key] = now.Add(basicAuthCacheTTL)
+	cc.mu.Unlock()
+	return true
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bypassKey marks requests from allowlisted clients
+const bypassKey = "bypass"
+
+// BypassMiddleware marks requests whose connecting address is allowlisted, so
+// verification and rate limiting let them through. Forwarding headers are not
+// consulted because clients can set them freely.
+func BypassMiddleware(prefixes []netip.Prefix) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if addr, ok := remoteAddr(c.Request.RemoteAddr); ok {
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr) {
+					c.Set(bypassKey, true)
+					break
+				}
+			}
+		}
+		c.Next()
+	}
+}
+
+// isBypassed reports whether the request comes from an allowlisted client
+func isBypassed(c *gin.Context) bool {
+	return c.GetBool(bypassKey)
+}
+
+// remoteAddr parses the IP of a host:port remote address
+func remoteAddr(hostport string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
@@ -0,0 +1,750 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/store"
+)
+
+// cacheKeyPrefix prefixes response cache keys in the state store
+const cacheKeyPrefix = "oka_cache:"
+
+// MethodPurge is the HTTP method dropping a URL from the cache
+const MethodPurge = "PURGE"
+
+// authenticatedKey marks requests an identity stage (basic auth, OIDC,
+// forward auth or API keys) let through; their responses are per user
+const authenticatedKey = "authenticated"
+
+// cacheableStatus lists the statuses whose responses are cached
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusMovedPermanently:     true,
+	http.StatusNotFound:             true,
+	http.StatusGone:                 true,
+}
+
+// uncachedHeaders are never stored with a response: they describe the
+// connection or a single request
+var uncachedHeaders = []string{"Age", "Connection", "Date", "Keep-Alive", "Pragma", "Transfer-Encoding", RequestIDHeader}
+
+// cachedResponse is a response kept in the cache. For responses that vary by
+// request headers, the entry at the request's key only lists those headers
+// and each variant is stored under its own key.
+type cachedResponse struct {
+	Status int         `json:"status,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+	Body   []byte      `json:"body,omitempty"`
+	Stored time.Time   `json:"stored"`
+	Age    int         `json:"age,omitempty"`  // Seconds the response had already been cached upstream
+	Vary   []string    `json:"vary,omitempty"` // Request headers the variants differ by
+
+	Fresh                time.Time `json:"fresh,omitempty"` // When the response expires
+	StaleWhileRevalidate int       `json:"swr,omitempty"`   // Seconds it is served after expiring while refreshed
+	StaleIfError         int       `json:"sie,omitempty"`   // Seconds it replaces upstream errors after expiring
+}
+
+// staleFor reports whether an expired response is within seconds of expiring
+func (cr *cachedResponse) staleFor(seconds int, now time.Time) bool {
+	return now.Before(cr.Fresh.Add(time.Duration(seconds) * time.Second))
+}
+
+// size approximates the memory used by the response
+func (cr *cachedResponse) size() int {
+	size := len(cr.Body)
+	for name, values := range cr.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return size
+}
+
+// cacheBackend keeps cached responses
+type cacheBackend interface {
+	get(key string) (*cachedResponse, bool)
+	set(key string, resp *cachedResponse, ttl time.Duration)
+	delete(key string)
+	keys(prefix string) []string
+}
+
+// ResponseCache stores proxied GET responses and serves them to later requests
+type ResponseCache struct {
+	backend    cacheBackend
+	refreshing sync.Map // Keys of expired responses being refreshed
+}
+
+// NewResponseCache creates a cache kept in st, or in memory when st is nil.
+// With the disk tier enabled, large responses are kept on disk instead.
+func NewResponseCache(st store.Store, cfg config.CacheConfig, log *logger.Logger) *ResponseCache {
+	var backend cacheBackend = newMemoryCache(cfg.MemorySize)
+	if st != nil {
+		backend = &storeCache{store: st, logger: log}
+	}
+	if cfg.Disk.Enabled {
+		if disk, err := newDiskCache(cfg.Disk.Dir, cfg.Disk.MaxSize, log); err != nil {
+			log.Errorf("Failed to open disk cache: %v. Large responses are cached with the others.", err)
+		} else {
+			backend = &tieredCache{primary: backend, disk: disk, minSize: cfg.Disk.MinSize}
+		}
+	}
+	return &ResponseCache{backend: backend}
+}
+
+// Middleware serves cached responses of a server and caches the responses of
+// misses. Responses are only stored when the target allows shared caching:
+// no Set-Cookie, no private, no-store or no-cache directive, and no Vary: *.
+// Authenticated requests skip the cache, and requests with cookies only share
+// responses marked public or with an s-maxage. Clients asking for a fresh copy
+// with no-cache or max-age=0 skip the cache.
+// Expired responses are served while they are refreshed, and in place of
+// upstream errors, for as long as their stale windows allow.
+func (rc *ResponseCache) Middleware(server string, cfg config.ServerCacheConfig) gin.HandlerFunc {
+	purgeFrom, _ := cfg.PurgePrefixes()
+	return func(c *gin.Context) {
+		req := c.Request
+		if req.Method == MethodPurge && len(purgeFrom) > 0 {
+			rc.purgeRequest(c, server, purgeFrom)
+			return
+		}
+		if (req.Method != http.MethodGet && req.Method != http.MethodHead) ||
+			!cfg.CachesPath(req.URL.Path) || req.Header.Get("Authorization") != "" || req.Header.Get("Upgrade") != "" ||
+			isAuthenticated(c) {
+			c.Next()
+			return
+		}
+		withCookies := req.Header.Get("Cookie") != ""
+
+		key := cacheKeyPrefix + server + ":" + req.Host + req.URL.RequestURI()
+		var stale *cachedResponse
+		if !wantsFresh(req.Header) {
+			if cached, ok := rc.lookup(key, req.Header); ok && (!withCookies || sharedWithCookies(cached.Header)) {
+				now := clock.Now()
+				switch {
+				case cached.Fresh.IsZero() || now.Before(cached.Fresh):
+					serveCached(c, cached, "HIT")
+					c.Abort()
+					return
+				case cached.staleFor(cached.StaleWhileRevalidate, now):
+					rc.serveStale(c, key, cached, cfg)
+					c.Abort()
+					return
+				case cached.staleFor(cached.StaleIfError, now):
+					stale = cached
+				}
+			}
+		}
+
+		c.Header("X-Cache", "MISS")
+		cacheable := req.Method == http.MethodGet && !hasDirective(req.Header, "no-store")
+		if !cacheable && stale == nil {
+			c.Next()
+			return
+		}
+
+		cw := newCacheWriter(c.Writer, c.Writer.Header(), cfg.MaxSize)
+		cw.hideErrors = stale != nil
+		c.Writer = cw
+		c.Next()
+		c.Writer = cw.ResponseWriter
+
+		if cw.failed {
+			serveCached(c, stale, "STALE")
+			return
+		}
+		if cacheable {
+			if resp, ttl, ok := cw.response(cfg); ok && (!withCookies || sharedWithCookies(resp.Header)) {
+				rc.save(key, req.Header, resp, ttl)
+			}
+		}
+	}
+}
+
+// sharedWithCookies reports whether a response may be shared with requests
+// carrying cookies, which may personalize it: the target must mark it public
+// or give it an s-maxage
+func sharedWithCookies(header http.Header) bool {
+	return hasDirective(header, "public", "s-maxage")
+}
+
+// isAuthenticated reports whether an identity stage let the request through
+func isAuthenticated(c *gin.Context) bool {
+	return c.GetBool(authenticatedKey)
+}
+
+// serveStale sends an expired response, then refreshes it unless another
+// request already is. The refresh outlives the client so it completes even
+// when the client disconnects.
+func (rc *ResponseCache) serveStale(c *gin.Context, key string, cached *cachedResponse, cfg config.ServerCacheConfig) {
+	before := c.Writer.Header().Clone()
+	serveCached(c, cached, "STALE")
+	c.Writer.Flush()
+	if c.Request.Method != http.MethodGet {
+		return
+	}
+	if _, busy := rc.refreshing.LoadOrStore(key, struct{}{}); busy {
+		return
+	}
+	defer rc.refreshing.Delete(key)
+
+	req, writer := c.Request, c.Writer
+	ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+	defer cancel()
+
+	cw := newCacheWriter(writer, before, cfg.MaxSize)
+	cw.discard = true
+	c.Request, c.Writer = req.WithContext(ctx), cw
+	c.Next()
+	c.Request, c.Writer = req, writer
+
+	if resp, ttl, ok := cw.response(cfg); ok && (req.Header.Get("Cookie") == "" || sharedWithCookies(resp.Header)) {
+		rc.save(key, req.Header, resp, ttl)
+	}
+}
+
+// purgeRequest answers a PURGE request from an allowed client, dropping the
+// cached responses of its URL, or of every URL starting with it when it ends
+// with "*"
+func (rc *ResponseCache) purgeRequest(c *gin.Context, server string, allowed []netip.Prefix) {
+	addr, ok := remoteAddr(c.Request.RemoteAddr)
+	if !ok || !aclPermits(addr, allowed, nil) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": "PURGE is not allowed from this address"})
+		return
+	}
+
+	path, prefix := strings.CutSuffix(c.Request.URL.RequestURI(), "*")
+	purged := rc.Purge(server, c.Request.Host, path, prefix)
+	c.AbortWithStatusJSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// Purge drops the cached responses of a server for path, or for every path
+// starting with it when prefix is set. An empty host matches every host, and
+// a host without a port matches it on any port.
+func (rc *ResponseCache) Purge(server, host, path string, prefix bool) int {
+	serverPrefix := cacheKeyPrefix + server + ":"
+	purged := 0
+	for _, key := range rc.backend.keys(serverPrefix) {
+		keyHost, uri, ok := strings.Cut(strings.TrimPrefix(key, serverPrefix), "/")
+		if !ok || !purgeHostMatches(keyHost, host) {
+			continue
+		}
+		uri = "/" + uri
+		if prefix && !strings.HasPrefix(uri, path) {
+			continue
+		}
+		if !prefix && uri != path && !strings.HasPrefix(uri, path+"|") {
+			continue
+		}
+		rc.backend.delete(key)
+		if !strings.Contains(uri, "|") {
+			purged++
+		}
+	}
+	return purged
+}
+
+// purgeHostMatches reports whether the host of a cache key matches a purge
+func purgeHostMatches(keyHost, host string) bool {
+	if host == "" || strings.EqualFold(keyHost, host) {
+		return true
+	}
+	hostname, _, err := net.SplitHostPort(keyHost)
+	return err == nil && !strings.Contains(host, ":") && strings.EqualFold(hostname, host)
+}
+
+// lookup returns the cached response for a request, following the entry
+// listing the headers responses vary by to the request's variant
+func (rc *ResponseCache) lookup(key string, header http.Header) (*cachedResponse, bool) {
+	cached, ok := rc.backend.get(key)
+	if ok && len(cached.Vary) > 0 {
+		return rc.backend.get(variantKey(key, cached.Vary, header))
+	}
+	return cached, ok
+}
+
+// save stores a response, as a variant when it varies by request headers
+func (rc *ResponseCache) save(key string, header http.Header, resp *cachedResponse, ttl time.Duration) {
+	vary := varyFields(resp.Header)
+	if len(vary) == 0 {
+		rc.backend.set(key, resp, ttl)
+		return
+	}
+	rc.backend.set(key, &cachedResponse{Stored: resp.Stored, Vary: vary}, ttl)
+	rc.backend.set(variantKey(key, vary, header), resp, ttl)
+}
+
+// variantKey is the key of the variant of a response matching the request's
+// values of the vary headers
+func variantKey(key string, vary []string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("|")
+		b.WriteString(strings.ToLower(strings.ReplaceAll(strings.Join(header.Values(name), ","), " ", "")))
+	}
+	return b.String()
+}
+
+// varyFields returns the request headers listed by Vary, canonicalized
+func varyFields(header http.Header) []string {
+	var fields []string
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	slices.Sort(fields)
+	return slices.Compact(fields)
+}
+
+// wantsFresh reports whether a request asks to bypass cached responses
+func wantsFresh(header http.Header) bool {
+	if maxAge, ok := directiveSeconds(header, "max-age"); ok && maxAge == 0 {
+		return true
+	}
+	if header.Get("Cache-Control") == "" && strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		return true
+	}
+	return hasDirective(header, "no-cache")
+}
+
+// serveCached writes a cached response, reporting state in X-Cache
+func serveCached(c *gin.Context, cached *cachedResponse, state string) {
+	header := c.Writer.Header()
+	for name, values := range cached.Header {
+		header[name] = values
+	}
+	header.Set("Content-Length", strconv.Itoa(len(cached.Body)))
+	header.Set("Age", strconv.Itoa(cached.Age+int(clock.Now().Sub(cached.Stored).Seconds())))
+	header.Set("X-Cache", state)
+
+	c.Status(cached.Status)
+	if c.Request.Method == http.MethodHead {
+		c.Writer.WriteHeaderNow()
+	} else {
+		c.Writer.Write(cached.Body)
+	}
+}
+
+// isServerError reports whether a status means the target failed, so that a
+// stale response is more useful to the client
+func isServerError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// cacheWriter copies a response as it is written. The handler sets headers on
+// a copy that is written out when the response starts, so the headers it set
+// are captured before middlewares writing the response, such as compression,
+// change them, and error responses can be held back.
+type cacheWriter struct {
+	gin.ResponseWriter
+	before   http.Header // Headers set before the handler ran
+	header   http.Header // Headers as the handler sets them
+	pending  int         // Status set by the handler
+	started  bool
+	status   int
+	captured http.Header // Headers the handler set, once the response started
+	body     bytes.Buffer
+	limit    int
+	tooLarge bool
+
+	discard    bool // Nothing is written out: the client already got a response
+	hideErrors bool // Server errors are not written out, a stale response replaces them
+	failed     bool // A server error was held back
+}
+
+func newCacheWriter(w gin.ResponseWriter, before http.Header, limit int) *cacheWriter {
+	return &cacheWriter{
+		ResponseWriter: w,
+		before:         before.Clone(),
+		header:         before.Clone(),
+		pending:        http.StatusOK,
+		limit:          limit,
+	}
+}
+
+// start captures the status and the headers the handler set, then writes
+// them out unless the response is held back
+func (cw *cacheWriter) start() {
+	if cw.started {
+		return
+	}
+	cw.started = true
+	cw.status = cw.pending
+	cw.captured = http.Header{}
+	for name, values := range cw.header {
+		if !slices.Equal(cw.before[name], values) {
+			cw.captured[name] = append([]string(nil), values...)
+		}
+	}
+
+	if cw.hideErrors && isServerError(cw.status) {
+		cw.failed, cw.discard = true, true
+	}
+	if cw.discard {
+		return
+	}
+	header := cw.ResponseWriter.Header()
+	for name := range header {
+		if _, ok := cw.header[name]; !ok {
+			delete(header, name)
+		}
+	}
+	for name, values := range cw.header {
+		header[name] = values
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+// Header returns the headers the handler sets
+func (cw *cacheWriter) Header() http.Header {
+	return cw.header
+}
+
+// WriteHeader records the status
+func (cw *cacheWriter) WriteHeader(code int) {
+	if code > 0 && !cw.started {
+		cw.pending = code
+	}
+}
+
+// WriteHeaderNow starts a response without a body
+func (cw *cacheWriter) WriteHeaderNow() {
+	cw.start()
+	if !cw.discard {
+		cw.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// Write copies body data up to the size limit
+func (cw *cacheWriter) Write(data []byte) (int, error) {
+	cw.start()
+	if !cw.tooLarge && !cw.failed {
+		if cw.body.Len()+len(data) > cw.limit {
+			cw.tooLarge = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(data)
+		}
+	}
+	if cw.discard {
+		return len(data), nil
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+// WriteString copies body data up to the size limit
+func (cw *cacheWriter) WriteString(s string) (int, error) {
+	return cw.Write([]byte(s))
+}
+
+// Flush starts the response and sends what was written so far
+func (cw *cacheWriter) Flush() {
+	cw.start()
+	if !cw.discard {
+		cw.ResponseWriter.Flush()
+	}
+}
+
+// Status returns the status of the response
+func (cw *cacheWriter) Status() int {
+	if cw.started {
+		return cw.status
+	}
+	return cw.pending
+}
+
+// Written reports whether the response started
+func (cw *cacheWriter) Written() bool {
+	return cw.started
+}
+
+// response returns the response to cache and how long to keep it, or false
+// when it may not be cached. Responses are kept past their freshness for the
+// longest of their stale windows.
+func (cw *cacheWriter) response(cfg config.ServerCacheConfig) (*cachedResponse, time.Duration, bool) {
+	header := cw.captured
+	if header == nil || cw.tooLarge || !cacheableStatus[cw.status] {
+		return nil, 0, false
+	}
+	if header.Get("Set-Cookie") != "" || hasDirective(header, "no-store", "no-cache", "private") {
+		return nil, 0, false
+	}
+	if header.Get("Cache-Control") == "" && strings.EqualFold(header.Get("Pragma"), "no-cache") {
+		return nil, 0, false
+	}
+	if slices.Contains(varyFields(header), "*") {
+		return nil, 0, false
+	}
+
+	lifetime, age := freshness(header, time.Duration(cfg.TTL)*time.Second)
+	if lifetime <= age {
+		return nil, 0, false
+	}
+
+	stored := header.Clone()
+	for _, name := range uncachedHeaders {
+		stored.Del(name)
+	}
+	now := clock.Now()
+	resp := &cachedResponse{
+		Status: cw.status,
+		Header: stored,
+		Body:   cw.body.Bytes(),
+		Stored: now,
+		Age:    int(age.Seconds()),
+		Fresh:  now.Add(lifetime - age),
+	}
+	if !hasDirective(header, "must-revalidate", "proxy-revalidate") {
+		resp.StaleWhileRevalidate = staleWindow(header, "stale-while-revalidate", cfg.StaleWhileRevalidate)
+		resp.StaleIfError = staleWindow(header, "stale-if-error", cfg.StaleIfError)
+	}
+	keep := lifetime - age + time.Duration(max(resp.StaleWhileRevalidate, resp.StaleIfError))*time.Second
+	return resp, keep, true
+}
+
+// staleWindow returns the seconds a Cache-Control directive allows serving
+// an expired response, or fallback when the response has none
+func staleWindow(header http.Header, directive string, fallback int) int {
+	if window, ok := directiveSeconds(header, directive); ok && window >= 0 {
+		return int(window.Seconds())
+	}
+	return fallback
+}
+
+// freshness returns how long a response stays fresh and how old it already
+// is. s-maxage, meant for shared caches, wins over max-age, which wins over
+// Expires; responses without any are kept for fallback.
+func freshness(header http.Header, fallback time.Duration) (lifetime, age time.Duration) {
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age = time.Duration(seconds) * time.Second
+	}
+
+	if maxAge, ok := directiveSeconds(header, "s-maxage"); ok {
+		return maxAge, age
+	}
+	if maxAge, ok := directiveSeconds(header, "max-age"); ok {
+		return maxAge, age
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		// Invalid dates such as "0" mean already expired
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, age
+		}
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = clock.Now()
+		}
+		return at.Sub(date), age
+	}
+	return fallback, age
+}
+
+// hasDirective reports whether Cache-Control contains any of the directives
+func hasDirective(header http.Header, directives ...string) bool {
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(part), "=")
+			for _, directive := range directives {
+				if strings.EqualFold(name, directive) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// directiveSeconds returns the value of a Cache-Control directive in seconds
+func directiveSeconds(header http.Header, directive string) (time.Duration, bool) {
+	for _, value := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || !strings.EqualFold(name, directive) {
+				continue
+			}
+			seconds, err := strconv.Atoi(strings.Trim(arg, `"`))
+			if err != nil {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// storeCache keeps responses in the state store, shared by every instance
+type storeCache struct {
+	store  store.Store
+	logger *logger.Logger
+}
+
+func (sc *storeCache) get(key string) (*cachedResponse, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	value, err := sc.store.Get(ctx, key)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			sc.logger.Debugf("Response cache read failed: %v", err)
+		}
+		return nil, false
+	}
+	var resp cachedResponse
+	if err := json.Unmarshal([]byte(value), &resp); err != nil {
+		return nil, false
+	}
+	return &resp, true
+}
+
+func (sc *storeCache) set(key string, resp *cachedResponse, ttl time.Duration) {
+	encoded, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := sc.store.Set(ctx, key, string(encoded), ttl); err != nil {
+		sc.logger.Debugf("Response cache write failed: %v", err)
+	}
+}
+
+func (sc *storeCache) delete(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	if err := sc.store.Delete(ctx, key); err != nil && !errors.Is(err, store.ErrNotFound) {
+		sc.logger.Debugf("Response cache delete failed: %v", err)
+	}
+}
+
+func (sc *storeCache) keys(prefix string) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	keys, err := sc.store.Keys(ctx, prefix)
+	if err != nil {
+		sc.logger.Warnf("Listing cached responses failed: %v", err)
+	}
+	return keys
+}
+
+// memoryCache keeps responses in process, evicting the least recently used
+// once the size budget is exceeded
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+	size    int
+	limit   int
+}
+
+// memoryEntry is a response in the memory cache
+type memoryEntry struct {
+	key     string
+	resp    *cachedResponse
+	expires time.Time
+	size    int
+}
+
+func newMemoryCache(limit int) *memoryCache {
+	return &memoryCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		limit:   limit,
+	}
+}
+
+func (mc *memoryCache) get(key string) (*cachedResponse, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	element, ok := mc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*memoryEntry)
+	if clock.Now().After(entry.expires) {
+		mc.remove(element)
+		return nil, false
+	}
+	mc.order.MoveToFront(element)
+	return entry.resp, true
+}
+
+func (mc *memoryCache) set(key string, resp *cachedResponse, ttl time.Duration) {
+	entry := &memoryEntry{key: key, resp: resp, expires: clock.Now().Add(ttl), size: len(key) + resp.size()}
+	if entry.size > mc.limit {
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if element, ok := mc.entries[key]; ok {
+		mc.remove(element)
+	}
+	mc.entries[key] = mc.order.PushFront(entry)
+	mc.size += entry.size
+
+	for mc.size > mc.limit {
+		mc.remove(mc.order.Back())
+	}
+}
+
+func (mc *memoryCache) delete(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if element, ok := mc.entries[key]; ok {
+		mc.remove(element)
+	}
+}
+
+func (mc *memoryCache) keys(prefix string) []string {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	var keys []string
+	for key := range mc.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// remove drops an entry; the caller holds mu
+func (mc *memoryCache) remove(element *list.Element) {
+	entry := mc.order.Remove(element).(*memoryEntry)
+	delete(mc.entries, entry.key)
+	mc.size -= entry.size
+}
@@ -0,0 +1,214 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+const (
+	// ChallengeCookie carries a proof-of-work challenge to the verification page's script
+	ChallengeCookie = "oka_challenge"
+
+	// ChallengeScriptPath serves the script that solves the challenge; custom
+	// verification pages include it with a script tag
+	ChallengeScriptPath = "/_oka/challenge.js"
+
+	// ChallengeVerifyPath receives solutions and issues the verification cookies
+	ChallengeVerifyPath = "/_oka/verify"
+)
+
+// challengeLifetime bounds how long a challenge may take to solve
+const challengeLifetime = 5 * time.Minute
+
+// issueChallenge sets a new challenge cookie. A challenge reads
+// "<difficulty>.<expiration ms>.<nonce>.<signature>"; the signature binds it to
+// the client address so a solution cannot be shared with other clients.
+func (am *AuthMiddleware) issueChallenge(c *gin.Context, serverConfig *config.ServerConfig) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	expiration := clock.Now().Add(challengeLifetime).UnixMilli()
+	data := fmt.Sprintf("%d.%d.%s", serverConfig.Challenge.Difficulty, expiration, hex.EncodeToString(nonce))
+	signature := am.encryptToken(challengeSigned(data, c.Request), serverConfig.SecretKey)
+
+	// The script reads the challenge, so it is not httpOnly
+	c.SetCookie(ChallengeCookie, data+"."+signature, int(challengeLifetime/time.Second), "/", "", false, false)
+}
+
+// challengeSigned returns what a challenge's signature covers
+func challengeSigned(data string, r *http.Request) string {
+	return "challenge:" + data + ":" + logger.GetClientIP(r)
+}
+
+// verifyChallenge checks a posted solution and, when it holds, issues the
+// verification cookies
+func (am *AuthMiddleware) verifyChallenge(c *gin.Context, serverConfig *config.ServerConfig) {
+	defer c.Abort()
+
+	challenge := c.PostForm("challenge")
+	solution := c.PostForm("solution")
+	if !am.solves(challenge, solution, c.Request, serverConfig.SecretKey) {
+		am.logger.WithFields(map[string]interface{}{
+			"ip":   logger.GetClientIP(c.Request),
+			"path": c.Request.URL.Path,
+		}).Info("Verification challenge failed")
+		c.JSON(http.StatusForbidden, gin.H{"message": "Verification failed, please reload the page."})
+		return
+	}
+
+	am.setValidationCookies(c, serverConfig)
+	c.SetCookie(ChallengeCookie, "", -1, "/", "", false, false)
+	c.Status(http.StatusNoContent)
+}
+
+// solves reports whether solution answers a valid, unexpired challenge issued
+// to the client
+func (am *AuthMiddleware) solves(challenge, solution string, r *http.Request, secretKey string) bool {
+	data, signature, ok := cutLast(challenge, ".")
+	if !ok || !am.verifyToken(challengeSigned(data, r), signature, secretKey) {
+		return false
+	}
+	fields := strings.Split(data, ".")
+	if len(fields) != 3 {
+		return false
+	}
+	difficulty, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return false
+	}
+	expiration, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || clock.Now().UnixMilli() > expiration {
+		return false
+	}
+	if _, err := strconv.ParseUint(solution, 10, 64); err != nil {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	return leadingZeroBits(sum[:]) >= difficulty
+}
+
+// cutLast slices s around the last instance of sep
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+// leadingZeroBits counts the zero bits at the start of b
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// serveChallengeScript serves the script that solves the challenge
+func serveChallengeScript(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.Data(http.StatusOK, "text/javascript; charset=utf-8", []byte(challengeScript))
+	c.Abort()
+}
+
+// challengeScript finds a counter whose SHA-256 with the challenge starts with
+// enough zero bits, posts it, and reloads the page once the cookies are set.
+// SHA-256 is implemented inline because crypto.subtle is missing over plain HTTP.
+const challengeScript = `(function () {
+  var match = document.cookie.match(/(?:^|; )oka_challenge=([^;]+)/);
+  if (!match) return;
+  var challenge = decodeURIComponent(match[1]);
+  var difficulty = parseInt(challenge.split('.')[0], 10);
+  window.okaChallenge = true;
+
+  var K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+  ];
+  var H = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+  var w = new Array(64);
+
+  // sha256 hashes an ASCII string into eight 32-bit words
+  function sha256(s) {
+    var m = new Array((((s.length + 8) >> 6) + 1) * 16), h = H.slice(), i, j;
+    for (i = 0; i < m.length; i++) m[i] = 0;
+    for (i = 0; i < s.length; i++) m[i >> 2] |= s.charCodeAt(i) << (24 - (i & 3) * 8);
+    m[i >> 2] |= 0x80 << (24 - (i & 3) * 8);
+    m[m.length - 1] = s.length * 8;
+    for (j = 0; j < m.length; j += 16) {
+      var a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], k = h[7];
+      for (i = 0; i < 64; i++) {
+        if (i < 16) {
+          w[i] = m[j + i];
+        } else {
+          var x = w[i - 15], y = w[i - 2];
+          w[i] = (((x >>> 7 | x << 25) ^ (x >>> 18 | x << 14) ^ (x >>> 3)) + w[i - 16] +
+            ((y >>> 17 | y << 15) ^ (y >>> 19 | y << 13) ^ (y >>> 10)) + w[i - 7]) | 0;
+        }
+        var t1 = (k + ((e >>> 6 | e << 26) ^ (e >>> 11 | e << 21) ^ (e >>> 25 | e << 7)) +
+          ((e & f) ^ (~e & g)) + K[i] + w[i]) | 0;
+        var t2 = (((a >>> 2 | a << 30) ^ (a >>> 13 | a << 19) ^ (a >>> 22 | a << 10)) +
+          ((a & b) ^ (a & c) ^ (b & c))) | 0;
+        k = g; g = f; f = e; e = (d + t1) | 0; d = c; c = b; b = a; a = (t1 + t2) | 0;
+      }
+      h[0] = (h[0] + a) | 0; h[1] = (h[1] + b) | 0; h[2] = (h[2] + c) | 0; h[3] = (h[3] + d) | 0;
+      h[4] = (h[4] + e) | 0; h[5] = (h[5] + f) | 0; h[6] = (h[6] + g) | 0; h[7] = (h[7] + k) | 0;
+    }
+    return h;
+  }
+
+  function leadingZeroBits(h) {
+    for (var i = 0, n = 0; i < h.length; i++, n += 32) {
+      if (h[i] !== 0) return n + Math.clz32(h[i]);
+    }
+    return n;
+  }
+
+  function submit(solution) {
+    var xhr = new XMLHttpRequest();
+    xhr.open('POST', '` + ChallengeVerifyPath + `');
+    xhr.setRequestHeader('Content-Type', 'application/x-www-form-urlencoded');
+    xhr.onloadend = function () { window.location.reload(); };
+    xhr.send('challenge=' + encodeURIComponent(challenge) + '&solution=' + solution);
+  }
+
+  // Work in slices so the page stays responsive
+  var counter = 0;
+  function work() {
+    var deadline = Date.now() + 50;
+    while (Date.now() < deadline) {
+      for (var n = 0; n < 1000; n++, counter++) {
+        if (leadingZeroBits(sha256(challenge + ':' + counter)) >= difficulty) {
+          submit(counter);
+          return;
+        }
+      }
+    }
+    setTimeout(work, 0);
+  }
+  work();
+})();
+`
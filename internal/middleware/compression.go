@@ -0,0 +1,210 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+
+	"okaproxy/internal/config"
+)
+
+// encoder is a compressed stream that can be reused for another response
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools returns a pool of encoders for each configured encoding
+func encoderPools(cfg config.CompressionConfig) map[string]*sync.Pool {
+	pools := make(map[string]*sync.Pool, len(cfg.Encodings))
+	for _, encoding := range cfg.Encodings {
+		var create func() interface{}
+		switch encoding {
+		case config.EncodingBrotli:
+			create = func() interface{} {
+				return brotli.NewWriterLevel(io.Discard, cfg.BrotliLevel)
+			}
+		case config.EncodingZstd:
+			create = func() interface{} {
+				// Browsers decode windows of up to 8 MB
+				zw, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zstd.EncoderLevel(cfg.ZstdLevel)),
+					zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(8<<20))
+				return zw
+			}
+		case config.EncodingGzip:
+			create = func() interface{} {
+				gz, _ := gzip.NewWriterLevel(io.Discard, cfg.GzipLevel)
+				return gz
+			}
+		default:
+			continue
+		}
+		pools[encoding] = &sync.Pool{New: create}
+	}
+	return pools
+}
+
+// CompressionMiddleware compresses responses with the encoding the client
+// prefers among those configured. The decision is made when the response
+// header is written, so responses that are already encoded (precompressed
+// pages, compressed upstream bodies) are passed through untouched, as are
+// responses below the minimum size and excluded types and paths.
+func CompressionMiddleware(cfg config.CompressionConfig) gin.HandlerFunc {
+	pools := encoderPools(cfg)
+
+	return func(c *gin.Context) {
+		encoding := negotiateEncoding(c.Request.Header.Get("Accept-Encoding"), cfg.Encodings)
+		if encoding == "" || strings.Contains(strings.ToLower(c.Request.Header.Get("Connection")), "upgrade") {
+			c.Next()
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: c.Writer,
+			encoding:       encoding,
+			pool:           pools[encoding],
+			cfg:            &cfg,
+			path:           c.Request.URL.Path,
+		}
+		c.Writer = cw
+		defer cw.close()
+
+		c.Next()
+	}
+}
+
+// negotiateEncoding picks the offered encoding with the highest quality in
+// Accept-Encoding, the first offered one winning ties, or "" for none
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	qualities := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		qualities[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := qualities[encoding]
+		if !ok {
+			q, ok = qualities["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter lazily wraps the response in a compressed stream
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	pool     *sync.Pool
+	cfg      *config.CompressionConfig
+	path     string
+	enc      encoder
+	decided  bool
+}
+
+// decide chooses whether to compress based on the final response headers
+func (cw *compressWriter) decide(status int) {
+	if cw.decided {
+		return
+	}
+	cw.decided = true
+
+	h := cw.Header()
+	if h.Get("Content-Encoding") != "" || !bodyAllowed(status) || isCompressedType(h.Get("Content-Type")) {
+		return
+	}
+	if cw.cfg.Excludes(cw.path, h.Get("Content-Type")) {
+		return
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < cw.cfg.MinSize {
+		return
+	}
+
+	h.Set("Content-Encoding", cw.encoding)
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+
+	cw.enc = cw.pool.Get().(encoder)
+	cw.enc.Reset(cw.ResponseWriter)
+}
+
+// WriteHeader records the status and decides on compression
+func (cw *compressWriter) WriteHeader(code int) {
+	cw.decide(code)
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// Write writes (possibly compressed) body data
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	cw.decide(cw.Status())
+	if cw.enc != nil {
+		return cw.enc.Write(data)
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+// WriteString writes (possibly compressed) body data
+func (cw *compressWriter) WriteString(s string) (int, error) {
+	return cw.Write([]byte(s))
+}
+
+// Flush flushes buffered compressed data to the client
+func (cw *compressWriter) Flush() {
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	cw.ResponseWriter.Flush()
+}
+
+// close finishes the compressed stream
+func (cw *compressWriter) close() {
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	cw.enc.Reset(io.Discard)
+	cw.pool.Put(cw.enc)
+	cw.enc = nil
+}
+
+// bodyAllowed reports whether a response with this status carries a body
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// isCompressedType reports whether the content type is already compressed
+func isCompressedType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range []string{"image/", "video/", "audio/", "font/woff",
+		"application/zip", "application/gzip", "application/x-gzip", "application/octet-stream"} {
+		if strings.HasPrefix(contentType, prefix) && contentType != "image/svg+xml" {
+			return true
+		}
+	}
+	return false
+}
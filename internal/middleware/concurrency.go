@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/metrics"
+	"okaproxy/internal/pages"
+)
+
+// QueueTicketCookie holds a browser's place in the waiting room
+const QueueTicketCookie = "oka_queue_ticket"
+
+// WaitingRoomData is available to the waiting room page template
+type WaitingRoomData struct {
+	ServerName string
+	Position   int64
+	RetryAfter int
+}
+
+// ConcurrencyLimiter bounds the requests a server proxies at once. Excess
+// requests wait in a FIFO queue; when the queue is full or the wait times out
+// they get a 503, or, with the waiting room enabled, browsers get a page
+// showing their place in line that retries automatically.
+type ConcurrencyLimiter struct {
+	config    config.ConcurrencyConfig
+	server    string
+	secretKey string
+	logger    *logger.Logger
+	page      *pages.Template
+	metrics   *metrics.QueueMetrics
+
+	slots   chan struct{}
+	waiting atomic.Int64
+
+	// Waiting room tickets are numbered; a ticket's turn comes once serving
+	// reaches it. serving advances as slots are released.
+	mu      sync.Mutex
+	issued  int64
+	serving int64
+}
+
+// NewConcurrencyLimiter creates the limiter of a server; page renders the
+// waiting room and queue records admissions for the status endpoint
+func NewConcurrencyLimiter(log *logger.Logger, serverConfig *config.ServerConfig, page *pages.Template, queue *metrics.QueueMetrics) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		config:    serverConfig.Concurrency,
+		server:    serverConfig.Name,
+		secretKey: serverConfig.SecretKey,
+		logger:    log,
+		page:      page,
+		metrics:   queue,
+		slots:     make(chan struct{}, serverConfig.Concurrency.Max),
+	}
+}
+
+// Middleware limits proxied requests; registered routes such as /health are not limited
+func (cl *ConcurrencyLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() != "" {
+			c.Next()
+			return
+		}
+
+		roomEnabled := cl.config.WaitingRoom && isBrowserRequest(c.Request)
+		ticket, hasTicket := int64(0), false
+		if roomEnabled {
+			ticket, hasTicket = cl.readTicket(c)
+		}
+
+		if !cl.admit(c, ticket, hasTicket, roomEnabled) {
+			cl.reject(c, ticket, hasTicket, roomEnabled)
+			return
+		}
+		defer cl.release()
+
+		if hasTicket {
+			c.SetCookie(QueueTicketCookie, "", -1, "/", "", false, true)
+		}
+		c.Next()
+	}
+}
+
+// admit acquires a slot, waiting in the queue when allowed
+func (cl *ConcurrencyLimiter) admit(c *gin.Context, ticket int64, hasTicket, roomEnabled bool) bool {
+	// A free slot is taken right away; queued requests are handed released slots first
+	select {
+	case cl.slots <- struct{}{}:
+		if hasTicket {
+			cl.advance(ticket)
+		}
+		cl.metrics.Admitted(0)
+		return true
+	default:
+	}
+
+	if roomEnabled {
+		cl.mu.Lock()
+		outstanding := cl.issued > cl.serving
+		turn := hasTicket && ticket <= cl.serving
+		cl.mu.Unlock()
+
+		// Browsers holding a ticket wait for their turn; new ones may not jump the line
+		if hasTicket && !turn {
+			return false
+		}
+		if !hasTicket && outstanding {
+			return false
+		}
+		// A ticket whose turn has come may queue even when the queue is full
+		if turn {
+			return cl.wait(c)
+		}
+	}
+
+	// A queue of -1 sheds excess requests without waiting
+	if cl.waiting.Load() >= int64(cl.config.Queue) {
+		return false
+	}
+	return cl.wait(c)
+}
+
+// wait queues for a slot until the queue timeout or the client goes away
+func (cl *ConcurrencyLimiter) wait(c *gin.Context) bool {
+	cl.waiting.Add(1)
+	defer cl.waiting.Add(-1)
+	cl.metrics.Enqueued()
+	defer cl.metrics.Dequeued()
+
+	start := time.Now()
+	timer := time.NewTimer(time.Duration(cl.config.QueueTimeout) * time.Second)
+	defer timer.Stop()
+
+	select {
+	case cl.slots <- struct{}{}:
+		cl.metrics.Admitted(time.Since(start))
+		return true
+	case <-timer.C:
+		return false
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// release frees a slot and lets the next waiting room ticket in
+func (cl *ConcurrencyLimiter) release() {
+	<-cl.slots
+	cl.metrics.Released()
+
+	cl.mu.Lock()
+	if cl.issued > cl.serving {
+		cl.serving++
+	}
+	cl.mu.Unlock()
+}
+
+// advance records that ticket has been served
+func (cl *ConcurrencyLimiter) advance(ticket int64) {
+	cl.mu.Lock()
+	if ticket > cl.serving {
+		cl.serving = ticket
+	}
+	cl.mu.Unlock()
+}
+
+// reject answers with the waiting room page or a plain 503
+func (cl *ConcurrencyLimiter) reject(c *gin.Context, ticket int64, hasTicket, roomEnabled bool) {
+	cl.metrics.Shed()
+	retryAfter := strconv.Itoa(cl.config.RetryAfter)
+	c.Header("Retry-After", retryAfter)
+
+	if !roomEnabled {
+		cl.logger.WithFields(map[string]interface{}{
+			"server": cl.server,
+			"ip":     logger.GetClientIP(c.Request),
+			"path":   c.Request.URL.Path,
+		}).Warn("Request rejected: concurrency limit and queue are full")
+
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message":     "Server is busy, please try again later.",
+			"retry_after": cl.config.RetryAfter,
+		})
+		c.Abort()
+		return
+	}
+
+	cl.mu.Lock()
+	if !hasTicket {
+		cl.issued++
+		ticket = cl.issued
+	}
+	position := ticket - cl.serving
+	cl.mu.Unlock()
+	if position < 1 {
+		position = 1
+	}
+
+	if !hasTicket {
+		c.SetCookie(QueueTicketCookie, cl.signTicket(ticket), 3600, "/", "", false, true)
+	}
+
+	c.Header("X-Queue-Position", strconv.FormatInt(position, 10))
+	cl.page.Write(c.Writer, c.Request, http.StatusServiceUnavailable, WaitingRoomData{
+		ServerName: cl.server,
+		Position:   position,
+		RetryAfter: cl.config.RetryAfter,
+	})
+	c.Abort()
+}
+
+// signTicket binds a ticket number to this server's secret key
+func (cl *ConcurrencyLimiter) signTicket(ticket int64) string {
+	value := strconv.FormatInt(ticket, 10)
+	return value + "." + (&AuthMiddleware{}).encryptToken("queue:"+value, cl.secretKey)
+}
+
+// readTicket returns the client's verified ticket, ignoring tickets issued
+// before a restart
+func (cl *ConcurrencyLimiter) readTicket(c *gin.Context) (int64, bool) {
+	cookie, err := c.Cookie(QueueTicketCookie)
+	if err != nil {
+		return 0, false
+	}
+
+	value, signature, ok := strings.Cut(cookie, ".")
+	if !ok || !(&AuthMiddleware{}).verifyToken("queue:"+value, signature, cl.secretKey) {
+		return 0, false
+	}
+	ticket, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ticket < 1 {
+		return 0, false
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if ticket > cl.issued {
+		return 0, false
+	}
+	return ticket, true
+}
+
+// isBrowserRequest reports whether the request is a page load that can show HTML
+func isBrowserRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return acceptsHTML(r)
+}
+
+// acceptsHTML reports whether the client asks for an HTML response, as browsers
+// loading pages and submitting forms do
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
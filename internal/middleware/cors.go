@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+)
+
+// forwardedPreflightKey marks OPTIONS requests that must reach the backend
+const forwardedPreflightKey = "cors.forward_preflight"
+
+var (
+	defaultCORSMethods = []string{"POST", "OPTIONS", "GET", "PUT", "DELETE"}
+	defaultCORSHeaders = []string{"Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "accept", "origin", "Cache-Control", "X-Requested-With"}
+)
+
+// CORSMiddleware applies the server's CORS policy and answers OPTIONS requests
+// at the edge unless the policy forwards them to the backend
+func CORSMiddleware(cors config.CORSConfig) gin.HandlerFunc {
+	methods := strings.Join(orDefault(cors.AllowMethods, defaultCORSMethods), ", ")
+	headers := strings.Join(orDefault(cors.AllowHeaders, defaultCORSHeaders), ", ")
+	expose := strings.Join(cors.ExposeHeaders, ", ")
+	credentials := cors.Credentials()
+
+	return func(c *gin.Context) {
+		origin := c.Request.Header.Get("Origin")
+		if originAllowed(cors.AllowOrigins, origin) {
+			c.Header("Access-Control-Allow-Origin", origin)
+			if credentials {
+				c.Header("Access-Control-Allow-Credentials", "true")
+			}
+			c.Header("Access-Control-Allow-Headers", headers)
+			c.Header("Access-Control-Allow-Methods", methods)
+			if expose != "" {
+				c.Header("Access-Control-Expose-Headers", expose)
+			}
+			if len(cors.AllowOrigins) > 0 {
+				c.Writer.Header().Add("Vary", "Origin")
+			}
+		}
+
+		if c.Request.Method == http.MethodOptions {
+			if cors.ForwardsPreflight(c.Request.URL.Path) {
+				c.Set(forwardedPreflightKey, true)
+				c.Next()
+				return
+			}
+
+			if cors.MaxAge > 0 {
+				c.Header("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// isForwardedPreflight reports whether the request is an OPTIONS request the CORS
+// policy sends to the backend. Browsers never attach cookies to preflights.
+func isForwardedPreflight(c *gin.Context) bool {
+	return c.GetBool(forwardedPreflightKey)
+}
+
+// originAllowed reports whether origin may receive CORS headers
+func originAllowed(allowed []string, origin string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == "*" || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func orDefault(values, def []string) []string {
+	if len(values) == 0 {
+		return def
+	}
+	return values
+}
@@ -0,0 +1,15 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/metrics"
+)
+
+// RequestCountersMiddleware counts every finished request by its response status
+func RequestCountersMiddleware(counters *metrics.RequestCounters) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		counters.Observe(c.Writer.Status())
+	}
+}
@@ -0,0 +1,310 @@
+package middleware
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/logger"
+)
+
+// diskCacheExt is the extension of cached response files
+const diskCacheExt = ".cache"
+
+// diskCache keeps responses as files, evicting the least recently used once
+// the size budget is exceeded. Each file holds a line of JSON describing the
+// response followed by its body.
+type diskCache struct {
+	dir    string
+	logger *logger.Logger
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // Most recently used first
+	size    int64
+	limit   int64
+}
+
+// diskEntry is a response in the disk cache
+type diskEntry struct {
+	key     string
+	expires time.Time
+	size    int64
+}
+
+// diskMeta is the first line of a cached response file
+type diskMeta struct {
+	Key      string          `json:"key"`
+	Expires  time.Time       `json:"expires"`
+	Response *cachedResponse `json:"response"`
+}
+
+// newDiskCache opens the disk cache in dir, indexing the responses already
+// stored there
+func newDiskCache(dir string, limit int64, log *logger.Logger) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v", err)
+	}
+	dc := &diskCache{
+		dir:     dir,
+		logger:  log,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		limit:   limit,
+	}
+	if err := dc.load(); err != nil {
+		return nil, fmt.Errorf("failed to read directory: %v", err)
+	}
+	return dc, nil
+}
+
+// load indexes the files in the directory, oldest first, dropping expired
+// and unreadable ones
+func (dc *diskCache) load() error {
+	files, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+
+	type stored struct {
+		entry    *diskEntry
+		modified time.Time
+	}
+	var found []stored
+	now := clock.Now()
+	for _, file := range files {
+		name := file.Name()
+		path := filepath.Join(dc.dir, name)
+		if strings.HasSuffix(name, ".tmp") {
+			os.Remove(path)
+			continue
+		}
+		if !strings.HasSuffix(name, diskCacheExt) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		meta, err := readDiskMeta(path)
+		if err != nil || dc.file(meta.Key) != path || now.After(meta.Expires) {
+			os.Remove(path)
+			continue
+		}
+		found = append(found, stored{
+			entry:    &diskEntry{key: meta.Key, expires: meta.Expires, size: info.Size()},
+			modified: info.ModTime(),
+		})
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].modified.Before(found[j].modified) })
+	for _, f := range found {
+		dc.entries[f.entry.key] = dc.order.PushFront(f.entry)
+		dc.size += f.entry.size
+	}
+	for dc.size > dc.limit {
+		dc.remove(dc.order.Back())
+	}
+	return nil
+}
+
+// readDiskMeta reads the description at the start of a cached response file
+func readDiskMeta(path string) (*diskMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(line, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// file returns where the response cached under key is stored
+func (dc *diskCache) file(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dc.dir, hex.EncodeToString(sum[:16])+diskCacheExt)
+}
+
+func (dc *diskCache) get(key string) (*cachedResponse, bool) {
+	dc.mu.Lock()
+	element, ok := dc.entries[key]
+	if ok && clock.Now().After(element.Value.(*diskEntry).expires) {
+		dc.remove(element)
+		ok = false
+	}
+	if ok {
+		dc.order.MoveToFront(element)
+	}
+	dc.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	f, err := os.Open(dc.file(key))
+	if err != nil {
+		// Evicted meanwhile
+		return nil, false
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, false
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(line, &meta); err != nil || meta.Key != key || meta.Response == nil {
+		return nil, false
+	}
+	if meta.Response.Body, err = io.ReadAll(reader); err != nil {
+		dc.logger.Debugf("Disk cache read failed: %v", err)
+		return nil, false
+	}
+	return meta.Response, true
+}
+
+func (dc *diskCache) set(key string, resp *cachedResponse, ttl time.Duration) {
+	expires := clock.Now().Add(ttl)
+	described := *resp
+	described.Body = nil
+	line, err := json.Marshal(diskMeta{Key: key, Expires: expires, Response: &described})
+	if err != nil {
+		return
+	}
+	size := int64(len(line)+1) + int64(len(resp.Body))
+	if size > dc.limit {
+		return
+	}
+
+	if err := dc.write(key, line, resp.Body); err != nil {
+		dc.logger.Debugf("Disk cache write failed: %v", err)
+		return
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if element, ok := dc.entries[key]; ok {
+		dc.drop(element)
+	}
+	dc.entries[key] = dc.order.PushFront(&diskEntry{key: key, expires: expires, size: size})
+	dc.size += size
+
+	for dc.size > dc.limit {
+		dc.remove(dc.order.Back())
+	}
+}
+
+// write stores a response file, replacing the previous one atomically
+func (dc *diskCache) write(key string, line, body []byte) error {
+	tmp, err := os.CreateTemp(dc.dir, "response-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.Write(line)
+	w.WriteByte('\n')
+	w.Write(body)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dc.file(key))
+}
+
+func (dc *diskCache) delete(key string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if element, ok := dc.entries[key]; ok {
+		dc.remove(element)
+	}
+}
+
+func (dc *diskCache) keys(prefix string) []string {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	var keys []string
+	for key := range dc.entries {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// remove drops an entry and its file; the caller holds mu
+func (dc *diskCache) remove(element *list.Element) {
+	entry := dc.drop(element)
+	os.Remove(dc.file(entry.key))
+}
+
+// drop removes an entry from the index only; the caller holds mu
+func (dc *diskCache) drop(element *list.Element) *diskEntry {
+	entry := dc.order.Remove(element).(*diskEntry)
+	delete(dc.entries, entry.key)
+	dc.size -= entry.size
+	return entry
+}
+
+// tieredCache keeps responses with large bodies on disk and the others in
+// the primary backend
+type tieredCache struct {
+	primary cacheBackend
+	disk    *diskCache
+	minSize int
+}
+
+func (tc *tieredCache) get(key string) (*cachedResponse, bool) {
+	if resp, ok := tc.disk.get(key); ok {
+		return resp, true
+	}
+	return tc.primary.get(key)
+}
+
+func (tc *tieredCache) set(key string, resp *cachedResponse, ttl time.Duration) {
+	if len(resp.Body) >= tc.minSize {
+		tc.disk.set(key, resp, ttl)
+		tc.primary.delete(key)
+		return
+	}
+	tc.primary.set(key, resp, ttl)
+	tc.disk.delete(key)
+}
+
+func (tc *tieredCache) delete(key string) {
+	tc.disk.delete(key)
+	tc.primary.delete(key)
+}
+
+func (tc *tieredCache) keys(prefix string) []string {
+	keys := append(tc.disk.keys(prefix), tc.primary.keys(prefix)...)
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"net/textproto"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+)
+
+// forwardAuthBodyLimit caps the denial body relayed from the auth service
+const forwardAuthBodyLimit = 1 << 20
+
+// hopHeaders belong to one connection and are not passed on
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+// ForwardAuthMiddleware asks the auth service about each protected request.
+// The service receives the request's headers and its method, host and URI in
+// X-Forwarded-* headers, but not its body. Redirects from the service go to
+// the client, so it can send users to a login page. Built-in endpoints are not
+// checked.
+func ForwardAuthMiddleware(log *logger.Logger, cfg config.ForwardAuthConfig, errorPage *pages.Page) gin.HandlerFunc {
+	client := &http.Client{
+		Timeout: cfg.TimeoutDuration(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	return func(c *gin.Context) {
+		// Identity headers only ever come from the auth service
+		for _, name := range cfg.ResponseHeaders {
+			c.Request.Header.Del(name)
+		}
+		if c.FullPath() != "" || !cfg.Protects(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		resp, err := client.Do(forwardAuthRequest(c.Request, cfg))
+		if err != nil {
+			log.Errorf("Forward auth request failed: %v", err)
+			errorPage.Write(c.Writer, c.Request, http.StatusBadGateway)
+			c.Abort()
+			return
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			for _, name := range cfg.ResponseHeaders {
+				if values := resp.Header.Values(name); len(values) > 0 {
+					c.Request.Header[textproto.CanonicalMIMEHeaderKey(name)] = values
+				}
+			}
+			c.Set(authenticatedKey, true)
+			c.Next()
+			return
+		}
+
+		// The service's answer, such as a 401 or a redirect to its login page,
+		// replaces the response
+		log.WithFields(map[string]interface{}{
+			"ip":     logger.GetClientIP(c.Request),
+			"path":   c.Request.URL.Path,
+			"status": resp.StatusCode,
+		}).Info("Request denied by forward auth")
+		for name, values := range resp.Header {
+			c.Writer.Header()[name] = values
+		}
+		for _, name := range hopHeaders {
+			c.Writer.Header().Del(name)
+		}
+		c.Status(resp.StatusCode)
+		io.Copy(c.Writer, io.LimitReader(resp.Body, forwardAuthBodyLimit))
+		c.Abort()
+	}
+}
+
+// forwardAuthRequest builds the subrequest describing r to the auth service
+func forwardAuthRequest(r *http.Request, cfg config.ForwardAuthConfig) *http.Request {
+	req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, cfg.Address, nil)
+
+	if len(cfg.RequestHeaders) == 0 {
+		req.Header = r.Header.Clone()
+		for _, name := range hopHeaders {
+			req.Header.Del(name)
+		}
+	} else {
+		for _, name := range cfg.RequestHeaders {
+			if values := r.Header.Values(name); len(values) > 0 {
+				req.Header[textproto.CanonicalMIMEHeaderKey(name)] = values
+			}
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", logger.GetClientIP(r))
+	return req
+}
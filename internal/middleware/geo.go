@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+)
+
+// geoChallengeKey marks requests that must pass a short-lived verification
+const geoChallengeKey = "geo_challenge"
+
+// GeoBlockMiddleware blocks or challenges clients by country. Blocked clients
+// get the forbidden page; challenged clients go through verification with a
+// shortened cookie lifetime. Allowlisted clients are not checked.
+func GeoBlockMiddleware(log *logger.Logger, geo config.GeoBlockConfig, page *pages.Page) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isBypassed(c) {
+			c.Next()
+			return
+		}
+
+		clientIP := logger.GetClientIP(c.Request)
+		country := log.GetCountry(clientIP)
+		if !geo.Matches(country) {
+			c.Next()
+			return
+		}
+
+		if geo.Action == config.GeoActionChallenge {
+			c.Set(geoChallengeKey, true)
+			c.Next()
+			return
+		}
+
+		log.WithFields(map[string]interface{}{
+			"ip":      clientIP,
+			"country": country,
+			"method":  c.Request.Method,
+			"path":    c.Request.URL.Path,
+		}).Info("Request blocked by country")
+
+		page.Write(c.Writer, c.Request, http.StatusForbidden)
+		c.Abort()
+	}
+}
+
+// isGeoChallenged reports whether the request must pass a geo challenge
+func isGeoChallenged(c *gin.Context) bool {
+	return c.GetBool(geoChallengeKey)
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/pages"
+)
+
+// maintenanceRetryAfter is advertised to clients while maintenance mode is on
+const maintenanceRetryAfter = "300"
+
+// MaintenanceMiddleware answers proxied requests with the maintenance page while
+// enabled reports true. Registered routes such as /health and /status keep working.
+// Proxied requests that are let through are counted in inFlight (optional) so a
+// drain can be observed; keep-alive connections are closed during maintenance.
+func MaintenanceMiddleware(page *pages.Page, enabled func() bool, inFlight *atomic.Int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.FullPath() != "" {
+			c.Next()
+			return
+		}
+
+		if !enabled() {
+			if inFlight != nil {
+				inFlight.Add(1)
+				defer inFlight.Add(-1)
+			}
+			c.Next()
+			return
+		}
+
+		c.Header("Connection", "close")
+		c.Header("Retry-After", maintenanceRetryAfter)
+		page.Write(c.Writer, c.Request, http.StatusServiceUnavailable)
+		c.Abort()
+	}
+}
@@ -0,0 +1,172 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// MemoryLimiter is an in-process per-key token bucket rate limiter covering the
+// general limit and every path-scoped rule
+type MemoryLimiter struct {
+	config  config.LimitConfig
+	general *bucketSet   // nil when the general limit is disabled
+	rules   []*bucketSet // parallel to config.Rules
+	logger  *logger.Logger
+}
+
+// bucketSet holds the token buckets of one limit
+type bucketSet struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	capacity  float64
+	rate      float64 // tokens per second
+	lastSweep time.Time
+}
+
+// tokenBucket holds the state of a single client's bucket
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryLimiter creates a limiter enforcing the given limit configuration
+func NewMemoryLimiter(logger *logger.Logger, limit config.LimitConfig) *MemoryLimiter {
+	ml := &MemoryLimiter{
+		config: limit,
+		logger: logger,
+	}
+	if limit.GeneralEnabled() {
+		ml.general = newBucketSet(limit.Count, limit.Window)
+	}
+	for _, rule := range limit.Rules {
+		ml.rules = append(ml.rules, newBucketSet(rule.Count, rule.Window))
+	}
+	return ml
+}
+
+// newBucketSet creates buckets allowing count requests per window seconds
+func newBucketSet(count, window int) *bucketSet {
+	return &bucketSet{
+		buckets:   make(map[string]*tokenBucket),
+		capacity:  float64(count),
+		rate:      float64(count) / float64(window),
+		lastSweep: clock.Now(),
+	}
+}
+
+// Allow consumes tokens for key on path and reports whether the request may proceed
+func (ml *MemoryLimiter) Allow(key, path string) bool {
+	result := ml.check(key, path)
+	return result == nil || result.allowed
+}
+
+// check counts the request against every applicable limit and returns the
+// rejecting result, or the tightest one when the request is allowed. The
+// general limit is debited the path's cost.
+func (ml *MemoryLimiter) check(key, path string) *limitResult {
+	var reported *limitResult
+	if i, ok := ml.config.MatchRule(path); ok {
+		result := ml.rules[i].take(key, 1)
+		if !result.allowed {
+			return result
+		}
+		reported = result
+	}
+	if ml.general != nil {
+		result := ml.general.take(key, float64(ml.config.CostOf(path)))
+		if !result.allowed {
+			return result
+		}
+		reported = tighter(reported, result)
+	}
+	return reported
+}
+
+// take consumes cost tokens for key and reports the resulting quota
+func (bs *bucketSet) take(key string, cost float64) *limitResult {
+	now := clock.Now()
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.sweep(now)
+
+	bucket, ok := bs.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: bs.capacity, last: now}
+		bs.buckets[key] = bucket
+	}
+
+	// Refill according to elapsed time
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bs.rate
+	if bucket.tokens > bs.capacity {
+		bucket.tokens = bs.capacity
+	}
+	bucket.last = now
+
+	result := &limitResult{limit: int(bs.capacity)}
+	if bucket.tokens >= cost {
+		bucket.tokens -= cost
+		result.allowed = true
+	} else {
+		result.retryAfter = bs.refill(cost - bucket.tokens)
+	}
+	result.remaining = int(bucket.tokens)
+	result.reset = bs.refill(bs.capacity - bucket.tokens)
+	return result
+}
+
+// refill returns how long it takes to regain the given number of tokens
+func (bs *bucketSet) refill(tokens float64) time.Duration {
+	return time.Duration(tokens / bs.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely to bound memory usage
+func (bs *bucketSet) sweep(now time.Time) {
+	if now.Sub(bs.lastSweep) < time.Minute {
+		return
+	}
+	bs.lastSweep = now
+
+	fullAfter := time.Duration(bs.capacity / bs.rate * float64(time.Second))
+	for key, bucket := range bs.buckets {
+		if now.Sub(bucket.last) > fullAfter {
+			delete(bs.buckets, key)
+		}
+	}
+}
+
+// RateLimitMiddleware creates a rate limiting middleware backed by this limiter
+func (ml *MemoryLimiter) RateLimitMiddleware(keyFunc RateLimitKeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ml.limit(c, keyFunc)
+	}
+}
+
+// limit applies the limiter to a single request
+func (ml *MemoryLimiter) limit(c *gin.Context, keyFunc RateLimitKeyFunc) {
+	if isBypassed(c) {
+		c.Next()
+		return
+	}
+
+	result := ml.check(keyFunc(c), c.Request.URL.Path)
+	if result == nil {
+		c.Next()
+		return
+	}
+	if !result.allowed {
+		ml.logger.LogRateLimit(c.Request)
+		abortRateLimited(c, result)
+		return
+	}
+
+	setRateLimitHeaders(c, result)
+	c.Next()
+}
@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/oidc"
+	"okaproxy/internal/pages"
+)
+
+const (
+	// OIDCSessionCookie carries a signed-in user's identity
+	OIDCSessionCookie = "oka_oidc_session"
+
+	// OIDCStateCookie ties a sign-in to the browser that started it
+	OIDCStateCookie = "oka_oidc_state"
+
+	// OIDCLogoutPath signs the user out
+	OIDCLogoutPath = "/_oka/logout"
+)
+
+// signInLifetime bounds how long a user may take at the provider
+const signInLifetime = 10 * time.Minute
+
+// oidcSession is the content of the session cookie
+type oidcSession struct {
+	Subject string `json:"sub"`
+	User    string `json:"user"`
+	Email   string `json:"email,omitempty"`
+	Expires int64  `json:"exp"`
+}
+
+// oidcSignIn is the content of the state cookie
+type oidcSignIn struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+	Expires  int64  `json:"exp"`
+}
+
+// OIDCMiddleware sends browsers without a session to the provider and passes
+// the identity of signed-in users to the target in headers. Clients cannot
+// set those headers themselves. Built-in endpoints are not protected.
+func OIDCMiddleware(log *logger.Logger, serverConfig *config.ServerConfig, provider *oidc.Provider, errorPage, forbidden *pages.Page) gin.HandlerFunc {
+	cfg := serverConfig.OIDC
+	callback := cfg.CallbackPath()
+	secure := strings.HasPrefix(cfg.RedirectURL, "https:")
+
+	return func(c *gin.Context) {
+		c.Request.Header.Del(cfg.UserHeader)
+		c.Request.Header.Del(cfg.EmailHeader)
+		if c.FullPath() != "" {
+			c.Next()
+			return
+		}
+
+		switch c.Request.URL.Path {
+		case callback:
+			finishSignIn(c, log, serverConfig, provider, secure, errorPage, forbidden)
+			return
+		case OIDCLogoutPath:
+			c.SetCookie(OIDCSessionCookie, "", -1, "/", "", secure, true)
+			logout := provider.LogoutURL()
+			if logout == "" {
+				logout = "/"
+			}
+			c.Redirect(http.StatusFound, logout)
+			c.Abort()
+			return
+		}
+
+		var session oidcSession
+		if openCookie(c, OIDCSessionCookie, serverConfig.SecretKey, &session) && clock.Now().Unix() < session.Expires {
+			c.Request.Header.Set(cfg.UserHeader, session.User)
+			if session.Email != "" {
+				c.Request.Header.Set(cfg.EmailHeader, session.Email)
+			}
+			c.Set(authenticatedKey, true)
+			c.Next()
+			return
+		}
+		if !cfg.Protects(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		defer c.Abort()
+
+		// Only page loads can follow the provider's login flow
+		if c.Request.Method != http.MethodGet || !acceptsHTML(c.Request) {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": "Sign-in required"})
+			return
+		}
+
+		signIn := oidcSignIn{
+			State:    oidc.RandomString(),
+			Nonce:    oidc.RandomString(),
+			Verifier: oidc.RandomString(),
+			Return:   c.Request.URL.RequestURI(),
+			Expires:  clock.Now().Add(signInLifetime).Unix(),
+		}
+		authURL, err := provider.AuthURL(signIn.State, signIn.Nonce, signIn.Verifier)
+		if err != nil {
+			log.Errorf("Failed to start sign-in for %s: %v", serverConfig.Name, err)
+			errorPage.Write(c.Writer, c.Request, http.StatusBadGateway)
+			return
+		}
+		setSignedCookie(c, OIDCStateCookie, signIn, int(signInLifetime/time.Second), serverConfig.SecretKey, secure)
+		c.Redirect(http.StatusFound, authURL)
+	}
+}
+
+// finishSignIn handles the provider redirecting the user back with a code,
+// and starts their session
+func finishSignIn(c *gin.Context, log *logger.Logger, serverConfig *config.ServerConfig, provider *oidc.Provider, secure bool, errorPage, forbidden *pages.Page) {
+	defer c.Abort()
+	cfg := serverConfig.OIDC
+
+	var signIn oidcSignIn
+	if !openCookie(c, OIDCStateCookie, serverConfig.SecretKey, &signIn) ||
+		clock.Now().Unix() > signIn.Expires ||
+		!hmac.Equal([]byte(c.Query("state")), []byte(signIn.State)) {
+		c.String(http.StatusBadRequest, "Sign-in expired, please try again.")
+		return
+	}
+	c.SetCookie(OIDCStateCookie, "", -1, "/", "", secure, true)
+
+	if reason := c.Query("error"); reason != "" {
+		log.WithFields(map[string]interface{}{
+			"ip":          logger.GetClientIP(c.Request),
+			"error":       reason,
+			"description": c.Query("error_description"),
+		}).Warn("Sign-in refused by the identity provider")
+		forbidden.Write(c.Writer, c.Request, http.StatusForbidden)
+		return
+	}
+
+	claims, err := provider.Exchange(c.Query("code"), signIn.Verifier, signIn.Nonce)
+	if err != nil {
+		log.Errorf("Failed to complete sign-in for %s: %v", serverConfig.Name, err)
+		errorPage.Write(c.Writer, c.Request, http.StatusBadGateway)
+		return
+	}
+
+	verified := claims.EmailVerified == nil || *claims.EmailVerified
+	if !cfg.Admits(claims.Email, verified) {
+		log.WithFields(map[string]interface{}{
+			"ip":    logger.GetClientIP(c.Request),
+			"user":  claims.User(),
+			"email": claims.Email,
+		}).Warn("Sign-in rejected: user not allowed")
+		forbidden.Write(c.Writer, c.Request, http.StatusForbidden)
+		return
+	}
+
+	session := oidcSession{
+		Subject: claims.Subject,
+		User:    claims.User(),
+		Email:   claims.Email,
+		Expires: clock.Now().Add(time.Duration(cfg.Session) * time.Second).Unix(),
+	}
+	setSignedCookie(c, OIDCSessionCookie, session, cfg.Session, serverConfig.SecretKey, secure)
+	log.WithFields(map[string]interface{}{
+		"ip":   logger.GetClientIP(c.Request),
+		"user": session.User,
+	}).Info("User signed in")
+
+	// Only return to paths on this server
+	target := signIn.Return
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		target = "/"
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// setSignedCookie stores value as JSON in a cookie signed with secretKey
+func setSignedCookie(c *gin.Context, name string, value interface{}, maxAge int, secretKey string, secure bool) {
+	encoded, _ := json.Marshal(value)
+	data := base64.RawURLEncoding.EncodeToString(encoded)
+	c.SetCookie(name, data+"."+cookieSignature(name, data, secretKey), maxAge, "/", "", secure, true)
+}
+
+// openCookie decodes a cookie set by setSignedCookie into value, reporting
+// whether it was present and its signature holds
+func openCookie(c *gin.Context, name, secretKey string, value interface{}) bool {
+	cookie, err := c.Cookie(name)
+	if err != nil {
+		return false
+	}
+	data, signature, ok := cutLast(cookie, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(cookieSignature(name, data, secretKey))) {
+		return false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(data)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(decoded, value) == nil
+}
+
+// cookieSignature signs a cookie's data; the name keeps one cookie from
+// standing in for another
+func cookieSignature(name, data, secretKey string) string {
+	h := hmac.New(sha256.New, []byte(secretKey))
+	h.Write([]byte(name + ":" + data))
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rate limit response headers
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset" // Seconds until the quota is fully restored
+)
+
+// limitResult describes the state of one limit after counting a request
+type limitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // until the quota is fully restored
+	retryAfter time.Duration // until the next request is allowed (rejected requests only)
+}
+
+// tighter returns the result that leaves the client less headroom
+func tighter(a, b *limitResult) *limitResult {
+	if a == nil {
+		return b
+	}
+	if b == nil || a.remaining <= b.remaining {
+		return a
+	}
+	return b
+}
+
+// setRateLimitHeaders reports the client's quota on the response
+func setRateLimitHeaders(c *gin.Context, r *limitResult) {
+	c.Header(RateLimitLimitHeader, strconv.Itoa(r.limit))
+	c.Header(RateLimitRemainingHeader, strconv.Itoa(r.remaining))
+	c.Header(RateLimitResetHeader, strconv.Itoa(ceilSeconds(r.reset)))
+}
+
+// abortRateLimited rejects a request that exceeded its rate limit
+func abortRateLimited(c *gin.Context, r *limitResult) {
+	recordViolation(c)
+	c.Set(rateLimitedKey, true)
+
+	setRateLimitHeaders(c, r)
+	retryAfter := ceilSeconds(r.retryAfter)
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"message":     "Too many requests, please try again later.",
+		"retry_after": retryAfter,
+	})
+	c.Abort()
+}
+
+// ceilSeconds rounds d up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/jwt"
+	"okaproxy/internal/logger"
+)
+
+// RateLimitKeyFunc derives the rate limit key of a request
+type RateLimitKeyFunc func(c *gin.Context) string
+
+// NewRateLimitKeyFunc builds the key function for a rate_limit_key setting.
+// Requests that do not carry the configured credential are keyed by client IP,
+// as are JWT subjects whose token jwtConfig does not verify. Header and cookie
+// values are client-supplied, so they only key requests an identity stage
+// (basic auth, OIDC, forward auth, API keys) has accepted: a client sending a
+// fresh value with each request would otherwise get a fresh bucket each time.
+// The ban stage runs ahead of those, so bans under these strategies are by IP.
+func NewRateLimitKeyFunc(setting string, jwtConfig config.JWTConfig) RateLimitKeyFunc {
+	strategy, name, err := config.ParseRateLimitKey(setting)
+	if err != nil {
+		strategy = config.RateLimitKeyIP
+	}
+
+	switch strategy {
+	case config.RateLimitKeyHeader:
+		return func(c *gin.Context) string {
+			if value := c.Request.Header.Get(name); value != "" && isAuthenticated(c) {
+				return credentialKey(strategy, value)
+			}
+			return logger.GetClientIP(c.Request)
+		}
+	case config.RateLimitKeyCookie:
+		return func(c *gin.Context) string {
+			if cookie, err := c.Request.Cookie(name); err == nil && cookie.Value != "" && isAuthenticated(c) {
+				return credentialKey(strategy, cookie.Value)
+			}
+			return logger.GetClientIP(c.Request)
+		}
+	case config.RateLimitKeyJWTSub:
+		verifier := jwt.New(jwt.Options{
+			Secret:   jwtConfig.HMACSecret,
+			JWKSURL:  jwtConfig.JWKSURL,
+			Issuer:   jwtConfig.Issuer,
+			Audience: jwtConfig.Audience,
+		})
+		return func(c *gin.Context) string {
+			if subject := jwtSubject(verifier, c.Request.Header.Get(name)); subject != "" {
+				return credentialKey(strategy, subject)
+			}
+			return logger.GetClientIP(c.Request)
+		}
+	default:
+		return func(c *gin.Context) string {
+			return logger.GetClientIP(c.Request)
+		}
+	}
+}
+
+// credentialKey hashes a client-supplied value so keys stay short and secrets stay out of Redis
+func credentialKey(strategy, value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return strategy + ":" + hex.EncodeToString(sum[:16])
+}
+
+// jwtSubject returns the "sub" claim of a bearer token, or "" when the token
+// is missing or fails verification
+func jwtSubject(verifier *jwt.Verifier, value string) string {
+	token := strings.TrimSpace(value)
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = strings.TrimSpace(token[7:])
+	}
+	if token == "" {
+		return ""
+	}
+	subject, err := verifier.Subject(token)
+	if err != nil {
+		return ""
+	}
+	return subject
+}
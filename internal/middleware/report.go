@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/logger"
+	"okaproxy/internal/report"
+)
+
+// bannedKey marks requests rejected because of a temporary ban
+const bannedKey = "banned"
+
+// ReportMiddleware feeds every finished request into the traffic report collector
+func ReportMiddleware(log *logger.Logger, collector *report.Collector, server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		country := log.GetCountry(logger.GetClientIP(c.Request))
+		collector.Record(server, country, c.Request.URL.Path, c.Writer.Status(), c.GetBool(bannedKey))
+	}
+}
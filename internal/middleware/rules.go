@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+)
+
+// ruleAllowedKey marks requests let through by an allow rule, which the WAF
+// then leaves alone
+const ruleAllowedKey = "rule_allowed"
+
+// ruleBodyLimit caps the bytes of a body that rules match against
+const ruleBodyLimit = 64 * 1024
+
+// requestRule is a rule with its patterns compiled; nil patterns match anything
+type requestRule struct {
+	config.RequestRule
+	path, query, body *regexp.Regexp
+	headers           map[string]*regexp.Regexp
+}
+
+// RulesMiddleware applies the server's request rules in order; the first rule
+// whose conditions all hold blocks or allows the request
+func RulesMiddleware(log *logger.Logger, rules []config.RequestRule, forbidden *pages.Page) gin.HandlerFunc {
+	// Validated in config.Validate
+	compile := func(pattern string) *regexp.Regexp {
+		if pattern == "" {
+			return nil
+		}
+		return regexp.MustCompile(pattern)
+	}
+	compiled := make([]*requestRule, 0, len(rules))
+	readsBody := false
+	for _, rule := range rules {
+		r := &requestRule{
+			RequestRule: rule,
+			path:        compile(rule.Path),
+			query:       compile(rule.Query),
+			body:        compile(rule.Body),
+			headers:     make(map[string]*regexp.Regexp),
+		}
+		for name, pattern := range rule.Headers {
+			r.headers[name] = regexp.MustCompile(pattern)
+		}
+		readsBody = readsBody || r.body != nil
+		compiled = append(compiled, r)
+	}
+
+	return func(c *gin.Context) {
+		var body []byte
+		if readsBody && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(c.Request.Body, ruleBodyLimit))
+			if err != nil {
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			c.Request.Body = &replayedBody{Reader: io.MultiReader(bytes.NewReader(body), c.Request.Body), body: c.Request.Body}
+		}
+
+		for _, rule := range compiled {
+			if !rule.matches(c.Request, body) {
+				continue
+			}
+			if rule.Action == config.RuleActionAllow {
+				c.Set(ruleAllowedKey, true)
+				break
+			}
+
+			log.WithFields(map[string]interface{}{
+				"ip":     logger.GetClientIP(c.Request),
+				"method": c.Request.Method,
+				"path":   c.Request.URL.Path,
+				"rule":   rule.Name,
+			}).Info("Request blocked by rule")
+			if rule.Message == "" {
+				forbidden.Write(c.Writer, c.Request, rule.Status)
+			} else {
+				c.String(rule.Status, rule.Message)
+			}
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// matches reports whether every condition of the rule holds for r
+func (rule *requestRule) matches(r *http.Request, body []byte) bool {
+	if len(rule.Methods) > 0 && !slices.ContainsFunc(rule.Methods, func(method string) bool {
+		return strings.EqualFold(method, r.Method)
+	}) {
+		return false
+	}
+	if rule.path != nil && !rule.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if rule.query != nil && !rule.query.MatchString(r.URL.RawQuery) {
+		return false
+	}
+	for name, pattern := range rule.headers {
+		if !pattern.MatchString(r.Header.Get(name)) {
+			return false
+		}
+	}
+	if rule.body != nil && !rule.body.Match(body) {
+		return false
+	}
+	return true
+}
+
+// isRuleAllowed reports whether an allow rule let the request through
+func isRuleAllowed(c *gin.Context) bool {
+	return c.GetBool(ruleAllowedKey)
+}
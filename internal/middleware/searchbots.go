@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+)
+
+// verifiedBotKey marks requests from verified search engine crawlers
+const verifiedBotKey = "verified_bot"
+
+// botLookupTimeout bounds the DNS lookups verifying a crawler
+const botLookupTimeout = 2 * time.Second
+
+// How long verification results are kept. Lookups that fail are retried
+// sooner than ones that gave an answer.
+const (
+	botVerdictTTL = 24 * time.Hour
+	botFailureTTL = time.Minute
+)
+
+// searchBot is a crawler recognized by its User-Agent, whose addresses resolve
+// to hosts under its operator's domains
+type searchBot struct {
+	name    string
+	agents  []string // User-Agent substrings, lowercase
+	domains []string // Host name suffixes
+}
+
+// searchBots are the crawlers whose operators document reverse DNS
+// verification
+var searchBots = []searchBot{
+	{"Googlebot", []string{"googlebot", "google-inspectiontool", "googleother", "storebot-google", "adsbot-google", "mediapartners-google"}, []string{".googlebot.com", ".google.com"}},
+	{"Bingbot", []string{"bingbot", "adidxbot", "bingpreview", "msnbot"}, []string{".search.msn.com"}},
+	{"Applebot", []string{"applebot"}, []string{".applebot.apple.com"}},
+	{"YandexBot", []string{"yandex.com/bots"}, []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+	{"Baiduspider", []string{"baiduspider"}, []string{".baidu.com", ".baidu.jp"}},
+	{"Yahoo Slurp", []string{"yahoo! slurp"}, []string{".crawl.yahoo.net"}},
+}
+
+// botVerdict is the cached outcome of verifying an address for a crawler
+type botVerdict struct {
+	verified bool
+	failed   bool // The lookups did not complete
+	expires  time.Time
+}
+
+// BotVerifier checks that clients claiming to be search engine crawlers
+// connect from their operator's addresses. Results are cached across reloads.
+type BotVerifier struct {
+	resolver *net.Resolver
+	logger   *logger.Logger
+
+	mu       sync.Mutex
+	verdicts map[string]botVerdict // by crawler name and address
+}
+
+// NewBotVerifier creates a crawler verifier using the system resolver
+func NewBotVerifier(log *logger.Logger) *BotVerifier {
+	return &BotVerifier{
+		resolver: net.DefaultResolver,
+		logger:   log,
+		verdicts: make(map[string]botVerdict),
+	}
+}
+
+// Middleware marks requests from verified crawlers so they skip the
+// verification challenge, and rejects impostors with the forbidden page when
+// the server blocks them
+func (bv *BotVerifier) Middleware(serverConfig *config.ServerConfig, forbidden *pages.Page) gin.HandlerFunc {
+	blockImpostors := serverConfig.SearchBots.BlocksImpostors()
+	return func(c *gin.Context) {
+		bot, ok := claimedBot(c.Request.UserAgent())
+		if !ok {
+			c.Next()
+			return
+		}
+
+		ip := logger.GetClientIP(c.Request)
+		verdict := bv.verify(bot, ip)
+		switch {
+		case verdict.verified:
+			c.Set(verifiedBotKey, true)
+		case !verdict.failed && blockImpostors:
+			bv.logger.WithFields(map[string]interface{}{
+				"ip":   ip,
+				"bot":  bot.name,
+				"path": c.Request.URL.Path,
+			}).Info("Request rejected: fake search engine crawler")
+			forbidden.Write(c.Writer, c.Request, http.StatusForbidden)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// isVerifiedBot reports whether the request comes from a verified crawler
+func isVerifiedBot(c *gin.Context) bool {
+	return c.GetBool(verifiedBotKey)
+}
+
+// claimedBot returns the crawler a User-Agent claims to be
+func claimedBot(userAgent string) (searchBot, bool) {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range searchBots {
+		for _, agent := range bot.agents {
+			if strings.Contains(userAgent, agent) {
+				return bot, true
+			}
+		}
+	}
+	return searchBot{}, false
+}
+
+// verify returns the cached verdict for ip, looking it up when missing
+func (bv *BotVerifier) verify(bot searchBot, ip string) botVerdict {
+	key := bot.name + "|" + ip
+	now := clock.Now()
+
+	bv.mu.Lock()
+	verdict, ok := bv.verdicts[key]
+	bv.mu.Unlock()
+	if ok && now.Before(verdict.expires) {
+		return verdict
+	}
+
+	verdict = bv.lookup(bot, ip)
+	ttl := botVerdictTTL
+	if verdict.failed {
+		ttl = botFailureTTL
+	}
+	verdict.expires = now.Add(ttl)
+
+	bv.mu.Lock()
+	// Expired verdicts are dropped as the cache fills up with new addresses
+	if len(bv.verdicts) >= 10000 {
+		for k, v := range bv.verdicts {
+			if now.After(v.expires) {
+				delete(bv.verdicts, k)
+			}
+		}
+	}
+	bv.verdicts[key] = verdict
+	bv.mu.Unlock()
+	return verdict
+}
+
+// lookup resolves ip to host names under the crawler's domains, then checks
+// that one of them resolves back to ip
+func (bv *BotVerifier) lookup(bot searchBot, ip string) botVerdict {
+	ctx, cancel := context.WithTimeout(context.Background(), botLookupTimeout)
+	defer cancel()
+
+	names, err := bv.resolver.LookupAddr(ctx, ip)
+	if err != nil && !isNotFound(err) {
+		bv.logger.Debugf("Failed to verify %s at %s: %v", bot.name, ip, err)
+		return botVerdict{failed: true}
+	}
+
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !slices.ContainsFunc(bot.domains, func(domain string) bool { return strings.HasSuffix(name, domain) }) {
+			continue
+		}
+		addrs, err := bv.resolver.LookupHost(ctx, name)
+		if err != nil {
+			if !isNotFound(err) {
+				bv.logger.Debugf("Failed to verify %s at %s: %v", bot.name, ip, err)
+				return botVerdict{failed: true}
+			}
+			continue
+		}
+		if slices.Contains(addrs, ip) {
+			return botVerdict{verified: true}
+		}
+	}
+	return botVerdict{}
+}
+
+// isNotFound reports whether a lookup failed because the name does not exist
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
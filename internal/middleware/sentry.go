@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/sentry"
+)
+
+// ErrorReportMiddleware reports panics and bursts of 5xx responses to Sentry.
+// Panics are passed on to the recovery middleware after being reported.
+func ErrorReportMiddleware(reporter *sentry.Reporter, server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				// Aborted handlers are not errors
+				if err != http.ErrAbortHandler {
+					reporter.CapturePanic(c.Request, server, err, debug.Stack())
+				}
+				panic(err)
+			}
+		}()
+
+		c.Next()
+
+		reporter.ObserveStatus(c.Request, server, c.Writer.Status())
+	}
+}
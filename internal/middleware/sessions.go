@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/store"
+)
+
+// VerificationSessionCookie identifies the server-side session of a verified client
+const VerificationSessionCookie = "oka_validation_session"
+
+// sessionKeyPrefix namespaces verification sessions in the store
+const sessionKeyPrefix = "session:"
+
+// sessionTimeout bounds store operations on the request path
+const sessionTimeout = 2 * time.Second
+
+// Session is a verification issued to a client
+type Session struct {
+	IP      string    `json:"ip"`
+	Issued  time.Time `json:"issued"`
+	Expires time.Time `json:"expires"`
+}
+
+// SessionStore records issued verifications in the state store, so they can
+// be counted and revoked. Sessions expire with their cookies.
+type SessionStore struct {
+	store  store.Store
+	logger *logger.Logger
+}
+
+// NewSessionStore creates a session store keeping sessions in st
+func NewSessionStore(st store.Store, log *logger.Logger) *SessionStore {
+	return &SessionStore{store: st, logger: log}
+}
+
+// sessionKey returns the store key of a server's session
+func sessionKey(server, id string) string {
+	return sessionKeyPrefix + server + ":" + id
+}
+
+// create records a new session and returns its ID. The ID is returned even
+// when the store fails, so the client is asked to verify again later rather
+// than right away.
+func (ss *SessionStore) create(server, ip string, lifetime time.Duration) string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	id := hex.EncodeToString(random)
+
+	now := clock.Now()
+	value, _ := json.Marshal(Session{IP: ip, Issued: now, Expires: now.Add(lifetime)})
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+	if err := ss.store.Set(ctx, sessionKey(server, id), string(value), lifetime); err != nil {
+		ss.logger.Warnf("Failed to record verification session: %v", err)
+	}
+	return id
+}
+
+// valid reports whether a session exists. Clients are let through when the
+// store cannot be reached.
+func (ss *SessionStore) valid(server, id string) bool {
+	if id == "" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+	_, err := ss.store.Get(ctx, sessionKey(server, id))
+	if errors.Is(err, store.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		ss.logger.Debugf("Failed to look up verification session: %v", err)
+	}
+	return true
+}
+
+// Count returns the active sessions of a server
+func (ss *SessionStore) Count(server string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+
+	keys, err := ss.keys(ctx, server)
+	return len(keys), err
+}
+
+// keys returns the store keys of a server's sessions
+func (ss *SessionStore) keys(ctx context.Context, server string) ([]string, error) {
+	prefix := sessionKey(server, "")
+	keys, err := ss.store.Keys(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	// Servers whose names extend this one's past a colon share the prefix
+	return slices.DeleteFunc(keys, func(key string) bool {
+		return strings.Contains(key[len(prefix):], ":")
+	}), nil
+}
+
+// Revoke ends one session of a server, reporting whether it existed
+func (ss *SessionStore) Revoke(server, id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+
+	key := sessionKey(server, id)
+	if _, err := ss.store.Get(ctx, key); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, ss.store.Delete(ctx, key)
+}
+
+// RevokeAll ends every session of a server and returns how many there were
+func (ss *SessionStore) RevokeAll(server string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionTimeout)
+	defer cancel()
+
+	keys, err := ss.keys(ctx, server)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err := ss.store.Delete(ctx, key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,264 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/store"
+)
+
+// storeProbeInterval is how often an unavailable store is re-checked
+const storeProbeInterval = 5 * time.Second
+
+// StateManager manages shared state (rate limit counters, cache) kept in a store
+type StateManager struct {
+	store  store.Store
+	logger *logger.Logger
+
+	// Availability tracking for the in-memory rate limit fallback
+	available    atomic.Bool
+	probing      atomic.Bool
+	stop         chan struct{}
+	fallbackOnce sync.Once
+	fallback     *MemoryLimiter
+}
+
+// NewStateManager creates a new state manager backed by st
+func NewStateManager(logger *logger.Logger, st store.Store) *StateManager {
+	sm := &StateManager{
+		store:  st,
+		logger: logger,
+		stop:   make(chan struct{}),
+	}
+	sm.available.Store(true)
+	return sm
+}
+
+// Store returns the underlying state store
+func (sm *StateManager) Store() store.Store {
+	return sm.store
+}
+
+// Close closes the store
+func (sm *StateManager) Close() {
+	close(sm.stop)
+	if sm.store != nil {
+		sm.store.Close()
+	}
+}
+
+// Ping tests the store connection. A failure switches rate limiting to the
+// in-memory fallback until the store becomes reachable again.
+func (sm *StateManager) Ping() error {
+	err := sm.ping()
+	if err != nil {
+		sm.markUnavailable(err)
+	}
+	return err
+}
+
+func (sm *StateManager) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return sm.store.Ping(ctx)
+}
+
+// Available reports whether the store is currently considered reachable
+func (sm *StateManager) Available() bool {
+	return sm.available.Load()
+}
+
+// markUnavailable switches to the fallback and starts probing the store
+func (sm *StateManager) markUnavailable(err error) {
+	if sm.available.CompareAndSwap(true, false) {
+		sm.logger.Warnf("%s store unavailable (%v), falling back to in-memory rate limiting", sm.store.Name(), err)
+	}
+	if sm.probing.CompareAndSwap(false, true) {
+		go sm.probe()
+	}
+}
+
+// probe pings the store until it answers, then re-promotes it. Probing ends
+// before the store is re-promoted, so an error right after starts a new probe.
+func (sm *StateManager) probe() {
+	ticker := time.NewTicker(storeProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sm.stop:
+			sm.probing.Store(false)
+			return
+		case <-ticker.C:
+			if err := sm.ping(); err == nil {
+				sm.probing.Store(false)
+				sm.available.Store(true)
+				sm.logger.Infof("%s store restored, rate limiting re-promoted to it", sm.store.Name())
+				return
+			}
+		}
+	}
+}
+
+// fallbackLimiter returns the shared in-memory limiter used while the store is down
+func (sm *StateManager) fallbackLimiter(cfg *config.Config) *MemoryLimiter {
+	sm.fallbackOnce.Do(func() {
+		sm.fallback = NewMemoryLimiter(sm.logger, cfg.Limit)
+	})
+	return sm.fallback
+}
+
+// RateLimitMiddleware creates a rate limiting middleware using the store
+func (sm *StateManager) RateLimitMiddleware(cfg *config.Config, keyFunc RateLimitKeyFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Skip rate limiting if disabled or the client is allowlisted
+		if !cfg.Limit.Enabled() || isBypassed(c) {
+			c.Next()
+			return
+		}
+
+		// Use the local limiter while the store is unavailable
+		if !sm.Available() {
+			sm.fallbackLimiter(cfg).limit(c, keyFunc)
+			return
+		}
+
+		clientKey := keyFunc(c)
+		var reported *limitResult
+
+		// Path-scoped rule first, so it does not consume the general budget when it rejects
+		if i, ok := cfg.Limit.MatchRule(c.Request.URL.Path); ok {
+			rule := cfg.Limit.Rules[i]
+			key := fmt.Sprintf("oka_rate_limit:%s:%s", rule.Path, clientKey)
+			result, err := sm.count(key, rule.Count, rule.Window, 1)
+			if err != nil {
+				sm.failOver(c, cfg, keyFunc, err)
+				return
+			}
+			reported = result
+		}
+
+		// General per-client limit, debited the path's cost
+		if reported == nil || reported.allowed {
+			if cfg.Limit.GeneralEnabled() {
+				key := fmt.Sprintf("oka_rate_limit:%s", clientKey)
+				cost := cfg.Limit.CostOf(c.Request.URL.Path)
+				result, err := sm.count(key, cfg.Limit.Count, cfg.Limit.Window, cost)
+				if err != nil {
+					sm.failOver(c, cfg, keyFunc, err)
+					return
+				}
+				if result.allowed {
+					reported = tighter(reported, result)
+				} else {
+					reported = result
+				}
+			}
+		}
+
+		if reported != nil {
+			if !reported.allowed {
+				sm.logger.LogRateLimit(c.Request)
+				abortRateLimited(c, reported)
+				return
+			}
+			setRateLimitHeaders(c, reported)
+		}
+
+		c.Next()
+	}
+}
+
+// count adds cost to the counter at key and reports the resulting quota
+func (sm *StateManager) count(key string, limit, window, cost int) (*limitResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	requests, reset, err := sm.store.IncrBy(ctx, key, int64(cost), time.Duration(window)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &limitResult{
+		allowed: requests <= int64(limit),
+		limit:   limit,
+		reset:   reset,
+	}
+	if result.allowed {
+		result.remaining = limit - int(requests)
+	} else {
+		result.retryAfter = reset
+	}
+	return result, nil
+}
+
+// failOver protects the backend locally while the store fails
+func (sm *StateManager) failOver(c *gin.Context, cfg *config.Config, keyFunc RateLimitKeyFunc, err error) {
+	sm.logger.Errorf("%s rate limit error: %v", sm.store.Name(), err)
+	sm.markUnavailable(err)
+	sm.fallbackLimiter(cfg).limit(c, keyFunc)
+}
+
+// SetCache stores a response in the cache
+func (sm *StateManager) SetCache(key string, value string, duration time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return sm.store.Set(ctx, key, value, duration)
+}
+
+// GetCache retrieves a cached value
+func (sm *StateManager) GetCache(key string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return sm.store.Get(ctx, key)
+}
+
+// GetHash retrieves all fields of a hash
+func (sm *StateManager) GetHash(key string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	return sm.store.GetHash(ctx, key)
+}
+
+// IncrementCounter increments a counter in the store
+func (sm *StateManager) IncrementCounter(key string, expiration time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	count, _, err := sm.store.Incr(ctx, key, expiration)
+	return count, err
+}
+
+// GetStats returns basic store stats
+func (sm *StateManager) GetStats() map[string]interface{} {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	stats := make(map[string]interface{})
+	stats["backend"] = sm.store.Name()
+
+	// Check connectivity
+	if err := sm.store.Ping(ctx); err == nil {
+		stats["store_info"] = "connected"
+	} else {
+		stats["store_info"] = "error: " + err.Error()
+	}
+
+	// Backend-specific statistics
+	if statter, ok := sm.store.(interface{ Stats() map[string]interface{} }); ok {
+		stats["pool_stats"] = statter.Stats()
+	}
+
+	return stats
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+)
+
+// StaticMiddleware serves files from the configured root in place of the
+// target. Requests for proxied paths continue down the chain; unknown paths
+// get the single-page app shell when a fallback is configured, else a 404.
+func StaticMiddleware(cfg config.StaticConfig) gin.HandlerFunc {
+	root := http.Dir(cfg.Root)
+	return func(c *gin.Context) {
+		if cfg.Proxied(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		defer c.Abort()
+
+		if c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead {
+			c.Header("Allow", "GET, HEAD")
+			c.String(http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		name := path.Clean("/" + c.Request.URL.Path)
+		f, info, ok := openStatic(root, name)
+		if !ok && cfg.SPAFallback != "" {
+			// The shell changes with every deploy, so it is always revalidated
+			f, info, ok = openStatic(root, "/"+cfg.SPAFallback)
+			c.Header("Cache-Control", "no-cache")
+		}
+		if !ok {
+			c.Writer.Header().Del("Cache-Control")
+			c.String(http.StatusNotFound, "Not found")
+			return
+		}
+		defer f.Close()
+
+		http.ServeContent(c.Writer, c.Request, info.Name(), info.ModTime(), f)
+	}
+}
+
+// openStatic opens the file for name, or the index.html of a directory.
+// Hidden files such as .env are never served.
+func openStatic(root http.FileSystem, name string) (http.File, fs.FileInfo, bool) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, nil, false
+		}
+	}
+
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, false
+	}
+	if info.IsDir() {
+		f.Close()
+		return openStatic(root, path.Join(name, "index.html"))
+	}
+	return f, info, true
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+)
+
+// responseTimeoutKey is the context key of a route's upstream response timeout
+type responseTimeoutKey struct{}
+
+// TimeoutMiddleware applies the timeouts of the route matching a request: the
+// connection's read and write deadlines are moved, and the upstream response
+// timeout is recorded for the proxy. It must run before any middleware wraps
+// the response writer.
+func TimeoutMiddleware(cfg config.TimeoutsConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, ok := cfg.Route(c.Request.URL.Path)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		rc := http.NewResponseController(c.Writer)
+		if route.Read > 0 {
+			rc.SetReadDeadline(time.Now().Add(time.Duration(route.Read) * time.Second))
+		}
+		if route.Write > 0 {
+			rc.SetWriteDeadline(time.Now().Add(time.Duration(route.Write) * time.Second))
+		}
+		if route.Response > 0 {
+			timeout := time.Duration(route.Response) * time.Second
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), responseTimeoutKey{}, timeout))
+		}
+		c.Next()
+	}
+}
+
+// ResponseTimeout returns the upstream response timeout of a request's route
+func ResponseTimeout(ctx context.Context) (time.Duration, bool) {
+	timeout, ok := ctx.Value(responseTimeoutKey{}).(time.Duration)
+	return timeout, ok
+}
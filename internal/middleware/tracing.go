@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/logger"
+	"okaproxy/internal/telemetry"
+)
+
+// TracingMiddleware starts the server span of every request. Later stages and
+// the upstream round trip become its children.
+func TracingMiddleware(tracer *telemetry.Tracer, server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, span := tracer.StartServerSpan(c.Request, c.Request.Method)
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttribute("okaproxy.server", server)
+		span.SetAttribute("http.request.method", c.Request.Method)
+		span.SetAttribute("url.path", c.Request.URL.Path)
+		span.SetAttribute("client.address", logger.GetClientIP(c.Request))
+		span.SetAttribute("user_agent.original", c.Request.UserAgent())
+		span.SetAttribute("http.response.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Sprintf("responded %d", status))
+		}
+		span.End()
+	}
+}
+
+// TraceStage records a middleware stage as a span. Stages that pass the request
+// on include the stages after them.
+func TraceStage(tracer *telemetry.Tracer, stage string, handler gin.HandlerFunc) gin.HandlerFunc {
+	if tracer == nil {
+		return handler
+	}
+	return func(c *gin.Context) {
+		parent := c.Request.Context()
+		ctx, span := tracer.StartSpan(parent, "middleware "+stage, telemetry.KindInternal)
+		c.Request = c.Request.WithContext(ctx)
+
+		handler(c)
+
+		if c.IsAborted() && span != nil {
+			span.SetAttribute("okaproxy.aborted", true)
+		}
+		span.End()
+
+		// Stages that return without calling c.Next are followed by the next one
+		c.Request = c.Request.WithContext(parent)
+	}
+}
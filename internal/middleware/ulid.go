@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"encoding/binary"
+
+	"okaproxy/internal/clock"
+)
+
+// crockfordAlphabet is the Base32 alphabet used by ULIDs
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// generateRequestID generates a ULID: a 48-bit millisecond timestamp followed by
+// 80 random bits, encoded as 26 Crockford Base32 characters. ULIDs sort by creation
+// time, which keeps correlated log lines ordered across services.
+func generateRequestID() string {
+	var id [16]byte
+	ms := uint64(clock.Now().UnixMilli())
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	clock.Read(id[6:])
+
+	// Encode 128 bits as 26 characters, most significant bits first
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// underAttackKey marks requests served while the server is under attack
+const underAttackKey = "under_attack"
+
+// UnderAttackMiddleware marks requests while active reports the server under
+// attack, so the verification challenge no longer exempts non-browser clients
+func UnderAttackMiddleware(active func() bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if active() {
+			c.Set(underAttackKey, true)
+		}
+		c.Next()
+	}
+}
+
+// isUnderAttack reports whether the request arrived in under attack mode
+func isUnderAttack(c *gin.Context) bool {
+	return c.GetBool(underAttackKey)
+}
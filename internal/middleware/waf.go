@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+	"okaproxy/internal/waf"
+)
+
+// WAFMiddleware inspects requests with the engine's rules and rejects those
+// reaching the anomaly threshold with the forbidden page, which counts towards
+// a ban. In detect mode they are only logged. The start of the body is read
+// for inspection and put back for the target. Requests let through by an
+// allow rule are not inspected.
+func WAFMiddleware(log *logger.Logger, cfg config.WAFConfig, engine *waf.Engine, forbidden *pages.Page) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.Skips(c.Request.URL.Path) || isRuleAllowed(c) {
+			c.Next()
+			return
+		}
+
+		request := &waf.Request{
+			Method:     c.Request.Method,
+			URI:        c.Request.RequestURI,
+			Path:       c.Request.URL.Path,
+			Query:      c.Request.URL.RawQuery,
+			Protocol:   c.Request.Proto,
+			Headers:    c.Request.Header,
+			RemoteAddr: logger.GetClientIP(c.Request),
+			ID:         c.GetString("RequestID"),
+		}
+		if cfg.BodyLimit > 0 && c.Request.Body != nil && c.Request.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(cfg.BodyLimit)))
+			if err != nil {
+				c.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+			request.Body = body
+			c.Request.Body = &replayedBody{Reader: io.MultiReader(bytes.NewReader(body), c.Request.Body), body: c.Request.Body}
+		}
+
+		result := engine.Inspect(request)
+		if len(result.Matches) == 0 {
+			c.Next()
+			return
+		}
+
+		fields := map[string]interface{}{
+			"ip":      logger.GetClientIP(c.Request),
+			"method":  c.Request.Method,
+			"path":    c.Request.URL.Path,
+			"score":   result.Score,
+			"rules":   result.Matches,
+			"blocked": result.Blocked && cfg.Mode == config.WAFModeBlock,
+		}
+		if !result.Blocked {
+			log.WithFields(fields).Debug("WAF rules matched below the threshold")
+			c.Next()
+			return
+		}
+		c.Set(wafFlaggedKey, true)
+		if cfg.Mode == config.WAFModeDetect {
+			log.WithFields(fields).Warn("WAF would block request")
+			c.Next()
+			return
+		}
+
+		log.WithFields(fields).Warn("Request blocked by WAF")
+		recordViolation(c)
+		forbidden.Write(c.Writer, c.Request, http.StatusForbidden)
+		c.Abort()
+	}
+}
+
+// replayedBody is a request body whose start was read ahead
+type replayedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// Close closes the original body
+func (rb *replayedBody) Close() error {
+	return rb.body.Close()
+}
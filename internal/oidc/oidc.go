@@ -0,0 +1,273 @@
+// Package oidc signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. ID tokens come straight from the
+// provider's token endpoint over TLS, so their issuer, audience, expiry and
+// nonce are checked but not their signature, as OpenID Connect Core 3.1.3.7
+// allows.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/clock"
+)
+
+const requestTimeout = 10 * time.Second
+
+// discoveryTTL is how long provider metadata is used before it is fetched again
+const discoveryTTL = time.Hour
+
+// Options configures a provider
+type Options struct {
+	Issuer       string   // e.g. "https://accounts.google.com"
+	ClientID     string   // Client registered with the provider
+	ClientSecret string   // Empty for public clients
+	RedirectURL  string   // Callback registered with the provider
+	Scopes       []string // Requested scopes, including "openid"
+}
+
+// Claims identifies a signed-in user
+type Claims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     *bool  `json:"email_verified"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// User returns the name the user is known by: their username, email or subject
+func (c *Claims) User() string {
+	switch {
+	case c.PreferredUsername != "":
+		return c.PreferredUsername
+	case c.Email != "":
+		return c.Email
+	}
+	return c.Subject
+}
+
+// metadata is the part of the provider's discovery document in use
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// Provider talks to one OpenID Connect provider
+type Provider struct {
+	options Options
+	http    *http.Client
+
+	mu      sync.Mutex
+	meta    *metadata
+	fetched time.Time
+}
+
+// New creates a provider. Its discovery document is fetched on first use.
+func New(options Options) *Provider {
+	return &Provider{
+		options: options,
+		http:    &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// AuthURL returns the provider's login URL for a sign-in carrying state, the
+// nonce expected back in the ID token and the PKCE verifier
+func (p *Provider) AuthURL(state, nonce, verifier string) (string, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.options.ClientID},
+		"redirect_uri":          {p.options.RedirectURL},
+		"scope":                 {strings.Join(p.options.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// LogoutURL returns the provider's end session endpoint, or "" when it has none
+func (p *Provider) LogoutURL() string {
+	meta, err := p.discover()
+	if err != nil {
+		return ""
+	}
+	return meta.EndSessionEndpoint
+}
+
+// Exchange redeems an authorization code and returns the claims of the ID
+// token, which must carry nonce
+func (p *Provider) Exchange(code, verifier, nonce string) (*Claims, error) {
+	meta, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.options.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if p.options.ClientSecret == "" {
+		form.Set("client_id", p.options.ClientID)
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.options.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.options.ClientID), url.QueryEscape(p.options.ClientSecret))
+	}
+
+	var response struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := p.do(req, &response); err != nil {
+		if response.Error != "" {
+			return nil, fmt.Errorf("oidc: token endpoint: %s %s", response.Error, response.ErrorDescription)
+		}
+		return nil, fmt.Errorf("oidc: token endpoint: %v", err)
+	}
+	if response.IDToken == "" {
+		return nil, errors.New("oidc: token endpoint returned no ID token")
+	}
+	return p.verify(response.IDToken, meta.Issuer, nonce)
+}
+
+// verify decodes an ID token and checks that it was issued to this client for
+// this sign-in and has not expired
+func (p *Provider) verify(idToken, issuer, nonce string) (*Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("oidc: malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token: %v", err)
+	}
+
+	var token struct {
+		Claims
+		Issuer   string          `json:"iss"`
+		Audience json.RawMessage `json:"aud"`
+		Expiry   int64           `json:"exp"`
+		Nonce    string          `json:"nonce"`
+	}
+	if err := json.Unmarshal(payload, &token); err != nil {
+		return nil, fmt.Errorf("oidc: malformed ID token: %v", err)
+	}
+
+	// The audience is a string or a list of them
+	var audience []string
+	if err := json.Unmarshal(token.Audience, &audience); err != nil {
+		var single string
+		if err := json.Unmarshal(token.Audience, &single); err != nil {
+			return nil, errors.New("oidc: ID token has no audience")
+		}
+		audience = []string{single}
+	}
+
+	switch {
+	case token.Issuer != issuer:
+		return nil, fmt.Errorf("oidc: ID token issued by %s, expected %s", token.Issuer, issuer)
+	case !slices.Contains(audience, p.options.ClientID):
+		return nil, errors.New("oidc: ID token issued to another client")
+	case clock.Now().Unix() > token.Expiry:
+		return nil, errors.New("oidc: ID token expired")
+	case token.Nonce != nonce:
+		return nil, errors.New("oidc: ID token nonce mismatch")
+	case token.Subject == "":
+		return nil, errors.New("oidc: ID token has no subject")
+	}
+	return &token.Claims, nil
+}
+
+// discover returns the provider metadata, fetching it when missing or stale.
+// Stale metadata is kept when the provider cannot be reached.
+func (p *Provider) discover() (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && clock.Now().Sub(p.fetched) < discoveryTTL {
+		return p.meta, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(p.options.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	var meta metadata
+	if err := p.do(req, &meta); err != nil {
+		if p.meta != nil {
+			return p.meta, nil
+		}
+		return nil, fmt.Errorf("oidc: discovery: %v", err)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" {
+		return nil, errors.New("oidc: discovery: authorization or token endpoint missing")
+	}
+	if meta.Issuer == "" {
+		meta.Issuer = p.options.Issuer
+	}
+
+	p.meta = &meta
+	p.fetched = clock.Now()
+	return p.meta, nil
+}
+
+// do sends a request and decodes the JSON response into result, which is
+// filled in for error responses too
+func (p *Provider) do(req *http.Request, result interface{}) error {
+	resp, err := p.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, result)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return decodeErr
+}
+
+// RandomString returns a random URL-safe string for states, nonces and PKCE
+// verifiers
+func RandomString() string {
+	random := make([]byte, 32)
+	rand.Read(random)
+	return base64.RawURLEncoding.EncodeToString(random)
+}
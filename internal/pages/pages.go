@@ -0,0 +1,147 @@
+package pages
+
+import (
+	"bytes"
+	"compress/gzip"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Data is made available to page templates when they are pre-rendered
+type Data struct {
+	ServerName string
+}
+
+// Page is a fully rendered HTML page kept in memory with precompressed variants
+type Page struct {
+	identity []byte
+	gzip     []byte
+	brotli   []byte
+}
+
+// Compile renders content as an HTML template with data and precompresses the result.
+// Content that is not a valid template is served verbatim.
+func Compile(content string, data Data) *Page {
+	rendered := []byte(content)
+	if tmpl, err := template.New("page").Parse(content); err == nil {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err == nil {
+			rendered = buf.Bytes()
+		}
+	}
+
+	return &Page{
+		identity: rendered,
+		gzip:     gzipBytes(rendered),
+		brotli:   brotliBytes(rendered),
+	}
+}
+
+// Write serves the page with the given status, choosing the best encoding the client accepts
+func (p *Page) Write(w http.ResponseWriter, r *http.Request, status int) {
+	body, encoding := p.negotiate(r.Header.Get("Accept-Encoding"))
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Cache-Control", "no-store")
+	h.Add("Vary", "Accept-Encoding")
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	} else {
+		h.Del("Content-Encoding")
+	}
+
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+// negotiate picks the smallest variant allowed by the Accept-Encoding header
+func (p *Page) negotiate(acceptEncoding string) ([]byte, string) {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(fields) > 1 && strings.ReplaceAll(strings.TrimSpace(fields[1]), " ", "") == "q=0" {
+			continue
+		}
+		accepted[name] = true
+	}
+
+	switch {
+	case accepted["br"] && p.brotli != nil:
+		return p.brotli, "br"
+	case accepted["gzip"] && p.gzip != nil:
+		return p.gzip, "gzip"
+	default:
+		return p.identity, ""
+	}
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if _, err := gz.Write(data); err != nil {
+		return nil
+	}
+	if err := gz.Close(); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+func brotliBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	br := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := br.Write(data); err != nil {
+		return nil
+	}
+	if err := br.Close(); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
+
+// Template is a page rendered on every request, for content that differs per client
+type Template struct {
+	tmpl     *template.Template
+	verbatim []byte
+}
+
+// CompileTemplate parses content as an HTML template. Content that is not a
+// valid template is served verbatim.
+func CompileTemplate(content string) *Template {
+	tmpl, err := template.New("page").Parse(content)
+	if err != nil {
+		return &Template{verbatim: []byte(content)}
+	}
+	return &Template{tmpl: tmpl}
+}
+
+// Write renders the template with data and serves it with the given status
+func (t *Template) Write(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	body := t.verbatim
+	if t.tmpl != nil {
+		var buf bytes.Buffer
+		if err := t.tmpl.Execute(&buf, data); err == nil {
+			body = buf.Bytes()
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Cache-Control", "no-store")
+	h.Del("Content-Encoding")
+
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
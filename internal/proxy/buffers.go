@@ -0,0 +1,36 @@
+package proxy
+
+import "sync"
+
+// copyBufferSize matches the buffer io.Copy and ReverseProxy allocate per copy
+const copyBufferSize = 32 * 1024
+
+// bufferPool lends the buffers ReverseProxy copies bodies through, shared by
+// all proxies so a busy server does not allocate one per request
+var bufferPool = &syncBufferPool{
+	pool: sync.Pool{
+		New: func() any {
+			buf := make([]byte, copyBufferSize)
+			return &buf
+		},
+	},
+}
+
+// syncBufferPool implements httputil.BufferPool with a sync.Pool
+type syncBufferPool struct {
+	pool sync.Pool
+}
+
+// Get returns a buffer for copying a body
+func (bp *syncBufferPool) Get() []byte {
+	return *bp.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool
+func (bp *syncBufferPool) Put(buf []byte) {
+	if cap(buf) != copyBufferSize {
+		return
+	}
+	buf = buf[:copyBufferSize]
+	bp.pool.Put(&buf)
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+// discardWriter is a ResponseWriter that drops the body, so the benchmark
+// measures the proxy's own allocations
+type discardWriter struct {
+	header http.Header
+}
+
+func (dw *discardWriter) Header() http.Header         { return dw.header }
+func (dw *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (dw *discardWriter) WriteHeader(int)             {}
+
+// BenchmarkReverseProxy proxies a 256 KB response with and without the shared
+// buffer pool; compare allocs/op and B/op of the two runs
+func BenchmarkReverseProxy(b *testing.B) {
+	body := bytes.Repeat([]byte("x"), 256*1024)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+
+	for _, bench := range []struct {
+		name string
+		pool httputil.BufferPool
+	}{
+		{"pool", bufferPool},
+		{"no_pool", nil},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.BufferPool = bench.pool
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				proxy.ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+			}
+		})
+	}
+}
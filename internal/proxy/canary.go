@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/flags"
+	"okaproxy/internal/pages"
+)
+
+// CanaryCookie holds the client's canary bucket, 0-99
+const CanaryCookie = "oka_canary"
+
+// canaryCookieAge keeps a client's bucket for a week
+const canaryCookieAge = 7 * 24 * 3600
+
+// canaryRouter sends the clients whose bucket is below the current weight to
+// the canary target
+type canaryRouter struct {
+	proxy    *httputil.ReverseProxy
+	upstream *upstream
+	weight   func() int
+}
+
+// newCanaryRouter creates the canary router of a server, or nil when it has no
+// canary target. The canary_weight flag overrides the configured weight.
+func (pm *ProxyManager) newCanaryRouter(serverConfig *config.ServerConfig, errorPage *pages.Page, snapshots *Snapshotter, serverFlags *flags.ServerFlags) *canaryRouter {
+	if !serverConfig.Canary.Enabled() {
+		return nil
+	}
+	canaryConfig := *serverConfig
+	canaryConfig.TargetURL = serverConfig.Canary.Target
+	canaryProxy, err := pm.CreateReverseProxy(&canaryConfig, errorPage, snapshots)
+	if err != nil {
+		pm.logger.Errorf("Failed to create canary reverse proxy: %v", err)
+		return nil
+	}
+	return &canaryRouter{
+		proxy:    canaryProxy,
+		upstream: pm.upstreams.lookup(serverConfig.Name, canaryConfig.TargetURL),
+		weight: func() int {
+			return min(max(serverFlags.Int(flags.CanaryWeight, serverConfig.Canary.Weight), 0), 100)
+		},
+	}
+}
+
+// route returns the canary proxy when the client's bucket is selected, or nil.
+// Clients without a bucket are assigned one while the canary has weight.
+func (cr *canaryRouter) route(c *gin.Context) *httputil.ReverseProxy {
+	weight := cr.weight()
+	if weight == 0 {
+		return nil
+	}
+
+	bucket := -1
+	if cookie, err := c.Request.Cookie(CanaryCookie); err == nil {
+		if n, err := strconv.Atoi(cookie.Value); err == nil && n >= 0 && n < 100 {
+			bucket = n
+		}
+	}
+	if bucket < 0 {
+		bucket = clock.Intn(100)
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     CanaryCookie,
+			Value:    strconv.Itoa(bucket),
+			Path:     "/",
+			MaxAge:   canaryCookieAge,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	if bucket >= weight || !cr.upstream.available() {
+		return nil
+	}
+	return cr.proxy
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+
+	"okaproxy/internal/middleware"
+)
+
+// CorrelationCounters counts how a backend handles the propagated request ID
+type CorrelationCounters struct {
+	Echoed     uint64
+	Missing    uint64
+	Mismatched uint64
+}
+
+// Compliance returns the fraction of responses that echoed the request ID
+func (cc CorrelationCounters) Compliance() float64 {
+	total := cc.Echoed + cc.Missing + cc.Mismatched
+	if total == 0 {
+		return 1
+	}
+	return float64(cc.Echoed) / float64(total)
+}
+
+// correlationTracker records request ID echo compliance per upstream
+type correlationTracker struct {
+	mu        sync.Mutex
+	upstreams map[string]*CorrelationCounters
+	flagged   map[string]bool
+}
+
+func newCorrelationTracker() *correlationTracker {
+	return &correlationTracker{
+		upstreams: make(map[string]*CorrelationCounters),
+		flagged:   make(map[string]bool),
+	}
+}
+
+// observe checks whether resp echoes the request ID of its request. It returns the
+// observed outcome and whether this is the first time the upstream dropped correlation.
+func (ct *correlationTracker) observe(upstream string, resp *http.Response) (string, bool) {
+	sent := resp.Request.Header.Get(middleware.RequestIDHeader)
+	if sent == "" {
+		return "", false
+	}
+	echoed := resp.Header.Get(middleware.RequestIDHeader)
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	counters, ok := ct.upstreams[upstream]
+	if !ok {
+		counters = &CorrelationCounters{}
+		ct.upstreams[upstream] = counters
+	}
+
+	var outcome string
+	switch echoed {
+	case sent:
+		counters.Echoed++
+		return "echoed", false
+	case "":
+		counters.Missing++
+		outcome = "missing"
+	default:
+		counters.Mismatched++
+		outcome = "mismatched"
+	}
+
+	first := !ct.flagged[upstream]
+	ct.flagged[upstream] = true
+	return outcome, first
+}
+
+// snapshot returns a copy of the counters for an upstream
+func (ct *correlationTracker) snapshot(upstream string) CorrelationCounters {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if counters, ok := ct.upstreams[upstream]; ok {
+		return *counters
+	}
+	return CorrelationCounters{}
+}
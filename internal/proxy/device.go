@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"okaproxy/internal/config"
+)
+
+// acceptClientHints lists the hints requested from browsers when accept_ch is on
+const acceptClientHints = "Sec-CH-UA-Mobile, Sec-CH-UA-Platform"
+
+// botSignatures are User-Agent fragments of crawlers and scripted clients
+var botSignatures = []string{
+	"bot", "crawl", "spider", "slurp", "facebookexternalhit", "mediapartners",
+	"headless", "curl/", "wget/", "python-requests", "go-http-client",
+}
+
+// mobileSignatures are User-Agent fragments of phones and tablets
+var mobileSignatures = []string{
+	"mobi", "android", "iphone", "ipad", "ipod", "windows phone", "opera mini",
+}
+
+// classifyDevice derives the device class of a request. Bots are recognized by
+// their User-Agent; otherwise the Sec-CH-UA-Mobile client hint wins over
+// User-Agent sniffing.
+func classifyDevice(r *http.Request) string {
+	ua := strings.ToLower(r.Header.Get("User-Agent"))
+	if ua == "" || containsAny(ua, botSignatures) {
+		return config.DeviceBot
+	}
+
+	switch strings.TrimSpace(r.Header.Get("Sec-CH-UA-Mobile")) {
+	case "?1":
+		return config.DeviceMobile
+	case "?0":
+		return config.DeviceDesktop
+	}
+
+	if containsAny(ua, mobileSignatures) {
+		return config.DeviceMobile
+	}
+	return config.DeviceDesktop
+}
+
+func containsAny(s string, fragments []string) bool {
+	for _, fragment := range fragments {
+		if strings.Contains(s, fragment) {
+			return true
+		}
+	}
+	return false
+}
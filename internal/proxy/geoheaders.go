@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Geolocation headers sent to the target
+const (
+	geoCountryHeader = "X-Geo-Country"
+	geoCityHeader    = "X-Geo-City"
+	geoASNHeader     = "X-Geo-ASN"
+)
+
+// setGeoHeaders replaces client-supplied geolocation headers with lookups of
+// clientIP. Unknown values are left out.
+func (pm *ProxyManager) setGeoHeaders(req *http.Request, clientIP string) {
+	req.Header.Del(geoCountryHeader)
+	req.Header.Del(geoCityHeader)
+	req.Header.Del(geoASNHeader)
+
+	place := pm.logger.GetPlace(clientIP)
+	if place.Country != "" {
+		req.Header.Set(geoCountryHeader, place.Country)
+	}
+	if place.City != "" {
+		req.Header.Set(geoCityHeader, place.City)
+	}
+	if asn, _ := pm.logger.GetASN(clientIP); asn != 0 {
+		req.Header.Set(geoASNHeader, strconv.FormatUint(uint64(asn), 10))
+	}
+}
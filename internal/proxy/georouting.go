@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http/httputil"
+	"strings"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/pages"
+)
+
+// targetGroup spreads requests over its targets by weight
+type targetGroup struct {
+	name      string
+	proxies   []*httputil.ReverseProxy
+	upstreams []*upstream
+	weights   []int
+}
+
+// pick returns a target proxy, chosen at random in proportion to the weights
+// of the targets that are not drained; nil when every target is drained
+func (tg *targetGroup) pick() *httputil.ReverseProxy {
+	total := 0
+	for i, u := range tg.upstreams {
+		if u.available() {
+			total += tg.weights[i]
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := clock.Intn(total)
+	for i, u := range tg.upstreams {
+		if !u.available() {
+			continue
+		}
+		if n < tg.weights[i] {
+			return tg.proxies[i]
+		}
+		n -= tg.weights[i]
+	}
+	return nil
+}
+
+// geoRouter selects a target group from the client's country or continent
+type geoRouter struct {
+	countries  map[string]*targetGroup
+	continents map[string]*targetGroup
+	fallback   *targetGroup
+}
+
+// newGeoRouter builds the target groups of a server; nil when geo routing is off
+func (pm *ProxyManager) newGeoRouter(serverConfig *config.ServerConfig, errorPage *pages.Page, snapshots *Snapshotter) *geoRouter {
+	routing := serverConfig.GeoRouting
+	if !routing.Enabled() {
+		return nil
+	}
+
+	router := &geoRouter{
+		countries:  make(map[string]*targetGroup),
+		continents: make(map[string]*targetGroup),
+	}
+	for _, group := range routing.Groups {
+		tg := &targetGroup{name: group.Name}
+		for _, target := range group.Targets {
+			targetConfig := *serverConfig
+			targetConfig.TargetURL = target.URL
+			targetProxy, err := pm.CreateReverseProxy(&targetConfig, errorPage, snapshots)
+			if err != nil {
+				pm.logger.Errorf("Failed to create reverse proxy for %s in group %s: %v", target.URL, group.Name, err)
+				continue
+			}
+			tg.proxies = append(tg.proxies, targetProxy)
+			tg.upstreams = append(tg.upstreams, pm.upstreams.lookup(serverConfig.Name, target.URL))
+			tg.weights = append(tg.weights, target.EffectiveWeight())
+		}
+		if len(tg.proxies) == 0 {
+			continue
+		}
+
+		for _, code := range group.Countries {
+			router.countries[strings.ToUpper(code)] = tg
+		}
+		for _, code := range group.Continents {
+			router.continents[strings.ToUpper(code)] = tg
+		}
+		if group.Name == routing.Fallback {
+			router.fallback = tg
+		}
+	}
+	return router
+}
+
+// route returns the group serving place; nil means the default target
+func (gr *geoRouter) route(place logger.Place) *targetGroup {
+	if tg, ok := gr.countries[place.Country]; ok {
+		return tg
+	}
+	if tg, ok := gr.continents[place.Continent]; ok {
+		return tg
+	}
+	return gr.fallback
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+
+	"okaproxy/internal/config"
+)
+
+// safeResponseHeaders are always forwarded in strict mode
+var safeResponseHeaders = []string{
+	"Accept-Ranges",
+	"Age",
+	"Cache-Control",
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Language",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"Date",
+	"ETag",
+	"Expires",
+	"Last-Modified",
+	"Location",
+	"Retry-After",
+	"Set-Cookie",
+	"Vary",
+	"WWW-Authenticate",
+}
+
+// clientPathKey carries the path requested by the client through the proxy
+type clientPathKey struct{}
+
+// withClientPath records the client's request path before the target rewrites it
+func withClientPath(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), clientPathKey{}, r.URL.Path))
+}
+
+// clientPath returns the path the client requested
+func clientPath(r *http.Request) string {
+	if path, ok := r.Context().Value(clientPathKey{}).(string); ok {
+		return path
+	}
+	return r.URL.Path
+}
+
+// responseHeaderFilter drops upstream response headers that are not allowlisted
+type responseHeaderFilter struct {
+	config  config.ResponseHeadersConfig
+	allowed map[string]bool
+}
+
+// newResponseHeaderFilter builds the filter, or returns nil when strict mode is off
+func newResponseHeaderFilter(cfg config.ResponseHeadersConfig) *responseHeaderFilter {
+	if !cfg.Strict {
+		return nil
+	}
+
+	allowed := make(map[string]bool, len(safeResponseHeaders)+len(cfg.Allow))
+	for _, name := range safeResponseHeaders {
+		allowed[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range cfg.Allow {
+		allowed[http.CanonicalHeaderKey(name)] = true
+	}
+	return &responseHeaderFilter{config: cfg, allowed: allowed}
+}
+
+// apply removes every non-allowlisted header from the upstream response
+func (f *responseHeaderFilter) apply(resp *http.Response) {
+	if f == nil || !f.config.StrictFor(clientPath(resp.Request)) {
+		return
+	}
+	for name := range resp.Header {
+		if !f.allowed[name] {
+			resp.Header.Del(name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// meshOverloadRetryAfter is advertised to clients when the mesh reports overload
+const meshOverloadRetryAfter = "5"
+
+// meshHeaders applies service mesh header conventions at the edge: clients may
+// not inject mesh control headers, configured hints are sent upstream, and mesh
+// diagnostics in responses are logged instead of leaking to clients.
+type meshHeaders struct {
+	config config.MeshConfig
+	server string
+	logger *logger.Logger
+}
+
+// newMeshHeaders returns nil when no mesh mode is configured
+func newMeshHeaders(serverConfig *config.ServerConfig, log *logger.Logger) *meshHeaders {
+	if serverConfig.Mesh.Mode == "" {
+		return nil
+	}
+	return &meshHeaders{config: serverConfig.Mesh, server: serverConfig.Name, logger: log}
+}
+
+// isMeshHeader reports whether name belongs to Envoy or Linkerd
+func isMeshHeader(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasPrefix(name, "x-envoy-") || strings.HasPrefix(name, "l5d-")
+}
+
+// prepare strips client-supplied mesh headers and adds the configured hints
+func (mh *meshHeaders) prepare(req *http.Request, clientIP string) {
+	if mh == nil {
+		return
+	}
+
+	for name := range req.Header {
+		if isMeshHeader(name) {
+			req.Header.Del(name)
+		}
+	}
+
+	switch mh.config.Mode {
+	case config.MeshEnvoy:
+		req.Header.Set("X-Envoy-External-Address", clientIP)
+		if mh.config.RetryOn != "" {
+			req.Header.Set("X-Envoy-Retry-On", mh.config.RetryOn)
+		}
+		if mh.config.MaxRetries > 0 {
+			req.Header.Set("X-Envoy-Max-Retries", strconv.Itoa(mh.config.MaxRetries))
+		}
+		if mh.config.Timeout > 0 {
+			req.Header.Set("X-Envoy-Upstream-Rq-Timeout-Ms", strconv.Itoa(mh.config.Timeout))
+		}
+	case config.MeshLinkerd:
+		if mh.config.DstOverride != "" {
+			req.Header.Set("L5d-Dst-Override", mh.config.DstOverride)
+		}
+	}
+}
+
+// apply records mesh failure hints and removes mesh headers from the response
+func (mh *meshHeaders) apply(resp *http.Response) {
+	if mh == nil {
+		return
+	}
+
+	fields := map[string]interface{}{
+		"server": mh.server,
+		"status": resp.StatusCode,
+		"url":    resp.Request.URL.String(),
+	}
+	if resp.Header.Get("X-Envoy-Overloaded") != "" {
+		mh.logger.WithFields(fields).Warn("Mesh reported upstream overload")
+		if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") == "" {
+			resp.Header.Set("Retry-After", meshOverloadRetryAfter)
+		}
+	}
+	if proxyError := resp.Header.Get("L5d-Proxy-Error"); proxyError != "" {
+		fields["error"] = proxyError
+		mh.logger.WithFields(fields).Warn("Mesh proxy failed to reach the upstream")
+	}
+
+	for name := range resp.Header {
+		if isMeshHeader(name) {
+			resp.Header.Del(name)
+		}
+	}
+}
@@ -2,36 +2,67 @@ package proxy
 
 import (
 	"fmt"
-	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	
 	"okaproxy/internal/config"
+	"okaproxy/internal/flags"
 	"okaproxy/internal/logger"
+	"okaproxy/internal/metrics"
+	"okaproxy/internal/middleware"
+	"okaproxy/internal/pages"
+	"okaproxy/internal/sentry"
+	"okaproxy/internal/telemetry"
+	"okaproxy/internal/version"
 )
 
 // ProxyManager manages HTTP proxy operations
 type ProxyManager struct {
-	logger    *logger.Logger
-	errorPage string
+	logger      *logger.Logger
+	tracer      *telemetry.Tracer
+	reporter    *sentry.Reporter
+	correlation *correlationTracker
+	resumption  *resumptionTracker
+	upstreams   *upstreamRegistry
+	draining    *atomic.Bool
 }
 
-// NewProxyManager creates a new proxy manager
-func NewProxyManager(logger *logger.Logger, errorPage string) *ProxyManager {
+// NewProxyManager creates a new proxy manager; tracer and reporter may be nil
+func NewProxyManager(logger *logger.Logger, tracer *telemetry.Tracer, reporter *sentry.Reporter) *ProxyManager {
 	return &ProxyManager{
-		logger:    logger,
-		errorPage: errorPage,
+		logger:      logger,
+		tracer:      tracer,
+		reporter:    reporter,
+		correlation: newCorrelationTracker(),
+		resumption:  newResumptionTracker(),
+		upstreams:   newUpstreamRegistry(),
+		draining:    &atomic.Bool{},
 	}
 }
 
-// CreateReverseProxy creates a reverse proxy for the given target URL and configuration
-func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig) (*httputil.ReverseProxy, error) {
+// SetDraining makes the health check fail so load balancers stop sending
+// traffic while the proxy shuts down
+func (pm *ProxyManager) SetDraining(draining bool) {
+	pm.draining.Store(draining)
+}
+
+// WithLogger returns a proxy manager logging to l that shares everything else
+func (pm *ProxyManager) WithLogger(l *logger.Logger) *ProxyManager {
+	derived := *pm
+	derived.logger = l
+	return &derived
+}
+
+// CreateReverseProxy creates a reverse proxy for the given target URL and configuration;
+// snapshots may be nil
+func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig, errorPage *pages.Page, snapshots *Snapshotter) (*httputil.ReverseProxy, error) {
 	// Parse target URL
 	target, err := url.Parse(serverConfig.TargetURL)
 	if err != nil {
@@ -40,33 +71,65 @@ func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig) (*
 
 	// Create reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.BufferPool = bufferPool
 
 	// Configure transport
 	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
+			Timeout:   time.Duration(serverConfig.Timeouts.Connect) * time.Second,
 			KeepAlive: 30 * time.Second,
 		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
+		ForceAttemptHTTP2:     serverConfig.Transport.ForceAttemptHTTP2(),
+		MaxIdleConns:          serverConfig.Transport.MaxIdleConns,
+		MaxIdleConnsPerHost:   serverConfig.Transport.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(serverConfig.Transport.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(serverConfig.Transport.TLSHandshakeTimeout) * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 
+	// Configure upstream TLS
+	tlsConfig, err := buildUpstreamTLSConfig(&serverConfig.UpstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+	pm.resumption.observe(serverConfig.Name, tlsConfig)
+	transport.TLSClientConfig = tlsConfig
+	if serverConfig.UpstreamTLS.InsecureSkipVerify {
+		pm.logger.Warnf("Upstream TLS verification disabled for server %s", serverConfig.Name)
+	}
+
+	// A PROXY protocol header describes a single client, so connections to the
+	// target cannot be shared between requests
+	if serverConfig.UpstreamProxyProtocol != "" {
+		transport.DialContext = proxyProtocolDialer(serverConfig.UpstreamProxyProtocol, transport.DialContext)
+		transport.DisableKeepAlives = true
+	}
+
 	// Set connection limits if specified
 	if serverConfig.CtnMax > 0 {
-		transport.MaxIdleConnsPerHost = serverConfig.CtnMax
 		transport.MaxConnsPerHost = serverConfig.CtnMax
 	}
 
 	proxy.Transport = transport
+	if serverConfig.Timeouts.Response > 0 || len(serverConfig.Timeouts.Routes) > 0 {
+		proxy.Transport = &responseTimeoutTransport{
+			next:    proxy.Transport,
+			timeout: time.Duration(serverConfig.Timeouts.Response) * time.Second,
+		}
+	}
+	if pm.tracer != nil {
+		proxy.Transport = &tracingTransport{next: proxy.Transport, tracer: pm.tracer}
+	}
+
+	// Service mesh header conventions
+	mesh := newMeshHeaders(serverConfig, pm.logger)
 
 	// Custom director to modify requests
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
+		markSent(req)
 		
 		// Preserve original Host header or use target host
 		if req.Header.Get("Host") == "" {
@@ -93,6 +156,28 @@ func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig) (*
 		// Add X-Forwarded-Host header
 		req.Header.Set("X-Forwarded-Host", req.Header.Get("Host"))
 
+		// Geolocation of the client, never trusting client-supplied values
+		if serverConfig.GeoHeaders {
+			pm.setGeoHeaders(req, pm.getClientIP(req))
+		}
+
+		// Mesh control headers come from us, never from clients
+		mesh.prepare(req, pm.getClientIP(req))
+
+		// Announce the client to the target at L4 as well
+		if serverConfig.UpstreamProxyProtocol != "" {
+			withProxyHeader(req, serverConfig.UpstreamProxyProtocol, pm.getClientIP(req))
+		}
+
+		// Pass the verified client certificate subject, never trusting a client-supplied value
+		if serverConfig.HTTPS.ClientAuthEnabled() {
+			certHeader := serverConfig.HTTPS.ClientCertHeaderName()
+			req.Header.Del(certHeader)
+			if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+				req.Header.Set(certHeader, req.TLS.VerifiedChains[0][0].Subject.String())
+			}
+		}
+
 		// Log the proxied request
 		pm.logger.WithFields(map[string]interface{}{
 			"method":     req.Method,
@@ -103,8 +188,16 @@ func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig) (*
 		}).Debug("Proxying request")
 	}
 
+	// Passive health of the target, reported through the admin API
+	up := pm.upstreams.register(serverConfig.Name, serverConfig.TargetURL)
+
 	// Custom error handler
-	proxy.ErrorHandler = pm.createErrorHandler(serverConfig)
+	proxy.ErrorHandler = pm.createErrorHandler(serverConfig.Name, target.Host, up, errorPage, snapshots)
+
+	// Strict response header allowlist
+	headerFilter := newResponseHeaderFilter(serverConfig.ResponseHeaders)
+	securityHeaders := serverConfig.SecurityHeaders.Values()
+	hsts := serverConfig.SecurityHeaders.HSTSValue()
 
 	// Custom response modifier
 	originalModifyResponse := proxy.ModifyResponse
@@ -115,10 +208,38 @@ func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig) (*
 				return err
 			}
 		}
+		up.observe(resp.StatusCode, nil, sinceSent(resp.Request))
+
+		// Check whether the backend echoed the propagated request ID
+		if outcome, first := pm.correlation.observe(target.Host, resp); outcome != "" && outcome != "echoed" {
+			fields := map[string]interface{}{
+				"upstream":   target.Host,
+				"request_id": resp.Request.Header.Get(middleware.RequestIDHeader),
+				"echo":       outcome,
+			}
+			if first {
+				pm.logger.WithFields(fields).Warn("Upstream does not echo the request ID header")
+			} else {
+				pm.logger.WithFields(fields).Debug("Upstream dropped request correlation")
+			}
+		}
+		// The client already receives our request ID
+		resp.Header.Del(middleware.RequestIDHeader)
+
+		// Mesh diagnostics stay inside the mesh
+		mesh.apply(resp)
+
+		// Drop upstream headers outside the allowlist
+		headerFilter.apply(resp)
 
-		// Add security headers to response
+		// Security headers set at the edge replace the target's own
+		for _, header := range securityHeaders {
+			resp.Header.Del(header[0])
+		}
+		if resp.Request.TLS != nil && hsts != "" {
+			resp.Header.Del("Strict-Transport-Security")
+		}
 		resp.Header.Set("X-Proxy-By", "OkaProxy")
-		resp.Header.Set("X-Content-Type-Options", "nosniff")
 		
 		// Remove potentially sensitive headers
 		resp.Header.Del("Server")
@@ -131,44 +252,27 @@ func (pm *ProxyManager) CreateReverseProxy(serverConfig *config.ServerConfig) (*
 }
 
 // createErrorHandler creates a custom error handler for the proxy
-func (pm *ProxyManager) createErrorHandler(serverConfig *config.ServerConfig) func(http.ResponseWriter, *http.Request, error) {
+func (pm *ProxyManager) createErrorHandler(server, target string, up *upstream, errorPage *pages.Page, snapshots *Snapshotter) func(http.ResponseWriter, *http.Request, error) {
 	return func(w http.ResponseWriter, r *http.Request, err error) {
 		pm.logger.LogRequestFailure(r, err)
+		up.observe(0, err, sinceSent(r))
+		pm.reporter.CaptureProxyError(r, server, target, err)
 
-		// Set error headers
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.Header().Set("X-Proxy-Error", "true")
-		
-		// Write error page
-		w.WriteHeader(http.StatusBadGateway)
-		
-		if pm.errorPage != "" {
-			io.WriteString(w, pm.errorPage)
-		} else {
-			io.WriteString(w, `
-			<!DOCTYPE html>
-			<html>
-			<head>
-				<title>502 Bad Gateway</title>
-				<style>
-					body { font-family: Arial, sans-serif; text-align: center; margin-top: 100px; }
-					.error { color: #e74c3c; font-size: 24px; }
-					.message { color: #7f8c8d; margin-top: 20px; }
-				</style>
-			</head>
-			<body>
-				<div class="error">502 Bad Gateway</div>
-				<div class="message">The server is temporarily unavailable. Please try again later.</div>
-			</body>
-			</html>
-			`)
+		// Serve the last snapshot of the page while the target is down
+		if snapshots.Serve(w, r) {
+			return
 		}
+
+		// Serve the precompiled error page
+		w.Header().Set("X-Proxy-Error", "true")
+		errorPage.Write(w, r, http.StatusBadGateway)
 	}
 }
 
-// ProxyHandler creates a Gin handler that proxies requests
-func (pm *ProxyManager) ProxyHandler(serverConfig *config.ServerConfig) gin.HandlerFunc {
-	proxy, err := pm.CreateReverseProxy(serverConfig)
+// ProxyHandler creates a Gin handler that proxies requests; snapshots and
+// serverFlags may be nil
+func (pm *ProxyManager) ProxyHandler(serverConfig *config.ServerConfig, errorPage *pages.Page, snapshots *Snapshotter, serverFlags *flags.ServerFlags) gin.HandlerFunc {
+	proxy, err := pm.CreateReverseProxy(serverConfig, errorPage, snapshots)
 	if err != nil {
 		pm.logger.Errorf("Failed to create reverse proxy: %v", err)
 		return func(c *gin.Context) {
@@ -176,9 +280,79 @@ func (pm *ProxyManager) ProxyHandler(serverConfig *config.ServerConfig) gin.Hand
 		}
 	}
 
+	defaultUpstream := pm.upstreams.lookup(serverConfig.Name, serverConfig.TargetURL)
+
+	// Separate target groups per device class
+	device := serverConfig.Device
+	deviceProxies := make(map[string]*httputil.ReverseProxy, len(device.Targets))
+	deviceUpstreams := make(map[string]*upstream, len(device.Targets))
+	for class, targetURL := range device.Targets {
+		classConfig := *serverConfig
+		classConfig.TargetURL = targetURL
+		classProxy, err := pm.CreateReverseProxy(&classConfig, errorPage, snapshots)
+		if err != nil {
+			pm.logger.Errorf("Failed to create %s reverse proxy: %v", class, err)
+			continue
+		}
+		deviceProxies[class] = classProxy
+		deviceUpstreams[class] = pm.upstreams.lookup(serverConfig.Name, targetURL)
+	}
+
+	// Target groups per client location take precedence over device targets
+	geo := pm.newGeoRouter(serverConfig, errorPage, snapshots)
+
+	// A share of the clients of the default target goes to the canary
+	canary := pm.newCanaryRouter(serverConfig, errorPage, snapshots, serverFlags)
+
 	return func(c *gin.Context) {
+		target := proxy
+		var group *targetGroup
+		if geo != nil {
+			group = geo.route(pm.logger.GetPlace(pm.getClientIP(c.Request)))
+		}
+		if group != nil {
+			// A group whose targets are all drained falls back to the default target
+			if picked := group.pick(); picked != nil {
+				target = picked
+			} else {
+				group = nil
+			}
+		}
+		if device.Enabled() {
+			class := classifyDevice(c.Request)
+			if device.Header != "" {
+				// Never trust a client-supplied class
+				c.Request.Header.Set(device.Header, class)
+			}
+			if classProxy, ok := deviceProxies[class]; ok && group == nil && deviceUpstreams[class].available() {
+				target = classProxy
+			}
+			c.Writer.Header().Add("Vary", "Sec-CH-UA-Mobile, User-Agent")
+		}
+		if device.AcceptCH {
+			c.Header("Accept-CH", acceptClientHints)
+		}
+		if canary != nil && target == proxy {
+			if canaryProxy := canary.route(c); canaryProxy != nil {
+				target = canaryProxy
+			}
+		}
+
+		// Every usable target is drained
+		if target == proxy && !defaultUpstream.available() {
+			if snapshots.Serve(c.Writer, c.Request) {
+				return
+			}
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"message": "No upstream available, please try again later.",
+			})
+			return
+		}
+
 		// Use the reverse proxy to handle the request
-		proxy.ServeHTTP(c.Writer, c.Request)
+		upstreamStart := time.Now()
+		target.ServeHTTP(c.Writer, withClientPath(c.Request))
+		c.Set(middleware.UpstreamTimeKey, time.Since(upstreamStart))
 	}
 }
 
@@ -190,16 +364,24 @@ func (pm *ProxyManager) getClientIP(r *http.Request) string {
 // HealthCheckHandler provides a health check endpoint
 func (pm *ProxyManager) HealthCheckHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if pm.draining.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"status":    "draining",
+				"timestamp": time.Now().Unix(),
+				"version":   version.Get().Version,
+			})
+			return
+		}
 		c.JSON(http.StatusOK, gin.H{
 			"status":    "healthy",
 			"timestamp": time.Now().Unix(),
-			"version":   "1.0.0",
+			"version":   version.Get().Version,
 		})
 	}
 }
 
 // StatusHandler provides server status information
-func (pm *ProxyManager) StatusHandler(serverConfig *config.ServerConfig) gin.HandlerFunc {
+func (pm *ProxyManager) StatusHandler(serverConfig *config.ServerConfig, listenerMetrics *metrics.ListenerMetrics, counters *metrics.RequestCounters, queue *metrics.QueueMetrics) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Test target connectivity
 		targetStatus := "unknown"
@@ -212,11 +394,55 @@ func (pm *ProxyManager) StatusHandler(serverConfig *config.ServerConfig) gin.Han
 			}
 		}
 
+		correlation := gin.H{}
+		if targetURL, err := url.Parse(serverConfig.TargetURL); err == nil {
+			counters := pm.correlation.snapshot(targetURL.Host)
+			correlation = gin.H{
+				"echoed":     counters.Echoed,
+				"missing":    counters.Missing,
+				"mismatched": counters.Mismatched,
+				"compliance": counters.Compliance(),
+			}
+		}
+
+		resumption := pm.resumption.snapshot(serverConfig.Name)
+		upstreamTLS := gin.H{
+			"handshakes":         resumption.Handshakes,
+			"resumed":            resumption.Resumed,
+			"resumption_ratio":   resumption.Ratio(),
+			"session_cache_size": serverConfig.UpstreamTLS.SessionCacheSize,
+		}
+		if serverConfig.UpstreamTLS.DisableSessionResumption {
+			upstreamTLS["session_cache_size"] = 0
+		}
+
+		// Passive health of the default target, from the requests proxied to it
+		var health *UpstreamStatus
+		if u := pm.upstreams.lookup(serverConfig.Name, serverConfig.TargetURL); u != nil {
+			status := u.status()
+			health = &status
+		}
+
+		// Admissions through the concurrency limit and its queue
+		var concurrency *metrics.QueueSnapshot
+		if serverConfig.Concurrency.Enabled() {
+			snapshot := queue.Snapshot()
+			concurrency = &snapshot
+		}
+
 		c.JSON(http.StatusOK, gin.H{
 			"server_name":   serverConfig.Name,
 			"target_url":    serverConfig.TargetURL,
 			"target_status": targetStatus,
-			"uptime":        time.Since(time.Now()).String(), // This should be actual uptime
+			"target_health": health,
+			"upstreams":     pm.Upstreams(serverConfig.Name),
+			"correlation":   correlation,
+			"upstream_tls":  upstreamTLS,
+			"listener":      listenerMetrics.Snapshot(),
+			"requests":      counters.Snapshot(),
+			"concurrency":   concurrency,
+			"started_at":    metrics.ProcessStart().Unix(),
+			"uptime":        metrics.Uptime().Round(time.Second).String(),
 			"timestamp":     time.Now().Unix(),
 		})
 	}
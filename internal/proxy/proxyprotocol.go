@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+
+	"okaproxy/internal/config"
+)
+
+// proxySignatureV2 starts every PROXY protocol v2 header
+var proxySignatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeaderKey is the context key of the PROXY protocol header of a request
+type proxyHeaderKey struct{}
+
+// withProxyHeader records on req the PROXY protocol header announcing its
+// client to the target
+func withProxyHeader(req *http.Request, version, clientIP string) {
+	src := netip.AddrPortFrom(parseAddr(clientIP), 0)
+	if remote, err := netip.ParseAddrPort(req.RemoteAddr); err == nil && remote.Addr().Unmap() == src.Addr() {
+		src = netip.AddrPortFrom(src.Addr(), remote.Port())
+	}
+	var dst netip.AddrPort
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		dst = local.AddrPort()
+	}
+
+	header := proxyHeader(version, src, dst)
+	*req = *req.WithContext(context.WithValue(req.Context(), proxyHeaderKey{}, header))
+}
+
+// parseAddr parses an IP address, returning the zero address when invalid
+func parseAddr(ip string) netip.Addr {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
+
+// proxyHeader encodes a v1 or v2 header. Clients without an IP address, such
+// as those of unix sockets, are sent as UNKNOWN (v1) or LOCAL (v2).
+func proxyHeader(version string, src, dst netip.AddrPort) []byte {
+	srcAddr, dstAddr := src.Addr(), dst.Addr().Unmap()
+	known := srcAddr.IsValid()
+	if known && (!dstAddr.IsValid() || srcAddr.Is4() != dstAddr.Is4()) {
+		// Both addresses must be of the same family
+		dstAddr = netip.IPv4Unspecified()
+		if srcAddr.Is6() {
+			dstAddr = netip.IPv6Unspecified()
+		}
+	}
+	dst = netip.AddrPortFrom(dstAddr, dst.Port())
+
+	if version == config.ProxyProtocolV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if srcAddr.Is6() {
+			family = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcAddr, dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	header := append([]byte{}, proxySignatureV2...)
+	if !known {
+		return append(header, 0x20, 0x00, 0x00, 0x00) // LOCAL, unspecified family
+	}
+	family := byte(0x11) // TCP over IPv4
+	if srcAddr.Is6() {
+		family = 0x21 // TCP over IPv6
+	}
+	srcBytes, dstBytes := srcAddr.AsSlice(), dst.Addr().AsSlice()
+	header = append(header, 0x21, family) // Version 2, PROXY command
+	header = binary.BigEndian.AppendUint16(header, uint16(len(srcBytes)+len(dstBytes)+4))
+	header = append(header, srcBytes...)
+	header = append(header, dstBytes...)
+	header = binary.BigEndian.AppendUint16(header, src.Port())
+	return binary.BigEndian.AppendUint16(header, dst.Port())
+}
+
+// dialFunc dials an upstream connection
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// proxyProtocolDialer writes the header recorded on the request ahead of the
+// upstream connection, before any TLS handshake
+func proxyProtocolDialer(version string, dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		header, ok := ctx.Value(proxyHeaderKey{}).([]byte)
+		if !ok {
+			header = proxyHeader(version, netip.AddrPort{}, netip.AddrPort{})
+		}
+		if _, err := conn.Write(header); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("sending PROXY protocol header: %v", err)
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// SnapshotHeader marks responses served from a snapshot, giving the time it was taken
+const SnapshotHeader = "X-Proxy-Snapshot"
+
+const (
+	snapshotTimeout = 30 * time.Second
+	maxSnapshotSize = 5 << 20
+)
+
+// snapshotPage is a copy of one page of the target site
+type snapshotPage struct {
+	Path        string    `json:"path"`
+	ContentType string    `json:"content_type"`
+	Taken       time.Time `json:"taken"`
+	Body        []byte    `json:"body"`
+}
+
+// Snapshotter periodically copies key pages of a server's target so they can
+// be served while the target is down. Snapshots are kept in memory and, when
+// a directory is configured, on disk so they survive restarts.
+type Snapshotter struct {
+	server   string
+	target   *url.URL
+	paths    []string
+	dir      string
+	interval time.Duration
+	client   *http.Client
+	logger   *logger.Logger
+
+	mu    sync.RWMutex
+	pages map[string]*snapshotPage
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSnapshotter creates the snapshotter of a server and loads the snapshots
+// already on disk
+func (pm *ProxyManager) NewSnapshotter(serverConfig *config.ServerConfig) (*Snapshotter, error) {
+	target, err := url.Parse(serverConfig.TargetURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse target URL: %v", err)
+	}
+
+	tlsConfig, err := buildUpstreamTLSConfig(&serverConfig.UpstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Snapshotter{
+		server:   serverConfig.Name,
+		target:   target,
+		paths:    serverConfig.Snapshot.Paths,
+		dir:      serverConfig.Snapshot.Dir,
+		interval: time.Duration(serverConfig.Snapshot.Interval) * time.Second,
+		client: &http.Client{
+			Timeout:   snapshotTimeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+			// Redirects are snapshotted as they are
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: pm.logger,
+		pages:  make(map[string]*snapshotPage),
+		stop:   make(chan struct{}),
+	}
+	s.load()
+	return s, nil
+}
+
+// Start takes snapshots now and then at the configured interval
+func (s *Snapshotter) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		s.refresh()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.refresh()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops taking snapshots
+func (s *Snapshotter) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Serve writes the snapshot of the requested page and reports whether one exists
+func (s *Snapshotter) Serve(w http.ResponseWriter, r *http.Request) bool {
+	if s == nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+
+	s.mu.RLock()
+	page, ok := s.pages[clientPath(r)]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", page.ContentType)
+	h.Set("Content-Length", strconv.Itoa(len(page.Body)))
+	h.Set("Cache-Control", "no-store")
+	h.Set(SnapshotHeader, page.Taken.UTC().Format(http.TimeFormat))
+
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(page.Body)
+	}
+	return true
+}
+
+// refresh snapshots every path, keeping the previous snapshot when one fails
+func (s *Snapshotter) refresh() {
+	for _, path := range s.paths {
+		page, err := s.fetch(path)
+		if err != nil {
+			s.logger.Warnf("Failed to snapshot %s for server %s: %v", path, s.server, err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.pages[path] = page
+		s.mu.Unlock()
+
+		if err := s.save(page); err != nil {
+			s.logger.Errorf("Failed to save snapshot of %s for server %s: %v", path, s.server, err)
+		}
+	}
+}
+
+// fetch requests path from the target
+func (s *Snapshotter) fetch(path string) (*snapshotPage, error) {
+	u := *s.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "OkaProxy-Snapshot/1.0")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSnapshotSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxSnapshotSize {
+		return nil, fmt.Errorf("page larger than %d bytes", maxSnapshotSize)
+	}
+
+	return &snapshotPage{
+		Path:        path,
+		ContentType: resp.Header.Get("Content-Type"),
+		Taken:       time.Now(),
+		Body:        body,
+	}, nil
+}
+
+// file returns where the snapshot of path is stored
+func (s *Snapshotter) file(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:8])+".json")
+}
+
+// save writes a snapshot to disk, replacing the previous one atomically
+func (s *Snapshotter) save(page *snapshotPage) error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(page)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.dir, "snapshot-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file(page.Path))
+}
+
+// load reads the snapshots of the configured paths from disk
+func (s *Snapshotter) load() {
+	if s.dir == "" {
+		return
+	}
+	for _, path := range s.paths {
+		data, err := os.ReadFile(s.file(path))
+		if err != nil {
+			continue
+		}
+		var page snapshotPage
+		if err := json.Unmarshal(data, &page); err != nil || page.Path != path {
+			s.logger.Warnf("Ignoring unreadable snapshot of %s for server %s", path, s.server)
+			continue
+		}
+		s.pages[path] = &page
+	}
+}
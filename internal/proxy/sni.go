@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+// helloReadTimeout bounds how long a client may take to send its TLS
+// ClientHello on an SNI passthrough server
+const helloReadTimeout = 10 * time.Second
+
+// errHelloRead stops the handshake once the ClientHello is read
+var errHelloRead = errors.New("client hello read")
+
+// sniRoutes maps server names, and "*."-prefixed parent domains for wildcard
+// routes, to target addresses
+type sniRoutes map[string]string
+
+// newSNIRoutes resolves the SNI routes of a server
+func newSNIRoutes(routes []config.SNIRoute) (sniRoutes, error) {
+	targets := make(sniRoutes)
+	for _, route := range routes {
+		_, address, err := config.ParseTCPTarget(route.Target)
+		if err != nil {
+			return nil, fmt.Errorf("sni target %v", err)
+		}
+		for _, host := range route.Hosts {
+			targets[strings.ToLower(host)] = address
+		}
+	}
+	return targets, nil
+}
+
+// lookup returns the target of a server name, trying an exact route before a
+// wildcard one covering a single label, as certificates do
+func (routes sniRoutes) lookup(serverName string) (string, bool) {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+	if name == "" {
+		return "", false
+	}
+	if target, ok := routes[name]; ok {
+		return target, true
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		target, ok := routes["*."+parent]
+		return target, ok
+	}
+	return "", false
+}
+
+// readServerName reads the TLS ClientHello of a connection without answering
+// it, and returns the server name it asks for along with the bytes read, which
+// must reach the target ahead of the rest of the stream
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var hello bytes.Buffer
+	var serverName string
+
+	conn.SetReadDeadline(time.Now().Add(helloReadTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	err := tls.Server(helloConn{Conn: conn, r: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloRead) {
+		return "", nil, fmt.Errorf("no TLS ClientHello: %v", err)
+	}
+	return serverName, hello.Bytes(), nil
+}
+
+// helloConn lets a TLS server read a client's ClientHello while keeping it
+// from writing anything back
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (hc helloConn) Read(b []byte) (int, error) {
+	return hc.r.Read(b)
+}
+
+func (hc helloConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
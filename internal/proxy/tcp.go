@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// tcpSettings is what a TCP proxy reads of its server's configuration
+type tcpSettings struct {
+	name           string
+	target         string      // Empty when only SNI routes have targets
+	sniRoutes      sniRoutes   // nil unless TLS is passed through by server name
+	tlsConfig      *tls.Config // nil for plain TCP targets
+	connectTimeout time.Duration
+	idleTimeout    time.Duration // 0 = no limit
+	proxyProtocol  string
+	allow, deny    []netip.Prefix
+	maxConns       int // 0 = unlimited
+}
+
+// newTCPSettings resolves the settings of a TCP server
+func newTCPSettings(serverConfig *config.ServerConfig) (*tcpSettings, error) {
+	target, useTLS, err := serverConfig.TCPTarget()
+	if err != nil {
+		return nil, err
+	}
+	allow, deny, err := serverConfig.ACL.Prefixes()
+	if err != nil {
+		return nil, fmt.Errorf("acl: %v", err)
+	}
+	settings := &tcpSettings{
+		name:           serverConfig.Name,
+		target:         target,
+		connectTimeout: time.Duration(serverConfig.Timeouts.Connect) * time.Second,
+		idleTimeout:    time.Duration(serverConfig.Connection.IdleTimeout) * time.Second,
+		proxyProtocol:  serverConfig.UpstreamProxyProtocol,
+		allow:          allow,
+		deny:           deny,
+		maxConns:       serverConfig.CtnMax,
+	}
+	if serverConfig.IsSNIPassthrough() {
+		if settings.sniRoutes, err = newSNIRoutes(serverConfig.SNI); err != nil {
+			return nil, err
+		}
+	}
+	if useTLS {
+		settings.tlsConfig, err = buildUpstreamTLSConfig(&serverConfig.UpstreamTLS)
+		if err != nil {
+			return nil, err
+		}
+		if settings.tlsConfig.ServerName == "" {
+			settings.tlsConfig.ServerName, _, _ = net.SplitHostPort(target)
+		}
+	}
+	return settings, nil
+}
+
+// admits reports whether the access rules let addr connect
+func (ts *tcpSettings) admits(addr netip.Addr) bool {
+	for _, prefix := range ts.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(ts.allow) == 0 {
+		return true
+	}
+	for _, prefix := range ts.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TCPProxy forwards the connections of a TCP server to its target. Each
+// connection is logged with its byte counts when it closes.
+type TCPProxy struct {
+	logger    *logger.Logger // Connection log
+	errLogger *logger.Logger
+	settings  atomic.Pointer[tcpSettings]
+	active    atomic.Int64
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// NewTCPProxy creates the proxy of a TCP server, logging connections to
+// accessLog and failures to errorLog
+func NewTCPProxy(serverConfig *config.ServerConfig, accessLog, errorLog *logger.Logger) (*TCPProxy, error) {
+	tp := &TCPProxy{
+		logger:    accessLog,
+		errLogger: errorLog,
+		conns:     make(map[net.Conn]struct{}),
+	}
+	if err := tp.Update(serverConfig); err != nil {
+		return nil, err
+	}
+	return tp, nil
+}
+
+// Update applies a reloaded configuration to new connections
+func (tp *TCPProxy) Update(serverConfig *config.ServerConfig) error {
+	settings, err := newTCPSettings(serverConfig)
+	if err != nil {
+		return err
+	}
+	tp.settings.Store(settings)
+	return nil
+}
+
+// Serve forwards the connections accepted by ln until it is closed
+func (tp *TCPProxy) Serve(ln net.Listener) error {
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// Out of file descriptors and the like; retry as net/http does
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+			tp.errLogger.Warnf("TCP accept error: %v; retrying in %v", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if !tp.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer tp.untrack(conn)
+			tp.handle(conn)
+		}()
+	}
+}
+
+// track records an open client connection, refusing it while draining
+func (tp *TCPProxy) track(conn net.Conn) bool {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.draining {
+		return false
+	}
+	tp.conns[conn] = struct{}{}
+	tp.wg.Add(1)
+	return true
+}
+
+// untrack forgets a closed client connection
+func (tp *TCPProxy) untrack(conn net.Conn) {
+	tp.mu.Lock()
+	delete(tp.conns, conn)
+	tp.mu.Unlock()
+	tp.wg.Done()
+}
+
+// Shutdown waits for open connections to close until ctx is done, then
+// closes the remaining ones. The listeners must be closed first.
+func (tp *TCPProxy) Shutdown(ctx context.Context) error {
+	tp.mu.Lock()
+	tp.draining = true
+	tp.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		tp.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	tp.mu.Lock()
+	for conn := range tp.conns {
+		conn.Close()
+	}
+	tp.mu.Unlock()
+	return ctx.Err()
+}
+
+// handle forwards one client connection
+func (tp *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+	settings := tp.settings.Load()
+	start := time.Now()
+
+	src, _ := netip.ParseAddrPort(client.RemoteAddr().String())
+	fields := map[string]interface{}{
+		"server": settings.name,
+		"ip":     client.RemoteAddr().String(),
+		"target": settings.target,
+	}
+	if src.IsValid() {
+		fields["ip"] = src.Addr().Unmap().String()
+	}
+	if src.IsValid() && !settings.admits(src.Addr().Unmap()) {
+		tp.logger.WithFields(fields).Info("TCP connection rejected by access rules")
+		return
+	}
+	if active := tp.active.Add(1); settings.maxConns > 0 && active > int64(settings.maxConns) {
+		tp.active.Add(-1)
+		tp.logger.WithFields(fields).Warn("TCP connection rejected: ctn_max reached")
+		return
+	}
+	defer tp.active.Add(-1)
+
+	// SNI passthrough picks the target by the server name of the ClientHello,
+	// which is then forwarded with the rest of the stream
+	target := settings.target
+	var hello []byte
+	if settings.sniRoutes != nil {
+		serverName, read, err := readServerName(client)
+		if err != nil {
+			fields["error"] = err.Error()
+			tp.logger.WithFields(fields).Info("TCP connection rejected: no TLS server name read")
+			return
+		}
+		hello = read
+		fields["sni"] = serverName
+		if routed, ok := settings.sniRoutes.lookup(serverName); ok {
+			target = routed
+		}
+		fields["target"] = target
+		if target == "" {
+			tp.logger.WithFields(fields).Info("TCP connection rejected: no SNI route for server name")
+			return
+		}
+	}
+
+	backend, err := tp.dial(settings, target, client, hello)
+	if err != nil {
+		fields["error"] = err.Error()
+		tp.errLogger.WithFields(fields).Warn("Failed to connect to TCP target")
+		return
+	}
+	defer backend.Close()
+
+	sent, received := pipe(client, backend, settings.idleTimeout)
+	fields["bytes_sent"] = sent + int64(len(hello))
+	fields["bytes_received"] = received
+	fields["duration"] = time.Since(start).Round(time.Millisecond).String()
+	tp.logger.WithFields(fields).Info("TCP connection closed")
+}
+
+// dial connects to target, sending the PROXY protocol header first when
+// configured, then the ClientHello read for SNI passthrough, and completes
+// the TLS handshake of tls:// targets
+func (tp *TCPProxy) dial(settings *tcpSettings, target string, client net.Conn, hello []byte) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), settings.connectTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	if settings.proxyProtocol != "" {
+		src, _ := netip.ParseAddrPort(client.RemoteAddr().String())
+		dst, _ := netip.ParseAddrPort(client.LocalAddr().String())
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if _, err := conn.Write(proxyHeader(settings.proxyProtocol, src, dst)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("sending PROXY protocol header: %v", err)
+		}
+	}
+	if len(hello) > 0 {
+		if _, err := conn.Write(hello); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("forwarding TLS ClientHello: %v", err)
+		}
+	}
+	if settings.tlsConfig == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, settings.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// pipe copies between client and backend until both directions are done, or
+// either fails or stays idle past idleTimeout, and returns the bytes sent to
+// the backend and received from it
+func pipe(client, backend net.Conn, idleTimeout time.Duration) (sent, received int64) {
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	copyHalf := func(dst, src net.Conn, n *int64, done chan<- error) {
+		written, err := io.Copy(&activityWriter{Writer: dst, lastActive: &lastActive}, src)
+		*n = written
+		closeWrite(dst)
+		done <- err
+	}
+	done := make(chan error, 2)
+	go copyHalf(backend, client, &sent, done)
+	go copyHalf(client, backend, &received, done)
+
+	var idle <-chan time.Time
+	if idleTimeout > 0 {
+		ticker := time.NewTicker(idleTimeout / 4)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	for finished := 0; finished < 2; {
+		select {
+		case err := <-done:
+			finished++
+			if err != nil {
+				client.Close()
+				backend.Close()
+			}
+		case <-idle:
+			if time.Since(time.Unix(0, lastActive.Load())) > idleTimeout {
+				client.Close()
+				backend.Close()
+			}
+		}
+	}
+	return sent, received
+}
+
+// activityWriter records when data last went through a connection
+type activityWriter struct {
+	io.Writer
+	lastActive *atomic.Int64
+}
+
+func (aw *activityWriter) Write(b []byte) (int, error) {
+	aw.lastActive.Store(time.Now().UnixNano())
+	return aw.Writer.Write(b)
+}
+
+// closeWrite shuts down the writing side of conn, or of the connection it
+// wraps, so the peer sees the end of the stream
+func closeWrite(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			c.CloseWrite()
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"okaproxy/internal/middleware"
+)
+
+// errResponseTimeout cancels requests whose target did not answer in time
+var errResponseTimeout = errors.New("upstream response timeout")
+
+// responseTimeoutTransport bounds the wait for the target's response headers
+// after the request was sent, using the timeout of the request's route when it
+// has one. The response body may take as long as the write timeout allows.
+type responseTimeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration // Server default (0 = no limit)
+}
+
+// RoundTrip implements http.RoundTripper
+func (rt *responseTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := rt.timeout
+	if route, ok := middleware.ResponseTimeout(req.Context()); ok {
+		timeout = route
+	}
+	if timeout <= 0 {
+		return rt.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	deadline := &responseDeadline{timeout: timeout, cancel: cancel}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{WroteRequest: deadline.start})
+	resp, err := rt.next.RoundTrip(req.WithContext(ctx))
+	if deadline.stop() {
+		// The deadline passed, possibly as the response arrived
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+		return nil, fmt.Errorf("no response within %s: %w", timeout, errResponseTimeout)
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: func() { cancel(nil) }}
+	return resp, nil
+}
+
+// responseDeadline cancels a request when the target does not answer in time
+// once the request, body included, was sent
+type responseDeadline struct {
+	timeout time.Duration
+	cancel  context.CancelCauseFunc
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+// start starts the timer when the request was written
+func (rd *responseDeadline) start(httptrace.WroteRequestInfo) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	if !rd.stopped && rd.timer == nil {
+		rd.timer = time.AfterFunc(rd.timeout, func() { rd.cancel(errResponseTimeout) })
+	}
+}
+
+// stop stops the timer and reports whether the deadline had passed
+func (rd *responseDeadline) stop() bool {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+
+	rd.stopped = true
+	return rd.timer != nil && !rd.timer.Stop()
+}
+
+// cancelOnClose releases the request context once the body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel func()
+}
+
+// Close closes the body and releases the request context
+func (cc *cancelOnClose) Close() error {
+	err := cc.ReadCloser.Close()
+	cc.cancel()
+	return err
+}
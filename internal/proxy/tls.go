@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"okaproxy/internal/config"
+)
+
+// buildUpstreamTLSConfig creates the TLS configuration used when dialing the target
+func buildUpstreamTLSConfig(upstreamTLS *config.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         upstreamTLS.ServerName,
+		InsecureSkipVerify: upstreamTLS.InsecureSkipVerify,
+	}
+
+	// Trust a custom CA for internal backends with private or self-signed certificates
+	if upstreamTLS.CAPath != "" {
+		pem, err := os.ReadFile(upstreamTLS.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", upstreamTLS.CAPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// Present a client certificate to backends that require mutual TLS
+	if upstreamTLS.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(upstreamTLS.CertPath, upstreamTLS.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Cache sessions so reconnects resume instead of performing a full handshake
+	if !upstreamTLS.DisableSessionResumption {
+		tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(upstreamTLS.SessionCacheSize)
+	}
+
+	return tlsConfig, nil
+}
+
+// ResumptionCounters counts upstream TLS handshakes and how many resumed a session
+type ResumptionCounters struct {
+	Handshakes uint64
+	Resumed    uint64
+}
+
+// Ratio returns the fraction of handshakes that resumed a session
+func (rc ResumptionCounters) Ratio() float64 {
+	if rc.Handshakes == 0 {
+		return 0
+	}
+	return float64(rc.Resumed) / float64(rc.Handshakes)
+}
+
+// resumptionTracker records upstream TLS session resumption per server
+type resumptionTracker struct {
+	mu      sync.Mutex
+	servers map[string]*resumptionCounters
+}
+
+// resumptionCounters are the live counters of one server
+type resumptionCounters struct {
+	handshakes atomic.Uint64
+	resumed    atomic.Uint64
+}
+
+func newResumptionTracker() *resumptionTracker {
+	return &resumptionTracker{servers: make(map[string]*resumptionCounters)}
+}
+
+// observe counts the handshakes made with tlsConfig towards the server's upstreams
+func (rt *resumptionTracker) observe(server string, tlsConfig *tls.Config) {
+	rt.mu.Lock()
+	counters, ok := rt.servers[server]
+	if !ok {
+		counters = &resumptionCounters{}
+		rt.servers[server] = counters
+	}
+	rt.mu.Unlock()
+
+	// VerifyConnection runs after every handshake, including resumed ones
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		counters.handshakes.Add(1)
+		if state.DidResume {
+			counters.resumed.Add(1)
+		}
+		return nil
+	}
+}
+
+// snapshot returns a copy of the counters of a server
+func (rt *resumptionTracker) snapshot(server string) ResumptionCounters {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if counters, ok := rt.servers[server]; ok {
+		return ResumptionCounters{
+			Handshakes: counters.handshakes.Load(),
+			Resumed:    counters.resumed.Load(),
+		}
+	}
+	return ResumptionCounters{}
+}
+
+// CheckUpstreamTLS loads the CA and client certificate files of the upstream
+// TLS configuration, without dialing the target
+func CheckUpstreamTLS(upstreamTLS *config.UpstreamTLSConfig) error {
+	_, err := buildUpstreamTLSConfig(upstreamTLS)
+	return err
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+
+	"okaproxy/internal/telemetry"
+)
+
+// tracingTransport records the upstream round trip as a client span and
+// propagates the trace context to the target
+type tracingTransport struct {
+	next   http.RoundTripper
+	tracer *telemetry.Tracer
+}
+
+// RoundTrip implements http.RoundTripper
+func (tt *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := tt.tracer.StartSpan(req.Context(), "upstream "+req.Method, telemetry.KindClient)
+	if span == nil {
+		return tt.next.RoundTrip(req)
+	}
+	defer span.End()
+
+	// Our span replaces the client's position in the trace
+	req = req.Clone(ctx)
+	req.Header.Set(telemetry.TraceparentHeader, span.Context().Traceparent())
+	if !tt.tracer.TrustIncoming() {
+		req.Header.Del("Tracestate")
+	}
+
+	span.SetAttribute("http.request.method", req.Method)
+	span.SetAttribute("url.full", req.URL.String())
+	span.SetAttribute("server.address", req.URL.Host)
+
+	resp, err := tt.next.RoundTrip(req)
+	if err != nil {
+		span.SetError(err.Error())
+		return nil, err
+	}
+
+	span.SetAttribute("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		span.SetError(fmt.Sprintf("upstream returned %d", resp.StatusCode))
+	}
+	return resp, nil
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/metrics"
+)
+
+// unhealthyAfter is the number of consecutive failures after which an upstream
+// is reported unhealthy
+const unhealthyAfter = 3
+
+// ErrUnknownUpstream is returned for a target URL the server does not proxy to
+var ErrUnknownUpstream = errors.New("unknown upstream")
+
+// upstream is a target URL of a server. Its health is observed passively from
+// proxied requests; a drained upstream receives no new requests.
+type upstream struct {
+	url     string
+	drained atomic.Bool
+
+	requests            atomic.Uint64
+	failures            atomic.Uint64
+	consecutiveFailures atomic.Int64
+	responses           *metrics.ResponseMetrics
+
+	mu          sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+	lastOKAt    time.Time
+}
+
+// UpstreamStatus is a point-in-time copy of an upstream's state
+type UpstreamStatus struct {
+	URL                 string     `json:"url"`
+	Drained             bool       `json:"drained"`
+	Healthy             bool       `json:"healthy"`
+	Requests            uint64     `json:"requests"`
+	Failures            uint64     `json:"failures"`
+	ConsecutiveFailures int64      `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastErrorAt         *time.Time `json:"last_error_at,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+
+	Responses metrics.ResponseSnapshot `json:"responses"`
+}
+
+// sentAtKey is the context key of the time a request was sent upstream
+type sentAtKey struct{}
+
+// markSent records on req, before it is sent upstream, when it was sent
+func markSent(req *http.Request) {
+	*req = *req.WithContext(context.WithValue(req.Context(), sentAtKey{}, time.Now()))
+}
+
+// sinceSent returns how long ago req was sent upstream, or 0 if unknown
+func sinceSent(req *http.Request) time.Duration {
+	if req == nil {
+		return 0
+	}
+	sentAt, ok := req.Context().Value(sentAtKey{}).(time.Time)
+	if !ok {
+		return 0
+	}
+	return time.Since(sentAt)
+}
+
+// available reports whether the upstream may receive new requests; a nil
+// upstream always may
+func (u *upstream) available() bool {
+	return u == nil || !u.drained.Load()
+}
+
+// observe records the outcome of a proxied request that took elapsed. Gateway
+// errors from the upstream count as failures like transport errors do.
+func (u *upstream) observe(status int, err error, elapsed time.Duration) {
+	u.requests.Add(1)
+	u.responses.Observe(status, elapsed)
+	now := time.Now()
+
+	if err == nil && status != http.StatusBadGateway && status != http.StatusServiceUnavailable && status != http.StatusGatewayTimeout {
+		u.consecutiveFailures.Store(0)
+		u.mu.Lock()
+		u.lastOKAt = now
+		u.mu.Unlock()
+		return
+	}
+
+	u.failures.Add(1)
+	u.consecutiveFailures.Add(1)
+	message := http.StatusText(status)
+	if err != nil {
+		message = err.Error()
+	}
+	u.mu.Lock()
+	u.lastError = message
+	u.lastErrorAt = now
+	u.mu.Unlock()
+}
+
+// status returns a copy of the upstream's state
+func (u *upstream) status() UpstreamStatus {
+	consecutive := u.consecutiveFailures.Load()
+	status := UpstreamStatus{
+		URL:                 u.url,
+		Drained:             u.drained.Load(),
+		Healthy:             consecutive < unhealthyAfter,
+		Requests:            u.requests.Load(),
+		Failures:            u.failures.Load(),
+		ConsecutiveFailures: consecutive,
+		Responses:           u.responses.Snapshot(),
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	status.LastError = u.lastError
+	if !u.lastErrorAt.IsZero() {
+		at := u.lastErrorAt
+		status.LastErrorAt = &at
+	}
+	if !u.lastOKAt.IsZero() {
+		at := u.lastOKAt
+		status.LastSuccessAt = &at
+	}
+	return status
+}
+
+// upstreamRegistry holds the upstreams of every server, keyed by target URL
+type upstreamRegistry struct {
+	mu      sync.Mutex
+	servers map[string]map[string]*upstream
+}
+
+func newUpstreamRegistry() *upstreamRegistry {
+	return &upstreamRegistry{servers: make(map[string]map[string]*upstream)}
+}
+
+// register returns the upstream of a server's target URL, creating it on first use
+func (ur *upstreamRegistry) register(server, url string) *upstream {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+
+	upstreams, ok := ur.servers[server]
+	if !ok {
+		upstreams = make(map[string]*upstream)
+		ur.servers[server] = upstreams
+	}
+	u, ok := upstreams[url]
+	if !ok {
+		u = &upstream{url: url, responses: metrics.NewResponseMetrics()}
+		upstreams[url] = u
+	}
+	return u
+}
+
+// lookup returns the upstream of a server's target URL, or nil
+func (ur *upstreamRegistry) lookup(server, url string) *upstream {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	return ur.servers[server][url]
+}
+
+// Upstreams reports the state of every target of a server, sorted by URL
+func (pm *ProxyManager) Upstreams(server string) []UpstreamStatus {
+	pm.upstreams.mu.Lock()
+	list := make([]*upstream, 0, len(pm.upstreams.servers[server]))
+	for _, u := range pm.upstreams.servers[server] {
+		list = append(list, u)
+	}
+	pm.upstreams.mu.Unlock()
+
+	statuses := make([]UpstreamStatus, 0, len(list))
+	for _, u := range list {
+		statuses = append(statuses, u.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].URL < statuses[j].URL
+	})
+	return statuses
+}
+
+// SetDrained stops or resumes sending new requests to a target of a server.
+// Requests for a drained geo or device target go to the remaining targets of
+// its group, then to the default target.
+func (pm *ProxyManager) SetDrained(server, url string, drained bool) (UpstreamStatus, error) {
+	u := pm.upstreams.lookup(server, url)
+	if u == nil {
+		return UpstreamStatus{}, ErrUnknownUpstream
+	}
+	u.drained.Store(drained)
+	return u.status(), nil
+}
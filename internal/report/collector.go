@@ -0,0 +1,102 @@
+package report
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxTrackedPaths bounds the attacked path table so random URLs cannot grow it forever
+const maxTrackedPaths = 10000
+
+// otherPaths collects attacked paths seen after the table is full
+const otherPaths = "(other)"
+
+// unknownCountry labels clients whose country cannot be resolved
+const unknownCountry = "unknown"
+
+// Counters are the traffic totals of a server or country
+type Counters struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`  // 5xx responses
+	Blocked  int64 `json:"blocked"` // 403 and 429 responses
+	Banned   int64 `json:"banned"`  // Requests rejected because of a temporary ban
+}
+
+// serverStats accumulates one server's traffic for the current period
+type serverStats struct {
+	Counters
+	countries map[string]*Counters
+	paths     map[string]int64
+}
+
+// Collector aggregates traffic per server and country until the next report
+type Collector struct {
+	mu      sync.Mutex
+	started time.Time
+	servers map[string]*serverStats
+}
+
+// NewCollector creates an empty collector
+func NewCollector() *Collector {
+	return &Collector{
+		started: time.Now(),
+		servers: make(map[string]*serverStats),
+	}
+}
+
+// Record counts one finished request
+func (c *Collector) Record(server, country, path string, status int, banned bool) {
+	if country == "" {
+		country = unknownCountry
+	}
+	blocked := status == http.StatusForbidden || status == http.StatusTooManyRequests
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats, ok := c.servers[server]
+	if !ok {
+		stats = &serverStats{
+			countries: make(map[string]*Counters),
+			paths:     make(map[string]int64),
+		}
+		c.servers[server] = stats
+	}
+	countryStats, ok := stats.countries[country]
+	if !ok {
+		countryStats = &Counters{}
+		stats.countries[country] = countryStats
+	}
+
+	for _, counters := range []*Counters{&stats.Counters, countryStats} {
+		counters.Requests++
+		if status >= http.StatusInternalServerError {
+			counters.Errors++
+		}
+		if blocked {
+			counters.Blocked++
+		}
+		if banned {
+			counters.Banned++
+		}
+	}
+
+	if blocked {
+		if _, ok := stats.paths[path]; !ok && len(stats.paths) >= maxTrackedPaths {
+			path = otherPaths
+		}
+		stats.paths[path]++
+	}
+}
+
+// swap returns the collected stats and starts a new period
+func (c *Collector) swap() (time.Time, map[string]*serverStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	started, servers := c.started, c.servers
+	c.started = time.Now()
+	c.servers = make(map[string]*serverStats)
+	return started, servers
+}
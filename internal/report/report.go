@@ -0,0 +1,270 @@
+package report
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// Report summarizes one period of traffic
+type Report struct {
+	Start   time.Time      `json:"start"`
+	End     time.Time      `json:"end"`
+	Servers []ServerReport `json:"servers"`
+}
+
+// ServerReport summarizes one server's traffic
+type ServerReport struct {
+	Name string `json:"name"`
+	Counters
+	Countries     []CountryReport `json:"countries"`
+	AttackedPaths []PathReport    `json:"attacked_paths"`
+}
+
+// CountryReport summarizes the traffic from one country
+type CountryReport struct {
+	Country string `json:"country"`
+	Counters
+}
+
+// PathReport counts blocked requests to one path
+type PathReport struct {
+	Path    string `json:"path"`
+	Blocked int64  `json:"blocked"`
+}
+
+// build turns collected stats into a report, busiest entries first
+func build(start, end time.Time, servers map[string]*serverStats, topPaths int) *Report {
+	report := &Report{Start: start, End: end, Servers: []ServerReport{}}
+
+	for name, stats := range servers {
+		server := ServerReport{
+			Name:          name,
+			Counters:      stats.Counters,
+			Countries:     []CountryReport{},
+			AttackedPaths: []PathReport{},
+		}
+		for country, counters := range stats.countries {
+			server.Countries = append(server.Countries, CountryReport{Country: country, Counters: *counters})
+		}
+		sort.Slice(server.Countries, func(i, j int) bool {
+			if server.Countries[i].Requests != server.Countries[j].Requests {
+				return server.Countries[i].Requests > server.Countries[j].Requests
+			}
+			return server.Countries[i].Country < server.Countries[j].Country
+		})
+
+		for path, blocked := range stats.paths {
+			server.AttackedPaths = append(server.AttackedPaths, PathReport{Path: path, Blocked: blocked})
+		}
+		sort.Slice(server.AttackedPaths, func(i, j int) bool {
+			if server.AttackedPaths[i].Blocked != server.AttackedPaths[j].Blocked {
+				return server.AttackedPaths[i].Blocked > server.AttackedPaths[j].Blocked
+			}
+			return server.AttackedPaths[i].Path < server.AttackedPaths[j].Path
+		})
+		if len(server.AttackedPaths) > topPaths {
+			server.AttackedPaths = server.AttackedPaths[:topPaths]
+		}
+
+		report.Servers = append(report.Servers, server)
+	}
+	sort.Slice(report.Servers, func(i, j int) bool {
+		return report.Servers[i].Name < report.Servers[j].Name
+	})
+
+	return report
+}
+
+// Scheduler generates a report at the end of every day or week
+type Scheduler struct {
+	config    config.ReportConfig
+	collector *Collector
+	logger    *logger.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewScheduler creates a report scheduler reading from collector
+func NewScheduler(cfg config.ReportConfig, collector *Collector, log *logger.Logger) *Scheduler {
+	return &Scheduler{
+		config:    cfg,
+		collector: collector,
+		logger:    log,
+		stop:      make(chan struct{}),
+	}
+}
+
+// Start begins waiting for the next report boundary
+func (s *Scheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		for {
+			next := nextBoundary(time.Now(), s.config.Schedule)
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-timer.C:
+				s.Generate()
+			case <-s.stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	s.logger.Infof("Scheduled %s %s traffic reports", s.config.Schedule, s.config.Format)
+}
+
+// Stop stops the scheduler; the current period is not reported
+func (s *Scheduler) Stop() {
+	close(s.stop)
+	s.wg.Wait()
+}
+
+// Generate reports the period collected so far and starts a new one
+func (s *Scheduler) Generate() {
+	start, servers := s.collector.swap()
+	report := build(start, time.Now(), servers, s.config.TopPaths)
+
+	body, contentType, err := s.render(report)
+	if err != nil {
+		s.logger.Errorf("Failed to render traffic report: %v", err)
+		return
+	}
+
+	if s.config.Dir != "" {
+		if path, err := s.write(report, body); err != nil {
+			s.logger.Errorf("Failed to write traffic report: %v", err)
+		} else {
+			s.logger.Infof("Traffic report written to %s", path)
+		}
+	}
+
+	if s.config.Email.Enabled() {
+		if err := s.send(report, body, contentType); err != nil {
+			s.logger.Errorf("Failed to email traffic report: %v", err)
+		} else {
+			s.logger.Infof("Traffic report emailed to %s", strings.Join(s.config.Email.To, ", "))
+		}
+	}
+}
+
+// render encodes the report in the configured format
+func (s *Scheduler) render(report *Report) ([]byte, string, error) {
+	if s.config.Format == config.ReportHTML {
+		var buf bytes.Buffer
+		if err := htmlReport.Execute(&buf, report); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), "text/html; charset=utf-8", nil
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	return body, "application/json; charset=utf-8", nil
+}
+
+// write stores the report in the report directory
+func (s *Scheduler) write(report *Report, body []byte) (string, error) {
+	if err := os.MkdirAll(s.config.Dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create report directory: %v", err)
+	}
+
+	name := fmt.Sprintf("report-%s-%s.%s", s.config.Schedule, report.Start.Format("2006-01-02"), s.config.Format)
+	path := filepath.Join(s.config.Dir, name)
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// send emails the report through the configured SMTP server
+func (s *Scheduler) send(report *Report, body []byte, contentType string) error {
+	email := s.config.Email
+
+	var auth smtp.Auth
+	if email.Username != "" {
+		host, _, err := net.SplitHostPort(email.SMTPAddr)
+		if err != nil {
+			return fmt.Errorf("invalid smtp_addr: %v", err)
+		}
+		auth = smtp.PlainAuth("", email.Username, email.Password, host)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", email.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(email.To, ", "))
+	fmt.Fprintf(&msg, "Subject: OkaProxy %s traffic report (%s - %s)\r\n", s.config.Schedule,
+		report.Start.Format("2006-01-02"), report.End.Format("2006-01-02"))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s\r\n\r\n", contentType)
+	msg.Write(body)
+
+	return smtp.SendMail(email.SMTPAddr, auth, email.From, email.To, msg.Bytes())
+}
+
+// nextBoundary returns the next local midnight, or the next Monday midnight for weekly reports
+func nextBoundary(now time.Time, schedule string) time.Time {
+	next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+	if schedule == config.ReportWeekly {
+		for next.Weekday() != time.Monday {
+			next = next.AddDate(0, 0, 1)
+		}
+	}
+	return next
+}
+
+// htmlReport renders a report for email clients
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>OkaProxy traffic report</title>
+    <style>
+        body { font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif; color: #333; }
+        table { border-collapse: collapse; margin-bottom: 1rem; }
+        th, td { border: 1px solid #ddd; padding: 4px 8px; text-align: right; }
+        th:first-child, td:first-child { text-align: left; }
+    </style>
+</head>
+<body>
+    <h1>Traffic report</h1>
+    <p>{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04"}}</p>
+    {{range .Servers}}
+    <h2>{{.Name}}</h2>
+    <p>{{.Requests}} requests, {{.Errors}} errors, {{.Blocked}} blocked, {{.Banned}} banned</p>
+    <table>
+        <tr><th>Country</th><th>Requests</th><th>Errors</th><th>Blocked</th><th>Banned</th></tr>
+        {{range .Countries}}<tr><td>{{.Country}}</td><td>{{.Requests}}</td><td>{{.Errors}}</td><td>{{.Blocked}}</td><td>{{.Banned}}</td></tr>
+        {{end}}
+    </table>
+    {{if .AttackedPaths}}
+    <table>
+        <tr><th>Top attacked paths</th><th>Blocked</th></tr>
+        {{range .AttackedPaths}}<tr><td>{{.Path}}</td><td>{{.Blocked}}</td></tr>
+        {{end}}
+    </table>
+    {{end}}
+    {{else}}
+    <p>No traffic was recorded.</p>
+    {{end}}
+</body>
+</html>
+`))
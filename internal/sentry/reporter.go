@@ -0,0 +1,310 @@
+package sentry
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/version"
+)
+
+const (
+	queueSize    = 100
+	sendTimeout  = 10 * time.Second
+	throttleTime = time.Minute
+)
+
+// Reporter sends panics, proxy errors and bursts of 5xx responses to Sentry.
+// Events are sent in the background; identical events are sent at most once
+// a minute and events are dropped while the queue is full. A nil reporter
+// reports nothing.
+type Reporter struct {
+	config   config.SentryConfig
+	logger   *logger.Logger
+	client   *http.Client
+	endpoint string
+	auth     string
+	hostname string
+
+	queue chan *event
+
+	mu     sync.Mutex
+	sent   map[string]time.Time    // last time each event fingerprint was queued
+	bursts map[string]*burstWindow // 5xx responses per server
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewReporter creates a reporter for the configured DSN
+func NewReporter(cfg config.SentryConfig, log *logger.Logger) *Reporter {
+	// Validated in config.Validate
+	endpoint, key, _ := cfg.Endpoint()
+
+	hostname, _ := os.Hostname()
+	return &Reporter{
+		config:   cfg,
+		logger:   log,
+		client:   &http.Client{Timeout: sendTimeout},
+		endpoint: endpoint,
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=okaproxy/1.0, sentry_key=%s", key),
+		hostname: hostname,
+		queue:    make(chan *event, queueSize),
+		sent:     make(map[string]time.Time),
+		bursts:   make(map[string]*burstWindow),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start sends queued events in the background
+func (r *Reporter) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			select {
+			case ev := <-r.queue:
+				r.send(ev)
+			case <-r.done:
+				// Send whatever is still queued
+				for {
+					select {
+					case ev := <-r.queue:
+						r.send(ev)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Stop sends the remaining events and stops reporting
+func (r *Reporter) Stop() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+// CapturePanic reports a panic recovered while serving req
+func (r *Reporter) CapturePanic(req *http.Request, server string, value interface{}, stack []byte) {
+	if r == nil {
+		return
+	}
+	ev := r.newEvent("fatal", "panic", server, req)
+	ev.Exception = &exceptions{Values: []exception{{
+		Type:  "panic",
+		Value: fmt.Sprint(value),
+	}}}
+	ev.Extra["stack"] = string(stack)
+	r.capture(ev, "panic|"+server+"|"+fmt.Sprint(value))
+}
+
+// CaptureProxyError reports a request the proxy could not forward to the target
+func (r *Reporter) CaptureProxyError(req *http.Request, server, target string, err error) {
+	if r == nil {
+		return
+	}
+	ev := r.newEvent("error", "proxy_error", server, req)
+	ev.Exception = &exceptions{Values: []exception{{
+		Type:  "ProxyError",
+		Value: err.Error(),
+	}}}
+	ev.Tags["target"] = target
+	r.capture(ev, "proxy_error|"+server+"|"+target+"|"+err.Error())
+}
+
+// ObserveStatus counts 5xx responses of a server and reports a burst once
+// burst_threshold of them happen within burst_window
+func (r *Reporter) ObserveStatus(req *http.Request, server string, status int) {
+	if r == nil || status < 500 {
+		return
+	}
+
+	window := time.Duration(r.config.BurstWindow) * time.Second
+	r.mu.Lock()
+	bw, ok := r.bursts[server]
+	if !ok {
+		bw = &burstWindow{}
+		r.bursts[server] = bw
+	}
+	count, fire := bw.add(time.Now(), window, r.config.BurstThreshold)
+	r.mu.Unlock()
+	if !fire {
+		return
+	}
+
+	ev := r.newEvent("error", "error_burst", server, req)
+	ev.Message = &message{Formatted: fmt.Sprintf("%d responses with status 5xx within %ds on server %s", count, r.config.BurstWindow, server)}
+	ev.Extra["last_status"] = status
+	r.capture(ev, "")
+}
+
+// newEvent creates an event carrying the request context
+func (r *Reporter) newEvent(level, kind, server string, req *http.Request) *event {
+	ev := &event{
+		EventID:     newEventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       level,
+		Logger:      "okaproxy",
+		ServerName:  r.hostname,
+		Environment: r.config.Environment,
+		Release:     r.release(),
+		Tags:        map[string]string{"kind": kind, "server": server},
+		Extra:       map[string]interface{}{},
+	}
+	if req != nil {
+		ev.Request = newRequest(req)
+		ev.User = &user{IPAddress: logger.GetClientIP(req)}
+	}
+	return ev
+}
+
+// release returns the configured release, or the version of the binary
+func (r *Reporter) release() string {
+	if r.config.Release != "" {
+		return r.config.Release
+	}
+	return "okaproxy@" + version.Get().Version
+}
+
+// capture queues an event unless the same fingerprint was queued within the
+// last minute; an empty fingerprint is never throttled
+func (r *Reporter) capture(ev *event, fingerprint string) {
+	if fingerprint != "" {
+		now := time.Now()
+		r.mu.Lock()
+		last, seen := r.sent[fingerprint]
+		if seen && now.Sub(last) < throttleTime {
+			r.mu.Unlock()
+			return
+		}
+		r.sent[fingerprint] = now
+		// Forget old fingerprints so the map stays small
+		if len(r.sent) > 1000 {
+			for key, at := range r.sent {
+				if now.Sub(at) >= throttleTime {
+					delete(r.sent, key)
+				}
+			}
+		}
+		r.mu.Unlock()
+	}
+
+	select {
+	case r.queue <- ev:
+	default:
+		r.logger.Warnf("Sentry queue full, dropped %s event", ev.Tags["kind"])
+	}
+}
+
+// send posts one event as an envelope
+func (r *Reporter) send(ev *event) {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		r.logger.Errorf("Failed to encode Sentry event: %v", err)
+		return
+	}
+	header, _ := json.Marshal(map[string]string{
+		"event_id": ev.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	item, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(payload)})
+
+	var body bytes.Buffer
+	body.Write(header)
+	body.WriteByte('\n')
+	body.Write(item)
+	body.WriteByte('\n')
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, &body)
+	if err != nil {
+		r.logger.Errorf("Failed to send Sentry event: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		r.logger.Errorf("Failed to send Sentry event: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+		r.logger.Errorf("Failed to send Sentry event: unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+}
+
+// burstWindow counts 5xx responses in the current window
+type burstWindow struct {
+	start   time.Time
+	count   int
+	alerted bool
+}
+
+// add counts a response and reports whether this one completes a burst
+func (bw *burstWindow) add(now time.Time, window time.Duration, threshold int) (int, bool) {
+	if now.Sub(bw.start) >= window {
+		bw.start = now
+		bw.count = 0
+		bw.alerted = false
+	}
+	bw.count++
+	if bw.count >= threshold && !bw.alerted {
+		bw.alerted = true
+		return bw.count, true
+	}
+	return bw.count, false
+}
+
+// newEventID returns a random 32 character event ID
+func newEventID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// newRequest describes req without credentials
+func newRequest(req *http.Request) *request {
+	u := url.URL{Scheme: "http", Host: req.Host, Path: req.URL.Path}
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	headers := make(map[string]string, len(req.Header))
+	for name, values := range req.Header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Authorization", "Cookie", "Proxy-Authorization":
+			continue
+		}
+		headers[name] = strings.Join(values, ", ")
+	}
+
+	return &request{
+		URL:         u.String(),
+		Method:      req.Method,
+		QueryString: req.URL.RawQuery,
+		Headers:     headers,
+	}
+}
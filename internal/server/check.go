@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/proxy"
+)
+
+// resolveTimeout bounds the lookup of each target host name
+const resolveTimeout = 5 * time.Second
+
+// CheckOptions selects the checks Check performs beyond loading the files
+type CheckOptions struct {
+	SkipDNS bool // Do not resolve target host names
+}
+
+// Check looks for problems config.Validate cannot find without touching the
+// environment: certificates and CA bundles must load and be current, and target
+// host names must resolve. It returns one message per problem.
+func Check(cfg *config.Config, opts CheckOptions) []string {
+	var problems []string
+	report := func(serverName, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("server %s: ", serverName)+fmt.Sprintf(format, args...))
+	}
+
+	resolved := make(map[string]error)
+	for i := range cfg.Server {
+		serverConfig := &cfg.Server[i]
+
+		// Certificates served to clients; ACME certificates are obtained at startup
+		if serverConfig.HTTPS.Enabled {
+			acme := serverConfig.HTTPS.ACME.Enabled
+			if !acme {
+				if tlsConfig, err := buildTLSConfig(&serverConfig.HTTPS, nil); err != nil {
+					report(serverConfig.Name, "%v", err)
+				} else if err := checkValidity(tlsConfig.Certificates[0].Certificate[0]); err != nil {
+					report(serverConfig.Name, "certificate %s: %v", certificateSource(&serverConfig.HTTPS), err)
+				}
+			} else if serverConfig.HTTPS.ClientAuthEnabled() {
+				if _, err := loadCertPool(serverConfig.HTTPS.ClientCAPath); err != nil {
+					report(serverConfig.Name, "failed to load client CA bundle: %v", err)
+				}
+			}
+		}
+
+		// Files used when dialing HTTPS targets
+		if err := proxy.CheckUpstreamTLS(&serverConfig.UpstreamTLS); err != nil {
+			report(serverConfig.Name, "%v", err)
+		}
+
+		if opts.SkipDNS {
+			continue
+		}
+		for _, target := range targetURLs(serverConfig) {
+			parsed, err := url.Parse(target)
+			if err != nil {
+				report(serverConfig.Name, "invalid target URL %s: %v", target, err)
+				continue
+			}
+			host := parsed.Hostname()
+			if _, ok := resolved[host]; !ok {
+				resolved[host] = resolve(host)
+			}
+			if err := resolved[host]; err != nil {
+				report(serverConfig.Name, "target %s does not resolve: %v", target, err)
+			}
+		}
+	}
+	return problems
+}
+
+// targetURLs returns every distinct URL a server proxies to
+func targetURLs(serverConfig *config.ServerConfig) []string {
+	seen := map[string]bool{serverConfig.TargetURL: true}
+	for _, target := range serverConfig.Device.Targets {
+		seen[target] = true
+	}
+	for _, group := range serverConfig.GeoRouting.Groups {
+		for _, target := range group.Targets {
+			seen[target.URL] = true
+		}
+	}
+	seen[serverConfig.Canary.Target] = true
+	for _, route := range serverConfig.SNI {
+		seen[route.Target] = true
+	}
+	delete(seen, "")
+
+	targets := make([]string, 0, len(seen))
+	for target := range seen {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// resolve looks up a host name; IP addresses need no lookup
+func resolve(host string) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	_, err := net.DefaultResolver.LookupHost(ctx, host)
+	return err
+}
+
+// certificateSource names where a manual certificate is loaded from
+func certificateSource(httpsConfig *config.HTTPSConfig) string {
+	if httpsConfig.Cert != "" {
+		return "from https.cert"
+	}
+	return httpsConfig.CertPath
+}
+
+// checkValidity reports a DER certificate that is expired or not yet valid
+func checkValidity(der []byte) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("expired on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	}
+	return nil
+}
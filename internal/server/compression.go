@@ -0,0 +1,15 @@
+//go:build !lite
+
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/middleware"
+)
+
+// compressionMiddleware returns the response compression middleware
+func compressionMiddleware(cfg config.CompressionConfig) gin.HandlerFunc {
+	return middleware.CompressionMiddleware(cfg)
+}
@@ -0,0 +1,14 @@
+//go:build lite
+
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+)
+
+// compressionMiddleware returns nil: lite builds do not compress responses
+func compressionMiddleware(config.CompressionConfig) gin.HandlerFunc {
+	return nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+// connInfoKey is the context key for per-connection state
+type connInfoKey struct{}
+
+// connInfo tracks the reuse of a single client connection
+type connInfo struct {
+	opened   time.Time
+	requests atomic.Int64
+	conn     *countingConn // nil when the listener does not count bytes
+}
+
+// connContext is installed as http.Server.ConnContext
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	info := &connInfo{opened: time.Now()}
+	info.conn, _ = countingConnOf(conn)
+	return context.WithValue(ctx, connInfoKey{}, info)
+}
+
+// connectionPolicy asks clients to close connections that used up their
+// request or age budget. HTTP/2 connections receive a GOAWAY instead.
+type connectionPolicy struct {
+	next        http.Handler
+	maxRequests int64
+	maxAge      time.Duration
+}
+
+// newConnectionPolicy wraps next when a per-connection limit is configured
+func newConnectionPolicy(next http.Handler, cfg config.ConnectionConfig) http.Handler {
+	if cfg.MaxRequests == 0 && cfg.MaxAge == 0 {
+		return next
+	}
+	return &connectionPolicy{
+		next:        next,
+		maxRequests: int64(cfg.MaxRequests),
+		maxAge:      time.Duration(cfg.MaxAge) * time.Second,
+	}
+}
+
+// ServeHTTP counts the request and marks the response as the connection's last when due
+func (cp *connectionPolicy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if info, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+		served := info.requests.Add(1)
+		if (cp.maxRequests > 0 && served >= cp.maxRequests) ||
+			(cp.maxAge > 0 && time.Since(info.opened) >= cp.maxAge) {
+			w.Header().Set("Connection", "close")
+		}
+	}
+	cp.next.ServeHTTP(w, r)
+}
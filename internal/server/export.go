@@ -0,0 +1,187 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/metrics"
+)
+
+// RuntimeModel is the resolved runtime configuration: what each server
+// listens on, which routes and middleware stages handle requests and where
+// they are proxied to. Secrets are left out.
+type RuntimeModel struct {
+	Lite    bool          `json:"lite"`
+	Store   string        `json:"store"`
+	Admin   string        `json:"admin,omitempty"`
+	Servers []ServerModel `json:"servers"`
+}
+
+// ServerModel describes one [[server]]
+type ServerModel struct {
+	Name       string          `json:"name"`
+	Type       string          `json:"type"` // "http" or "tcp"
+	Listeners  []ListenerModel `json:"listeners"`
+	TLS        *TLSModel       `json:"tls,omitempty"`
+	Routes     []RouteModel    `json:"routes"`
+	Middleware []string        `json:"middleware"`
+	Upstreams  UpstreamsModel  `json:"upstreams"`
+}
+
+// ListenerModel is an address a server accepts connections on
+type ListenerModel struct {
+	Network string `json:"network"`
+	Address string `json:"address"`
+}
+
+// TLSModel describes how a server terminates TLS
+type TLSModel struct {
+	Certificate string   `json:"certificate"` // "manual" or "acme"
+	Domains     []string `json:"domains,omitempty"`
+	ClientAuth  string   `json:"client_auth,omitempty"`
+}
+
+// RouteModel is a request route; the proxy handles every unmatched request
+type RouteModel struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Handler string `json:"handler"` // "local" or "proxy"
+}
+
+// UpstreamsModel lists the target pools of a server
+type UpstreamsModel struct {
+	Default     string            `json:"default"`
+	Devices     map[string]string `json:"devices,omitempty"`
+	GeoGroups   []GeoGroupModel   `json:"geo_groups,omitempty"`
+	GeoFallback string            `json:"geo_fallback,omitempty"`
+	Mesh        string            `json:"mesh,omitempty"`
+	Canary      string            `json:"canary,omitempty"`
+	SNI         map[string]string `json:"sni,omitempty"` // TCP servers: target of each passed-through server name
+}
+
+// GeoGroupModel is a weighted target pool selected by client location
+type GeoGroupModel struct {
+	Name       string             `json:"name"`
+	Countries  []string           `json:"countries,omitempty"`
+	Continents []string           `json:"continents,omitempty"`
+	Targets    []WeightedURLModel `json:"targets"`
+}
+
+// WeightedURLModel is a target and its share of a pool's traffic
+type WeightedURLModel struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+// Export builds the runtime model of cfg by assembling every server's handler
+// without opening listeners or connecting to the store
+func Export(cfg *config.Config) (*RuntimeModel, error) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Building handlers must not create per-server log files
+	exportConfig := *cfg
+	exportConfig.Server = make([]config.ServerConfig, len(cfg.Server))
+	copy(exportConfig.Server, cfg.Server)
+	for i := range exportConfig.Server {
+		exportConfig.Server[i].AccessLog = ""
+		exportConfig.Server[i].ErrorLog = ""
+	}
+
+	m := newOfflineManager(&exportConfig)
+	defer m.cleanup()
+
+	model := &RuntimeModel{
+		Lite:    cfg.Lite,
+		Store:   cfg.Store.Backend,
+		Admin:   cfg.Admin.Listen,
+		Servers: make([]ServerModel, 0, len(cfg.Server)),
+	}
+	if cfg.Lite {
+		model.Store = "memory"
+	} else if model.Store == "" {
+		model.Store = config.StoreBackendRedis
+	}
+
+	for i := range exportConfig.Server {
+		serverConfig := &exportConfig.Server[i]
+		server := ServerModel{
+			Name:      serverConfig.Name,
+			Type:      serverConfig.Type,
+			Upstreams: exportUpstreams(serverConfig),
+		}
+
+		for _, addr := range serverConfig.ListenAddrs() {
+			// Validated in config.Validate
+			network, address, _ := config.ParseListenAddr(addr)
+			server.Listeners = append(server.Listeners, ListenerModel{Network: network, Address: address})
+		}
+
+		if https := serverConfig.HTTPS; https.Enabled {
+			server.TLS = &TLSModel{Certificate: "manual", ClientAuth: https.ClientAuth}
+			if https.ACME.Enabled {
+				server.TLS.Certificate = "acme"
+				server.TLS.Domains = https.ACME.Domains
+			}
+		}
+
+		// TCP servers forward connections without routes or middleware
+		if serverConfig.IsTCP() {
+			server.Routes = []RouteModel{}
+			server.Middleware = []string{}
+			model.Servers = append(model.Servers, server)
+			continue
+		}
+
+		router := m.buildRouter(serverConfig, metrics.NewListenerMetrics(serverConfig.Name))
+		server.Middleware = m.chains[router]
+		for _, route := range router.Routes() {
+			server.Routes = append(server.Routes, RouteModel{Method: route.Method, Path: route.Path, Handler: "local"})
+		}
+		sort.Slice(server.Routes, func(a, b int) bool {
+			return server.Routes[a].Path < server.Routes[b].Path
+		})
+		server.Routes = append(server.Routes, RouteModel{Method: "*", Path: "/*", Handler: "proxy"})
+
+		model.Servers = append(model.Servers, server)
+	}
+
+	return model, nil
+}
+
+// exportUpstreams lists the target pools of a server
+func exportUpstreams(serverConfig *config.ServerConfig) UpstreamsModel {
+	upstreams := UpstreamsModel{
+		Default: serverConfig.TargetURL,
+		Devices: serverConfig.Device.Targets,
+		Mesh:    serverConfig.Mesh.Mode,
+		Canary:  serverConfig.Canary.Target,
+	}
+
+	if len(serverConfig.SNI) > 0 {
+		upstreams.SNI = make(map[string]string)
+		for _, route := range serverConfig.SNI {
+			for _, host := range route.Hosts {
+				upstreams.SNI[host] = route.Target
+			}
+		}
+	}
+
+	if serverConfig.GeoRouting.Enabled() {
+		upstreams.GeoFallback = serverConfig.GeoRouting.Fallback
+		for _, group := range serverConfig.GeoRouting.Groups {
+			geoGroup := GeoGroupModel{
+				Name:       group.Name,
+				Countries:  group.Countries,
+				Continents: group.Continents,
+			}
+			for _, target := range group.Targets {
+				geoGroup.Targets = append(geoGroup.Targets, WeightedURLModel{URL: target.URL, Weight: target.EffectiveWeight()})
+			}
+			upstreams.GeoGroups = append(upstreams.GeoGroups, geoGroup)
+		}
+	}
+
+	return upstreams
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"okaproxy/internal/clock"
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/metrics"
+	"okaproxy/internal/middleware"
+	"okaproxy/internal/store"
+)
+
+// stubUpstreams stands in for every target URL and records which one was hit
+type stubUpstreams struct {
+	servers []*httptest.Server
+	stubs   map[string]string // target URL -> stub URL
+
+	mu  sync.Mutex
+	hit string
+}
+
+// stub returns the URL replacing target, starting a stub server on first use
+func (su *stubUpstreams) stub(target string) (string, error) {
+	if stubURL, ok := su.stubs[target]; ok {
+		return stubURL, nil
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid target URL %s: %v", target, err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		su.mu.Lock()
+		su.hit = target
+		su.mu.Unlock()
+		io.WriteString(w, "upstream "+target)
+	}))
+	su.servers = append(su.servers, srv)
+
+	// Keep the target's base path so path rewriting is exercised too
+	parsed.Scheme = "http"
+	parsed.Host = strings.TrimPrefix(srv.URL, "http://")
+	su.stubs[target] = parsed.String()
+	return su.stubs[target], nil
+}
+
+// take returns and clears the last target hit
+func (su *stubUpstreams) take() string {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	hit := su.hit
+	su.hit = ""
+	return hit
+}
+
+func (su *stubUpstreams) close() {
+	for _, srv := range su.servers {
+		srv.Close()
+	}
+}
+
+// closeNotifyRecorder satisfies the reverse proxy's use of http.CloseNotifier
+type closeNotifyRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (closeNotifyRecorder) CloseNotify() <-chan bool {
+	return make(chan bool)
+}
+
+// RunTests runs the configured test fixtures against the servers' handlers
+// without opening listeners. Targets are replaced by local stubs and state is
+// kept in memory, so the results depend on the configuration alone. Results
+// are written to out; the number of failed tests is returned.
+func RunTests(cfg *config.Config, out io.Writer) (int, error) {
+	gin.SetMode(gin.ReleaseMode)
+
+	// Work on a copy so stub targets do not leak into the caller's configuration
+	testConfig := *cfg
+	testConfig.Paths.ReadOnly = true
+	testConfig.Telemetry = config.TelemetryConfig{}
+	testConfig.Log.Remote = config.LogRemoteConfig{}
+	testConfig.Sentry = config.SentryConfig{}
+	testConfig.Server = make([]config.ServerConfig, len(cfg.Server))
+	copy(testConfig.Server, cfg.Server)
+
+	upstreams := &stubUpstreams{stubs: make(map[string]string)}
+	defer upstreams.close()
+
+	for i := range testConfig.Server {
+		serverConfig := &testConfig.Server[i]
+		if serverConfig.IsTCP() {
+			continue
+		}
+		stubURL, err := upstreams.stub(serverConfig.TargetURL)
+		if err != nil {
+			return 0, err
+		}
+		serverConfig.TargetURL = stubURL
+		serverConfig.AccessLog = ""
+		serverConfig.ErrorLog = ""
+
+		targets := make(map[string]string, len(serverConfig.Device.Targets))
+		for class, target := range serverConfig.Device.Targets {
+			if targets[class], err = upstreams.stub(target); err != nil {
+				return 0, err
+			}
+		}
+		serverConfig.Device.Targets = targets
+
+		if serverConfig.Canary.Enabled() {
+			if serverConfig.Canary.Target, err = upstreams.stub(serverConfig.Canary.Target); err != nil {
+				return 0, err
+			}
+		}
+
+		groups := make([]config.GeoRouteGroup, len(serverConfig.GeoRouting.Groups))
+		for j, group := range serverConfig.GeoRouting.Groups {
+			group.Targets = append([]config.WeightedTarget(nil), group.Targets...)
+			for k := range group.Targets {
+				if group.Targets[k].URL, err = upstreams.stub(group.Targets[k].URL); err != nil {
+					return 0, err
+				}
+			}
+			groups[j] = group
+		}
+		serverConfig.GeoRouting.Groups = groups
+	}
+
+	// Run on a fixed clock with seeded randomness so results are reproducible
+	start, err := testConfig.TestMode.StartTime()
+	if err != nil {
+		return 0, err
+	}
+	fixed := clock.Deterministic(start, testConfig.TestMode.Seed)
+	defer clock.Real()
+
+	m := newOfflineManager(&testConfig)
+	defer m.cleanup()
+
+	handlers := make(map[string]http.Handler, len(testConfig.Server))
+	for i := range testConfig.Server {
+		serverConfig := &testConfig.Server[i]
+		if serverConfig.IsTCP() {
+			continue
+		}
+		handlers[serverConfig.Name] = m.buildHandler(serverConfig, metrics.NewListenerMetrics(serverConfig.Name))
+	}
+
+	failed := 0
+	for _, test := range testConfig.Test {
+		serverConfig := testConfig.ServerByName(test.Server)
+
+		req := httptest.NewRequest(test.Method, test.Path, nil)
+		req.RemoteAddr = test.RemoteAddr
+		for name, value := range test.Headers {
+			if strings.EqualFold(name, "Host") {
+				req.Host = value
+				continue
+			}
+			req.Header.Set(name, value)
+		}
+		if test.Verified {
+			for _, cookie := range middleware.NewVerificationCookies(serverConfig, req, m.sessions) {
+				req.AddCookie(cookie)
+			}
+		}
+		// Cookies issued above age by the advance too
+		fixed.Advance(time.Duration(test.Advance) * time.Second)
+
+		rec := httptest.NewRecorder()
+		handlers[test.Server].ServeHTTP(closeNotifyRecorder{rec}, req)
+
+		failures := checkExpectations(test.Expect, rec, upstreams.take())
+		if len(failures) == 0 {
+			fmt.Fprintf(out, "PASS  %s\n", test.Name)
+			continue
+		}
+
+		failed++
+		fmt.Fprintf(out, "FAIL  %s\n", test.Name)
+		for _, failure := range failures {
+			fmt.Fprintf(out, "        %s\n", failure)
+		}
+	}
+
+	fmt.Fprintf(out, "\n%d passed, %d failed\n", len(testConfig.Test)-failed, failed)
+	return failed, nil
+}
+
+// newOfflineManager creates a manager for building handlers without serving:
+// state is kept in memory and nothing is logged
+func newOfflineManager(cfg *config.Config) *Manager {
+	log := logger.NewLogger(logger.Options{
+		DisableGeoIP: cfg.Lite,
+		GeoIPDir:     cfg.Paths.GeoIPPath(),
+		Output:       io.Discard,
+	})
+	return newManager(cfg, log, func(*config.Config) (store.Store, error) {
+		return store.NewMemoryStore(), nil
+	})
+}
+
+// checkExpectations compares a recorded response with the expected outcome
+func checkExpectations(expect config.TestExpect, rec *httptest.ResponseRecorder, hit string) []string {
+	var failures []string
+
+	if expect.Status != 0 && rec.Code != expect.Status {
+		failures = append(failures, fmt.Sprintf("status: expected %d, got %d", expect.Status, rec.Code))
+	}
+
+	route := hit
+	if route == "" {
+		route = config.TestRouteLocal
+	}
+	switch expect.Route {
+	case "":
+	case config.TestRouteUpstream:
+		if hit == "" {
+			failures = append(failures, "route: expected upstream, got local")
+		}
+	default:
+		if route != expect.Route {
+			failures = append(failures, fmt.Sprintf("route: expected %s, got %s", expect.Route, route))
+		}
+	}
+
+	for name, value := range expect.Headers {
+		got := rec.Header().Get(name)
+		if value == "" && got != "" {
+			failures = append(failures, fmt.Sprintf("header %s: expected none, got %q", name, got))
+		} else if value != "" && got != value {
+			failures = append(failures, fmt.Sprintf("header %s: expected %q, got %q", name, value, got))
+		}
+	}
+
+	if expect.BodyContains != "" && !strings.Contains(rec.Body.String(), expect.BodyContains) {
+		failures = append(failures, fmt.Sprintf("body: does not contain %q", expect.BodyContains))
+	}
+
+	return failures
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/logger"
+	"okaproxy/internal/metrics"
+)
+
+// tlsHandshakeTimeout bounds how long a client may take to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// maxHeaderBytes limits the size of request headers
+const maxHeaderBytes = 1 << 20 // 1 MB
+
+// errSlowClient is returned by reads of connections dropped for sending too slowly
+var errSlowClient = errors.New("client sending below the minimum rate")
+
+// instrumentedListener counts accepted connections
+type instrumentedListener struct {
+	net.Listener
+	metrics *metrics.ListenerMetrics
+
+	// Optional slow client protection
+	limiter *connLimiter
+	slow    *slowClients
+}
+
+// Accept accepts a connection and records it. Connections from addresses
+// already at the per-address limit are closed right away.
+func (l *instrumentedListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.metrics.ConnAccepted()
+
+		cc := &countingConn{Conn: conn, slow: l.slow}
+		if l.limiter != nil {
+			if addr, err := netip.ParseAddrPort(conn.RemoteAddr().String()); err == nil {
+				ip := addr.Addr().Unmap()
+				if !l.limiter.acquire(ip) {
+					l.metrics.ConnLimitRejected()
+					conn.Close()
+					continue
+				}
+				cc.release = func() { l.limiter.release(ip) }
+			}
+		}
+		return cc, nil
+	}
+}
+
+// connLimiter caps the open connections per client address
+type connLimiter struct {
+	max   int
+	mu    sync.Mutex
+	conns map[netip.Addr]int
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[netip.Addr]int)}
+}
+
+// acquire counts a connection from addr, reporting false when it is over the limit
+func (cl *connLimiter) acquire(addr netip.Addr) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.conns[addr] >= cl.max {
+		return false
+	}
+	cl.conns[addr]++
+	return true
+}
+
+// release forgets a closed connection from addr
+func (cl *connLimiter) release(addr netip.Addr) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.conns[addr] <= 1 {
+		delete(cl.conns, addr)
+		return
+	}
+	cl.conns[addr]--
+}
+
+// slowClients drops connections that send requests below a minimum rate
+type slowClients struct {
+	minRate float64
+	grace   time.Duration
+	metrics *metrics.ListenerMetrics
+
+	// onDropped is called with the client address (optional)
+	onDropped func(remote net.Addr)
+}
+
+// countingConn counts the bytes read from a client connection. The count at the
+// last request boundary is kept so bytes the HTTP server consumed without ever
+// producing a request, such as oversized headers, can be detected on close.
+// The same boundaries delimit the reads the minimum rate is measured over.
+type countingConn struct {
+	net.Conn
+	read    atomic.Int64
+	handled atomic.Int64
+
+	slow    *slowClients
+	started atomic.Int64 // Unix nanoseconds of the first read since the last boundary
+	exempt  atomic.Bool  // Multiplexed connections have no request boundaries
+
+	release   func()
+	closeOnce sync.Once
+}
+
+// Read reads from the connection and counts the bytes
+func (cc *countingConn) Read(b []byte) (int, error) {
+	n, err := cc.Conn.Read(b)
+	cc.read.Add(int64(n))
+	if n > 0 && cc.slow != nil && !cc.exempt.Load() && cc.tooSlow(n) {
+		cc.slow.metrics.SlowClientDropped()
+		if cc.slow.onDropped != nil {
+			cc.slow.onDropped(cc.RemoteAddr())
+		}
+		cc.Close()
+		return 0, errSlowClient
+	}
+	return n, err
+}
+
+// tooSlow reports whether the bytes read since the last request boundary
+// arrived below the minimum rate once the grace period is over
+func (cc *countingConn) tooSlow(n int) bool {
+	now := time.Now()
+	pending := cc.unhandled()
+	if pending == int64(n) {
+		cc.started.Store(now.UnixNano())
+		return false
+	}
+	elapsed := now.Sub(time.Unix(0, cc.started.Load()))
+	return elapsed > cc.slow.grace && float64(pending) < cc.slow.minRate*elapsed.Seconds()
+}
+
+// Close closes the connection and releases its per-address slot
+func (cc *countingConn) Close() error {
+	cc.closeOnce.Do(func() {
+		if cc.release != nil {
+			cc.release()
+		}
+	})
+	return cc.Conn.Close()
+}
+
+// NetConn returns the wrapped connection
+func (cc *countingConn) NetConn() net.Conn {
+	return cc.Conn
+}
+
+// mark records a request boundary
+func (cc *countingConn) mark() {
+	cc.handled.Store(cc.read.Load())
+}
+
+// unhandled returns the bytes read since the last request boundary
+func (cc *countingConn) unhandled() int64 {
+	return cc.read.Load() - cc.handled.Load()
+}
+
+// countingConnOf returns the countingConn beneath conn, if any
+func countingConnOf(conn net.Conn) (*countingConn, bool) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	cc, ok := conn.(*countingConn)
+	return cc, ok
+}
+
+// connTracker detects connections that close before sending a request, and
+// connections closed after sending more header bytes than the server accepts
+type connTracker struct {
+	metrics *metrics.ListenerMetrics
+	active  sync.Map // net.Conn -> bool (served at least one request)
+
+	// onOversizedHeaders is called with the client address (optional)
+	onOversizedHeaders func(remote net.Addr)
+}
+
+// connState is installed as http.Server.ConnState
+func (ct *connTracker) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		ct.active.Store(conn, false)
+	case http.StateActive:
+		ct.active.Store(conn, true)
+	case http.StateClosed, http.StateHijacked:
+		if served, ok := ct.active.LoadAndDelete(conn); ok && !served.(bool) {
+			ct.metrics.ConnClosedBeforeRequest()
+		}
+		if cc, ok := countingConnOf(conn); ok && state == http.StateClosed && cc.unhandled() >= maxHeaderBytes {
+			ct.metrics.OversizedHeaders()
+			if ct.onOversizedHeaders != nil {
+				ct.onOversizedHeaders(conn.RemoteAddr())
+			}
+		}
+	}
+}
+
+// markRequests records request boundaries on the underlying countingConn
+func markRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+		if ok && info.conn != nil {
+			if r.ProtoMajor == 2 {
+				info.conn.exempt.Store(true)
+			}
+			info.conn.mark()
+			defer info.conn.mark()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handshakeListener completes TLS handshakes before handing connections to the
+// HTTP server, so handshake durations and failures can be measured per listener.
+type handshakeListener struct {
+	inner   net.Listener
+	config  *tls.Config
+	metrics *metrics.ListenerMetrics
+	logger  *logger.Logger
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newHandshakeListener wraps inner and starts its accept loop
+func newHandshakeListener(inner net.Listener, config *tls.Config, m *metrics.ListenerMetrics, log *logger.Logger) *handshakeListener {
+	// Serve negotiates HTTP/2 only when it is offered via ALPN
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	hl := &handshakeListener{
+		inner:   inner,
+		config:  config,
+		metrics: m,
+		logger:  log,
+		conns:   make(chan net.Conn),
+		errs:    make(chan error),
+		closed:  make(chan struct{}),
+	}
+	go hl.acceptLoop()
+	return hl
+}
+
+func (hl *handshakeListener) acceptLoop() {
+	for {
+		conn, err := hl.inner.Accept()
+		if err != nil {
+			select {
+			case hl.errs <- err:
+			case <-hl.closed:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go hl.handshake(conn)
+	}
+}
+
+func (hl *handshakeListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, hl.config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+
+	start := time.Now()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		hl.metrics.HandshakeFailed()
+		hl.logger.WithFields(map[string]interface{}{
+			"listener": hl.metrics.Name,
+			"remote":   conn.RemoteAddr().String(),
+			"error":    err.Error(),
+		}).Debug("TLS handshake failed")
+		conn.Close()
+		return
+	}
+	hl.metrics.HandshakeCompleted(time.Since(start))
+	if cc, ok := countingConnOf(tlsConn); ok {
+		// The handshake is not part of the first request
+		cc.mark()
+	}
+
+	select {
+	case hl.conns <- tlsConn:
+	case <-hl.closed:
+		tlsConn.Close()
+	}
+}
+
+// Accept returns the next connection that completed its handshake
+func (hl *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-hl.conns:
+		return conn, nil
+	case err := <-hl.errs:
+		return nil, err
+	case <-hl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (hl *handshakeListener) Close() error {
+	hl.closeOnce.Do(func() { close(hl.closed) })
+	return hl.inner.Close()
+}
+
+// Addr returns the listener's network address
+func (hl *handshakeListener) Addr() net.Addr {
+	return hl.inner.Addr()
+}
@@ -2,61 +2,293 @@ package server
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
 	
+	"okaproxy/internal/accesslog"
+	"okaproxy/internal/admin"
+	"okaproxy/internal/certs"
+	"okaproxy/internal/clock"
 	"okaproxy/internal/config"
+	"okaproxy/internal/flags"
+	"okaproxy/internal/geoip"
 	"okaproxy/internal/logger"
+	"okaproxy/internal/logship"
+	"okaproxy/internal/maintenance"
+	"okaproxy/internal/metrics"
 	"okaproxy/internal/middleware"
+	"okaproxy/internal/oidc"
+	"okaproxy/internal/pages"
 	"okaproxy/internal/proxy"
+	"okaproxy/internal/report"
+	"okaproxy/internal/sentry"
+	"okaproxy/internal/store"
+	"okaproxy/internal/telemetry"
+	"okaproxy/internal/version"
+	"okaproxy/internal/waf"
 )
 
 // Manager manages multiple proxy servers
 type Manager struct {
 	config       *config.Config
 	logger       *logger.Logger
-	redisManager *middleware.RedisManager
-	servers      []*http.Server
+	stateManager *middleware.StateManager
+	memLimiter   *middleware.MemoryLimiter
+	servers      []*liveServer
 	proxyManager *proxy.ProxyManager
+	certs        *certs.Inventory
+	flagsManager *flags.Manager
+	banManager   *middleware.BanManager
+	cache        *middleware.ResponseCache
+	sessions     *middleware.SessionStore
+	apiKeys      *middleware.APIKeys
+	botVerifier  *middleware.BotVerifier
+	scheduler    *maintenance.Scheduler
+	collector    *report.Collector
+	geoUpdater   *geoip.Updater
+	reports      *report.Scheduler
+	tracer       *telemetry.Tracer
+	shipper      *logship.Shipper
+	reporter     *sentry.Reporter
+	snapshots    map[string]*proxy.Snapshotter
+	logFiles     map[string]*logger.Logger
+	chains       map[*gin.Engine][]string
+	adminServer  *admin.Server
+	watcher      *configWatcher
+	secrets      *secretsRefresher
+	bypass       []netip.Prefix
+	pageSources  pageSources
 	wg           sync.WaitGroup
 	shutdown     chan os.Signal
+	reloadMu     sync.Mutex
+	closing      bool // guarded by reloadMu
+
+	inherited *inheritedListeners // Sockets handed over by the process being upgraded
+	upgrading bool                // guarded by reloadMu
+}
+
+// liveServer is a running proxy server
+type liveServer struct {
+	config    config.ServerConfig
+	server    connServer
+	handler   *swapHandler    // nil for TCP servers
+	tcp       *proxy.TCPProxy // nil for HTTP servers
+	metrics   *metrics.ListenerMetrics
+	listeners []net.Listener
+	sockets   []socket           // The bound sockets behind listeners
+	acme      *certs.ACMEManager // nil without ACME
+	stopping  atomic.Bool
+}
+
+// connServer serves the connections of listeners until shut down: an
+// http.Server, or the proxy of a TCP server
+type connServer interface {
+	Serve(net.Listener) error
+	Shutdown(context.Context) error
 }
 
 // NewManager creates a new server manager
 func NewManager(cfg *config.Config) *Manager {
 	// Initialize logger
-	log := logger.NewLogger()
-	
-	// Initialize Redis manager
-	redisManager := middleware.NewRedisManager(log)
-	
-	// Test Redis connection
-	if err := redisManager.Ping(); err != nil {
-		log.Warnf("Redis connection failed: %v. Rate limiting will be disabled.", err)
+	opts := logger.Options{
+		DisableGeoIP: cfg.Lite,
+		LogDir:       cfg.Paths.LogPath(),
+		GeoIPDir:     cfg.Paths.GeoIPPath(),
+		JSON:         cfg.Log.Format == config.LogFormatJSON,
+		Level:        cfg.Log.Level,
+	}
+	if syslog := cfg.Log.Syslog; syslog.Enabled() {
+		// Validated in config.Validate
+		network, address, _ := syslog.Endpoint()
+		opts.Syslog = &logger.SyslogOptions{
+			Network:  network,
+			Address:  address,
+			Facility: syslog.FacilityCode(),
+			Tag:      syslog.Tag,
+			Only:     syslog.Only,
+		}
+	}
+	log := logger.NewLogger(opts)
+
+	// Deterministic mode: fixed clock and seeded randomness
+	if cfg.TestMode.Enabled {
+		// Validated in config.Validate
+		start, _ := cfg.TestMode.StartTime()
+		clock.Deterministic(start, cfg.TestMode.Seed)
+		log.Warnf("Test mode enabled: the clock is fixed at %s and only moves through the admin API", cfg.TestMode.Time)
+	}
+
+	return newManager(cfg, log, store.Open)
+}
+
+// newManager creates a server manager keeping shared state in the store returned by openStore
+func newManager(cfg *config.Config, log *logger.Logger, openStore func(*config.Config) (store.Store, error)) *Manager {
+	var stateManager *middleware.StateManager
+	var memLimiter *middleware.MemoryLimiter
+	if cfg.Lite {
+		// Lite mode keeps all state in process
+		log.Info("Lite mode enabled: using in-memory rate limiting, Redis and GeoIP disabled")
+		if cfg.Limit.Enabled() {
+			memLimiter = middleware.NewMemoryLimiter(log, cfg.Limit)
+		}
+	} else if st, err := openStore(cfg); err != nil {
+		// Without a store, rate limiting stays in process
+		log.Errorf("Failed to open state store: %v. Falling back to in-memory rate limiting.", err)
+		if cfg.Limit.Enabled() {
+			memLimiter = middleware.NewMemoryLimiter(log, cfg.Limit)
+		}
 	} else {
-		log.Info("Redis connection established successfully")
+		// Initialize state manager
+		stateManager = middleware.NewStateManager(log, st)
+
+		// Test store connection
+		if err := stateManager.Ping(); err != nil {
+			log.Warnf("%s connection failed: %v. Falling back to in-memory rate limiting.", st.Name(), err)
+		} else {
+			log.Infof("%s state store ready", st.Name())
+		}
+	}
+
+	// Runtime feature flags
+	flagsManager := newFlagsManager(cfg, stateManager, log)
+
+	// Validated in config.Validate
+	bypass, _ := cfg.Bypass.Prefixes()
+	trusted, _ := cfg.TrustedProxies.Prefixes()
+	logger.SetTrustedProxies(trusted)
+
+	// Temporary bans share the rate limit store, or live in memory without one
+	var banManager *middleware.BanManager
+	if cfg.Limit.Ban.Enabled {
+		var banStore store.Store = store.NewMemoryStore()
+		if stateManager != nil {
+			banStore = stateManager.Store()
+		}
+		banManager = middleware.NewBanManager(log, cfg.Limit.Ban, banStore)
+	}
+
+	// Cached responses are shared through the state store when there is one
+	var cacheStore store.Store
+	if stateManager != nil {
+		cacheStore = stateManager.Store()
+	}
+	cache := middleware.NewResponseCache(cacheStore, cfg.Cache, log)
+
+	// Verification sessions and created API keys share the state store, or
+	// live in memory without one
+	var sessionStore store.Store = store.NewMemoryStore()
+	if stateManager != nil {
+		sessionStore = stateManager.Store()
+	}
+	sessions := middleware.NewSessionStore(sessionStore, log)
+	apiKeys := middleware.NewAPIKeys(sessionStore, log)
+
+	// Maintenance windows opened through the admin API
+	serverNames := make([]string, 0, len(cfg.Server))
+	for _, serverConfig := range cfg.Server {
+		serverNames = append(serverNames, serverConfig.Name)
+	}
+	scheduler := maintenance.NewScheduler(serverNames, log)
+
+	// Certificates of HTTPS servers are registered as they start
+	inventory := certs.NewInventory()
+
+	// GeoLite2 database downloads
+	var geoUpdater *geoip.Updater
+	if cfg.GeoIP.Enabled() {
+		geoUpdater = geoip.NewUpdater(cfg.GeoIP, cfg.Paths.GeoIPPath(), log)
+	}
+
+	// Scheduled traffic reports
+	var collector *report.Collector
+	var reports *report.Scheduler
+	if cfg.Report.Enabled() {
+		collector = report.NewCollector()
+		reports = report.NewScheduler(cfg.Report, collector, log)
+	}
+
+	// OpenTelemetry trace export
+	var tracer *telemetry.Tracer
+	if cfg.Telemetry.Enabled() {
+		tracer = telemetry.NewTracer(cfg.Telemetry, log)
+	}
+
+	// Access log shipping to Loki or Elasticsearch
+	var shipper *logship.Shipper
+	if cfg.Log.Remote.Enabled() {
+		shipper = logship.NewShipper(cfg.Log.Remote, log)
+	}
+
+	// Error reporting to Sentry
+	var reporter *sentry.Reporter
+	if cfg.Sentry.Enabled() {
+		reporter = sentry.NewReporter(cfg.Sentry, log)
 	}
 
 	// Load static pages
-	errorPage := loadStaticPage("public/502.html", getDefaultErrorPage())
+	sources := pageSources{
+		verification: loadStaticPage("public/verification.html", getDefaultVerificationPage()),
+		errorPage:    loadStaticPage("public/502.html", getDefaultErrorPage()),
+		maintenance:  loadStaticPage("public/maintenance.html", getDefaultMaintenancePage()),
+		forbidden:    loadStaticPage("public/403.html", getDefaultForbiddenPage()),
+		waitingRoom:  loadStaticPage("public/waiting-room.html", getDefaultWaitingRoomPage()),
+	}
 
 	// Initialize proxy manager
-	proxyManager := proxy.NewProxyManager(log, errorPage)
+	proxyManager := proxy.NewProxyManager(log, tracer, reporter)
+
+	// Admin API on its own listener
+	var adminServer *admin.Server
+	if cfg.Admin.Enabled() {
+		adminServer = admin.NewServer(cfg.Admin, admin.Runtime{
+			Config:    cfg,
+			Scheduler: scheduler,
+			Certs:     inventory,
+			Proxy:     proxyManager,
+			Bans:      banManager,
+			Cache:     cache,
+			Sessions:  sessions,
+			APIKeys:   apiKeys,
+		}, log)
+	}
 
 	return &Manager{
 		config:       cfg,
 		logger:       log,
-		redisManager: redisManager,
+		stateManager: stateManager,
+		memLimiter:   memLimiter,
 		proxyManager: proxyManager,
+		flagsManager: flagsManager,
+		banManager:   banManager,
+		cache:        cache,
+		sessions:     sessions,
+		apiKeys:      apiKeys,
+		botVerifier:  middleware.NewBotVerifier(log),
+		scheduler:    scheduler,
+		certs:        inventory,
+		collector:    collector,
+		geoUpdater:   geoUpdater,
+		reports:      reports,
+		tracer:       tracer,
+		shipper:      shipper,
+		reporter:     reporter,
+		snapshots:    make(map[string]*proxy.Snapshotter),
+		logFiles:     make(map[string]*logger.Logger),
+		chains:       make(map[*gin.Engine][]string),
+		adminServer:  adminServer,
+		bypass:       bypass,
+		pageSources:  sources,
 		shutdown:     make(chan os.Signal, 1),
 	}
 }
@@ -66,134 +298,649 @@ func (m *Manager) Start() error {
 	if len(m.config.Server) == 0 {
 		return fmt.Errorf("no server configurations found")
 	}
+	m.logger.Info(version.Get().String())
+
+	// Sockets handed over when this process is an upgrade or socket activated
+	inherited, err := inheritListeners()
+	if err != nil {
+		return err
+	}
+	m.inherited = inherited
+	if inherited != nil && len(inherited.activated) > 0 {
+		m.logger.Infof("Serving %d sockets passed by systemd", len(inherited.activated))
+	}
 
 	// Setup signal handling
 	signal.Notify(m.shutdown, syscall.SIGINT, syscall.SIGTERM)
+	m.handleDebugSignal()
+
+	// Load feature flags before serving traffic
+	if m.flagsManager != nil {
+		m.flagsManager.Start()
+	}
+
+	// Keep GeoIP databases fresh
+	if m.geoUpdater != nil {
+		m.geoUpdater.Start()
+	}
+
+	// Start traffic reports
+	if m.reports != nil {
+		m.reports.Start()
+	}
+
+	// Export traces
+	if m.tracer != nil {
+		m.tracer.Start()
+	}
+
+	// Ship access logs
+	if m.shipper != nil {
+		m.shipper.Start()
+	}
+
+	// Report errors
+	if m.reporter != nil {
+		m.reporter.Start()
+	}
 
 	// Start each server
-	for i, serverConfig := range m.config.Server {
-		if err := m.startServer(i, &serverConfig); err != nil {
+	for i := range m.config.Server {
+		serverConfig := &m.config.Server[i]
+		live, err := m.startServer(serverConfig)
+		if err != nil {
 			m.logger.Errorf("Failed to start server %s: %v", serverConfig.Name, err)
 			return err
 		}
+		m.servers = append(m.servers, live)
 	}
 
 	m.logger.Infof("Started %d proxy servers successfully", len(m.servers))
+
+	// Start admin API
+	if m.adminServer != nil {
+		if inherited := m.inherited.take(adminSocket(m.config.Admin)); len(inherited) > 0 {
+			m.adminServer.UseListener(inherited[0])
+		}
+		if err := m.adminServer.Start(); err != nil {
+			m.logger.Errorf("Failed to start admin API: %v", err)
+			return err
+		}
+	}
+
+	// Every listener is served; an upgraded process can stop now
+	m.finishUpgrade()
+
+	// Reload the configuration on request once everything runs
+	m.handleReloadSignal()
+	m.handleUpgradeSignal()
+	if m.config.Reload.Watch {
+		m.watcher = newConfigWatcher(m.sourceFiles, time.Duration(m.config.Reload.Interval)*time.Second, m.Reload, m.logger)
+		m.watcher.Start()
+	}
+	if m.config.Secrets.Provider != "" {
+		m.secrets = newSecretsRefresher(m.currentConfig, time.Duration(m.config.Secrets.RefreshInterval)*time.Second, m.Reload, m.logger)
+		m.secrets.Start()
+	}
+
 	return nil
 }
 
 // startServer starts a single proxy server
-func (m *Manager) startServer(index int, serverConfig *config.ServerConfig) error {
+func (m *Manager) startServer(serverConfig *config.ServerConfig) (*liveServer, error) {
 	// Set Gin mode to release for production
 	gin.SetMode(gin.ReleaseMode)
 
-	// Create Gin router
-	router := gin.New()
+	// Listener metrics are reported through the status endpoint
+	listenerMetrics := metrics.NewListenerMetrics(serverConfig.Name)
 
-	// Add middlewares
-	m.addMiddlewares(router, serverConfig)
+	// TCP servers forward connections instead of serving HTTP
+	if serverConfig.IsTCP() {
+		return m.startTCPServer(serverConfig, listenerMetrics)
+	}
 
-	// Add routes
-	m.addRoutes(router, serverConfig)
+	// Snapshot key pages to serve while the target is down
+	if err := m.startSnapshots(serverConfig); err != nil {
+		return nil, err
+	}
+
+	// Reloads replace the handler without touching the listeners
+	handler := newSwapHandler(m.buildHandler(serverConfig, listenerMetrics))
 
 	// Create HTTP server
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", serverConfig.Port),
-		Handler: router,
+		Handler: handler,
 		
 		// Timeouts
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		ReadHeaderTimeout: 5 * time.Second,
-		IdleTimeout:       120 * time.Second,
+		ReadTimeout:       time.Duration(serverConfig.Timeouts.Read) * time.Second,
+		WriteTimeout:      time.Duration(serverConfig.Timeouts.Write) * time.Second,
+		ReadHeaderTimeout: time.Duration(serverConfig.Timeouts.ReadHeader) * time.Second,
+		IdleTimeout:       serverConfig.Connection.IdleTimeoutDuration(),
 		
 		// Security settings
-		MaxHeaderBytes: 1 << 20, // 1 MB
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+
+	// Track connections that never send a request
+	tracker := &connTracker{
+		metrics:            listenerMetrics,
+		onOversizedHeaders: m.oversizedHeaders(serverConfig.Name),
+	}
+	server.ConnState = tracker.connState
+
+	// Client connection management
+	server.ConnContext = connContext
+	if serverConfig.Connection.ForceClose {
+		server.SetKeepAlivesEnabled(false)
+	}
+
+	bound, err := m.bindListeners(serverConfig, listenerMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := "HTTP"
+	if serverConfig.HTTPS.Enabled {
+		protocol = "HTTPS"
+	}
+
+	live := &liveServer{
+		config:    *serverConfig,
+		server:    server,
+		handler:   handler,
+		metrics:   listenerMetrics,
+		listeners: bound.listeners,
+		sockets:   bound.sockets,
+		acme:      bound.acme,
+	}
+
+	m.serve(live, bound.announce, protocol)
+	return live, nil
+}
+
+// startTCPServer starts a server forwarding raw TCP connections
+func (m *Manager) startTCPServer(serverConfig *config.ServerConfig, listenerMetrics *metrics.ListenerMetrics) (*liveServer, error) {
+	tcpProxy, err := proxy.NewTCPProxy(serverConfig, m.serverLogger(serverConfig.AccessLog), m.serverLogger(serverConfig.ErrorLog))
+	if err != nil {
+		return nil, err
+	}
+	bound, err := m.bindListeners(serverConfig, listenerMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := "TCP"
+	if serverConfig.HTTPS.Enabled {
+		protocol = "TLS"
+	}
+
+	live := &liveServer{
+		config:    *serverConfig,
+		server:    tcpProxy,
+		tcp:       tcpProxy,
+		metrics:   listenerMetrics,
+		listeners: bound.listeners,
+		sockets:   bound.sockets,
+		acme:      bound.acme,
+	}
+	m.serve(live, bound.announce, protocol)
+	return live, nil
+}
+
+// boundListeners are the listeners of a server, ready to serve
+type boundListeners struct {
+	listeners []net.Listener
+	sockets   []socket           // The bound sockets behind listeners
+	announce  []bool             // Whether each listener is the first of its address
+	acme      *certs.ACMEManager // nil without ACME
+}
+
+// bindListeners binds the listeners of a server and wraps them for PROXY
+// protocol, connection limits and TLS termination as configured
+func (m *Manager) bindListeners(serverConfig *config.ServerConfig, listenerMetrics *metrics.ListenerMetrics) (*boundListeners, error) {
+	// Bind the listeners synchronously so port conflicts fail startup. With
+	// several accept loops an address has several listeners; only the first
+	// of each is announced.
+	var listeners []net.Listener
+	var sockets []socket
+	var announce []bool
+	closeListeners := func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}
+	proxyProtocol := serverConfig.ProxyProtocol
+	trusted, err := proxyProtocol.TrustedPrefixes()
+	if err != nil {
+		return nil, fmt.Errorf("proxy_protocol trusted: %v", err)
+	}
+	// Slow client protection is shared by all of the server's listeners
+	var limiter *connLimiter
+	if serverConfig.SlowClients.MaxConnsPerIP > 0 {
+		limiter = newConnLimiter(serverConfig.SlowClients.MaxConnsPerIP)
+	}
+	// TCP connections have no requests to measure the minimum rate over
+	var slow *slowClients
+	if serverConfig.SlowClients.MinRate > 0 && !serverConfig.IsTCP() {
+		slow = &slowClients{
+			minRate:   float64(serverConfig.SlowClients.MinRate),
+			grace:     serverConfig.SlowClients.GraceDuration(),
+			metrics:   listenerMetrics,
+			onDropped: m.slowClient(serverConfig.Name),
+		}
+	}
+	for _, addr := range serverConfig.ListenAddrs() {
+		lns, err := m.listen(addr, serverConfig.TCP)
+		if err != nil {
+			closeListeners()
+			return nil, err
+		}
+		for i, ln := range lns {
+			sockets = append(sockets, socket{addr: addr, ln: ln})
+			if proxyProtocol.Enabled {
+				ln = newProxyProtocolListener(ln, trusted, proxyProtocol.TimeoutDuration(), listenerMetrics.Name, m.logger)
+			}
+			listeners = append(listeners, &instrumentedListener{Listener: ln, metrics: listenerMetrics, limiter: limiter, slow: slow})
+			announce = append(announce, i == 0)
+		}
 	}
 
 	// Configure TLS if enabled
+	var acmeManager *certs.ACMEManager
 	if serverConfig.HTTPS.Enabled {
-		// Load TLS certificate
-		cert, err := tls.LoadX509KeyPair(serverConfig.HTTPS.CertPath, serverConfig.HTTPS.KeyPath)
+		if serverConfig.HTTPS.ACME.Enabled {
+			var err error
+			acmeManager, err = certs.NewACMEManager(serverConfig.Name, serverConfig.HTTPS.ACME, m.logger)
+			if err != nil {
+				closeListeners()
+				return nil, err
+			}
+			if err := acmeManager.Start(); err != nil {
+				closeListeners()
+				return nil, err
+			}
+		}
+
+		tlsConfig, err := buildTLSConfig(&serverConfig.HTTPS, acmeManager)
 		if err != nil {
-			return fmt.Errorf("failed to load TLS certificate: %v", err)
+			if acmeManager != nil {
+				acmeManager.Stop()
+			}
+			closeListeners()
+			return nil, err
+		}
+		for i := range listeners {
+			listeners[i] = newHandshakeListener(listeners[i], tlsConfig, listenerMetrics, m.logger)
 		}
 
-		server.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			},
+		if acmeManager != nil {
+			m.certs.AddACME(acmeManager)
+		} else {
+			m.certs.AddManual(serverConfig.Name, &tlsConfig.Certificates[0])
 		}
 	}
 
-	// Start server in goroutine
-	m.wg.Add(1)
-	go func() {
-		defer m.wg.Done()
-		
-		var err error
-		if serverConfig.HTTPS.Enabled {
-			m.logger.LogServerStart("HTTPS", serverConfig.Port)
-			err = server.ListenAndServeTLS("", "")
-		} else {
-			m.logger.LogServerStart("HTTP", serverConfig.Port)
-			err = server.ListenAndServe()
+	return &boundListeners{listeners: listeners, sockets: sockets, announce: announce, acme: acmeManager}, nil
+}
+
+// serve serves every listener of a server in its own goroutine
+func (m *Manager) serve(live *liveServer, announce []bool, protocol string) {
+	serverConfig := live.config
+	for i, listener := range live.listeners {
+		m.wg.Add(1)
+		go func(primary, announce bool, listener net.Listener) {
+			defer m.wg.Done()
+
+			switch {
+			case primary && serverConfig.Port > 0 && serverConfig.Bind == "" && serverConfig.TCP.Family != config.TCPFamilyIPv6:
+				m.logger.LogServerStart(protocol, serverConfig.Port)
+			case primary:
+				m.logger.Infof("%s server %s listening on %s", protocol, serverConfig.Name, listener.Addr())
+			case announce:
+				m.logger.Infof("%s server %s also listening on %s", protocol, serverConfig.Name, listener.Addr())
+			}
+
+			// TLS handshakes are completed by the listener
+			err := live.server.Serve(listener)
+			if err != nil && err != http.ErrServerClosed && !live.stopping.Load() {
+				m.logger.Errorf("Server %s stopped with error: %v", serverConfig.Name, err)
+			}
+		}(i == 0, announce[i], listener)
+	}
+}
+
+// startSnapshots starts taking snapshots of a server's key pages, replacing
+// those of an earlier configuration
+func (m *Manager) startSnapshots(serverConfig *config.ServerConfig) error {
+	if previous, ok := m.snapshots[serverConfig.Name]; ok {
+		previous.Stop()
+		delete(m.snapshots, serverConfig.Name)
+	}
+	if !serverConfig.Snapshot.Enabled() {
+		return nil
+	}
+
+	snapshots, err := m.proxyManager.WithLogger(m.serverLogger(serverConfig.ErrorLog)).NewSnapshotter(serverConfig)
+	if err != nil {
+		return err
+	}
+	snapshots.Start()
+	m.snapshots[serverConfig.Name] = snapshots
+	return nil
+}
+
+// listen binds a listen address, applying the TCP options to TCP addresses.
+// A unix socket left behind by an earlier run is replaced; one that still
+// accepts connections is not.
+func listen(addr string, tcp config.TCPConfig) ([]net.Listener, error) {
+	network, address, err := config.ParseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", address, time.Second); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(address)
+			}
 		}
+	}
 
-		if err != nil && err != http.ErrServerClosed {
-			m.logger.Errorf("Server %s stopped with error: %v", serverConfig.Name, err)
+	if network != "unix" {
+		listeners, err := listenTCP(network, address, tcp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
 		}
-	}()
+		return listeners, nil
+	}
 
-	// Store server reference for shutdown
-	m.servers = append(m.servers, server)
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return []net.Listener{ln}, nil
+}
 
-	return nil
+// buildHandler creates the request handler of a server
+func (m *Manager) buildHandler(serverConfig *config.ServerConfig, listenerMetrics *metrics.ListenerMetrics) http.Handler {
+	router := m.buildRouter(serverConfig, listenerMetrics)
+
+	// Stage lists are only kept for exports; reloads would accumulate them
+	delete(m.chains, router)
+	return markRequests(newConnectionPolicy(router, serverConfig.Connection))
+}
+
+// buildRouter creates the router of a server with its middlewares and routes
+func (m *Manager) buildRouter(serverConfig *config.ServerConfig, listenerMetrics *metrics.ListenerMetrics) *gin.Engine {
+	// Create Gin router
+	router := gin.New()
+
+	// Pre-render and compress static pages once per server
+	serverPages := m.pageSources.compile(serverConfig)
+
+	// Request counters are reported through the status endpoint
+	counters := metrics.NewRequestCounters()
+	queue := metrics.NewQueueMetrics()
+
+	// Add middlewares
+	m.addMiddlewares(router, serverConfig, serverPages, counters, queue)
+
+	// Add routes
+	m.addRoutes(router, serverConfig, serverPages, listenerMetrics, counters, queue)
+
+	return router
 }
 
 // addMiddlewares adds all necessary middlewares to the router
-func (m *Manager) addMiddlewares(router *gin.Engine, serverConfig *config.ServerConfig) {
+func (m *Manager) addMiddlewares(router *gin.Engine, serverConfig *config.ServerConfig, serverPages *staticPages, counters *metrics.RequestCounters, queue *metrics.QueueMetrics) {
+	// Routes with their own timeouts move the connection deadlines first
+	if len(serverConfig.Timeouts.Routes) > 0 {
+		m.use(router, "timeouts", middleware.TimeoutMiddleware(serverConfig.Timeouts))
+	}
+
+	// Count requests outside recovery so panics count as 500
+	m.use(router, "counters", middleware.RequestCountersMiddleware(counters))
+
 	// Recovery middleware
 	router.Use(gin.Recovery())
+	m.record(router, "recovery")
+
+	// Report panics and 5xx bursts
+	if m.reporter != nil {
+		router.Use(middleware.ErrorReportMiddleware(m.reporter, serverConfig.Name))
+		m.record(router, "error_report")
+	}
+
+	// Trace every request; each stage below becomes a child span
+	if m.tracer != nil {
+		router.Use(middleware.TracingMiddleware(m.tracer, serverConfig.Name))
+		m.record(router, "tracing")
+	}
+
+	// Servers may log to their own files
+	serverLog := m.serverLogger(serverConfig.ErrorLog)
 
 	// Custom logger middleware
-	router.Use(middleware.LoggerMiddleware(m.logger))
+	var accessLogFormat *accesslog.Format
+	if serverConfig.AccessLogFormat != "" {
+		// Validated in config.Validate
+		accessLogFormat, _ = accesslog.Parse(serverConfig.AccessLogFormat)
+	}
+	m.use(router, "logger", middleware.LoggerMiddleware(m.serverLogger(serverConfig.AccessLog), accessLogFormat, serverConfig.Name, m.shipper))
+
+	// Traffic report collection sees every response, including rejections
+	if m.collector != nil {
+		m.use(router, "report", middleware.ReportMiddleware(serverLog, m.collector, serverConfig.Name))
+	}
 
 	// Request ID middleware
-	router.Use(middleware.RequestIDMiddleware())
+	m.use(router, "request_id", middleware.RequestIDMiddleware())
 
 	// Security headers middleware
-	router.Use(middleware.SecurityHeadersMiddleware())
+	m.use(router, "security_headers", middleware.SecurityHeadersMiddleware(serverConfig.SecurityHeaders))
+
+	// Per-server access control lists apply to every client
+	if serverConfig.ACL.Enabled() {
+		// Validated in config.Validate
+		allow, deny, _ := serverConfig.ACL.Prefixes()
+		m.use(router, "acl", middleware.ACLMiddleware(serverLog, allow, deny, serverPages.forbidden))
+	}
+
+	// Allowlisted clients skip bans, verification and rate limiting
+	if len(m.bypass) > 0 {
+		m.use(router, "bypass", middleware.BypassMiddleware(m.bypass))
+	}
+
+	// Country-based blocking and challenges
+	if serverConfig.GeoBlock.Enabled() {
+		m.use(router, "geo_block", middleware.GeoBlockMiddleware(serverLog, serverConfig.GeoBlock, serverPages.forbidden))
+	}
+
+	// Banned clients are rejected before any other work
+	rateLimitKey := middleware.NewRateLimitKeyFunc(serverConfig.RateLimitKey, serverConfig.JWT)
+	if m.banManager != nil {
+		m.use(router, "ban", m.banManager.BanMiddleware(rateLimitKey))
+	}
+
+	// Authentication, for allowlisted clients too. Banned clients are turned
+	// away first: a wrong password costs a bcrypt comparison, an OIDC or forward
+	// auth check a subrequest and an unknown API key a store lookup.
+	if serverConfig.BasicAuth.Enabled() {
+		// Validated in config.Validate
+		credentials, _ := serverConfig.BasicAuth.Credentials()
+		m.use(router, "basic_auth", middleware.BasicAuthMiddleware(serverLog, serverConfig.BasicAuth, credentials))
+	}
+
+	// Single sign-on with an OpenID Connect provider
+	if serverConfig.OIDC.Enabled() {
+		provider := oidc.New(oidc.Options{
+			Issuer:       serverConfig.OIDC.Issuer,
+			ClientID:     serverConfig.OIDC.ClientID,
+			ClientSecret: serverConfig.OIDC.ClientSecret,
+			RedirectURL:  serverConfig.OIDC.RedirectURL,
+			Scopes:       serverConfig.OIDC.Scopes,
+		})
+		m.use(router, "oidc", middleware.OIDCMiddleware(serverLog, serverConfig, provider, serverPages.errorPage, serverPages.forbidden))
+	}
+
+	// An external auth service decides on each request
+	if serverConfig.ForwardAuth.Enabled() {
+		m.use(router, "forward_auth", middleware.ForwardAuthMiddleware(serverLog, serverConfig.ForwardAuth, serverPages.errorPage))
+	}
+
+	// API keys, each with its own rate limit
+	if serverConfig.APIKeys.Enabled() {
+		m.use(router, "api_keys", m.apiKeys.Middleware(serverConfig))
+	}
+
+	// ASN blocking and shared per-ASN limits
+	if serverConfig.ASN.Enabled() {
+		if !serverLog.HasASN() {
+			serverLog.Warnf("ASN filtering for server %s is inactive: GeoLite2-ASN.mmdb not found", serverConfig.Name)
+		}
+		var asnStore store.Store = store.NewMemoryStore()
+		if m.stateManager != nil {
+			asnStore = m.stateManager.Store()
+		}
+		m.use(router, "asn", middleware.ASNMiddleware(serverLog, serverConfig.Name, serverConfig.ASN, serverPages.forbidden, asnStore))
+	}
+
+	// Anomaly scoring, escalating from the challenge to delays to bans
+	if serverConfig.Anomaly.Enabled {
+		if m.banManager == nil && serverConfig.Anomaly.Ban > 0 {
+			serverLog.Warnf("Anomaly bans for server %s are inactive: [limit.ban] is not enabled", serverConfig.Name)
+		}
+		var anomalyStore store.Store = store.NewMemoryStore()
+		if m.stateManager != nil {
+			anomalyStore = m.stateManager.Store()
+		}
+		m.use(router, "anomaly", middleware.AnomalyMiddleware(serverLog, serverConfig, anomalyStore, m.banManager, rateLimitKey))
+	}
+
+	// Request rules for quick blocking, and exemptions from the WAF
+	if len(serverConfig.Rules) > 0 {
+		m.use(router, "rules", middleware.RulesMiddleware(serverLog, serverConfig.Rules, serverPages.forbidden))
+	}
+
+	// Web application firewall rules
+	if serverConfig.WAF.Enabled {
+		// Validated in config.Validate, but rule files may have changed since
+		if engine, err := waf.New(serverConfig.WAF.Options()); err != nil {
+			serverLog.Errorf("Failed to load WAF rules, requests are not inspected: %v", err)
+		} else {
+			m.use(router, "waf", middleware.WAFMiddleware(serverLog, serverConfig.WAF, engine, serverPages.forbidden))
+		}
+	}
 
 	// CORS middleware
-	router.Use(middleware.CORSMiddleware())
+	m.use(router, "cors", middleware.CORSMiddleware(serverConfig.CORS))
+
+	// Response compression, which lite mode leaves out
+	if compression := compressionMiddleware(serverConfig.Compression); compression != nil && len(serverConfig.Compression.Encodings) > 0 {
+		m.use(router, "compression", compression)
+	}
 
-	// Gzip compression
-	router.Use(gzip.Gzip(gzip.DefaultCompression))
+	// Maintenance mode short-circuits proxied traffic while an admin maintenance
+	// window is open or the maintenance flag is on
+	serverFlags := m.serverFlags(serverConfig.Name)
+	m.use(router, "maintenance", middleware.MaintenanceMiddleware(serverPages.maintenance, func() bool {
+		return m.scheduler.Active(serverConfig.Name) || serverFlags.Bool(flags.Maintenance, false)
+	}, m.scheduler.InFlight(serverConfig.Name)))
+
+	// Search engine crawlers skip the challenge once their address is verified
+	if serverConfig.SearchBots.Verify {
+		m.use(router, "search_bots", m.botVerifier.Middleware(serverConfig, serverPages.forbidden))
+	}
+
+	// Under attack mode challenges every client; the flag overrides the config
+	if serverConfig.UnderAttack || serverFlags != nil {
+		m.use(router, "under_attack", middleware.UnderAttackMiddleware(func() bool {
+			return serverFlags.Bool(flags.UnderAttack, serverConfig.UnderAttack)
+		}))
+	}
 
 	// Authentication middleware
-	verificationPage := loadStaticPage("public/verification.html", getDefaultVerificationPage())
-	authMiddleware := middleware.NewAuthMiddleware(m.logger, verificationPage)
-	router.Use(authMiddleware.CheckVerification(serverConfig))
+	authMiddleware := middleware.NewAuthMiddleware(serverLog, serverPages.verification, m.sessions)
+	m.use(router, "verification", authMiddleware.CheckVerification(serverConfig))
 
 	// Rate limiting middleware
-	router.Use(m.redisManager.RateLimitMiddleware(m.config))
+	if m.stateManager != nil {
+		m.use(router, "rate_limit", m.stateManager.RateLimitMiddleware(m.config, rateLimitKey))
+	} else if m.memLimiter != nil {
+		m.use(router, "rate_limit", m.memLimiter.RateLimitMiddleware(rateLimitKey))
+	}
+
+	// Concurrency limit, queueing requests beyond it
+	if serverConfig.Concurrency.Enabled() {
+		limiter := middleware.NewConcurrencyLimiter(serverLog, serverConfig, serverPages.waitingRoom, queue)
+		m.use(router, "concurrency", limiter.Middleware())
+	}
+}
+
+// use adds a middleware stage, traced when telemetry is enabled
+func (m *Manager) use(router *gin.Engine, stage string, handler gin.HandlerFunc) {
+	router.Use(middleware.TraceStage(m.tracer, stage, handler))
+	m.record(router, stage)
+}
+
+// record notes a middleware stage of router, in order, for exports
+func (m *Manager) record(router *gin.Engine, stage string) {
+	m.chains[router] = append(m.chains[router], stage)
+}
+
+// serverLogger returns the logger writing to path, or the shared logger when
+// path is empty or cannot be opened
+func (m *Manager) serverLogger(path string) *logger.Logger {
+	if path == "" {
+		return m.logger
+	}
+	if l, ok := m.logFiles[path]; ok {
+		return l
+	}
+
+	l, err := m.logger.OpenFile(path)
+	if err != nil {
+		m.logger.Warnf("Failed to open %s, logging to the shared log: %v", path, err)
+		l = m.logger
+	}
+	m.logFiles[path] = l
+	return l
 }
 
 // addRoutes adds all routes to the router
-func (m *Manager) addRoutes(router *gin.Engine, serverConfig *config.ServerConfig) {
+func (m *Manager) addRoutes(router *gin.Engine, serverConfig *config.ServerConfig, serverPages *staticPages, listenerMetrics *metrics.ListenerMetrics, counters *metrics.RequestCounters, queue *metrics.QueueMetrics) {
+	// Built-in endpoints, optionally moved, disabled or limited to internal clients
+	endpoints := serverConfig.Endpoints
+	var guard []gin.HandlerFunc
+	if allow, _ := endpoints.AllowPrefixes(); len(allow) > 0 {
+		guard = append(guard, middleware.InternalOnly(allow))
+	}
+
 	// Health check endpoint
-	router.GET("/health", m.proxyManager.HealthCheckHandler())
+	if endpoints.Health != config.EndpointOff {
+		router.GET(endpoints.Health, append(guard, m.proxyManager.HealthCheckHandler())...)
+	}
 
 	// Status endpoint
-	router.GET("/status", m.proxyManager.StatusHandler(serverConfig))
+	if endpoints.Status != config.EndpointOff {
+		router.GET(endpoints.Status, append(guard, m.proxyManager.StatusHandler(serverConfig, listenerMetrics, counters, queue))...)
+	}
 
-	// Catch-all proxy handler
-	router.NoRoute(m.proxyManager.ProxyHandler(serverConfig))
+	// Catch-all proxy handler, behind the static files and the response cache when enabled
+	proxyManager := m.proxyManager.WithLogger(m.serverLogger(serverConfig.ErrorLog))
+	proxyHandler := proxyManager.ProxyHandler(serverConfig, serverPages.errorPage, m.snapshots[serverConfig.Name], m.serverFlags(serverConfig.Name))
+	var handlers []gin.HandlerFunc
+	if serverConfig.Static.Enabled() {
+		handlers = append(handlers, middleware.TraceStage(m.tracer, "static", middleware.StaticMiddleware(serverConfig.Static)))
+		m.record(router, "static")
+	}
+	if serverConfig.Cache.Enabled {
+		handlers = append(handlers, middleware.TraceStage(m.tracer, "cache", m.cache.Middleware(serverConfig.Name, serverConfig.Cache)))
+		m.record(router, "cache")
+	}
+	router.NoRoute(append(handlers, proxyHandler)...)
 }
 
 // WaitForShutdown waits for shutdown signal and gracefully shuts down all servers
@@ -201,24 +948,59 @@ func (m *Manager) WaitForShutdown() {
 	<-m.shutdown
 	m.logger.Info("Shutdown signal received, starting graceful shutdown...")
 
-	// Create context with timeout for graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// No reloads once shutting down
+	m.reloadMu.Lock()
+	m.closing = true
+	upgraded := m.upgrading
+	shutdown := m.config.Shutdown
+	m.reloadMu.Unlock()
+
+	// Refuse new connections at once; open ones keep being served
+	for _, live := range m.servers {
+		live.stopping.Store(true)
+		for _, ln := range live.listeners {
+			ln.Close()
+		}
+	}
+
+	// Let load balancers notice through the health check on their open
+	// connections. After an upgrade the new process is healthy.
+	if shutdown.FailHealth > 0 && !upgraded {
+		m.proxyManager.SetDraining(true)
+		m.logger.Infof("Failing health checks for %ds before draining", shutdown.FailHealth)
+		time.Sleep(time.Duration(shutdown.FailHealth) * time.Second)
+	}
+
+	// Give requests in flight the drain period
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdown.DrainTimeout)*time.Second)
 	defer cancel()
 
+	// Stop accepting admin requests
+	if m.adminServer != nil {
+		if err := m.adminServer.Shutdown(ctx); err != nil {
+			m.logger.Errorf("Admin API shutdown error: %v", err)
+		}
+	}
+
 	// Shutdown all servers
-	for i, server := range m.servers {
-		go func(index int, srv *http.Server) {
-			if err := srv.Shutdown(ctx); err != nil {
-				m.logger.Errorf("Server %d shutdown error: %v", index, err)
+	var drained sync.WaitGroup
+	for _, live := range m.servers {
+		drained.Add(1)
+		go func(live *liveServer) {
+			defer drained.Done()
+			// The listeners were closed above
+			if err := live.server.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+				m.logger.Errorf("Server %s shutdown error: %v", live.config.Name, err)
 			} else {
-				m.logger.Infof("Server %d shutdown completed", index)
+				m.logger.Infof("Server %s shutdown completed", live.config.Name)
 			}
-		}(i, server)
+		}(live)
 	}
 
 	// Wait for all servers to shutdown or timeout
 	done := make(chan struct{})
 	go func() {
+		drained.Wait()
 		m.wg.Wait()
 		close(done)
 	}()
@@ -227,7 +1009,7 @@ func (m *Manager) WaitForShutdown() {
 	case <-done:
 		m.logger.Info("All servers shutdown gracefully")
 	case <-ctx.Done():
-		m.logger.Warn("Graceful shutdown timeout, forcing exit")
+		m.logger.Warnf("Requests still running after the %ds drain period, forcing exit", shutdown.DrainTimeout)
 	}
 
 	// Close resources
@@ -237,9 +1019,69 @@ func (m *Manager) WaitForShutdown() {
 
 // cleanup closes all resources
 func (m *Manager) cleanup() {
-	// Close Redis connection
-	if m.redisManager != nil {
-		m.redisManager.Close()
+	// Stop watching the configuration file and secrets
+	if m.watcher != nil {
+		m.watcher.Stop()
+	}
+	if m.secrets != nil {
+		m.secrets.Stop()
+	}
+
+	// Stop certificate renewal
+	for _, live := range m.servers {
+		if live.acme != nil {
+			live.acme.Stop()
+		}
+	}
+
+	// Stop taking snapshots
+	for _, snapshots := range m.snapshots {
+		snapshots.Stop()
+	}
+
+	// Stop GeoIP refreshes
+	if m.geoUpdater != nil {
+		m.geoUpdater.Stop()
+	}
+
+	// Stop traffic reports
+	if m.reports != nil {
+		m.reports.Stop()
+	}
+
+	// Cancel pending maintenance restores
+	m.scheduler.Stop()
+
+	// Stop feature flag polling
+	if m.flagsManager != nil {
+		m.flagsManager.Stop()
+	}
+
+	// Flush pending trace spans
+	if m.tracer != nil {
+		m.tracer.Stop()
+	}
+
+	// Flush pending access log records
+	if m.shipper != nil {
+		m.shipper.Stop()
+	}
+
+	// Send pending error reports
+	if m.reporter != nil {
+		m.reporter.Stop()
+	}
+
+	// Close state store
+	if m.stateManager != nil {
+		m.stateManager.Close()
+	}
+
+	// Close per-server log files
+	for _, l := range m.logFiles {
+		if l != m.logger {
+			l.Close()
+		}
 	}
 
 	// Close logger resources
@@ -248,6 +1090,132 @@ func (m *Manager) cleanup() {
 	}
 }
 
+// oversizedHeaders returns the handler for connections closed after sending too
+// large request headers: the event is logged and, when configured, counted
+// toward a temporary ban of the connecting address
+func (m *Manager) oversizedHeaders(serverName string) func(net.Addr) {
+	ban := m.banManager != nil && m.config.Limit.Ban.OversizedHeaders
+	return func(remote net.Addr) {
+		addr, err := netip.ParseAddrPort(remote.String())
+		if err != nil {
+			return
+		}
+		ip := addr.Addr().Unmap()
+
+		m.logger.WithFields(map[string]interface{}{
+			"server": serverName,
+			"ip":     ip.String(),
+			"limit":  maxHeaderBytes,
+		}).Warn("Connection closed after oversized request headers")
+
+		if ban {
+			m.banManager.RecordAddrViolation(ip, "oversized headers")
+		}
+	}
+}
+
+// slowClient returns the handler for connections dropped for sending requests
+// below the minimum rate: the event is logged and, when configured, counted
+// toward a temporary ban of the connecting address
+func (m *Manager) slowClient(serverName string) func(net.Addr) {
+	ban := m.banManager != nil && m.config.Limit.Ban.SlowClients
+	return func(remote net.Addr) {
+		addr, err := netip.ParseAddrPort(remote.String())
+		if err != nil {
+			return
+		}
+		ip := addr.Addr().Unmap()
+
+		m.logger.WithFields(map[string]interface{}{
+			"server": serverName,
+			"ip":     ip.String(),
+		}).Warn("Connection closed for sending a request too slowly")
+
+		if ban {
+			m.banManager.RecordAddrViolation(ip, "slow client")
+		}
+	}
+}
+
+// serverFlags returns the runtime flags of a server, or nil when flags are disabled
+func (m *Manager) serverFlags(name string) *flags.ServerFlags {
+	if m.flagsManager == nil {
+		return nil
+	}
+	return m.flagsManager.Server(name)
+}
+
+// newFlagsManager creates the configured feature flag manager, or nil when disabled
+func newFlagsManager(cfg *config.Config, stateManager *middleware.StateManager, log *logger.Logger) *flags.Manager {
+	var source flags.Source
+	switch cfg.Flags.Provider {
+	case config.FlagsProviderRedis:
+		if stateManager == nil {
+			return nil
+		}
+		source = flags.NewRedisSource(stateManager, cfg.Flags.KeyPrefix)
+	case config.FlagsProviderHTTP:
+		source = flags.NewHTTPSource(cfg.Flags.URL)
+	default:
+		return nil
+	}
+
+	servers := make([]string, 0, len(cfg.Server))
+	for _, serverConfig := range cfg.Server {
+		servers = append(servers, serverConfig.Name)
+	}
+
+	log.Infof("Feature flags enabled using the %s provider", cfg.Flags.Provider)
+	return flags.NewManager(source, time.Duration(cfg.Flags.PollInterval)*time.Second, servers, log)
+}
+
+// pageSources holds the raw static page templates
+type pageSources struct {
+	verification string
+	errorPage    string
+	maintenance  string
+	forbidden    string
+	waitingRoom  string
+}
+
+// staticPages holds the pages rendered for a single server
+type staticPages struct {
+	verification *pages.Page
+	errorPage    *pages.Page
+	maintenance  *pages.Page
+	forbidden    *pages.Page
+	waitingRoom  *pages.Template
+}
+
+// compile renders and precompresses every page for the given server
+func (ps pageSources) compile(serverConfig *config.ServerConfig) *staticPages {
+	data := pages.Data{ServerName: serverConfig.Name}
+
+	// Servers may bring their own pages
+	own := serverConfig.Pages
+	forbidden := serverPage(own.Forbidden, ps.forbidden)
+	if serverConfig.ACL.Page != "" {
+		forbidden = loadStaticPage(serverConfig.ACL.Page, forbidden)
+	}
+
+	return &staticPages{
+		verification: pages.Compile(serverPage(own.Verification, ps.verification), data),
+		errorPage:    pages.Compile(serverPage(own.Error, ps.errorPage), data),
+		maintenance:  pages.Compile(serverPage(own.Maintenance, ps.maintenance), data),
+		forbidden:    pages.Compile(forbidden, data),
+		waitingRoom:  pages.CompileTemplate(serverPage(own.WaitingRoom, ps.waitingRoom)),
+	}
+}
+
+// serverPage loads a server's own page file, falling back to the shared page
+// when none is configured
+func serverPage(filePath, shared string) string {
+	if filePath == "" {
+		return shared
+	}
+	return loadStaticPage(filePath, shared)
+}
+
 // loadStaticPage loads a static HTML page from file, fallback to default if not found
 func loadStaticPage(filePath, defaultContent string) string {
 	if content, err := os.ReadFile(filePath); err == nil {
@@ -336,10 +1304,14 @@ func getDefaultVerificationPage() string {
             <div class="progress-bar"></div>
         </div>
     </div>
+    <script src="/_oka/challenge.js"></script>
     <script>
-        setTimeout(function() {
-            window.location.reload();
-        }, 5000);
+        // With a proof-of-work challenge the page reloads once it is solved
+        if (!window.okaChallenge) {
+            setTimeout(function() {
+                window.location.reload();
+            }, 5000);
+        }
     </script>
 </body>
 </html>`
@@ -416,4 +1388,170 @@ func getDefaultErrorPage() string {
     </div>
 </body>
 </html>`
-}
\ No newline at end of file
+}
+
+// getDefaultMaintenancePage returns the default maintenance page HTML
+func getDefaultMaintenancePage() string {
+	return `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>503 Service Unavailable</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #f7b733 0%, #fc4a1a 100%);
+            margin: 0;
+            padding: 0;
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+        }
+        .container {
+            background: white;
+            padding: 2rem;
+            border-radius: 10px;
+            box-shadow: 0 10px 25px rgba(0,0,0,0.1);
+            text-align: center;
+            max-width: 400px;
+            width: 90%;
+        }
+        h1 {
+            color: #333;
+            margin-bottom: 1rem;
+            font-size: 1.8rem;
+        }
+        p {
+            color: #666;
+            margin-bottom: 1rem;
+            line-height: 1.5;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>Under Maintenance</h1>
+        <p>This service is undergoing scheduled maintenance.</p>
+        <p>Please check back shortly.</p>
+    </div>
+</body>
+</html>`
+}
+
+// getDefaultForbiddenPage returns the default access denied page HTML
+func getDefaultForbiddenPage() string {
+	return `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>403 Forbidden</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #434343 0%, #000000 100%);
+            margin: 0;
+            padding: 0;
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+        }
+        .container {
+            background: white;
+            padding: 2rem;
+            border-radius: 10px;
+            box-shadow: 0 10px 25px rgba(0,0,0,0.1);
+            text-align: center;
+            max-width: 400px;
+            width: 90%;
+        }
+        h1 {
+            color: #333;
+            margin-bottom: 1rem;
+            font-size: 1.8rem;
+        }
+        p {
+            color: #666;
+            margin-bottom: 1rem;
+            line-height: 1.5;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>Access Denied</h1>
+        <p>Your network is not allowed to access this service.</p>
+    </div>
+</body>
+</html>`
+}
+
+// getDefaultWaitingRoomPage returns the default waiting room page template
+func getDefaultWaitingRoomPage() string {
+	return `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta http-equiv="refresh" content="{{.RetryAfter}}">
+    <title>Please Wait</title>
+    <style>
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            margin: 0;
+            padding: 0;
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+        }
+        .container {
+            background: white;
+            padding: 2rem;
+            border-radius: 10px;
+            box-shadow: 0 10px 25px rgba(0,0,0,0.1);
+            text-align: center;
+            max-width: 400px;
+            width: 90%;
+        }
+        h1 {
+            color: #333;
+            margin-bottom: 1rem;
+            font-size: 1.8rem;
+        }
+        p {
+            color: #666;
+            margin-bottom: 1rem;
+            line-height: 1.5;
+        }
+        .position {
+            font-size: 2.5rem;
+            font-weight: bold;
+            color: #667eea;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>You're in line</h1>
+        <p>The service is busy right now. Your place in the queue:</p>
+        <p class="position">{{.Position}}</p>
+        <p>This page will retry in <span id="countdown">{{.RetryAfter}}</span> seconds.</p>
+    </div>
+    <script>
+        var remaining = {{.RetryAfter}};
+        var countdown = document.getElementById('countdown');
+        setInterval(function() {
+            if (remaining > 0) {
+                remaining--;
+                countdown.textContent = remaining;
+            }
+        }, 1000);
+    </script>
+</body>
+</html>`
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/logger"
+)
+
+// proxySignatureV2 starts every PROXY protocol v2 header
+var proxySignatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyHeaderV1 is the longest valid v1 header, line break included
+const maxProxyHeaderV1 = 107
+
+// proxyProtocolListener reads the PROXY protocol header load balancers send
+// ahead of each connection. Headers are read off the accept loop so a slow
+// peer cannot hold up other connections.
+type proxyProtocolListener struct {
+	inner   net.Listener
+	trusted []netip.Prefix // Peers allowed to connect (empty = everyone)
+	timeout time.Duration
+	name    string
+	logger  *logger.Logger
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newProxyProtocolListener wraps inner and starts its accept loop
+func newProxyProtocolListener(inner net.Listener, trusted []netip.Prefix, timeout time.Duration, name string, log *logger.Logger) *proxyProtocolListener {
+	pl := &proxyProtocolListener{
+		inner:   inner,
+		trusted: trusted,
+		timeout: timeout,
+		name:    name,
+		logger:  log,
+		conns:   make(chan net.Conn),
+		errs:    make(chan error),
+		closed:  make(chan struct{}),
+	}
+	go pl.acceptLoop()
+	return pl
+}
+
+func (pl *proxyProtocolListener) acceptLoop() {
+	for {
+		conn, err := pl.inner.Accept()
+		if err != nil {
+			select {
+			case pl.errs <- err:
+			case <-pl.closed:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go pl.readHeader(conn)
+	}
+}
+
+func (pl *proxyProtocolListener) readHeader(conn net.Conn) {
+	if !pl.isTrusted(conn.RemoteAddr()) {
+		pl.reject(conn, errors.New("peer is not a trusted load balancer"))
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(pl.timeout))
+	pc, err := readProxyHeader(conn)
+	if err != nil {
+		pl.reject(conn, err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	select {
+	case pl.conns <- pc:
+	case <-pl.closed:
+		pc.Close()
+	}
+}
+
+// isTrusted reports whether a peer may send PROXY protocol headers. Unix
+// socket peers have no address and are trusted.
+func (pl *proxyProtocolListener) isTrusted(remote net.Addr) bool {
+	if len(pl.trusted) == 0 {
+		return true
+	}
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range pl.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pl *proxyProtocolListener) reject(conn net.Conn, err error) {
+	pl.logger.WithFields(map[string]interface{}{
+		"listener": pl.name,
+		"remote":   conn.RemoteAddr().String(),
+		"error":    err.Error(),
+	}).Debug("PROXY protocol header rejected")
+	conn.Close()
+}
+
+// Accept returns the next connection whose header was read
+func (pl *proxyProtocolListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case err := <-pl.errs:
+		return nil, err
+	case <-pl.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (pl *proxyProtocolListener) Close() error {
+	pl.closeOnce.Do(func() { close(pl.closed) })
+	return pl.inner.Close()
+}
+
+// Addr returns the listener's network address
+func (pl *proxyProtocolListener) Addr() net.Addr {
+	return pl.inner.Addr()
+}
+
+// proxyConn is a connection whose addresses come from its PROXY protocol
+// header. Bytes read past the header are kept in the reader.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+// Read reads from the data following the header
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.reader.Read(b)
+}
+
+// RemoteAddr returns the client address the load balancer reported
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	return pc.remote
+}
+
+// LocalAddr returns the address the client connected to
+func (pc *proxyConn) LocalAddr() net.Addr {
+	return pc.local
+}
+
+// NetConn returns the wrapped connection
+func (pc *proxyConn) NetConn() net.Conn {
+	return pc.Conn
+}
+
+// readProxyHeader reads a v1 or v2 header. Headers without addresses, such as
+// v1 UNKNOWN or v2 LOCAL health checks, keep the connection's own addresses.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+
+	start, err := pc.reader.Peek(len(proxySignatureV2))
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	switch {
+	case bytes.Equal(start, proxySignatureV2):
+		err = pc.readV2()
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		err = pc.readV1()
+	default:
+		err = errors.New("missing PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 reads a text header: "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func (pc *proxyConn) readV1() error {
+	line, err := pc.reader.ReadSlice('\n')
+	if err != nil || len(line) > maxProxyHeaderV1 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid v1 header")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+
+	src, err1 := parseProxyAddr(fields[2], fields[4])
+	dst, err2 := parseProxyAddr(fields[3], fields[5])
+	if err1 != nil || err2 != nil || src.Addr().Is4() != (fields[1] == "TCP4") {
+		return fmt.Errorf("invalid v1 header %q", strings.TrimSpace(string(line)))
+	}
+	pc.remote = net.TCPAddrFromAddrPort(src)
+	pc.local = net.TCPAddrFromAddrPort(dst)
+	return nil
+}
+
+// parseProxyAddr parses an address and port of a v1 header
+func parseProxyAddr(host, port string) (netip.AddrPort, error) {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(addr, uint16(p)), nil
+}
+
+// readV2 reads a binary header. TLVs following the addresses are skipped.
+func (pc *proxyConn) readV2() error {
+	var header [16]byte
+	if _, err := io.ReadFull(pc.reader, header[:]); err != nil {
+		return fmt.Errorf("reading v2 header: %v", err)
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(pc.reader, body); err != nil {
+		return fmt.Errorf("reading v2 addresses: %v", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL: sent by the load balancer itself
+		return nil
+	case 0x1: // PROXY
+	default:
+		return fmt.Errorf("unsupported v2 command %d", command)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4
+		size = 4
+	case 0x21: // TCP over IPv6
+		size = 16
+	default: // UDP, unix sockets and unspecified families carry no usable client address
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return errors.New("truncated v2 addresses")
+	}
+	src, _ := netip.AddrFromSlice(body[:size])
+	dst, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+
+	pc.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort))
+	pc.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort))
+	return nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+	"okaproxy/internal/middleware"
+)
+
+// swapHandler serves through a handler that reloads replace while serving
+type swapHandler struct {
+	current atomic.Pointer[http.Handler]
+}
+
+func newSwapHandler(h http.Handler) *swapHandler {
+	sh := &swapHandler{}
+	sh.swap(h)
+	return sh
+}
+
+// ServeHTTP implements http.Handler
+func (sh *swapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*sh.current.Load()).ServeHTTP(w, r)
+}
+
+// swap routes new requests to h; requests in progress finish on the old handler
+func (sh *swapHandler) swap(h http.Handler) {
+	sh.current.Store(&h)
+}
+
+// Reload loads the configuration file again and applies it. Rate limits,
+// bypass ranges and everything per server take effect without dropping
+// connections; only servers whose listener settings changed are restarted.
+// Sections read at startup keep their running values. An invalid
+// configuration is rejected and the running one kept.
+func (m *Manager) Reload() error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	if m.closing {
+		return errors.New("shutting down")
+	}
+
+	cfg, err := config.LoadConfig(m.config.Path)
+	if err != nil {
+		return err
+	}
+	for _, section := range cfg.RetainStatic(m.config) {
+		m.logger.Warnf("Changes to [%s] take effect after a restart", section)
+	}
+
+	// Validated in config.Validate
+	m.bypass, _ = cfg.Bypass.Prefixes()
+	trusted, _ := cfg.TrustedProxies.Prefixes()
+	logger.SetTrustedProxies(trusted)
+
+	// The in-process limiter is rebuilt when the limits change; Redis-backed
+	// limits read the configuration on every request
+	if m.stateManager == nil && !reflect.DeepEqual(cfg.Limit, m.config.Limit) {
+		m.memLimiter = nil
+		if cfg.Limit.Enabled() {
+			m.memLimiter = middleware.NewMemoryLimiter(m.logger, cfg.Limit)
+		}
+	}
+	m.config = cfg
+
+	running := make(map[string]*liveServer, len(m.servers))
+	for _, live := range m.servers {
+		running[live.config.Name] = live
+	}
+
+	servers := make([]*liveServer, 0, len(cfg.Server))
+	for i := range cfg.Server {
+		serverConfig := &cfg.Server[i]
+		m.scheduler.Add(serverConfig.Name)
+
+		live, ok := running[serverConfig.Name]
+		delete(running, serverConfig.Name)
+
+		if ok && sameListeners(&live.config, serverConfig) {
+			if err := m.startSnapshots(serverConfig); err != nil {
+				m.logger.Errorf("Failed to snapshot pages of server %s: %v", serverConfig.Name, err)
+			}
+			if live.tcp != nil {
+				// Validated in config.Validate, but upstream TLS files may have changed since
+				if err := live.tcp.Update(serverConfig); err != nil {
+					m.logger.Errorf("Failed to update server %s, keeping its previous settings: %v", serverConfig.Name, err)
+				}
+			} else {
+				live.handler.swap(m.buildHandler(serverConfig, live.metrics))
+			}
+			live.config = *serverConfig
+			servers = append(servers, live)
+			continue
+		}
+
+		// The old listeners must be closed before binding the same ports again
+		if ok {
+			m.logger.Infof("Listener settings of server %s changed, restarting it", serverConfig.Name)
+			m.stopServer(live)
+		}
+		started, err := m.startServer(serverConfig)
+		if err != nil {
+			m.logger.Errorf("Failed to start server %s: %v", serverConfig.Name, err)
+			continue
+		}
+		servers = append(servers, started)
+	}
+
+	for name, live := range running {
+		m.logger.Infof("Server %s removed from the configuration, stopping it", name)
+		m.stopServer(live)
+		if snapshots, ok := m.snapshots[name]; ok {
+			snapshots.Stop()
+			delete(m.snapshots, name)
+		}
+	}
+	m.servers = servers
+
+	if m.adminServer != nil {
+		m.adminServer.SetConfig(cfg)
+	}
+
+	m.logger.Infof("Configuration reloaded from %s: %d servers running", cfg.Path, len(servers))
+	return nil
+}
+
+// sourceFiles returns the files the running configuration was loaded from
+func (m *Manager) sourceFiles() []string {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	return m.config.SourceFiles()
+}
+
+// currentConfig returns the running configuration
+func (m *Manager) currentConfig() *config.Config {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	return m.config
+}
+
+// stopServer closes the listeners of a server at once and lets its
+// connections finish their requests in the background
+func (m *Manager) stopServer(live *liveServer) {
+	live.stopping.Store(true)
+	for _, ln := range live.listeners {
+		ln.Close()
+	}
+	if live.acme != nil {
+		live.acme.Stop()
+	}
+	m.certs.Remove(live.config.Name)
+
+	drain := time.Duration(m.config.Shutdown.DrainTimeout) * time.Second
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), drain)
+		defer cancel()
+		if err := live.server.Shutdown(ctx); err != nil && !errors.Is(err, net.ErrClosed) {
+			m.logger.Errorf("Server %s shutdown error: %v", live.config.Name, err)
+		}
+	}()
+}
+
+// sameListeners reports whether two configurations of a server bind the same
+// listeners with the same settings, so the running ones can be kept
+func sameListeners(a, b *config.ServerConfig) bool {
+	return a.Type == b.Type &&
+		reflect.DeepEqual(a.ListenAddrs(), b.ListenAddrs()) &&
+		reflect.DeepEqual(a.TCP, b.TCP) &&
+		reflect.DeepEqual(a.ProxyProtocol, b.ProxyProtocol) &&
+		a.SlowClients == b.SlowClients &&
+		reflect.DeepEqual(a.HTTPS, b.HTTPS) &&
+		a.Connection.IdleTimeoutDuration() == b.Connection.IdleTimeoutDuration() &&
+		a.Timeouts.Read == b.Timeouts.Read && a.Timeouts.Write == b.Timeouts.Write &&
+		a.Timeouts.ReadHeader == b.Timeouts.ReadHeader &&
+		a.Connection.ForceClose == b.Connection.ForceClose
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// secretsRefresher renews the Vault token on a schedule and reloads the
+// configuration when a secret read from Vault changes, such as a rotated
+// secret_key or certificate
+type secretsRefresher struct {
+	config   func() *config.Config // The running configuration
+	interval time.Duration
+	reload   func() error
+	logger   *logger.Logger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSecretsRefresher(cfg func() *config.Config, interval time.Duration, reload func() error, log *logger.Logger) *secretsRefresher {
+	return &secretsRefresher{
+		config:   cfg,
+		interval: interval,
+		reload:   reload,
+		logger:   log,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start begins refreshing
+func (sr *secretsRefresher) Start() {
+	sr.wg.Add(1)
+	go func() {
+		defer sr.wg.Done()
+
+		ticker := time.NewTicker(sr.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				sr.refresh()
+			case <-sr.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing
+func (sr *secretsRefresher) Stop() {
+	close(sr.stop)
+	sr.wg.Wait()
+}
+
+// refresh reloads when Vault returns different secrets. Failures keep the
+// running secrets and are retried on the next tick.
+func (sr *secretsRefresher) refresh() {
+	changed, err := sr.config().RefreshSecrets()
+	if err != nil {
+		sr.logger.Errorf("Failed to refresh secrets, keeping the running ones: %v", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	sr.logger.Info("Secrets changed in Vault, reloading configuration")
+	if err := sr.reload(); err != nil {
+		sr.logger.Errorf("Rejected configuration with the new secrets, keeping the running configuration: %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package server
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// handleDebugSignal toggles debug logging on SIGUSR1
+func (m *Manager) handleDebugSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	duration := time.Duration(m.config.Log.DebugMinutes) * time.Minute
+	go func() {
+		for range signals {
+			level := m.logger.ToggleDebug(duration)
+			m.logger.Warnf("SIGUSR1 received, log level set to %s", level)
+		}
+	}()
+}
+
+// handleReloadSignal reloads the configuration on SIGHUP
+func (m *Manager) handleReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	go func() {
+		for range signals {
+			m.logger.Info("SIGHUP received, reloading configuration")
+			if err := m.Reload(); err != nil {
+				m.logger.Errorf("Configuration reload failed, keeping the running configuration: %v", err)
+			}
+		}
+	}()
+}
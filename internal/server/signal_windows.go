@@ -0,0 +1,9 @@
+//go:build windows
+
+package server
+
+// handleDebugSignal does nothing: Windows has no SIGUSR1, use the admin API instead
+func (m *Manager) handleDebugSignal() {}
+
+// handleReloadSignal does nothing: Windows has no SIGHUP
+func (m *Manager) handleReloadSignal() {}
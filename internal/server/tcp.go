@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+// listenTCP binds the sockets of a TCP address: one per accept loop
+func listenTCP(network, address string, tcp config.TCPConfig) ([]net.Listener, error) {
+	if network == "tcp" {
+		network = tcp.Network()
+	}
+	// Addresses naming an IP bind only that IP version, so "0.0.0.0:80" and
+	// "[::]:80" can both be listed
+	if host, _, err := net.SplitHostPort(address); err == nil && network == "tcp" {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			network = "tcp6"
+			if ip.Is4() {
+				network = "tcp4"
+			}
+		}
+	}
+	lc := net.ListenConfig{
+		KeepAliveConfig: net.KeepAliveConfig{
+			Enable:   tcp.KeepAlive >= 0,
+			Idle:     time.Duration(tcp.KeepAlive) * time.Second,
+			Interval: time.Duration(tcp.KeepAliveInterval) * time.Second,
+			Count:    tcp.KeepAliveCount,
+		},
+	}
+	if tcp.KeepAlive < 0 {
+		lc.KeepAlive = -1
+	}
+	if tcp.ReusePort {
+		lc.Control = reusePort
+	}
+
+	var listeners []net.Listener
+	for i := 0; i < tcp.AcceptLoops; i++ {
+		ln, err := lc.Listen(context.Background(), network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		if tcp.Backlog > 0 {
+			if err := setBacklog(ln, tcp.Backlog); err != nil {
+				ln.Close()
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+		}
+		if !tcp.NoDelayEnabled() {
+			ln = &delayListener{Listener: ln}
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// delayListener turns off TCP_NODELAY on accepted connections so small
+// writes are coalesced
+type delayListener struct {
+	net.Listener
+}
+
+// Accept accepts a connection and enables Nagle's algorithm on it
+func (l *delayListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(false)
+	}
+	return conn, nil
+}
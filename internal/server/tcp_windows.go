@@ -0,0 +1,19 @@
+//go:build windows
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// reusePort fails: Windows has no SO_REUSEPORT (rejected in config.Validate)
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on Windows")
+}
+
+// setBacklog does nothing: Windows sizes the accept queue itself
+func setBacklog(ln net.Listener, backlog int) error {
+	return nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"okaproxy/internal/certs"
+	"okaproxy/internal/config"
+)
+
+// buildTLSConfig creates the TLS configuration for an HTTPS listener.
+// When acmeManager is non-nil certificates are served from it instead of cert_path/key_path.
+func buildTLSConfig(httpsConfig *config.HTTPSConfig, acmeManager *certs.ACMEManager) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// ECDSA suites serve ACME certificates, which have P-256 keys
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+
+	if acmeManager != nil {
+		tlsConfig.GetCertificate = acmeManager.GetCertificate
+	} else {
+		// Load TLS certificate
+		var cert tls.Certificate
+		var err error
+		if httpsConfig.Cert != "" {
+			cert, err = tls.X509KeyPair([]byte(httpsConfig.Cert), []byte(httpsConfig.Key))
+		} else {
+			cert, err = tls.LoadX509KeyPair(httpsConfig.CertPath, httpsConfig.KeyPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	// Configure client certificate verification (mTLS)
+	if httpsConfig.ClientAuthEnabled() {
+		pool, err := loadCertPool(httpsConfig.ClientCAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA bundle: %v", err)
+		}
+		tlsConfig.ClientCAs = pool
+
+		if httpsConfig.ClientAuth == config.ClientAuthRequire {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertPool reads a PEM encoded CA bundle into a certificate pool
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"okaproxy/internal/config"
+)
+
+// socket is a bound listen address, before instrumentation and TLS
+type socket struct {
+	addr string
+	ln   net.Listener
+}
+
+// inheritedListeners holds the sockets handed over by the process being
+// upgraded, by listen address, and the sockets bound by systemd
+type inheritedListeners struct {
+	mu        sync.Mutex
+	byAddr    map[string][]net.Listener
+	activated []net.Listener // Matched to listen addresses by their bound address
+	parent    int            // Process stopped once the listeners are taken over
+}
+
+// take removes and returns the sockets of a listen address, or of the admin
+// API for a key made by adminSocket
+func (il *inheritedListeners) take(key string) []net.Listener {
+	if il == nil {
+		return nil
+	}
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	if listeners, ok := il.byAddr[key]; ok {
+		delete(il.byAddr, key)
+		return listeners
+	}
+
+	addr := strings.TrimPrefix(key, adminPrefix)
+	var taken []net.Listener
+	rest := il.activated[:0]
+	for _, ln := range il.activated {
+		if boundTo(ln, addr) {
+			taken = append(taken, ln)
+		} else {
+			rest = append(rest, ln)
+		}
+	}
+	il.activated = rest
+	return taken
+}
+
+// closeRest closes the sockets no longer in the configuration and returns
+// the addresses of the systemd sockets among them
+func (il *inheritedListeners) closeRest() []string {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+	for addr, listeners := range il.byAddr {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		delete(il.byAddr, addr)
+	}
+
+	var unused []string
+	for _, ln := range il.activated {
+		unused = append(unused, ln.Addr().String())
+		ln.Close()
+	}
+	il.activated = nil
+	return unused
+}
+
+// boundTo reports whether a socket is bound to a listen address. Addresses
+// without a host match sockets bound to every interface.
+func boundTo(ln net.Listener, addr string) bool {
+	network, address, err := config.ParseListenAddr(addr)
+	if err != nil {
+		return false
+	}
+	switch bound := ln.Addr().(type) {
+	case *net.UnixAddr:
+		return network == "unix" && bound.Name == address
+	case *net.TCPAddr:
+		if network == "unix" {
+			return false
+		}
+		want, err := net.ResolveTCPAddr(network, address)
+		if err != nil || want.Port != bound.Port {
+			return false
+		}
+		if want.IP == nil || want.IP.IsUnspecified() {
+			return bound.IP.IsUnspecified()
+		}
+		return want.IP.Equal(bound.IP)
+	}
+	return false
+}
+
+// listen binds a listen address, or takes over its sockets from the process
+// being upgraded
+func (m *Manager) listen(addr string, tcp config.TCPConfig) ([]net.Listener, error) {
+	inherited := m.inherited.take(addr)
+	if len(inherited) == 0 {
+		return listen(addr, tcp)
+	}
+	if !tcp.NoDelayEnabled() {
+		for i, ln := range inherited {
+			inherited[i] = &delayListener{Listener: ln}
+		}
+	}
+	return inherited, nil
+}
+
+// finishUpgrade closes the inherited sockets left unused and stops the
+// process that handed them over, which finishes its requests in flight
+func (m *Manager) finishUpgrade() {
+	if m.inherited == nil {
+		return
+	}
+	for _, addr := range m.inherited.closeRest() {
+		m.logger.Warnf("systemd socket %s matches no listen address, closing it", addr)
+	}
+	if m.inherited.parent == 0 {
+		return
+	}
+	if err := stopProcess(m.inherited.parent); err != nil {
+		m.logger.Errorf("Failed to stop process %d after taking over its listeners: %v", m.inherited.parent, err)
+		return
+	}
+	m.logger.Infof("Took over the listeners of process %d, which now finishes its requests", m.inherited.parent)
+}
+
+// adminPrefix marks the admin listener among handed over sockets
+const adminPrefix = "admin:"
+
+// adminSocket is the key the admin listener is handed over with
+func adminSocket(admin config.AdminConfig) string {
+	return adminPrefix + admin.Listen
+}
+
+// listenerFile returns a duplicate of the file descriptor of a socket
+func listenerFile(ln net.Listener) (*os.File, error) {
+	if dl, ok := ln.(*delayListener); ok {
+		ln = dl.Listener
+	}
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		return l.File()
+	case *net.UnixListener:
+		return l.File()
+	default:
+		return nil, fmt.Errorf("cannot hand over a %T", ln)
+	}
+}
@@ -0,0 +1,182 @@
+//go:build !windows
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"okaproxy/internal/config"
+)
+
+// Environment of a process started by Upgrade
+const (
+	envUpgradeAddrs  = "OKAPROXY_UPGRADE_ADDRS"  // JSON list of the listen addresses of the sockets passed from fd 3 on
+	envUpgradeParent = "OKAPROXY_UPGRADE_PARENT" // Process to stop once the sockets are served
+)
+
+// handleUpgradeSignal upgrades the binary on SIGUSR2
+func (m *Manager) handleUpgradeSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			m.logger.Info("SIGUSR2 received, upgrading the binary")
+			if err := m.Upgrade(); err != nil {
+				m.logger.Errorf("Binary upgrade failed, keeping this process: %v", err)
+			}
+		}
+	}()
+}
+
+// Upgrade starts the okaproxy executable again, usually a newer version
+// installed over this one, and hands it the listening sockets. Both processes
+// accept connections until the new one serves every listener and stops this
+// one, which then finishes its requests in flight; no connection is refused.
+// If the new process fails to start, this one keeps running.
+func (m *Manager) Upgrade() error {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	if m.closing {
+		return errors.New("shutting down")
+	}
+	if m.upgrading {
+		return errors.New("an upgrade is already in progress")
+	}
+	if m.stateManager != nil && m.config.Store.Backend == config.StoreBackendBolt {
+		return errors.New("the bolt store can only be opened by one process; restart instead")
+	}
+
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	handOver := func(addr string, ln net.Listener) error {
+		f, err := listenerFile(ln)
+		if err != nil {
+			return fmt.Errorf("%s: %v", addr, err)
+		}
+		addrs = append(addrs, addr)
+		files = append(files, f)
+		return nil
+	}
+	for _, live := range m.servers {
+		for _, s := range live.sockets {
+			if err := handOver(s.addr, s.ln); err != nil {
+				return err
+			}
+		}
+	}
+	if m.adminServer != nil {
+		if err := handOver(adminSocket(m.config.Admin), m.adminServer.Listener()); err != nil {
+			return err
+		}
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the executable: %v", err)
+	}
+	encoded, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		envUpgradeAddrs+"="+string(encoded),
+		envUpgradeParent+"="+strconv.Itoa(os.Getpid()),
+	)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %v", executable, err)
+	}
+	m.upgrading = true
+
+	// The socket files now belong to the new process too
+	for _, live := range m.servers {
+		for _, s := range live.sockets {
+			ln := s.ln
+			if dl, ok := ln.(*delayListener); ok {
+				ln = dl.Listener
+			}
+			if ul, ok := ln.(*net.UnixListener); ok {
+				ul.SetUnlinkOnClose(false)
+			}
+		}
+	}
+
+	pid := cmd.Process.Pid
+	go func() {
+		err := cmd.Wait()
+
+		m.reloadMu.Lock()
+		defer m.reloadMu.Unlock()
+		m.upgrading = false
+		if !m.closing {
+			m.logger.Errorf("Process %d exited before taking over the listeners: %v", pid, err)
+		}
+	}()
+
+	m.logger.Infof("Started process %d from %s to take over %d listeners", pid, executable, len(addrs))
+	return nil
+}
+
+// inheritListeners takes over the sockets passed by Upgrade or systemd, if any
+func inheritListeners() (*inheritedListeners, error) {
+	activated, err := activatedListeners()
+	if err != nil {
+		return nil, err
+	}
+	il := &inheritedListeners{byAddr: make(map[string][]net.Listener), activated: activated}
+
+	encoded := os.Getenv(envUpgradeAddrs)
+	if encoded == "" {
+		if len(activated) == 0 {
+			return nil, nil
+		}
+		return il, nil
+	}
+	il.parent, _ = strconv.Atoi(os.Getenv(envUpgradeParent))
+
+	// Later upgrades pass their own sockets
+	os.Unsetenv(envUpgradeAddrs)
+	os.Unsetenv(envUpgradeParent)
+
+	var addrs []string
+	if err := json.Unmarshal([]byte(encoded), &addrs); err != nil {
+		il.closeRest()
+		return nil, fmt.Errorf("invalid %s: %v", envUpgradeAddrs, err)
+	}
+
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			il.closeRest()
+			return nil, fmt.Errorf("failed to inherit socket %s: %v", addr, err)
+		}
+		il.byAddr[addr] = append(il.byAddr[addr], ln)
+	}
+	return il, nil
+}
+
+// stopProcess asks a process to shut down gracefully
+func stopProcess(pid int) error {
+	return syscall.Kill(pid, syscall.SIGTERM)
+}
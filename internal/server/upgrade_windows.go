@@ -0,0 +1,23 @@
+//go:build windows
+
+package server
+
+import "errors"
+
+// handleUpgradeSignal does nothing: Windows has no SIGUSR2
+func (m *Manager) handleUpgradeSignal() {}
+
+// Upgrade is not supported: Windows cannot pass sockets to a new process
+func (m *Manager) Upgrade() error {
+	return errors.New("binary upgrades are not supported on Windows")
+}
+
+// inheritListeners returns no sockets: Windows processes are never upgraded
+func inheritListeners() (*inheritedListeners, error) {
+	return nil, nil
+}
+
+// stopProcess is never called on Windows
+func stopProcess(pid int) error {
+	return errors.New("not supported on Windows")
+}
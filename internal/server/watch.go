@@ -0,0 +1,203 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"okaproxy/internal/logger"
+)
+
+// watchDelay lets editors finish saving, which often takes several writes or
+// a rename, before the files are read
+const watchDelay = 250 * time.Millisecond
+
+// configWatcher reloads the configuration when the content of its files
+// changes. It is told of changes by the file system, watching the directories
+// of the files rather than the files themselves, so editors that replace a
+// file instead of writing to it are noticed too. Where notifications are not
+// available the files are polled every interval.
+type configWatcher struct {
+	files    func() []string // The configuration file and the files it includes
+	interval time.Duration
+	reload   func() error
+	logger   *logger.Logger
+
+	digest [sha256.Size]byte
+	dirs   map[string]bool // Directories being watched
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newConfigWatcher(files func() []string, interval time.Duration, reload func() error, log *logger.Logger) *configWatcher {
+	return &configWatcher{
+		files:    files,
+		interval: interval,
+		reload:   reload,
+		logger:   log,
+		dirs:     make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start records the current content and begins watching, or polling when
+// the file system cannot notify of changes
+func (cw *configWatcher) Start() {
+	cw.digest, _ = cw.read()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = cw.watchDirs(watcher); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		cw.logger.Warnf("File change notifications are unavailable, checking %s every %v: %v", strings.Join(cw.files(), ", "), cw.interval, err)
+		cw.wg.Add(1)
+		go cw.poll()
+		return
+	}
+
+	cw.logger.Infof("Watching %s for configuration changes", strings.Join(cw.files(), ", "))
+	cw.wg.Add(1)
+	go cw.notify(watcher)
+}
+
+// Stop stops watching
+func (cw *configWatcher) Stop() {
+	close(cw.stop)
+	cw.wg.Wait()
+}
+
+// notify checks the files shortly after the file system reports a change to
+// one of them, or a new file that may be included
+func (cw *configWatcher) notify(watcher *fsnotify.Watcher) {
+	defer cw.wg.Done()
+	defer watcher.Close()
+
+	var pending <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) || event.Op != fsnotify.Chmod && cw.isSource(event.Name) {
+				pending = time.After(watchDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost, e.g. when the queue overflowed
+			cw.logger.Warnf("Configuration file watch error: %v", err)
+			pending = time.After(watchDelay)
+		case <-pending:
+			pending = nil
+			cw.check()
+			// Includes may have moved to other directories
+			if err := cw.watchDirs(watcher); err != nil {
+				cw.logger.Warnf("Failed to watch configuration directories: %v", err)
+			}
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+// poll checks the files every interval
+func (cw *configWatcher) poll() {
+	defer cw.wg.Done()
+
+	ticker := time.NewTicker(cw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cw.check()
+		case <-cw.stop:
+			return
+		}
+	}
+}
+
+// watchDirs watches the directories of the current files and stops watching
+// those no longer holding any
+func (cw *configWatcher) watchDirs(watcher *fsnotify.Watcher) error {
+	dirs := make(map[string]bool)
+	for _, file := range cw.files() {
+		if abs, err := filepath.Abs(file); err == nil {
+			dirs[filepath.Dir(abs)] = true
+		}
+	}
+	for dir := range dirs {
+		if cw.dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("%s: %v", dir, err)
+		}
+		cw.dirs[dir] = true
+	}
+	for dir := range cw.dirs {
+		if !dirs[dir] {
+			watcher.Remove(dir)
+			delete(cw.dirs, dir)
+		}
+	}
+	return nil
+}
+
+// isSource reports whether name is one of the configuration files
+func (cw *configWatcher) isSource(name string) bool {
+	for _, file := range cw.files() {
+		if abs, err := filepath.Abs(file); err == nil && abs == filepath.Clean(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// check reloads when the content differs from the last one seen. A rejected
+// configuration is not retried until the file changes again.
+func (cw *configWatcher) check() {
+	digest, err := cw.read()
+	if err != nil {
+		// Editors may briefly remove a file while saving
+		cw.logger.Debugf("Failed to read the configuration: %v", err)
+		return
+	}
+	if digest == cw.digest {
+		return
+	}
+	cw.digest = digest
+
+	cw.logger.Info("Configuration files changed, reloading configuration")
+	if err := cw.reload(); err != nil {
+		cw.logger.Errorf("Rejected configuration change, keeping the running configuration: %v", err)
+	}
+}
+
+// read digests the names and contents of the configuration files, so added
+// and removed files count as changes too
+func (cw *configWatcher) read() ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	h := sha256.New()
+	for _, file := range cw.files() {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return digest, err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", file, len(content))
+		h.Write(content)
+	}
+	copy(digest[:], h.Sum(nil))
+	return digest, nil
+}
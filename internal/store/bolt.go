@@ -0,0 +1,278 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"okaproxy/internal/clock"
+)
+
+// boltSweepInterval is how often expired keys are removed from disk
+const boltSweepInterval = time.Minute
+
+var (
+	boltValues = []byte("values")
+	boltHashes = []byte("hashes")
+)
+
+// BoltStore keeps state in an embedded BoltDB file, for single-node deployments
+// that do not run Redis
+type BoltStore struct {
+	db *bolt.DB
+
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// OpenBoltStore opens (or creates) the database at path
+func OpenBoltStore(path string) (*BoltStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database %s: %v", path, err)
+	}
+	// Counters are short-lived; skipping fsync keeps per-request writes cheap
+	db.NoSync = true
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltValues, boltHashes} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize state database: %v", err)
+	}
+
+	bs := &BoltStore{db: db, stop: make(chan struct{})}
+	bs.wg.Add(1)
+	go bs.sweepLoop()
+	return bs, nil
+}
+
+// Name identifies the backend in logs
+func (bs *BoltStore) Name() string {
+	return "bolt"
+}
+
+// Incr increments the counter at key
+func (bs *BoltStore) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	return bs.IncrBy(ctx, key, 1, window)
+}
+
+// IncrBy adds n to the counter at key
+func (bs *BoltStore) IncrBy(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Duration, error) {
+	now := clock.Now()
+	var count int64
+	var expires time.Time
+
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltValues)
+		value, exp, ok := decodeRecord(bucket.Get([]byte(key)), now)
+		if ok {
+			count, _ = strconv.ParseInt(value, 10, 64)
+			expires = exp
+		} else {
+			expires = now.Add(window)
+		}
+		count += n
+		return bucket.Put([]byte(key), encodeRecord(strconv.FormatInt(count, 10), expires))
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return count, expires.Sub(now), nil
+}
+
+// Get returns the value at key
+func (bs *BoltStore) Get(ctx context.Context, key string) (string, error) {
+	var value string
+	var ok bool
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		value, _, ok = decodeRecord(tx.Bucket(boltValues).Get([]byte(key)), clock.Now())
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+// Set stores value at key
+func (bs *BoltStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	var expires time.Time
+	if ttl > 0 {
+		expires = clock.Now().Add(ttl)
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValues).Put([]byte(key), encodeRecord(value, expires))
+	})
+}
+
+// Delete removes key
+func (bs *BoltStore) Delete(ctx context.Context, key string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltValues).Delete([]byte(key)); err != nil {
+			return err
+		}
+		hashes := tx.Bucket(boltHashes)
+		if hashes.Bucket([]byte(key)) != nil {
+			return hashes.DeleteBucket([]byte(key))
+		}
+		return nil
+	})
+}
+
+// Keys returns the keys of the live values starting with prefix
+func (bs *BoltStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	now := clock.Now()
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltValues).Cursor()
+		for key, record := c.Seek([]byte(prefix)); key != nil && bytes.HasPrefix(key, []byte(prefix)); key, record = c.Next() {
+			if _, _, ok := decodeRecord(record, now); ok {
+				keys = append(keys, string(key))
+			}
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// GetHash returns all fields of the hash at key
+func (bs *BoltStore) GetHash(ctx context.Context, key string) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		hash := tx.Bucket(boltHashes).Bucket([]byte(key))
+		if hash == nil {
+			return nil
+		}
+		return hash.ForEach(func(k, v []byte) error {
+			fields[string(k)] = string(v)
+			return nil
+		})
+	})
+	return fields, err
+}
+
+// SetHash stores fields in the hash at key
+func (bs *BoltStore) SetHash(ctx context.Context, key string, fields map[string]string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		hash, err := tx.Bucket(boltHashes).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		for field, value := range fields {
+			if err := hash.Put([]byte(field), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Ping always succeeds for the embedded store
+func (bs *BoltStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close stops the sweeper and closes the database
+func (bs *BoltStore) Close() error {
+	var err error
+	bs.closeOnce.Do(func() {
+		close(bs.stop)
+		bs.wg.Wait()
+		err = bs.db.Close()
+	})
+	return err
+}
+
+// sweepLoop periodically deletes expired keys
+func (bs *BoltStore) sweepLoop() {
+	defer bs.wg.Done()
+
+	ticker := time.NewTicker(boltSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			bs.sweep()
+		case <-bs.stop:
+			return
+		}
+	}
+}
+
+// sweep removes every expired key
+func (bs *BoltStore) sweep() {
+	now := clock.Now()
+	bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltValues)
+
+		// Deleting while iterating skips entries, so collect first
+		var expired [][]byte
+		bucket.ForEach(func(k, v []byte) error {
+			if _, _, ok := decodeRecord(v, now); !ok {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// encodeRecord prefixes value with its expiry (zero = never)
+func encodeRecord(value string, expires time.Time) []byte {
+	record := make([]byte, 8+len(value))
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(record, uint64(expires.UnixNano()))
+	}
+	copy(record[8:], value)
+	return record
+}
+
+// decodeRecord returns the value and expiry, and false when missing or expired
+func decodeRecord(record []byte, now time.Time) (string, time.Time, bool) {
+	if len(record) < 8 {
+		return "", time.Time{}, false
+	}
+
+	var expires time.Time
+	if nanos := binary.BigEndian.Uint64(record); nanos != 0 {
+		expires = time.Unix(0, int64(nanos))
+		if !now.Before(expires) {
+			return "", time.Time{}, false
+		}
+	}
+	return string(record[8:]), expires, true
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"okaproxy/internal/clock"
+)
+
+// memorySweepInterval is how often expired keys are dropped
+const memorySweepInterval = time.Minute
+
+// MemoryStore keeps state in process memory. It is used in lite mode and is
+// lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	values    map[string]memoryEntry
+	hashes    map[string]map[string]string
+	lastSweep time.Time
+}
+
+type memoryEntry struct {
+	value   string
+	expires time.Time // zero = never
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		values:    make(map[string]memoryEntry),
+		hashes:    make(map[string]map[string]string),
+		lastSweep: clock.Now(),
+	}
+}
+
+// Name identifies the backend in logs
+func (ms *MemoryStore) Name() string {
+	return "memory"
+}
+
+// Incr increments the counter at key
+func (ms *MemoryStore) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	return ms.IncrBy(ctx, key, 1, window)
+}
+
+// IncrBy adds n to the counter at key
+func (ms *MemoryStore) IncrBy(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Duration, error) {
+	now := clock.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sweep(now)
+
+	entry, ok := ms.lookup(key, now)
+	var count int64
+	if ok {
+		count, _ = strconv.ParseInt(entry.value, 10, 64)
+	} else {
+		entry.expires = now.Add(window)
+	}
+	count += n
+	entry.value = strconv.FormatInt(count, 10)
+	ms.values[key] = entry
+
+	return count, entry.expires.Sub(now), nil
+}
+
+// Get returns the value at key
+func (ms *MemoryStore) Get(ctx context.Context, key string) (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	entry, ok := ms.lookup(key, clock.Now())
+	if !ok {
+		return "", ErrNotFound
+	}
+	return entry.value, nil
+}
+
+// Set stores value at key
+func (ms *MemoryStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	now := clock.Now()
+	entry := memoryEntry{value: value}
+	if ttl > 0 {
+		entry.expires = now.Add(ttl)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sweep(now)
+
+	ms.values[key] = entry
+	return nil
+}
+
+// Delete removes key
+func (ms *MemoryStore) Delete(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.values, key)
+	delete(ms.hashes, key)
+	return nil
+}
+
+// Keys returns the keys of the live values starting with prefix
+func (ms *MemoryStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var keys []string
+	now := clock.Now()
+	for key := range ms.values {
+		if _, ok := ms.lookup(key, now); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// GetHash returns all fields of the hash at key
+func (ms *MemoryStore) GetHash(ctx context.Context, key string) (map[string]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	fields := make(map[string]string, len(ms.hashes[key]))
+	for field, value := range ms.hashes[key] {
+		fields[field] = value
+	}
+	return fields, nil
+}
+
+// SetHash stores fields in the hash at key
+func (ms *MemoryStore) SetHash(ctx context.Context, key string, fields map[string]string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	hash, ok := ms.hashes[key]
+	if !ok {
+		hash = make(map[string]string, len(fields))
+		ms.hashes[key] = hash
+	}
+	for field, value := range fields {
+		hash[field] = value
+	}
+	return nil
+}
+
+// Ping always succeeds for the in-memory store
+func (ms *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close releases nothing; the store lives as long as the process
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// lookup returns the live entry at key; callers hold ms.mu
+func (ms *MemoryStore) lookup(key string, now time.Time) (memoryEntry, bool) {
+	entry, ok := ms.values[key]
+	if !ok || (!entry.expires.IsZero() && !now.Before(entry.expires)) {
+		return memoryEntry{}, false
+	}
+	return entry, true
+}
+
+// sweep drops expired entries to bound memory usage; callers hold ms.mu
+func (ms *MemoryStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < memorySweepInterval {
+		return
+	}
+	ms.lastSweep = now
+
+	for key, entry := range ms.values {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			delete(ms.values, key)
+		}
+	}
+}
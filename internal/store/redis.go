@@ -0,0 +1,142 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"okaproxy/internal/config"
+)
+
+// incrScript atomically adds ARGV[2] to a counter, sets its expiration and
+// returns the count together with the remaining TTL
+const incrScript = `
+	local current
+	current = redis.call("INCRBY", KEYS[1], ARGV[2])
+	if current == tonumber(ARGV[2]) then
+		redis.call("EXPIRE", KEYS[1], ARGV[1])
+	end
+	return {current, redis.call("TTL", KEYS[1])}
+`
+
+// RedisStore keeps state in Redis, shared by every okaproxy instance using it
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore creates a Redis-backed store
+func NewRedisStore(cfg config.StoreConfig) *RedisStore {
+	return &RedisStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:            cfg.RedisAddress(),
+			Password:        cfg.RedisPassword,
+			DB:              cfg.RedisDB,
+			ConnMaxIdleTime: 10 * time.Second,
+			MaxRetries:      3,
+		}),
+	}
+}
+
+// Name identifies the backend in logs
+func (rs *RedisStore) Name() string {
+	return "redis"
+}
+
+// Incr increments the counter at key
+func (rs *RedisStore) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error) {
+	return rs.IncrBy(ctx, key, 1, window)
+}
+
+// IncrBy adds n to the counter at key
+func (rs *RedisStore) IncrBy(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Duration, error) {
+	seconds := int64(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	values, err := rs.client.Eval(ctx, incrScript, []string{key}, seconds, n).Int64Slice()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(values) != 2 {
+		return 0, 0, errors.New("unexpected counter result")
+	}
+
+	ttl := time.Duration(values[1]) * time.Second
+	if values[1] < 0 {
+		ttl = window
+	}
+	return values[0], ttl, nil
+}
+
+// Get returns the value at key
+func (rs *RedisStore) Get(ctx context.Context, key string) (string, error) {
+	value, err := rs.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", ErrNotFound
+	}
+	return value, err
+}
+
+// Set stores value at key
+func (rs *RedisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return rs.client.Set(ctx, key, value, ttl).Err()
+}
+
+// Delete removes key
+func (rs *RedisStore) Delete(ctx context.Context, key string) error {
+	return rs.client.Del(ctx, key).Err()
+}
+
+// Keys returns the keys starting with prefix, scanning instead of blocking
+// Redis with KEYS
+func (rs *RedisStore) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := rs.client.Scan(ctx, 0, globEscaper.Replace(prefix)+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// globEscaper escapes the pattern characters of SCAN MATCH
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// GetHash returns all fields of the hash at key
+func (rs *RedisStore) GetHash(ctx context.Context, key string) (map[string]string, error) {
+	return rs.client.HGetAll(ctx, key).Result()
+}
+
+// SetHash stores fields in the hash at key
+func (rs *RedisStore) SetHash(ctx context.Context, key string, fields map[string]string) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	return rs.client.HSet(ctx, key, fields).Err()
+}
+
+// Ping checks the Redis connection
+func (rs *RedisStore) Ping(ctx context.Context) error {
+	return rs.client.Ping(ctx).Err()
+}
+
+// Stats returns connection pool statistics
+func (rs *RedisStore) Stats() map[string]interface{} {
+	poolStats := rs.client.PoolStats()
+	return map[string]interface{}{
+		"hits":        poolStats.Hits,
+		"misses":      poolStats.Misses,
+		"timeouts":    poolStats.Timeouts,
+		"total_conns": poolStats.TotalConns,
+		"idle_conns":  poolStats.IdleConns,
+		"stale_conns": poolStats.StaleConns,
+	}
+}
+
+// Close closes the Redis connection
+func (rs *RedisStore) Close() error {
+	return rs.client.Close()
+}
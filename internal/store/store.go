@@ -0,0 +1,66 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"okaproxy/internal/config"
+)
+
+// ErrNotFound is returned when a key does not exist or has expired
+var ErrNotFound = errors.New("key not found")
+
+// Store holds okaproxy's shared state: counters, cached values and hashes
+type Store interface {
+	// Incr increments the counter at key, starting a new window of the given
+	// length when the key is new, and returns the count and remaining TTL
+	Incr(ctx context.Context, key string, window time.Duration) (int64, time.Duration, error)
+
+	// IncrBy is Incr adding n instead of one
+	IncrBy(ctx context.Context, key string, n int64, window time.Duration) (int64, time.Duration, error)
+
+	// Get returns the value at key or ErrNotFound
+	Get(ctx context.Context, key string) (string, error)
+
+	// Set stores value at key; a zero ttl keeps it forever
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+
+	// Delete removes key
+	Delete(ctx context.Context, key string) error
+
+	// Keys returns the keys of the values starting with prefix
+	Keys(ctx context.Context, prefix string) ([]string, error)
+
+	// GetHash returns all fields of the hash at key (empty when missing)
+	GetHash(ctx context.Context, key string) (map[string]string, error)
+
+	// SetHash stores fields in the hash at key
+	SetHash(ctx context.Context, key string, fields map[string]string) error
+
+	// Ping checks that the store is reachable
+	Ping(ctx context.Context) error
+
+	// Name identifies the backend in logs
+	Name() string
+
+	Close() error
+}
+
+// Open creates the store selected by the configuration
+func Open(cfg *config.Config) (Store, error) {
+	switch cfg.Store.Backend {
+	case "", config.StoreBackendRedis:
+		return NewRedisStore(cfg.Store), nil
+	case config.StoreBackendBolt:
+		path := cfg.Store.Path
+		if path == "" {
+			path = filepath.Join(cfg.Paths.DataPath(), "state.db")
+		}
+		return OpenBoltStore(path)
+	default:
+		return nil, fmt.Errorf("unsupported store backend %q", cfg.Store.Backend)
+	}
+}
@@ -0,0 +1,237 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+const (
+	queueSize     = 4096
+	maxBatchSize  = 512
+	exportTimeout = 10 * time.Second
+)
+
+// exporter batches finished spans and sends them as OTLP/HTTP JSON
+type exporter struct {
+	config   config.TelemetryConfig
+	logger   *logger.Logger
+	client   *http.Client
+	interval time.Duration
+
+	queue   chan *Span
+	dropped atomic.Uint64
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newExporter(cfg config.TelemetryConfig, log *logger.Logger) *exporter {
+	return &exporter{
+		config:   cfg,
+		logger:   log,
+		client:   &http.Client{Timeout: exportTimeout},
+		interval: time.Duration(cfg.FlushInterval) * time.Second,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// enqueue queues a span, dropping it when the exporter falls behind
+func (e *exporter) enqueue(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *exporter) start() {
+	e.wg.Add(1)
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(e.interval)
+		defer ticker.Stop()
+
+		batch := make([]*Span, 0, maxBatchSize)
+		for {
+			select {
+			case span := <-e.queue:
+				batch = append(batch, span)
+				if len(batch) == maxBatchSize {
+					e.export(batch)
+					batch = batch[:0]
+				}
+			case <-ticker.C:
+				e.export(batch)
+				batch = batch[:0]
+			case <-e.done:
+				// Flush whatever is still queued
+				for {
+					select {
+					case span := <-e.queue:
+						batch = append(batch, span)
+					default:
+						e.export(batch)
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (e *exporter) stop() {
+	close(e.done)
+	e.wg.Wait()
+}
+
+// export sends a batch, logging failures; spans are not retried
+func (e *exporter) export(batch []*Span) {
+	if dropped := e.dropped.Swap(0); dropped > 0 {
+		e.logger.Warnf("Dropped %d trace spans: export queue full", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		e.logger.Errorf("Failed to encode trace spans: %v", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		e.logger.Errorf("Failed to export %d trace spans: %v", len(batch), err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.logger.Errorf("Failed to export %d trace spans: %v", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e.logger.Errorf("Failed to export %d trace spans: unexpected status %d", len(batch), resp.StatusCode)
+	}
+}
+
+// OTLP JSON encoding, see opentelemetry-proto's trace service
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 2 = error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func (e *exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, span := range batch {
+		span.mu.Lock()
+		encoded := otlpSpan{
+			TraceID:           span.context.TraceID.String(),
+			SpanID:            span.context.SpanID.String(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+		}
+		if span.parent.IsValid() {
+			encoded.ParentSpanID = span.parent.String()
+		}
+		for key, value := range span.attributes {
+			encoded.Attributes = append(encoded.Attributes, attribute(key, value))
+		}
+		if span.failed {
+			encoded.Status = otlpStatus{Code: 2, Message: span.message}
+		}
+		span.mu.Unlock()
+		spans = append(spans, encoded)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			attribute("service.name", e.config.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "okaproxy"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+// attribute encodes a value as an OTLP AnyValue
+func attribute(key string, value interface{}) otlpAttribute {
+	var encoded map[string]interface{}
+	switch v := value.(type) {
+	case string:
+		encoded = map[string]interface{}{"stringValue": v}
+	case bool:
+		encoded = map[string]interface{}{"boolValue": v}
+	case int:
+		encoded = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		encoded = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		encoded = map[string]interface{}{"doubleValue": v}
+	default:
+		encoded = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: key, Value: encoded}
+}
@@ -0,0 +1,179 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/logger"
+)
+
+// Span kinds as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// spanKey is the context key of the current span
+type spanKey struct{}
+
+// Span is a timed operation within a trace. A nil span is valid and records nothing.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  SpanID
+	name    string
+	kind    int
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	failed     bool
+	message    string
+}
+
+// Context returns the span's propagation context
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a string, bool, int or float attribute
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.mu.Lock()
+	s.failed = true
+	s.message = message
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for export
+func (s *Span) End() {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.exporter.enqueue(s)
+}
+
+// SpanFromContext returns the current span, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithSpan returns ctx with span as the current span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// Tracer creates spans and exports the sampled ones. A nil tracer is valid and
+// creates no spans.
+type Tracer struct {
+	config    config.TelemetryConfig
+	threshold uint64
+	exporter  *exporter
+}
+
+// NewTracer creates a tracer exporting to the configured OTLP endpoint
+func NewTracer(cfg config.TelemetryConfig, log *logger.Logger) *Tracer {
+	threshold := uint64(math.MaxUint64)
+	if cfg.SampleRatio < 1 {
+		threshold = uint64(cfg.SampleRatio * math.MaxUint64)
+	}
+	return &Tracer{
+		config:    cfg,
+		threshold: threshold,
+		exporter:  newExporter(cfg, log),
+	}
+}
+
+// Start begins exporting spans in the background
+func (t *Tracer) Start() {
+	t.exporter.start()
+}
+
+// Stop exports the remaining spans and stops exporting
+func (t *Tracer) Stop() {
+	t.exporter.stop()
+}
+
+// TrustIncoming reports whether client trace context is continued
+func (t *Tracer) TrustIncoming() bool {
+	return t != nil && t.config.TrustIncoming
+}
+
+// StartServerSpan starts the span of an incoming request, continuing the
+// client's trace when incoming trace context is trusted
+func (t *Tracer) StartServerSpan(r *http.Request, name string) (context.Context, *Span) {
+	if t == nil {
+		return r.Context(), nil
+	}
+
+	if t.config.TrustIncoming {
+		if remote, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			return t.startSpan(r.Context(), name, KindServer, remote.TraceID, remote.SpanID, remote.Sampled)
+		}
+	}
+
+	traceID := newTraceID()
+	return t.startSpan(r.Context(), name, KindServer, traceID, SpanID{}, t.sample(traceID))
+}
+
+// StartSpan starts a child of the current span in ctx. Without a current span
+// no span is created.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if t == nil || parent == nil {
+		return ctx, nil
+	}
+	return t.startSpan(ctx, name, kind, parent.context.TraceID, parent.context.SpanID, parent.context.Sampled)
+}
+
+func (t *Tracer) startSpan(ctx context.Context, name string, kind int, traceID TraceID, parent SpanID, sampled bool) (context.Context, *Span) {
+	span := &Span{
+		tracer:  t,
+		context: SpanContext{TraceID: traceID, SpanID: newSpanID(), Sampled: sampled},
+		parent:  parent,
+		name:    name,
+		kind:    kind,
+		start:   time.Now(),
+	}
+	if sampled {
+		span.attributes = make(map[string]interface{})
+	}
+	return ContextWithSpan(ctx, span), span
+}
+
+// sample decides from the trace ID whether a new trace is recorded, so every
+// instance makes the same decision for the same trace
+func (t *Tracer) sample(traceID TraceID) bool {
+	return binary.BigEndian.Uint64(traceID[8:]) <= t.threshold
+}
@@ -0,0 +1,220 @@
+// Package vault reads secrets from HashiCorp Vault over its HTTP API. Both
+// KV version 1 and 2 mounts are supported; clients authenticate with a token
+// or an AppRole and renew their token on request.
+package vault
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// Options configures a client
+type Options struct {
+	Address      string // e.g. "https://vault.example.com:8200"
+	Namespace    string // Vault Enterprise namespace (optional)
+	CAPath       string // CA bundle used to verify the server (optional)
+	Token        string // Static token; ignored when RoleID is set
+	RoleID       string // AppRole role ID
+	SecretID     string // AppRole secret ID
+	AppRoleMount string // Mount path of the AppRole auth method
+}
+
+// errDenied is returned for requests rejected because of the token
+var errDenied = errors.New("permission denied")
+
+// Client reads secrets from a Vault server
+type Client struct {
+	options Options
+	http    *http.Client
+
+	mu    sync.Mutex
+	token string
+}
+
+// New creates a client. AppRole clients log in on their first request.
+func New(options Options) (*Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.CAPath != "" {
+		pem, err := os.ReadFile(options.CAPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no valid certificates found in %s", options.CAPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	c := &Client{
+		options: options,
+		http:    &http.Client{Timeout: requestTimeout, Transport: transport},
+	}
+	if options.RoleID == "" {
+		c.token = options.Token
+	}
+	return c, nil
+}
+
+// Read returns one field of the secret at path, such as
+// "secret/data/okaproxy" for a KV version 2 mount
+func (c *Client) Read(path, field string) (string, error) {
+	var response struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := c.call(http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), nil, &response); err != nil {
+		return "", fmt.Errorf("vault: read %s: %v", path, err)
+	}
+
+	data := response.Data
+	// KV version 2 nests the secret under data.data next to its metadata
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+
+	value, ok := data[field]
+	if !ok || value == nil {
+		return "", fmt.Errorf("vault: %s has no field %q", path, field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// Renew extends the lease of the token. AppRole clients whose token can no
+// longer be renewed log in again.
+func (c *Client) Renew() error {
+	err := c.call(http.MethodPost, "/v1/auth/token/renew-self", struct{}{}, nil)
+	if err != nil && c.options.RoleID != "" {
+		err = c.login()
+	}
+	if err != nil {
+		return fmt.Errorf("vault: renew token: %v", err)
+	}
+	return nil
+}
+
+// call sends a request with the current token, logging in first when an
+// AppRole client has none or its token was rejected
+func (c *Client) call(method, path string, body, result interface{}) error {
+	c.mu.Lock()
+	needLogin := c.token == "" && c.options.RoleID != ""
+	c.mu.Unlock()
+	if needLogin {
+		if err := c.login(); err != nil {
+			return err
+		}
+	}
+
+	err := c.do(method, path, c.currentToken(), body, result)
+	if errors.Is(err, errDenied) && c.options.RoleID != "" {
+		if err := c.login(); err != nil {
+			return err
+		}
+		err = c.do(method, path, c.currentToken(), body, result)
+	}
+	return err
+}
+
+// login obtains a token with the AppRole credentials
+func (c *Client) login() error {
+	mount := c.options.AppRoleMount
+	if mount == "" {
+		mount = "approle"
+	}
+	credentials := map[string]string{"role_id": c.options.RoleID, "secret_id": c.options.SecretID}
+
+	var response struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.do(http.MethodPost, "/v1/auth/"+mount+"/login", "", credentials, &response); err != nil {
+		return fmt.Errorf("approle login: %v", err)
+	}
+	if response.Auth.ClientToken == "" {
+		return errors.New("approle login: no token returned")
+	}
+
+	c.mu.Lock()
+	c.token = response.Auth.ClientToken
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) currentToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// do sends one request and decodes the JSON response into result
+func (c *Client) do(method, path, token string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(c.options.Address, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if c.options.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.options.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusForbidden:
+		return errDenied
+	case resp.StatusCode == http.StatusNotFound:
+		return errors.New("not found")
+	case resp.StatusCode >= 300:
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&failure)
+		if len(failure.Errors) > 0 {
+			return fmt.Errorf("%s: %s", resp.Status, strings.Join(failure.Errors, "; "))
+		}
+		return errors.New(resp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
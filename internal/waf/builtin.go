@@ -0,0 +1,42 @@
+package waf
+
+// builtinRules catch common attacks: SQL injection, XSS, path traversal,
+// command injection and scanners. Their IDs follow the ranges the OWASP Core
+// Rule Set uses for the same attack classes.
+const builtinRules = `
+# Scanners announcing themselves
+SecRule REQUEST_HEADERS:User-Agent "@pm sqlmap nikto nmap masscan dirbuster gobuster wpscan nuclei acunetix netsparker" \
+    "id:913100,phase:1,block,t:lowercase,msg:'Security scanner',severity:CRITICAL"
+
+# Path traversal
+SecRule REQUEST_URI_RAW|ARGS|REQUEST_HEADERS:Referer "@rx (?:^|[\\/])\.\.(?:[\\/]|$)" \
+    "id:930100,phase:2,block,t:urlDecodeUni,t:urlDecodeUni,msg:'Path traversal attack',severity:CRITICAL"
+SecRule REQUEST_FILENAME|ARGS "@pm /etc/passwd /etc/shadow /proc/self/environ /.htaccess /.htpasswd win.ini boot.ini /.git/config /.env" \
+    "id:930120,phase:2,block,t:urlDecodeUni,t:normalizePath,t:lowercase,msg:'OS file access attempt',severity:CRITICAL"
+
+# Remote command execution
+SecRule ARGS|REQUEST_COOKIES "@rx (?i)(?:[;|&\x60]|\$\()\s*(?:cat|ls|id|whoami|uname|wget|curl|nc|ncat|bash|sh|python|perl|ping|nslookup)\b" \
+    "id:932100,phase:2,block,t:urlDecodeUni,t:compressWhitespace,msg:'Remote command execution: Unix command injection',severity:CRITICAL"
+
+# Cross-site scripting
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES|REQUEST_HEADERS:Referer "@rx (?i)<script[^>]*>" \
+    "id:941100,phase:2,block,t:urlDecodeUni,t:htmlEntityDecode,t:removeNulls,msg:'XSS attack: script tag',severity:CRITICAL"
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES "@rx (?i)<[^>]*\bon[a-z]+\s*=" \
+    "id:941110,phase:2,block,t:urlDecodeUni,t:htmlEntityDecode,t:removeNulls,msg:'XSS attack: event handler',severity:CRITICAL"
+SecRule ARGS|REQUEST_COOKIES "@rx (?i)(?:javascript|vbscript|livescript)\s*:" \
+    "id:941120,phase:2,block,t:urlDecodeUni,t:htmlEntityDecode,t:removeNulls,t:removeWhitespace,msg:'XSS attack: script URI',severity:CRITICAL"
+SecRule ARGS|REQUEST_COOKIES "@rx (?i)<(?:iframe|object|embed|applet|base|meta|svg|math)\b" \
+    "id:941130,phase:2,block,t:urlDecodeUni,t:htmlEntityDecode,t:removeNulls,msg:'XSS attack: dangerous element',severity:CRITICAL"
+
+# SQL injection
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES "@rx (?i)\bunion\b[\s\S]{0,100}?\bselect\b" \
+    "id:942100,phase:2,block,t:urlDecodeUni,t:replaceComments,msg:'SQL injection: UNION SELECT',severity:CRITICAL"
+SecRule ARGS|REQUEST_COOKIES "@rx (?i)['\x22\x60]\s*(?:or|and|\|\||&&)\s*['\x22\x60]?[\w-]+['\x22\x60]?\s*(?:=|<|>|like\b|is\b)" \
+    "id:942110,phase:2,block,t:urlDecodeUni,t:replaceComments,t:compressWhitespace,msg:'SQL injection: tautology',severity:CRITICAL"
+SecRule ARGS|REQUEST_COOKIES "@rx (?i)\b(?:sleep|benchmark|pg_sleep|waitfor\s+delay|load_file|extractvalue|updatexml)\s*\(|\binformation_schema\b|\bxp_cmdshell\b" \
+    "id:942130,phase:2,block,t:urlDecodeUni,t:replaceComments,t:compressWhitespace,msg:'SQL injection: function or system table',severity:CRITICAL"
+SecRule ARGS|REQUEST_COOKIES "@rx (?i);\s*(?:drop|delete|insert|update|alter|create|truncate|shutdown|exec)\b" \
+    "id:942140,phase:2,block,t:urlDecodeUni,t:replaceComments,t:compressWhitespace,msg:'SQL injection: stacked query',severity:CRITICAL"
+SecRule ARGS|REQUEST_COOKIES "@rx ['\x22\x60]\s*(?:--|#|/\*)" \
+    "id:942150,phase:2,block,t:urlDecodeUni,msg:'SQL injection: comment after quote',severity:WARNING"
+`
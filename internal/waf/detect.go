@@ -0,0 +1,37 @@
+package waf
+
+import "regexp"
+
+// sqlInjection and crossSiteScripting back @detectSQLi and @detectXSS. They
+// are regular expression heuristics for the common attack shapes, not the
+// libinjection tokenizers ModSecurity and Coraza use, so they catch less and
+// rule sets relying on them should be tuned with that in mind.
+var (
+	sqlInjection = regexp.MustCompile(`(?is)` +
+		`\bunion\b[\s\S]{0,100}?\bselect\b` +
+		`|['"` + "`" + `]\s*(?:or|and|\|\||&&)\s*['"` + "`" + `]?[\w-]+['"` + "`" + `]?\s*(?:=|<|>|like\b|is\b)` +
+		`|\b(?:or|and)\s+\d+\s*=\s*\d+` +
+		`|\b(?:sleep|benchmark|pg_sleep|waitfor\s+delay|load_file|extractvalue|updatexml)\s*\(` +
+		`|\binformation_schema\b|\bxp_cmdshell\b` +
+		`|;\s*(?:drop|delete|insert|update|alter|create|truncate|shutdown|exec)\b` +
+		`|['"` + "`" + `]\s*(?:--|#|/\*)`)
+	crossSiteScripting = regexp.MustCompile(`(?is)` +
+		`<script[^>]*>` +
+		`|<[^>]*\bon[a-z]+\s*=` +
+		`|(?:javascript|vbscript|livescript)\s*:` +
+		`|<(?:iframe|object|embed|applet|base|meta|svg|math)\b`)
+)
+
+// detectSQLi reports whether s looks like SQL injection, with the matched
+// fragment
+func detectSQLi(s string) (bool, string) {
+	match := sqlInjection.FindString(s)
+	return match != "", match
+}
+
+// detectXSS reports whether s looks like cross-site scripting, with the
+// matched fragment
+func detectXSS(s string) (bool, string) {
+	match := crossSiteScripting.FindString(s)
+	return match != "", match
+}
@@ -0,0 +1,924 @@
+package waf
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Anomaly scores of rule severities, as in the OWASP Core Rule Set. Rules
+// without a severity count as critical.
+var severityScores = map[string]int{
+	"CRITICAL": 5, "2": 5,
+	"ERROR": 4, "3": 4,
+	"WARNING": 3, "4": 3,
+	"NOTICE": 2, "5": 2,
+	"INFO": 0, "6": 0,
+	"DEBUG": 0, "7": 0,
+}
+
+// Rule actions
+const (
+	actionBlock = "block" // Add the rule's score to the request's anomaly score
+	actionDeny  = "deny"  // Reject the request outright
+	actionPass  = "pass"  // Only log the match
+	actionAllow = "allow" // Stop inspecting and let the request through
+)
+
+// ignoredActions are accepted for compatibility with ModSecurity rule files
+// but have no effect
+var ignoredActions = map[string]bool{
+	"log": true, "auditlog": true, "noauditlog": true, "ver": true, "rev": true,
+	"logdata": true, "maturity": true, "accuracy": true, "status": true,
+	"expirevar": true, "initcol": true, "setuid": true, "setsid": true, "setenv": true,
+	"deprecatevar": true, "sanitiseArg": true, "sanitiseMatched": true,
+	"sanitiseMatchedBytes": true, "sanitiseRequestHeader": true,
+	"sanitiseResponseHeader": true, "xmlns": true,
+}
+
+// ignoredDirectives configure parts of ModSecurity that have no counterpart
+// here, such as audit logs and body limits
+var ignoredDirectives = map[string]bool{
+	"seccomponentsignature": true, "secruleengine": true, "secrequestbodyaccess": true,
+	"secresponsebodyaccess": true, "secrequestbodylimit": true, "secrequestbodynofileslimit": true,
+	"secrequestbodyinmemorylimit": true, "secrequestbodylimitaction": true,
+	"secrequestbodyjsondepthlimit": true, "secargumentslimit": true,
+	"secresponsebodylimit": true, "secresponsebodylimitaction": true, "secresponsebodymimetype": true,
+	"secresponsebodymimetypesclear": true, "sectmpdir": true, "secdatadir": true,
+	"secuploaddir": true, "secuploadkeepfiles": true, "secuploadfilemode": true,
+	"secauditengine": true, "secauditlog": true, "secauditlog2": true, "secauditlogparts": true,
+	"secauditlogrelevantstatus": true, "secauditlogtype": true, "secauditlogformat": true,
+	"secauditlogstoragedir": true, "secauditlogdirmode": true, "secauditlogfilemode": true,
+	"secdebuglog": true, "secdebugloglevel": true, "secargumentseparator": true,
+	"seccookieformat": true, "secunicodemapfile": true, "secstatusengine": true,
+	"seccollectiontimeout": true, "secpcrematchlimit": true, "secpcrematchlimitrecursion": true,
+	"secwebappid": true, "secserversignature": true, "sechashengine": true, "secgeolookupdb": true,
+}
+
+// Rule is a parsed SecRule or SecAction, or a SecMarker
+type Rule struct {
+	ID     int
+	Msg    string
+	Score  int
+	Action string
+	Phase  int
+	Tags   []string
+	Source string // File and line the rule was read from
+
+	targets       []target
+	excluded      []target
+	op            operator
+	unconditional bool // SecAction: no variables or operator
+	tfns          []transform
+	tNone         bool // t:none given, so default transformations do not apply
+	hasAction     bool // A disruptive action was given
+	hasPhase      bool
+
+	chain      *Rule // Next rule of a chain, which must match as well
+	chained    bool  // The chain action was given
+	setvars    []setvar
+	ctls       []ctl
+	capture    bool
+	multiMatch bool
+	nolog      bool
+	skip       int
+	skipAfter  string
+	marker     string // SecMarker name
+}
+
+// target selects the values of a variable, or only those under key
+type target struct {
+	variable string
+	key      string
+	keyRe    *regexp.Regexp // Key given as /regex/
+	count    bool           // &VARIABLE: the number of values
+}
+
+// selects reports whether the target covers the value under key
+func (t target) selects(key string) bool {
+	switch {
+	case t.keyRe != nil:
+		return t.keyRe.MatchString(key)
+	case t.key != "":
+		return strings.EqualFold(t.key, key)
+	}
+	return true
+}
+
+// operator tests a transformed value, returning what it captured
+type operator struct {
+	name   string
+	negate bool
+	test   func(tr *transaction, value string) (bool, []string)
+}
+
+// setvar changes a TX variable
+type setvar struct {
+	name  string // May contain macros
+	value string // May contain macros
+	op    byte   // '=' sets, '+' adds, '-' subtracts, '!' deletes
+}
+
+// ctl changes how the rest of a request is inspected
+type ctl struct {
+	name   string
+	ids    [][2]int       // ruleRemoveById, ruleRemoveTargetById
+	tag    *regexp.Regexp // ruleRemoveByTag, ruleRemoveTargetByTag
+	target []target       // ruleRemoveTarget*
+	value  string         // ruleEngine
+}
+
+// parser reads rule files in order, keeping what earlier directives set up
+type parser struct {
+	rules    []*Rule
+	defaults map[int]*Rule // SecDefaultAction by phase
+	open     *Rule         // Last link of a chain waiting for its next rule
+	head     *Rule         // First rule of that chain
+	depth    int           // Include nesting
+}
+
+// newParser creates a parser
+func newParser() *parser {
+	return &parser{defaults: make(map[int]*Rule)}
+}
+
+// parseFile reads the directives of a rule file
+func (p *parser) parseFile(file string) error {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return p.parse(string(text), file, filepath.Dir(file))
+}
+
+// parse reads directives. Lines ending in a backslash continue on the next
+// line. Files named by Include and @pmFromFile are relative to dir.
+func (p *parser) parse(text, source, dir string) error {
+	var directive strings.Builder
+	start := 0
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if directive.Len() == 0 {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			start = n
+		}
+		if strings.HasSuffix(line, "\\") {
+			directive.WriteString(strings.TrimSuffix(line, "\\"))
+			directive.WriteString(" ")
+			continue
+		}
+		directive.WriteString(line)
+
+		at := fmt.Sprintf("%s:%d", source, start)
+		if err := p.directive(directive.String(), at, dir); err != nil {
+			return fmt.Errorf("%s: %v", at, err)
+		}
+		directive.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", source, err)
+	}
+	if directive.Len() > 0 {
+		return fmt.Errorf("%s:%d: unterminated directive", source, start)
+	}
+	return nil
+}
+
+// directive applies one directive
+func (p *parser) directive(text, at, dir string) error {
+	tokens, err := tokenize(text)
+	if err != nil {
+		return err
+	}
+	name, args := strings.ToLower(tokens[0]), tokens[1:]
+	if p.open != nil && name != "secrule" {
+		return fmt.Errorf("%s follows a rule with the chain action", tokens[0])
+	}
+
+	switch name {
+	case "secrule":
+		if len(args) != 2 && len(args) != 3 {
+			return fmt.Errorf("expected SecRule VARIABLES \"OPERATOR\" \"ACTIONS\"")
+		}
+		actions := ""
+		if len(args) == 3 {
+			actions = args[2]
+		}
+		rule, err := parseRule(args[0], args[1], actions, dir)
+		if err != nil {
+			return err
+		}
+		return p.add(rule, at)
+	case "secaction":
+		if len(args) != 1 {
+			return fmt.Errorf("expected SecAction \"ACTIONS\"")
+		}
+		rule := &Rule{unconditional: true, Action: actionPass}
+		if err := rule.parseActions(args[0]); err != nil {
+			return err
+		}
+		return p.add(rule, at)
+	case "secmarker":
+		if len(args) != 1 {
+			return fmt.Errorf("expected SecMarker NAME")
+		}
+		p.rules = append(p.rules, &Rule{marker: args[0], Source: at})
+	case "secdefaultaction":
+		if len(args) != 1 {
+			return fmt.Errorf("expected SecDefaultAction \"ACTIONS\"")
+		}
+		defaults := &Rule{}
+		if err := defaults.parseActions(args[0]); err != nil {
+			return err
+		}
+		if !defaults.hasPhase || !defaults.hasAction {
+			return fmt.Errorf("SecDefaultAction needs a phase and a disruptive action")
+		}
+		p.defaults[defaults.Phase] = defaults
+	case "secruleremovebyid":
+		if len(args) == 0 {
+			return fmt.Errorf("expected SecRuleRemoveById ID...")
+		}
+		var ids [][2]int
+		for _, arg := range args {
+			ranges, err := parseIDRanges(arg)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, ranges...)
+		}
+		p.remove(func(rule *Rule) bool { return inRanges(ids, rule.ID) })
+	case "secruleremovebytag", "secruleremovebymsg":
+		if len(args) != 1 {
+			return fmt.Errorf("expected %s REGEX", tokens[0])
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return err
+		}
+		if name == "secruleremovebytag" {
+			p.remove(func(rule *Rule) bool { return rule.hasTag(re) })
+		} else {
+			p.remove(func(rule *Rule) bool { return rule.marker == "" && re.MatchString(rule.Msg) })
+		}
+	case "secruleupdatetargetbyid", "secruleupdatetargetbytag":
+		if len(args) != 2 {
+			return fmt.Errorf("expected %s RULE \"VARIABLES\" (replacing variables is not supported)", tokens[0])
+		}
+		var selects func(*Rule) bool
+		if name == "secruleupdatetargetbyid" {
+			ids, err := parseIDRanges(args[0])
+			if err != nil {
+				return err
+			}
+			selects = func(rule *Rule) bool { return inRanges(ids, rule.ID) }
+		} else {
+			re, err := regexp.Compile(args[0])
+			if err != nil {
+				return err
+			}
+			selects = func(rule *Rule) bool { return rule.hasTag(re) }
+		}
+		update := &Rule{}
+		if err := update.parseTargets(args[1], true); err != nil {
+			return err
+		}
+		for _, rule := range p.rules {
+			if rule.marker == "" && selects(rule) {
+				rule.targets = append(rule.targets, update.targets...)
+				rule.excluded = append(rule.excluded, update.excluded...)
+			}
+		}
+	case "include":
+		if len(args) != 1 {
+			return fmt.Errorf("expected Include PATH")
+		}
+		if p.depth >= 10 {
+			return fmt.Errorf("includes nested too deeply")
+		}
+		pattern := args[0]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil || len(files) == 0 {
+			return fmt.Errorf("no rule files match %s", args[0])
+		}
+		p.depth++
+		defer func() { p.depth-- }()
+		for _, file := range files {
+			if err := p.parseFile(file); err != nil {
+				return err
+			}
+		}
+	default:
+		if !ignoredDirectives[name] {
+			return fmt.Errorf("unsupported directive %s", tokens[0])
+		}
+	}
+	return nil
+}
+
+// add appends a rule, or links it to the open chain, applying the default
+// actions of its phase
+func (p *parser) add(rule *Rule, at string) error {
+	rule.Source = at
+	if p.open != nil {
+		if defaults, ok := p.defaults[p.head.Phase]; ok && !rule.tNone {
+			rule.tfns = append(append([]transform(nil), defaults.tfns...), rule.tfns...)
+		}
+		p.open.chain = rule
+		if rule.chained {
+			p.open = rule
+		} else {
+			p.open = nil
+		}
+		return nil
+	}
+
+	if rule.ID == 0 {
+		return fmt.Errorf("rule has no id")
+	}
+	if !rule.hasPhase {
+		rule.Phase = 2
+	}
+	if defaults, ok := p.defaults[rule.Phase]; ok {
+		// Under a SecDefaultAction, "block" means its action, as in ModSecurity
+		if !rule.hasAction || rule.Action == actionBlock {
+			rule.Action = defaults.Action
+		}
+		if !rule.tNone {
+			rule.tfns = append(append([]transform(nil), defaults.tfns...), rule.tfns...)
+		}
+	}
+	p.rules = append(p.rules, rule)
+	if rule.chained {
+		p.open, p.head = rule, rule
+	}
+	return nil
+}
+
+// remove drops the rules defined so far that match
+func (p *parser) remove(match func(*Rule) bool) {
+	kept := p.rules[:0]
+	for _, rule := range p.rules {
+		if rule.marker != "" || !match(rule) {
+			kept = append(kept, rule)
+		}
+	}
+	p.rules = kept
+}
+
+// parseRule parses the parts of a SecRule directive
+func parseRule(variables, op, actions, dir string) (*Rule, error) {
+	rule := &Rule{Action: actionBlock, Score: severityScores["CRITICAL"]}
+	if err := rule.parseTargets(variables, false); err != nil {
+		return nil, err
+	}
+	if err := rule.parseActions(actions); err != nil {
+		return nil, err
+	}
+	var err error
+	if rule.op, err = parseOperator(op, dir); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// tokenize splits a directive into words and double-quoted strings, in which
+// \" stands for a quote and other backslashes are kept
+func tokenize(directive string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(directive); {
+		switch {
+		case directive[i] == ' ' || directive[i] == '\t':
+			i++
+		case directive[i] == '"':
+			var token strings.Builder
+			i++
+			for ; i < len(directive) && directive[i] != '"'; i++ {
+				if directive[i] == '\\' && i+1 < len(directive) && directive[i+1] == '"' {
+					i++
+				}
+				token.WriteByte(directive[i])
+			}
+			if i == len(directive) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			tokens = append(tokens, token.String())
+			i++
+		default:
+			end := strings.IndexAny(directive[i:], " \t")
+			if end < 0 {
+				end = len(directive) - i
+			}
+			tokens = append(tokens, directive[i:i+end])
+			i += end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty directive")
+	}
+	return tokens, nil
+}
+
+// parseTargets reads variables such as "ARGS|REQUEST_HEADERS:User-Agent|!ARGS:token",
+// with /regex/ keys and &-prefixed counts. Updates may consist of exclusions only.
+func (r *Rule) parseTargets(spec string, update bool) error {
+	for _, part := range strings.Split(spec, "|") {
+		part = strings.TrimSpace(part)
+		exclude := strings.HasPrefix(part, "!")
+		part = strings.TrimPrefix(part, "!")
+		count := strings.HasPrefix(part, "&")
+		part = strings.TrimPrefix(part, "&")
+		name, key, _ := strings.Cut(part, ":")
+		name = strings.ToUpper(name)
+		if !knownVariables[name] {
+			return fmt.Errorf("unsupported variable %s", name)
+		}
+		t := target{variable: name, key: strings.Trim(key, "'"), count: count}
+		if len(t.key) > 2 && strings.HasPrefix(t.key, "/") && strings.HasSuffix(t.key, "/") && name != "XML" {
+			re, err := regexp.Compile("(?i)" + t.key[1:len(t.key)-1])
+			if err != nil {
+				return fmt.Errorf("variable %s: %v", part, err)
+			}
+			t.keyRe = re
+		}
+		if exclude {
+			r.excluded = append(r.excluded, t)
+		} else {
+			r.targets = append(r.targets, t)
+		}
+	}
+	if len(r.targets) == 0 && !update {
+		return fmt.Errorf("rule inspects no variables")
+	}
+	return nil
+}
+
+// hasTag reports whether one of the rule's tags matches re
+func (r *Rule) hasTag(re *regexp.Regexp) bool {
+	for _, tag := range r.Tags {
+		if re.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// macroArg returns the operator argument, expanding macros per request when
+// it has any
+func macroArg(arg string) func(tr *transaction) string {
+	if !strings.Contains(arg, "%{") {
+		return func(*transaction) string { return arg }
+	}
+	return func(tr *transaction) string { return tr.expand(arg) }
+}
+
+// parseOperator reads "@name argument", with an optional leading "!". A
+// string without an operator is a regular expression. Files are relative to dir.
+func parseOperator(spec, dir string) (operator, error) {
+	op := operator{negate: strings.HasPrefix(spec, "!")}
+	spec = strings.TrimPrefix(spec, "!")
+	name, arg := "rx", spec
+	if strings.HasPrefix(spec, "@") {
+		name, arg, _ = strings.Cut(spec[1:], " ")
+		arg = strings.TrimSpace(arg)
+	}
+	op.name = name
+	argOf := macroArg(arg)
+
+	switch name {
+	case "rx", "rxGlobal":
+		if strings.Contains(arg, "%{") {
+			var compiled sync.Map
+			op.test = func(tr *transaction, value string) (bool, []string) {
+				pattern := tr.expand(arg)
+				re, ok := compiled.Load(pattern)
+				if !ok {
+					parsed, err := regexp.Compile("(?s)" + pattern)
+					if err != nil {
+						return false, nil
+					}
+					re, _ = compiled.LoadOrStore(pattern, parsed)
+				}
+				return matchRegexp(re.(*regexp.Regexp), value)
+			}
+			break
+		}
+		re, err := regexp.Compile("(?s)" + arg)
+		if err != nil {
+			return op, fmt.Errorf("@rx: %v", err)
+		}
+		op.test = func(_ *transaction, value string) (bool, []string) { return matchRegexp(re, value) }
+	case "pm", "pmFromFile", "pmf":
+		phrases := strings.Fields(strings.ToLower(arg))
+		if name != "pm" {
+			phrases = nil
+			for _, file := range strings.Fields(arg) {
+				read, err := readPhrases(resolve(dir, file))
+				if err != nil {
+					return op, fmt.Errorf("@%s: %v", name, err)
+				}
+				phrases = append(phrases, read...)
+			}
+		}
+		op.test = func(_ *transaction, value string) (bool, []string) {
+			value = strings.ToLower(value)
+			for _, phrase := range phrases {
+				if strings.Contains(value, phrase) {
+					return true, []string{phrase}
+				}
+			}
+			return false, nil
+		}
+	case "contains", "strmatch":
+		op.test = stringTest(argOf, strings.Contains)
+	case "containsWord":
+		op.test = stringTest(argOf, func(value, word string) bool {
+			for _, field := range strings.FieldsFunc(value, func(r rune) bool {
+				return !(r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z')
+			}) {
+				if field == word {
+					return true
+				}
+			}
+			return false
+		})
+	case "streq":
+		op.test = stringTest(argOf, func(value, arg string) bool { return value == arg })
+	case "beginsWith":
+		op.test = stringTest(argOf, strings.HasPrefix)
+	case "endsWith":
+		op.test = stringTest(argOf, strings.HasSuffix)
+	case "within":
+		op.test = stringTest(argOf, func(value, arg string) bool { return strings.Contains(arg, value) })
+	case "eq", "gt", "ge", "lt", "le":
+		if _, err := strconv.Atoi(arg); err != nil && !strings.Contains(arg, "%{") {
+			return op, fmt.Errorf("@%s needs a number", name)
+		}
+		op.test = func(tr *transaction, value string) (bool, []string) {
+			want, _ := strconv.Atoi(strings.TrimSpace(argOf(tr)))
+			got, _ := strconv.Atoi(strings.TrimSpace(value))
+			switch name {
+			case "eq":
+				return got == want, nil
+			case "gt":
+				return got > want, nil
+			case "ge":
+				return got >= want, nil
+			case "lt":
+				return got < want, nil
+			}
+			return got <= want, nil
+		}
+	case "ipMatch", "ipMatchFromFile", "ipMatchF":
+		list := strings.Split(arg, ",")
+		if name != "ipMatch" {
+			read, err := readPhrases(resolve(dir, arg))
+			if err != nil {
+				return op, fmt.Errorf("@%s: %v", name, err)
+			}
+			list = read
+		}
+		var prefixes []netip.Prefix
+		for _, entry := range list {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if !strings.Contains(entry, "/") {
+				addr, err := netip.ParseAddr(entry)
+				if err != nil {
+					return op, fmt.Errorf("@%s: %v", name, err)
+				}
+				entry = netip.PrefixFrom(addr, addr.BitLen()).String()
+			}
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return op, fmt.Errorf("@%s: %v", name, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+		op.test = func(_ *transaction, value string) (bool, []string) {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return false, nil
+			}
+			addr = addr.Unmap()
+			for _, prefix := range prefixes {
+				if prefix.Contains(addr) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	case "validateByteRange":
+		var allowed [256]bool
+		for _, part := range strings.Split(arg, ",") {
+			low, high, isRange := strings.Cut(strings.TrimSpace(part), "-")
+			from, err1 := strconv.Atoi(low)
+			to, err2 := from, error(nil)
+			if isRange {
+				to, err2 = strconv.Atoi(high)
+			}
+			if err1 != nil || err2 != nil || from < 0 || to > 255 || from > to {
+				return op, fmt.Errorf("@validateByteRange: invalid range %q", part)
+			}
+			for b := from; b <= to; b++ {
+				allowed[b] = true
+			}
+		}
+		op.test = func(_ *transaction, value string) (bool, []string) {
+			for i := 0; i < len(value); i++ {
+				if !allowed[value[i]] {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	case "validateUrlEncoding":
+		op.test = func(_ *transaction, value string) (bool, []string) {
+			for i := 0; i < len(value); i++ {
+				if value[i] == '%' && (i+2 >= len(value) || !isHex(value[i+1:i+3])) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	case "validateUtf8Encoding":
+		op.test = func(_ *transaction, value string) (bool, []string) { return !utf8.ValidString(value), nil }
+	case "detectSQLi", "detectXSS":
+		detect := detectSQLi
+		if name == "detectXSS" {
+			detect = detectXSS
+		}
+		op.test = func(_ *transaction, value string) (bool, []string) {
+			matched, fragment := detect(value)
+			return matched, []string{fragment}
+		}
+	case "unconditionalMatch":
+		op.test = func(*transaction, string) (bool, []string) { return true, nil }
+	case "noMatch":
+		op.test = func(*transaction, string) (bool, []string) { return false, nil }
+	default:
+		return op, fmt.Errorf("unsupported operator @%s", name)
+	}
+	return op, nil
+}
+
+// stringTest builds an operator comparing values with its expanded argument
+func stringTest(argOf func(*transaction) string, compare func(value, arg string) bool) func(*transaction, string) (bool, []string) {
+	return func(tr *transaction, value string) (bool, []string) {
+		return compare(value, argOf(tr)), nil
+	}
+}
+
+// matchRegexp matches re, capturing the whole match and up to nine groups
+func matchRegexp(re *regexp.Regexp, value string) (bool, []string) {
+	groups := re.FindStringSubmatch(value)
+	if groups == nil {
+		return false, nil
+	}
+	if len(groups) > 10 {
+		groups = groups[:10]
+	}
+	return true, groups
+}
+
+// resolve returns file relative to dir unless it is absolute
+func resolve(dir, file string) string {
+	if filepath.IsAbs(file) || dir == "" {
+		return file
+	}
+	return filepath.Join(dir, file)
+}
+
+// readPhrases reads the non-empty, non-comment lines of a data file, lowercased
+func readPhrases(file string) ([]string, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var phrases []string
+	for _, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			phrases = append(phrases, strings.ToLower(line))
+		}
+	}
+	return phrases, nil
+}
+
+// parseActions reads "id:942100,phase:2,block,t:lowercase,msg:'...'"
+func (r *Rule) parseActions(spec string) error {
+	if strings.TrimSpace(spec) == "" {
+		return nil
+	}
+	for _, action := range splitActions(spec) {
+		name, value, _ := strings.Cut(action, ":")
+		name = strings.TrimSpace(name)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") {
+			value = value[1 : len(value)-1]
+		}
+
+		switch name {
+		case "id":
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				return fmt.Errorf("invalid id %q", value)
+			}
+			r.ID = id
+		case "phase":
+			phase, ok := map[string]int{"1": 1, "2": 2, "3": 3, "4": 4, "5": 5, "request": 2, "response": 4, "logging": 5}[value]
+			if !ok {
+				return fmt.Errorf("invalid phase %q", value)
+			}
+			r.Phase, r.hasPhase = phase, true
+		case "msg":
+			r.Msg = value
+		case "tag":
+			r.Tags = append(r.Tags, value)
+		case "severity":
+			score, ok := severityScores[strings.ToUpper(value)]
+			if !ok {
+				return fmt.Errorf("invalid severity %q", value)
+			}
+			r.Score = score
+		case "block", "deny", "pass", "allow":
+			r.Action, r.hasAction = name, true
+		case "drop", "redirect":
+			r.Action, r.hasAction = actionDeny, true
+		case "t":
+			if value == "none" {
+				r.tfns, r.tNone = nil, true
+				continue
+			}
+			tfn, ok := transforms[value]
+			if !ok {
+				return fmt.Errorf("unsupported transformation t:%s", value)
+			}
+			r.tfns = append(r.tfns, tfn)
+		case "chain":
+			r.chained = true
+		case "capture":
+			r.capture = true
+		case "multiMatch":
+			r.multiMatch = true
+		case "nolog":
+			r.nolog = true
+		case "skip":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid skip %q", value)
+			}
+			r.skip = n
+		case "skipAfter":
+			r.skipAfter = value
+		case "setvar":
+			sv, ok, err := parseSetvar(value)
+			if err != nil {
+				return err
+			}
+			if ok {
+				r.setvars = append(r.setvars, sv)
+			}
+		case "ctl":
+			c, err := parseCtl(value)
+			if err != nil {
+				return err
+			}
+			r.ctls = append(r.ctls, c)
+		default:
+			if !ignoredActions[name] {
+				return fmt.Errorf("unsupported action %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseSetvar reads "tx.name=value", "tx.name=+n", "tx.name=-n", "!tx.name"
+// or "tx.name" (set to 1). Other collections are not kept between requests,
+// so their variables are skipped.
+func parseSetvar(spec string) (setvar, bool, error) {
+	sv := setvar{op: '='}
+	if strings.HasPrefix(spec, "!") {
+		sv.op = '!'
+		spec = spec[1:]
+	}
+	name, value, hasValue := strings.Cut(spec, "=")
+	collection, variable, ok := strings.Cut(name, ".")
+	if !ok || variable == "" {
+		return sv, false, fmt.Errorf("invalid setvar %q", spec)
+	}
+	if !strings.EqualFold(collection, "tx") {
+		return sv, false, nil
+	}
+	sv.name, sv.value = variable, "1"
+	if hasValue && sv.op == '=' {
+		sv.value = value
+		if strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") {
+			sv.op, sv.value = value[0], value[1:]
+		}
+	}
+	return sv, true, nil
+}
+
+// parseCtl reads ctl:ruleRemoveById=942100, ctl:ruleRemoveByTag=attack-sqli,
+// ctl:ruleRemoveTargetById=942100;ARGS:password, ctl:ruleRemoveTargetByTag=...
+// and ctl:ruleEngine=Off. Other settings have nothing to change and are
+// ignored.
+func parseCtl(spec string) (ctl, error) {
+	name, value, _ := strings.Cut(spec, "=")
+	c := ctl{name: name, value: value}
+	switch name {
+	case "ruleRemoveById":
+		ids, err := parseIDRanges(value)
+		c.ids = ids
+		return c, err
+	case "ruleRemoveByTag":
+		re, err := regexp.Compile(value)
+		c.tag = re
+		return c, err
+	case "ruleRemoveTargetById", "ruleRemoveTargetByTag":
+		rule, targets, ok := strings.Cut(value, ";")
+		if !ok {
+			return c, fmt.Errorf("invalid ctl %q", spec)
+		}
+		update := &Rule{}
+		if err := update.parseTargets(targets, false); err != nil {
+			return c, err
+		}
+		c.target = update.targets
+		if name == "ruleRemoveTargetById" {
+			ids, err := parseIDRanges(rule)
+			c.ids = ids
+			return c, err
+		}
+		re, err := regexp.Compile(rule)
+		c.tag = re
+		return c, err
+	}
+	return c, nil
+}
+
+// parseIDRanges reads "942100", "942100-942199" or a comma-separated list
+func parseIDRanges(spec string) ([][2]int, error) {
+	var ranges [][2]int
+	for _, part := range strings.Split(spec, ",") {
+		low, high, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		from, err := strconv.Atoi(low)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule id %q", part)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(high); err != nil || to < from {
+				return nil, fmt.Errorf("invalid rule id range %q", part)
+			}
+		}
+		ranges = append(ranges, [2]int{from, to})
+	}
+	return ranges, nil
+}
+
+// inRanges reports whether id is in one of the ranges
+func inRanges(ranges [][2]int, id int) bool {
+	for _, r := range ranges {
+		if id >= r[0] && id <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// splitActions splits an action list at commas outside single quotes
+func splitActions(spec string) []string {
+	var actions []string
+	quoted, start := false, 0
+	for i := 0; i < len(spec); i++ {
+		switch spec[i] {
+		case '\'':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				actions = append(actions, spec[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(actions, spec[start:])
+}
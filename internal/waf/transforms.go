@@ -0,0 +1,280 @@
+package waf
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// transform normalizes a value before it is tested
+type transform func(string) string
+
+// transforms are the supported t: transformations
+var transforms = map[string]transform{
+	"lowercase":          strings.ToLower,
+	"uppercase":          strings.ToUpper,
+	"trim":               strings.TrimSpace,
+	"trimLeft":           func(s string) string { return strings.TrimLeft(s, " \t\n\r\f\v") },
+	"trimRight":          func(s string) string { return strings.TrimRight(s, " \t\n\r\f\v") },
+	"urlDecode":          urlDecode,
+	"urlDecodeUni":       urlDecodeUni,
+	"urlEncode":          url.QueryEscape,
+	"htmlEntityDecode":   html.UnescapeString,
+	"jsDecode":           jsDecode,
+	"cssDecode":          cssDecode,
+	"escapeSeqDecode":    escapeSeqDecode,
+	"utf8toUnicode":      utf8ToUnicode,
+	"removeNulls":        func(s string) string { return strings.ReplaceAll(s, "\x00", "") },
+	"replaceNulls":       func(s string) string { return strings.ReplaceAll(s, "\x00", " ") },
+	"removeWhitespace":   func(s string) string { return strings.Join(strings.Fields(s), "") },
+	"compressWhitespace": func(s string) string { return strings.Join(strings.Fields(s), " ") },
+	"replaceComments":    func(s string) string { return comments.ReplaceAllString(s, " ") },
+	"removeComments":     func(s string) string { return allComments.ReplaceAllString(s, "") },
+	"removeCommentsChar": removeCommentsChar,
+	"normalizePath":      normalizePath,
+	"normalisePath":      normalizePath,
+	"normalizePathWin":   func(s string) string { return normalizePath(strings.ReplaceAll(s, "\\", "/")) },
+	"normalisePathWin":   func(s string) string { return normalizePath(strings.ReplaceAll(s, "\\", "/")) },
+	"cmdLine":            cmdLine,
+	"sqlHexDecode":       sqlHexDecode,
+	"hexDecode":          hexDecode,
+	"hexEncode":          func(s string) string { return hex.EncodeToString([]byte(s)) },
+	"base64Decode":       base64Decode,
+	"base64DecodeExt":    base64Decode,
+	"base64Encode":       func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"md5":                func(s string) string { sum := md5.Sum([]byte(s)); return string(sum[:]) },
+	"sha1":               func(s string) string { sum := sha1.Sum([]byte(s)); return string(sum[:]) },
+	"length":             func(s string) string { return strconv.Itoa(len(s)) },
+}
+
+var (
+	unicodeEscapes = regexp.MustCompile(`%u[0-9a-fA-F]{4}`)
+	comments       = regexp.MustCompile(`(?s)/\*.*?(?:\*/|$)`)
+	allComments    = regexp.MustCompile(`(?s)/\*.*?(?:\*/|$)|<!--.*?(?:-->|$)|--[^\n]*|#[^\n]*`)
+	sqlHex         = regexp.MustCompile(`(?i)0x((?:[0-9a-f]{2})+)`)
+)
+
+// urlDecode decodes percent escapes and plus signs, keeping invalid escapes
+func urlDecode(s string) string {
+	if decoded, err := url.QueryUnescape(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+// urlDecodeUni also decodes IIS-style %uHHHH escapes
+func urlDecodeUni(s string) string {
+	return urlDecode(unicodeEscapes.ReplaceAllStringFunc(s, func(m string) string {
+		n, _ := strconv.ParseUint(m[2:], 16, 32)
+		return string(rune(n))
+	}))
+}
+
+// normalizePath resolves "." and ".." segments and repeated slashes
+func normalizePath(s string) string {
+	if s == "" {
+		return s
+	}
+	cleaned := path.Clean(strings.ReplaceAll(s, "\\", "/"))
+	if strings.HasSuffix(s, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// jsDecode decodes JavaScript escapes: \uHHHH, \xHH, octal and the single
+// character ones
+func jsDecode(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		next := s[i+1]
+		switch {
+		case next == 'u' && i+6 <= len(s) && isHex(s[i+2:i+6]):
+			n, _ := strconv.ParseUint(s[i+2:i+6], 16, 32)
+			b.WriteRune(rune(n))
+			i += 5
+		case next == 'x' && i+4 <= len(s) && isHex(s[i+2:i+4]):
+			n, _ := strconv.ParseUint(s[i+2:i+4], 16, 8)
+			b.WriteByte(byte(n))
+			i += 3
+		case next >= '0' && next <= '7':
+			end := i + 2
+			for end < len(s) && end < i+4 && s[end] >= '0' && s[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(s[i+1:end], 8, 16)
+			b.WriteByte(byte(n))
+			i = end - 1
+		default:
+			b.WriteByte(unescapeChar(next))
+			i++
+		}
+	}
+	return b.String()
+}
+
+// escapeSeqDecode decodes ANSI C escapes
+func escapeSeqDecode(s string) string {
+	return jsDecode(s)
+}
+
+// unescapeChar returns the character a backslash escape stands for
+func unescapeChar(c byte) byte {
+	switch c {
+	case 'a':
+		return '\a'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'v':
+		return '\v'
+	}
+	return c
+}
+
+// cssDecode decodes CSS escapes: a backslash followed by up to six hex digits
+// and an optional space, or by any other character
+func cssDecode(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		end := i + 1
+		for end < len(s) && end < i+7 && isHex(s[end:end+1]) {
+			end++
+		}
+		if end == i+1 {
+			if s[i+1] != '\n' {
+				b.WriteByte(s[i+1])
+			}
+			i++
+			continue
+		}
+		n, _ := strconv.ParseUint(s[i+1:end], 16, 32)
+		if n > utf8.MaxRune {
+			n = utf8.RuneError
+		}
+		b.WriteRune(rune(n))
+		if end < len(s) && s[end] == ' ' {
+			end++
+		}
+		i = end - 1
+	}
+	return b.String()
+}
+
+// utf8ToUnicode replaces non-ASCII characters with %uHHHH escapes
+func utf8ToUnicode(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+			continue
+		}
+		if r > 0xffff {
+			r = utf8.RuneError
+		}
+		b.WriteString("%u")
+		b.WriteString(strconv.FormatInt(int64(r)+0x10000, 16)[1:])
+	}
+	return b.String()
+}
+
+// removeCommentsChar removes comment markers but keeps the comments
+func removeCommentsChar(s string) string {
+	return strings.NewReplacer("/*", "", "*/", "", "<!--", "", "-->", "", "--", "", "#", "").Replace(s)
+}
+
+// cmdLine normalizes shell command lines: escapes and quotes are removed,
+// separators become spaces, whitespace is compressed and letters lowercased
+func cmdLine(s string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\', '"', '\'', '^':
+			continue
+		case ' ', '\t', '\n', '\r', ',', ';':
+			space = true
+			continue
+		case '/', '(':
+			space = false
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// sqlHexDecode decodes 0xHEX literals
+func sqlHexDecode(s string) string {
+	return sqlHex.ReplaceAllStringFunc(s, func(m string) string {
+		decoded, _ := hex.DecodeString(m[2:])
+		return string(decoded)
+	})
+}
+
+// hexDecode decodes a hex string, keeping invalid input
+func hexDecode(s string) string {
+	if decoded, err := hex.DecodeString(s); err == nil {
+		return string(decoded)
+	}
+	return s
+}
+
+// base64Decode decodes standard or URL-safe base64, padded or not, keeping
+// invalid input
+func base64Decode(s string) string {
+	trimmed := strings.TrimRight(strings.TrimSpace(s), "=")
+	for _, encoding := range []*base64.Encoding{base64.RawStdEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(trimmed); err == nil {
+			return string(decoded)
+		}
+	}
+	return s
+}
+
+// isHex reports whether s consists of hex digits
+func isHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F') {
+			return false
+		}
+	}
+	return s != ""
+}
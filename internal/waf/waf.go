@@ -0,0 +1,648 @@
+// Package waf inspects requests with rules in ModSecurity's SecRule language,
+// covering what the OWASP Core Rule Set uses on requests: SecRule, SecAction,
+// SecMarker, SecDefaultAction, the SecRuleRemove and SecRuleUpdateTarget
+// directives and Include; chained rules; TX variables changed by setvar and
+// read through macros; skip, skipAfter, capture, multiMatch and ctl rule
+// exclusions. Only the request phases (1 and 2) run; rules of later phases
+// are read and ignored. Request bodies are parsed as forms or JSON, never as
+// multipart or XML, and collections do not persist between requests.
+//
+// Without a SecDefaultAction, each matching block rule adds its severity's
+// anomaly score and requests reaching the threshold are blocked. Rule sets
+// such as the Core Rule Set keep their own score in TX variables and deny
+// requests themselves; that score is reported and counts against the
+// threshold too.
+package waf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// matchValueLimit caps the matched value kept for logs
+const matchValueLimit = 100
+
+// knownVariables are the variables rules may inspect. Those the engine has
+// no source for, such as response and multipart variables, are always empty.
+var knownVariables = map[string]bool{
+	"ARGS": true, "ARGS_GET": true, "ARGS_POST": true, "ARGS_NAMES": true,
+	"ARGS_GET_NAMES": true, "ARGS_POST_NAMES": true, "ARGS_COMBINED_SIZE": true,
+	"REQUEST_HEADERS": true, "REQUEST_HEADERS_NAMES": true,
+	"REQUEST_COOKIES": true, "REQUEST_COOKIES_NAMES": true,
+	"REQUEST_URI": true, "REQUEST_URI_RAW": true, "REQUEST_FILENAME": true,
+	"REQUEST_BASENAME": true, "QUERY_STRING": true, "REQUEST_METHOD": true,
+	"REQUEST_PROTOCOL": true, "REQUEST_LINE": true, "REQUEST_BODY": true,
+	"REQUEST_BODY_LENGTH": true, "REQBODY_PROCESSOR": true, "REQBODY_ERROR": true,
+	"REQBODY_ERROR_MSG": true, "REQBODY_PROCESSOR_ERROR": true, "REMOTE_ADDR": true,
+	"UNIQUE_ID": true, "TX": true, "RULE": true, "MATCHED_VAR": true,
+	"MATCHED_VAR_NAME": true, "MATCHED_VARS": true, "MATCHED_VARS_NAMES": true,
+
+	"FILES": true, "FILES_NAMES": true, "FILES_SIZES": true, "FILES_COMBINED_SIZE": true,
+	"FILES_TMPNAMES": true, "FILES_TMP_CONTENT": true, "MULTIPART_FILENAME": true,
+	"MULTIPART_NAME": true, "MULTIPART_PART_HEADERS": true, "MULTIPART_STRICT_ERROR": true,
+	"MULTIPART_UNMATCHED_BOUNDARY": true, "XML": true, "RESPONSE_HEADERS": true,
+	"RESPONSE_HEADERS_NAMES": true, "RESPONSE_BODY": true, "RESPONSE_STATUS": true,
+	"RESPONSE_PROTOCOL": true, "RESPONSE_CONTENT_TYPE": true, "RESPONSE_CONTENT_LENGTH": true,
+	"STATUS_LINE": true, "GEO": true, "IP": true, "GLOBAL": true, "SESSION": true,
+	"USER": true, "RESOURCE": true, "ENV": true, "REMOTE_HOST": true, "REMOTE_PORT": true,
+	"SERVER_NAME": true, "SERVER_ADDR": true, "SERVER_PORT": true, "AUTH_TYPE": true,
+	"DURATION": true, "HIGHEST_SEVERITY": true, "INBOUND_DATA_ERROR": true,
+	"OUTBOUND_DATA_ERROR": true, "URLENCODED_ERROR": true, "WEBAPPID": true,
+}
+
+// bodyVariables are only available once the body has been read, in phase 2
+var bodyVariables = map[string]bool{
+	"ARGS_POST": true, "ARGS_POST_NAMES": true, "REQUEST_BODY": true, "REQUEST_BODY_LENGTH": true,
+	"REQBODY_PROCESSOR": true, "REQBODY_ERROR": true, "REQBODY_ERROR_MSG": true,
+	"REQBODY_PROCESSOR_ERROR": true,
+}
+
+// Options selects the rules of an engine
+type Options struct {
+	Builtin   bool     // Include the built-in SQL injection, XSS, traversal and scanner rules
+	Files     []string // Rule file glob patterns
+	Disabled  []int    // Rule IDs left out
+	Threshold int      // Anomaly score that blocks a request
+}
+
+// Engine inspects requests with a set of rules
+type Engine struct {
+	phases    [2][]*Rule // Rules of the request header and body phases, with the markers
+	threshold int
+}
+
+// New loads the rules of an engine. Rule files are read in order, so
+// directives such as SecDefaultAction and SecRuleRemoveById apply to what
+// follows or precedes them as in ModSecurity.
+func New(options Options) (*Engine, error) {
+	p := newParser()
+	if options.Builtin {
+		if err := p.parse(builtinRules, "builtin", ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range options.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rules %s: %v", pattern, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no rule files match %s", pattern)
+		}
+		for _, file := range files {
+			if err := p.parseFile(file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.open != nil {
+		return nil, fmt.Errorf("%s: chain action without a following rule", p.open.Source)
+	}
+
+	ids := make(map[int]string)
+	engine := &Engine{threshold: options.Threshold}
+	for _, rule := range p.rules {
+		if rule.marker != "" {
+			engine.phases[0] = append(engine.phases[0], rule)
+			engine.phases[1] = append(engine.phases[1], rule)
+			continue
+		}
+		if source, ok := ids[rule.ID]; ok {
+			return nil, fmt.Errorf("%s: rule id %d already used at %s", rule.Source, rule.ID, source)
+		}
+		ids[rule.ID] = rule.Source
+		if slices.Contains(options.Disabled, rule.ID) || rule.Phase > 2 {
+			continue
+		}
+		engine.phases[rule.Phase-1] = append(engine.phases[rule.Phase-1], rule)
+	}
+	return engine, nil
+}
+
+// Rules returns how many rules the engine applies
+func (e *Engine) Rules() int {
+	n := 0
+	for _, rules := range e.phases {
+		for _, rule := range rules {
+			if rule.marker == "" {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Request is what rules see of a request
+type Request struct {
+	Method     string
+	URI        string // As sent, with the query
+	Path       string // Decoded
+	Query      string
+	Protocol   string
+	Headers    http.Header
+	Body       []byte // Up to the inspection limit
+	RemoteAddr string // Client IP
+	ID         string // Request ID
+}
+
+// Match is a rule that matched a request
+type Match struct {
+	ID       int    `json:"id"`
+	Msg      string `json:"msg"`
+	Variable string `json:"variable,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+// Result is the outcome of inspecting a request
+type Result struct {
+	Score   int
+	Blocked bool
+	Matches []Match
+}
+
+// value is one inspected value and where it came from
+type value struct {
+	key, value string
+}
+
+// Inspect applies the rules of the request phases to the request, in order.
+// A deny rule ends inspection, as does an allow rule, which lets the request
+// through.
+func (e *Engine) Inspect(r *Request) *Result {
+	tr := newTransaction(r)
+	result := &Result{}
+	denied, allowed := false, false
+
+phases:
+	for phase, rules := range e.phases {
+		tr.phase = phase + 1
+		for i := 0; i < len(rules); i++ {
+			rule := rules[i]
+			if rule.marker != "" || tr.isRemoved(rule) {
+				continue
+			}
+			match, ok := tr.apply(rule)
+			if !ok {
+				continue
+			}
+			if !rule.nolog {
+				result.Matches = append(result.Matches, match)
+			}
+			if tr.engineOff {
+				break phases
+			}
+			switch rule.Action {
+			case actionDeny:
+				if !tr.detectionOnly {
+					denied = true
+					break phases
+				}
+			case actionAllow:
+				if !tr.detectionOnly {
+					allowed = true
+					break phases
+				}
+			case actionBlock:
+				result.Score += rule.Score
+			}
+
+			switch {
+			case rule.skipAfter != "":
+				i = skipAfter(rules, i, rule.skipAfter)
+			case rule.skip > 0:
+				for skipped := 0; skipped < rule.skip && i+1 < len(rules); {
+					i++
+					if rules[i].marker == "" {
+						skipped++
+					}
+				}
+			}
+		}
+	}
+
+	if score := tr.anomalyScore(); score > result.Score {
+		result.Score = score
+	}
+	result.Blocked = !allowed && !tr.engineOff && !tr.detectionOnly && (denied || result.Score >= e.threshold)
+	return result
+}
+
+// skipAfter returns the index of the marker named after i, or the last index
+// when there is none
+func skipAfter(rules []*Rule, i int, marker string) int {
+	for j := i + 1; j < len(rules); j++ {
+		if rules[j].marker == marker {
+			return j
+		}
+	}
+	return len(rules) - 1
+}
+
+// removedTarget is a variable a ctl action left out of some rules
+type removedTarget struct {
+	ctl
+	target target
+}
+
+// transaction is the state of inspecting one request
+type transaction struct {
+	collections map[string][]value
+	tx          map[string]string // TX variables, by lowercased name
+	matched     []value           // MATCHED_VARS of the last matching rule, keyed by name
+	rule        *Rule             // Rule being applied, for RULE
+	phase       int
+
+	removedIDs     [][2]int
+	removedTags    []*regexp.Regexp
+	removedTargets []removedTarget
+	engineOff      bool
+	detectionOnly  bool
+}
+
+// newTransaction prepares the inspection of a request
+func newTransaction(r *Request) *transaction {
+	return &transaction{collections: collect(r), tx: make(map[string]string)}
+}
+
+// isRemoved reports whether a ctl action removed the rule
+func (tr *transaction) isRemoved(rule *Rule) bool {
+	if inRanges(tr.removedIDs, rule.ID) {
+		return true
+	}
+	for _, tag := range tr.removedTags {
+		if rule.hasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies a rule with its chain. When every link matches, their setvar
+// and ctl actions run and the match of the first link is returned, with the
+// macros of its message expanded.
+func (tr *transaction) apply(rule *Rule) (Match, bool) {
+	tr.rule = rule
+	var first Match
+	for link := rule; link != nil; link = link.chain {
+		match, ok := tr.evaluate(rule, link)
+		if !ok {
+			return Match{}, false
+		}
+		if link == rule {
+			first = match
+		}
+	}
+	first.Msg = tr.expand(first.Msg)
+	for link := rule; link != nil; link = link.chain {
+		for _, sv := range link.setvars {
+			tr.setvar(sv)
+		}
+		for _, c := range link.ctls {
+			tr.ctl(c)
+		}
+	}
+	return first, true
+}
+
+// evaluate tests the values of a rule's variables, recording those matching
+// as the matched variables. head is the first rule of the chain.
+func (tr *transaction) evaluate(head, r *Rule) (Match, bool) {
+	if r.unconditional {
+		return Match{ID: head.ID, Msg: head.Msg}, true
+	}
+
+	var first *Match
+	var matched []value
+	for _, t := range r.targets {
+		for _, v := range tr.selected(head, r, t) {
+			name := t.variable
+			if t.count {
+				name = "&" + name
+			}
+			if v.key != "" {
+				name += ":" + v.key
+			}
+			for _, candidate := range r.transformed(v.value) {
+				ok, captured := r.op.test(tr, candidate)
+				if ok == r.op.negate {
+					continue
+				}
+				if r.capture && ok {
+					for i, group := range captured {
+						tr.tx[strconv.Itoa(i)] = group
+					}
+				}
+				matched = append(matched, value{name, v.value})
+				if first == nil {
+					if len(candidate) > matchValueLimit {
+						candidate = candidate[:matchValueLimit]
+					}
+					first = &Match{ID: head.ID, Msg: head.Msg, Variable: name, Value: candidate}
+				}
+				break
+			}
+		}
+	}
+	if first == nil {
+		return Match{}, false
+	}
+	tr.matched = matched
+	return *first, true
+}
+
+// selected returns the values a target of a rule covers, less those excluded
+// by the rule or a ctl action. &-targets yield the number of values.
+func (tr *transaction) selected(head, r *Rule, t target) []value {
+	var selected []value
+	for _, v := range tr.values(t.variable) {
+		if !t.selects(v.key) || tr.isExcluded(head, r, t.variable, v.key) {
+			continue
+		}
+		selected = append(selected, v)
+	}
+	if t.count {
+		return []value{{value: strconv.Itoa(len(selected))}}
+	}
+	return selected
+}
+
+// isExcluded reports whether the value under key of variable is left out of
+// a rule
+func (tr *transaction) isExcluded(head, r *Rule, variable, key string) bool {
+	for _, t := range r.excluded {
+		if t.variable == variable && t.selects(key) {
+			return true
+		}
+	}
+	for _, removed := range tr.removedTargets {
+		if removed.target.variable != variable || !removed.target.selects(key) {
+			continue
+		}
+		if inRanges(removed.ids, head.ID) || removed.tag != nil && head.hasTag(removed.tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformed returns the value after the rule's transformations. With
+// multiMatch, the value before and after each transformation is tested.
+func (r *Rule) transformed(v string) []string {
+	candidates := []string{v}
+	for _, tfn := range r.tfns {
+		next := tfn(v)
+		if r.multiMatch && next != v {
+			candidates = append(candidates, next)
+		}
+		v = next
+	}
+	if !r.multiMatch {
+		return []string{v}
+	}
+	return candidates
+}
+
+// values returns the values of a variable
+func (tr *transaction) values(variable string) []value {
+	if tr.phase == 1 {
+		if bodyVariables[variable] {
+			return nil
+		}
+		switch variable {
+		case "ARGS":
+			variable = "ARGS_GET"
+		case "ARGS_NAMES":
+			variable = "ARGS_GET_NAMES"
+		}
+	}
+
+	switch variable {
+	case "TX":
+		names := make([]string, 0, len(tr.tx))
+		for name := range tr.tx {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]value, len(names))
+		for i, name := range names {
+			values[i] = value{name, tr.tx[name]}
+		}
+		return values
+	case "MATCHED_VARS":
+		return tr.matched
+	case "MATCHED_VARS_NAMES":
+		names := make([]value, len(tr.matched))
+		for i, v := range tr.matched {
+			names[i] = value{v.key, v.key}
+		}
+		return names
+	case "MATCHED_VAR", "MATCHED_VAR_NAME":
+		if len(tr.matched) == 0 {
+			return nil
+		}
+		last := tr.matched[len(tr.matched)-1]
+		if variable == "MATCHED_VAR_NAME" {
+			return []value{{value: last.key}}
+		}
+		return []value{{value: last.value}}
+	case "RULE":
+		if tr.rule == nil {
+			return nil
+		}
+		return []value{
+			{"id", strconv.Itoa(tr.rule.ID)},
+			{"msg", tr.rule.Msg},
+			{"phase", strconv.Itoa(tr.rule.Phase)},
+		}
+	}
+	return tr.collections[variable]
+}
+
+// macro matches %{VARIABLE} and %{VARIABLE.key}
+var macro = regexp.MustCompile(`%\{([^}]+)\}`)
+
+// expand replaces macros in s with the first value they name, or nothing
+func (tr *transaction) expand(s string) string {
+	if !strings.Contains(s, "%{") {
+		return s
+	}
+	return macro.ReplaceAllStringFunc(s, func(m string) string {
+		name, key, _ := strings.Cut(m[2:len(m)-1], ".")
+		t := target{variable: strings.ToUpper(name), key: key}
+		for _, v := range tr.values(t.variable) {
+			if t.selects(v.key) {
+				return v.value
+			}
+		}
+		return ""
+	})
+}
+
+// setvar changes a TX variable
+func (tr *transaction) setvar(sv setvar) {
+	name := strings.ToLower(tr.expand(sv.name))
+	v := tr.expand(sv.value)
+	switch sv.op {
+	case '!':
+		delete(tr.tx, name)
+	case '+', '-':
+		current, _ := strconv.Atoi(tr.tx[name])
+		n, _ := strconv.Atoi(v)
+		if sv.op == '-' {
+			n = -n
+		}
+		tr.tx[name] = strconv.Itoa(current + n)
+	default:
+		tr.tx[name] = v
+	}
+}
+
+// ctl applies a ctl action to the rest of the request
+func (tr *transaction) ctl(c ctl) {
+	switch c.name {
+	case "ruleEngine":
+		switch strings.ToLower(c.value) {
+		case "off":
+			tr.engineOff = true
+		case "detectiononly":
+			tr.detectionOnly = true
+		}
+	case "ruleRemoveById":
+		tr.removedIDs = append(tr.removedIDs, c.ids...)
+	case "ruleRemoveByTag":
+		tr.removedTags = append(tr.removedTags, c.tag)
+	case "ruleRemoveTargetById", "ruleRemoveTargetByTag":
+		for _, t := range c.target {
+			tr.removedTargets = append(tr.removedTargets, removedTarget{c, t})
+		}
+	}
+}
+
+// anomalyScore returns the inbound anomaly score a rule set such as the Core
+// Rule Set keeps in TX variables
+func (tr *transaction) anomalyScore() int {
+	for _, name := range []string{"blocking_inbound_anomaly_score", "inbound_anomaly_score", "anomaly_score"} {
+		if v, ok := tr.tx[name]; ok {
+			score, _ := strconv.Atoi(v)
+			return score
+		}
+	}
+	return 0
+}
+
+// collect gathers the values of every request variable. Form and JSON bodies
+// add their fields to ARGS_POST; JSON fields are named by their path, e.g.
+// "json.user.name". Values of *_NAMES variables are keyed by the name, so
+// rules can select and exclude them.
+func collect(r *Request) map[string][]value {
+	c := make(map[string][]value)
+	add := func(variable, key, v string) {
+		c[variable] = append(c[variable], value{key, v})
+	}
+
+	for _, arg := range parseArgs(r.Query) {
+		add("ARGS_GET", arg.key, arg.value)
+		add("ARGS_GET_NAMES", arg.key, arg.key)
+	}
+
+	contentType := strings.ToLower(r.Headers.Get("Content-Type"))
+	switch {
+	case len(r.Body) == 0:
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		add("REQBODY_PROCESSOR", "", "URLENCODED")
+		add("REQBODY_ERROR", "", "0")
+		for _, arg := range parseArgs(string(r.Body)) {
+			add("ARGS_POST", arg.key, arg.value)
+			add("ARGS_POST_NAMES", arg.key, arg.key)
+		}
+	case strings.Contains(contentType, "json"):
+		add("REQBODY_PROCESSOR", "", "JSON")
+		var document interface{}
+		if err := json.Unmarshal(r.Body, &document); err != nil {
+			add("REQBODY_ERROR", "", "1")
+			add("REQBODY_ERROR_MSG", "", err.Error())
+			add("REQBODY_PROCESSOR_ERROR", "", "1")
+			break
+		}
+		add("REQBODY_ERROR", "", "0")
+		flattenJSON("json", document, func(key, v string) {
+			add("ARGS_POST", key, v)
+			add("ARGS_POST_NAMES", key, key)
+		})
+	}
+	c["ARGS"] = append(slices.Clone(c["ARGS_GET"]), c["ARGS_POST"]...)
+	c["ARGS_NAMES"] = append(slices.Clone(c["ARGS_GET_NAMES"]), c["ARGS_POST_NAMES"]...)
+	size := 0
+	for _, arg := range c["ARGS"] {
+		size += len(arg.key) + len(arg.value)
+	}
+	add("ARGS_COMBINED_SIZE", "", strconv.Itoa(size))
+
+	for name, values := range r.Headers {
+		for _, v := range values {
+			add("REQUEST_HEADERS", name, v)
+		}
+		add("REQUEST_HEADERS_NAMES", name, name)
+	}
+	for _, cookie := range (&http.Request{Header: r.Headers}).Cookies() {
+		add("REQUEST_COOKIES", cookie.Name, cookie.Value)
+		add("REQUEST_COOKIES_NAMES", cookie.Name, cookie.Name)
+	}
+
+	add("REQUEST_URI", "", r.URI)
+	add("REQUEST_URI_RAW", "", r.URI)
+	add("REQUEST_FILENAME", "", r.Path)
+	add("REQUEST_BASENAME", "", r.Path[strings.LastIndex(r.Path, "/")+1:])
+	add("QUERY_STRING", "", r.Query)
+	add("REQUEST_METHOD", "", r.Method)
+	add("REQUEST_PROTOCOL", "", r.Protocol)
+	add("REQUEST_LINE", "", r.Method+" "+r.URI+" "+r.Protocol)
+	add("REMOTE_ADDR", "", r.RemoteAddr)
+	add("UNIQUE_ID", "", r.ID)
+	if len(r.Body) > 0 {
+		add("REQUEST_BODY", "", string(r.Body))
+		add("REQUEST_BODY_LENGTH", "", strconv.Itoa(len(r.Body)))
+	}
+	return c
+}
+
+// parseArgs splits a query string or form body into its fields. Unlike
+// url.ParseQuery it keeps fields containing semicolons or bad escapes, which
+// attacks often do.
+func parseArgs(query string) []value {
+	var args []value
+	for _, field := range strings.Split(query, "&") {
+		if field == "" {
+			continue
+		}
+		key, v, _ := strings.Cut(field, "=")
+		args = append(args, value{urlDecode(key), urlDecode(v)})
+	}
+	return args
+}
+
+// flattenJSON calls add with the path and value of every scalar in document
+func flattenJSON(prefix string, document interface{}, add func(key, value string)) {
+	switch v := document.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			flattenJSON(prefix+"."+key, child, add)
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenJSON(prefix+"."+strconv.Itoa(i), child, add)
+		}
+	case string:
+		add(prefix, v)
+	case nil:
+	default:
+		add(prefix, fmt.Sprint(v))
+	}
+}
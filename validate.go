@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"okaproxy/internal/config"
+	"okaproxy/internal/server"
+)
+
+// runValidate implements the `okaproxy validate` subcommand
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", "config.toml", "Path to configuration file")
+	skipDNS := fs.Bool("skip-dns", false, "Do not resolve target host names")
+	fs.Parse(args)
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration: %v\n", err)
+		return 1
+	}
+
+	problems := server.Check(cfg, server.CheckOptions{SkipDNS: *skipDNS})
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, problem)
+	}
+	if len(problems) > 0 {
+		noun := "problems"
+		if len(problems) == 1 {
+			noun = "problem"
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d %s found\n", *configPath, len(problems), noun)
+		return 1
+	}
+
+	fmt.Printf("%s: configuration OK (%d servers)\n", *configPath, len(cfg.Server))
+	return 0
+}
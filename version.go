@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"okaproxy/internal/version"
+)
+
+// runVersion implements the `okaproxy version` subcommand
+func runVersion(args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the build metadata as JSON")
+	fs.Parse(args)
+
+	info := version.Get()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(info); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write version: %v\n", err)
+			return 2
+		}
+		return 0
+	}
+
+	fmt.Println(info)
+	return 0
+}
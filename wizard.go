@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"okaproxy/internal/config"
+)
+
+// wizardAnswers holds everything needed to render a configuration file
+type wizardAnswers struct {
+	Name        string
+	Domain      string
+	Port        int
+	TargetURL   string
+	SecretKey   string
+	Expired     int
+	HTTPSMode   string // "none", "manual" or "acme"
+	CertPath    string
+	KeyPath     string
+	ACMEEmail   string
+	DNSProvider string
+	DNSToken    string
+	DNSKeyID    string
+	DNSSecret   string
+	DNSZoneID   string
+	RateCount   int
+	RateWindow  int
+}
+
+// runInit implements the `okaproxy init` subcommand
+func runInit(args []string) int {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	output := fs.String("output", "config.toml", "Path of the configuration file to write")
+	force := fs.Bool("force", false, "Overwrite an existing configuration file")
+	yes := fs.Bool("yes", false, "Do not prompt; use flags and defaults only")
+	systemdPath := fs.String("systemd", "", "Also write a systemd unit to this path")
+	binaryPath := fs.String("binary", "", "Path of the okaproxy binary for the systemd unit (default: this executable)")
+
+	a := wizardAnswers{}
+	fs.StringVar(&a.Name, "name", "", "Server name")
+	fs.StringVar(&a.Domain, "domain", "", "Public domain name")
+	fs.IntVar(&a.Port, "port", 0, "Port to listen on")
+	fs.StringVar(&a.TargetURL, "target", "", "Backend URL to proxy to")
+	fs.StringVar(&a.HTTPSMode, "https", "", "HTTPS mode: none, manual or acme")
+	fs.StringVar(&a.CertPath, "cert", "", "Certificate path (manual HTTPS)")
+	fs.StringVar(&a.KeyPath, "key", "", "Private key path (manual HTTPS)")
+	fs.StringVar(&a.ACMEEmail, "acme-email", "", "ACME account email")
+	fs.StringVar(&a.DNSProvider, "dns-provider", "", "ACME DNS provider: cloudflare, route53 or aliyun")
+	fs.StringVar(&a.DNSToken, "dns-token", "", "Cloudflare API token")
+	fs.StringVar(&a.DNSZoneID, "dns-zone-id", "", "Route53 hosted zone ID")
+	fs.StringVar(&a.DNSKeyID, "dns-access-key-id", "", "Route53 / Aliyun access key ID")
+	fs.StringVar(&a.DNSSecret, "dns-secret-access-key", "", "Route53 / Aliyun secret access key")
+	fs.IntVar(&a.RateCount, "rate-count", -1, "Maximum requests per window (0 = disabled)")
+	fs.IntVar(&a.RateWindow, "rate-window", 0, "Rate limit window in seconds")
+	fs.Parse(args)
+
+	if _, err := os.Stat(*output); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists (use --force to overwrite)\n", *output)
+		return 1
+	}
+
+	// Resolve the unit's binary before writing anything
+	var executable string
+	if *systemdPath != "" {
+		var err error
+		if executable, err = unitExecutable(*binaryPath); err != nil {
+			fmt.Fprintf(os.Stderr, "init: %v\n", err)
+			return 1
+		}
+	}
+
+	p := &prompter{
+		in:          bufio.NewReader(os.Stdin),
+		out:         os.Stdout,
+		interactive: !*yes && isTerminal(os.Stdin),
+	}
+	if err := p.collect(&a); err != nil {
+		fmt.Fprintf(os.Stderr, "init: %v\n", err)
+		return 1
+	}
+
+	if err := writeTemplate(*output, configTemplate, a, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "init: failed to write %s: %v\n", *output, err)
+		return 1
+	}
+	fmt.Printf("Configuration written to %s\n", *output)
+
+	if *systemdPath != "" {
+		if err := writeSystemdUnit(*systemdPath, executable, *output, a.Port); err != nil {
+			fmt.Fprintf(os.Stderr, "init: failed to write %s: %v\n", *systemdPath, err)
+			return 1
+		}
+		fmt.Printf("systemd unit written to %s\n", *systemdPath)
+	}
+
+	// Make sure what we generated actually loads. Interactive users may still
+	// be creating certificates; unattended runs must not report success.
+	if _, err := config.LoadConfig(*output); err != nil {
+		if *yes {
+			fmt.Fprintf(os.Stderr, "init: generated configuration does not validate: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "warning: generated configuration does not validate yet: %v\n", err)
+	}
+	return 0
+}
+
+// prompter asks for missing values, falling back to defaults when not interactive
+type prompter struct {
+	in          *bufio.Reader
+	out         io.Writer
+	interactive bool
+}
+
+// collect fills in every answer not given on the command line
+func (p *prompter) collect(a *wizardAnswers) error {
+	a.Domain = p.ask("Public domain name", a.Domain, "localhost")
+	a.Name = p.ask("Server name", a.Name, strings.ReplaceAll(a.Domain, ".", "-"))
+	a.TargetURL = p.ask("Backend URL", a.TargetURL, "http://localhost:8080")
+	if u, err := url.Parse(a.TargetURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid backend URL %q", a.TargetURL)
+	}
+
+	a.HTTPSMode = strings.ToLower(p.ask("HTTPS (none, manual, acme)", a.HTTPSMode, "none"))
+	defaultPort := 3000
+	switch a.HTTPSMode {
+	case "none":
+	case "manual":
+		defaultPort = 443
+		a.CertPath = p.ask("Certificate path", a.CertPath, "/etc/ssl/certs/"+a.Domain+".pem")
+		a.KeyPath = p.ask("Private key path", a.KeyPath, "/etc/ssl/private/"+a.Domain+".key")
+	case "acme":
+		defaultPort = 443
+		a.ACMEEmail = p.ask("ACME account email", a.ACMEEmail, "admin@"+a.Domain)
+		a.DNSProvider = strings.ToLower(p.ask("DNS provider (cloudflare, route53, aliyun)", a.DNSProvider, config.DNSProviderCloudflare))
+		switch a.DNSProvider {
+		case config.DNSProviderCloudflare:
+			a.DNSToken = p.ask("Cloudflare API token", a.DNSToken, "")
+		case config.DNSProviderRoute53:
+			a.DNSZoneID = p.ask("Route53 hosted zone ID", a.DNSZoneID, "")
+			a.DNSKeyID = p.ask("AWS access key ID", a.DNSKeyID, "")
+			a.DNSSecret = p.ask("AWS secret access key", a.DNSSecret, "")
+		case config.DNSProviderAliyun:
+			a.DNSKeyID = p.ask("Aliyun AccessKey ID", a.DNSKeyID, "")
+			a.DNSSecret = p.ask("Aliyun AccessKey secret", a.DNSSecret, "")
+		default:
+			return fmt.Errorf("unsupported DNS provider %q", a.DNSProvider)
+		}
+	default:
+		return fmt.Errorf("invalid HTTPS mode %q (expected none, manual or acme)", a.HTTPSMode)
+	}
+
+	if a.Port == 0 {
+		a.Port = p.askInt("Listen port", defaultPort)
+	}
+	if a.RateCount < 0 {
+		a.RateCount = p.askInt("Max requests per window (0 = disabled)", 100)
+	}
+	if a.RateWindow == 0 {
+		a.RateWindow = p.askInt("Rate limit window in seconds", 60)
+	}
+	a.Expired = 300
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	a.SecretKey = hex.EncodeToString(secret)
+	return nil
+}
+
+// ask returns current if already set, otherwise prompts (or returns def)
+func (p *prompter) ask(question, current, def string) string {
+	if current != "" {
+		return current
+	}
+	if !p.interactive {
+		return def
+	}
+
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, _ := p.in.ReadString('\n')
+	if line = strings.TrimSpace(line); line != "" {
+		return line
+	}
+	return def
+}
+
+// askInt prompts for an integer, repeating until the answer parses
+func (p *prompter) askInt(question string, def int) int {
+	for {
+		answer := p.ask(question, "", strconv.Itoa(def))
+		if n, err := strconv.Atoi(answer); err == nil && n >= 0 {
+			return n
+		}
+		fmt.Fprintln(p.out, "Please enter a non-negative number.")
+	}
+}
+
+// isTerminal reports whether f is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// writeSystemdUnit renders a systemd service running executable with the
+// generated configuration
+func writeSystemdUnit(path, executable, configPath string, port int) error {
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return err
+	}
+
+	return writeTemplate(path, systemdTemplate, map[string]interface{}{
+		"Executable":       executable,
+		"Config":           absConfig,
+		"WorkingDirectory": filepath.Dir(absConfig),
+		"PrivilegedPort":   port < 1024,
+	}, 0644)
+}
+
+// unitExecutable resolves the binary a systemd unit starts. A binary built by
+// `go run` lives in a temporary go-build directory that is gone once the
+// command exits, so it has to be named explicitly.
+func unitExecutable(binary string) (string, error) {
+	if binary != "" {
+		return filepath.Abs(binary)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(filepath.ToSlash(executable), "/go-build") {
+		return "", fmt.Errorf("%s is a temporary `go run` build; pass --binary with the installed okaproxy path", executable)
+	}
+	return executable, nil
+}
+
+// writeTemplate renders tmpl with data into path
+func writeTemplate(path, tmpl string, data interface{}, perm os.FileMode) error {
+	t, err := template.New(filepath.Base(path)).Funcs(template.FuncMap{
+		"quote": strconv.Quote,
+	}).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return t.Execute(f, data)
+}
+
+const configTemplate = `# OkaProxy configuration generated by "okaproxy init"
+# See config.toml.example for every available option
+
+[limit]
+count = {{.RateCount}}    # Maximum requests per window (0 = disabled)
+window = {{.RateWindow}}    # Time window in seconds
+
+[[server]]
+name = {{quote .Name}}
+port = {{.Port}}
+target_url = {{quote .TargetURL}}
+secret_key = {{quote .SecretKey}}
+expired = {{.Expired}}
+ctn_max = 50
+
+[server.https]
+{{- if eq .HTTPSMode "none"}}
+enabled = false
+{{- else}}
+enabled = true
+{{- end}}
+{{- if eq .HTTPSMode "manual"}}
+cert_path = {{quote .CertPath}}
+key_path = {{quote .KeyPath}}
+{{- end}}
+{{- if eq .HTTPSMode "acme"}}
+
+[server.https.acme]
+enabled = true
+email = {{quote .ACMEEmail}}
+domains = [{{quote .Domain}}]
+
+[server.https.acme.dns]
+provider = {{quote .DNSProvider}}
+{{- if .DNSToken}}
+api_token = {{quote .DNSToken}}
+{{- end}}
+{{- if .DNSZoneID}}
+zone_id = {{quote .DNSZoneID}}
+{{- end}}
+{{- if .DNSKeyID}}
+access_key_id = {{quote .DNSKeyID}}
+secret_access_key = {{quote .DNSSecret}}
+{{- end}}
+{{- end}}
+`
+
+const systemdTemplate = `[Unit]
+Description=OkaProxy reverse proxy
+After=network-online.target redis.service
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{.Executable}} --config {{.Config}}
+WorkingDirectory={{.WorkingDirectory}}
+Restart=on-failure
+RestartSec=5
+NoNewPrivileges=true
+{{- if .PrivilegedPort}}
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+{{- end}}
+
+[Install]
+WantedBy=multi-user.target
+`